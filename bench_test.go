@@ -0,0 +1,90 @@
+package parrot
+
+import (
+	"context"
+	"fmt"
+	"parrot/internal/bench"
+	"strings"
+	"testing"
+)
+
+var benchBackends = []Backend{Eval, VM, Reg}
+
+func TestBenchPrograms(t *testing.T) {
+	for _, p := range bench.Programs {
+		for _, backend := range benchBackends {
+			prog, err := Compile(p.Source, WithBackend(backend))
+			if err != nil {
+				t.Fatalf("%s: %v", p.Name, err)
+			}
+			v, err := Run(context.Background(), prog, nil)
+			if err != nil {
+				t.Errorf("%s on %s: %v", p.Name, backend, err)
+			} else if v.String() != p.Result {
+				t.Errorf("%s on %s = %s, want %s", p.Name, backend, v, p.Result)
+			}
+		}
+	}
+}
+
+func BenchmarkPrograms(b *testing.B) {
+	for _, p := range bench.Programs {
+		for _, backend := range benchBackends {
+			b.Run(p.Name+"/"+backend.String(), func(b *testing.B) {
+				prog, err := Compile(p.Source, WithBackend(backend))
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range b.N {
+					if _, err := Run(context.Background(), prog, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// callsSrc makes 600 calls on small integers.
+func callsSrc() string {
+	var b strings.Builder
+	b.WriteString("fn add(a, b) { c = a + b; c * 2 - a }\n")
+	b.WriteString("fn sq(x) { x * x }\n")
+	for i := range 300 {
+		fmt.Fprintf(&b, "v%d = add(%d, sq(%d)) %% 7 + %d\n", i, i%10, i%5, i%20)
+	}
+	b.WriteString("v1 + v2\n")
+	return b.String()
+}
+
+// cmpSrc makes 300 calls of a function of comparisons.
+func cmpSrc() string {
+	var b strings.Builder
+	b.WriteString("fn f(a, b) { a < b and !(a == b) or a - b > 3 }\n")
+	for i := range 300 {
+		fmt.Fprintf(&b, "c%d = f(%d, %d)\n", i, i%17, i%13)
+	}
+	b.WriteString("c1\n")
+	return b.String()
+}
+
+// BenchmarkAllocs measures the allocations of programs whose values are
+// small integers and booleans, which are shared.
+func BenchmarkAllocs(b *testing.B) {
+	for _, src := range []struct{ name, src string }{{"calls", callsSrc()}, {"cmp", cmpSrc()}} {
+		for _, backend := range benchBackends {
+			b.Run(src.name+"/"+backend.String(), func(b *testing.B) {
+				prog, err := Compile(src.src, WithBackend(backend), WithOptimizer(false))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				for range b.N {
+					if _, err := Run(context.Background(), prog, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
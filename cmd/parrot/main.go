@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"parrot"
+	"parrot/internal/bench"
+	"parrot/internal/compile"
+	"parrot/internal/gogen"
+	"parrot/internal/object"
+	"parrot/internal/optimize"
+	"parrot/internal/parser"
+	"parrot/internal/prc"
+	"parrot/internal/ptest"
+	"parrot/internal/regvm"
+	"parrot/internal/ssa"
+	"parrot/internal/vm"
+	"parrot/internal/wasm"
+	"parrot/repl"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage:
+	parrot [-backend=eval|vm|reg]                                    start a REPL
+	parrot compile [-noopt] [-ssa] [-stats] file.pr [-o file.prc]    compile a script to bytecode
+	parrot run [-noopt] [-ssa] [-backend=vm|reg] [-profile] file.pr|file.prc
+	                                                                 run a script or its bytecode
+	parrot disasm [-noopt] [-ssa] [-backend=vm|reg] file.pr|file.prc list a script's bytecode
+	parrot build [-noopt] [-pkg name] file.pr [-o file.go]           translate a script to Go
+	parrot wasm [-noopt] [-run] file.pr|file.wat [-o file.wat]       translate a script to WebAssembly
+	parrot test [-backend=eval|vm|reg] [-run regexp] [-v] [dir|file.pr ...]
+	            [-noopt] [-timeout d] [-json file] [-junit file]     run the tests of *_test.pr scripts
+	parrot bench [-backend=eval|vm|all] [-time d] [-profile] [file.pr ...]
+	                                                                 measure scripts, by default the built-in programs
+`
+
+func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "compile":
+			err = guard(compileCmd, os.Args[2:])
+		case "run":
+			err = guard(runCmd, os.Args[2:])
+		case "disasm":
+			err = guard(disasmCmd, os.Args[2:])
+		case "build":
+			err = guard(buildCmd, os.Args[2:])
+		case "wasm":
+			err = guard(wasmCmd, os.Args[2:])
+		case "test":
+			err = guard(testCmd, os.Args[2:])
+		case "bench":
+			err = guard(benchCmd, os.Args[2:])
+		default:
+			replCmd()
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "parrot:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	replCmd()
+}
+
+// guard runs the command cmd with args, turning a panic, which is a bug of
+// parrot rather than of the script, into an error.
+func guard(cmd func(args []string) error, args []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return cmd(args)
+}
+
+func replCmd() {
+	var useVM bool
+	var backend string
+
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.BoolVar(&useVM, "vm", false, "Use the VM instead of eval method, same as -backend=vm.")
+	flag.StringVar(&backend, "backend", "eval", "Run the input with `eval`, the bytecode `vm` or the register VM `reg`.")
+	flag.Parse()
+	if useVM {
+		backend = "vm"
+	}
+	switch backend {
+	case "eval":
+		repl.EvalREPL()
+	case "vm":
+		repl.VMREPL()
+	case "reg":
+		repl.RegREPL()
+	default:
+		fmt.Fprintf(os.Stderr, "parrot: unknown backend %q\n", backend)
+		os.Exit(2)
+	}
+}
+
+// parseArgs parses flags placed before or after the positional arguments,
+// which it returns.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func compileCmd(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := fs.String("o", "", "write the bytecode to `file` (default: the script name with a .prc extension)")
+	noopt := fs.Bool("noopt", false, "don't optimize the script")
+	useSSA := fs.Bool("ssa", false, "compile the script through the SSA form")
+	stats := fs.Bool("stats", false, "print the rewrites of each peephole pass")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return errors.New("compile: expected one script")
+	}
+	f, st, err := compileFile(files[0], !*noopt, *useSSA)
+	if err != nil {
+		return err
+	}
+	if *stats {
+		for _, p := range compile.DefaultPasses() {
+			fmt.Fprintf(os.Stderr, "%-18s %d\n", p.Name(), st[p.Name()])
+		}
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(files[0], filepath.Ext(files[0])) + ".prc"
+	}
+	var buf bytes.Buffer
+	if err := prc.Encode(&buf, f); err != nil {
+		return err
+	}
+	return os.WriteFile(*out, buf.Bytes(), 0o644)
+}
+
+func buildCmd(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	out := fs.String("o", "", "write the Go code to `file` (default: the script name with a .go extension)")
+	pkg := fs.String("pkg", "main", "the `name` of the generated package")
+	noopt := fs.Bool("noopt", false, "don't optimize the script")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return errors.New("build: expected one script")
+	}
+	prog, err := parseFile(files[0], !*noopt)
+	if err != nil {
+		return err
+	}
+	src, err := gogen.Generate(prog, gogen.Config{Package: *pkg, Source: filepath.Base(files[0])})
+	if err != nil {
+		return fmt.Errorf("%s: %w", files[0], err)
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(files[0], filepath.Ext(files[0])) + ".go"
+	}
+	return os.WriteFile(*out, src, 0o644)
+}
+
+func wasmCmd(args []string) error {
+	fs := flag.NewFlagSet("wasm", flag.ExitOnError)
+	out := fs.String("o", "", "write the module to `file` (default: the script name with a .wat extension)")
+	noopt := fs.Bool("noopt", false, "don't optimize the script")
+	run := fs.Bool("run", false, "run the module's main function on the built-in interpreter instead")
+	fuel := fs.Int64("fuel", 100_000_000, "stop the run after `n` instructions, 0 for no limit")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return errors.New("wasm: expected one script")
+	}
+	var wat string
+	if filepath.Ext(files[0]) == ".wat" {
+		src, err := os.ReadFile(files[0])
+		if err != nil {
+			return err
+		}
+		wat = string(src)
+	} else {
+		prog, err := parseFile(files[0], !*noopt)
+		if err != nil {
+			return err
+		}
+		if wat, err = wasm.Generate(prog); err != nil {
+			return fmt.Errorf("%s: %w", files[0], err)
+		}
+	}
+	if !*run {
+		if *out == "" {
+			*out = strings.TrimSuffix(files[0], filepath.Ext(files[0])) + ".wat"
+		}
+		return os.WriteFile(*out, []byte(wat), 0o644)
+	}
+	m, err := wasm.Parse(wat)
+	if err != nil {
+		return fmt.Errorf("%s: %w", files[0], err)
+	}
+	machine := wasm.NewMachine(m)
+	machine.Fuel = *fuel
+	res, err := machine.Invoke("main")
+	if err != nil {
+		return fmt.Errorf("%s: %w", files[0], err)
+	}
+	fn := m.Funcs[m.Exports["main"]]
+	for i, v := range res {
+		// Generate only uses i32 for booleans.
+		if fn.Results[i] == wasm.I32 {
+			fmt.Println(v != 0)
+		} else {
+			fmt.Println(int64(v))
+		}
+	}
+	return nil
+}
+
+func testCmd(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	backend := fs.String("backend", "vm", "run the tests on the evaluator `eval`, the bytecode `vm` or the register VM `reg`")
+	noopt := fs.Bool("noopt", false, "don't optimize the scripts")
+	match := fs.String("run", "", "run only the tests whose names match `regexp`")
+	verbose := fs.Bool("v", false, "list the tests that pass and their output too")
+	timeout := fs.Duration("timeout", 10*time.Second, "fail a test running longer than `d`, 0 for no limit")
+	jsonOut := fs.String("json", "", "write a JSON report to `file`")
+	junitOut := fs.String("junit", "", "write a JUnit XML report to `file`")
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	cfg := ptest.Config{Timeout: *timeout}
+	switch *backend {
+	case "eval":
+		cfg.Options = append(cfg.Options, parrot.WithBackend(parrot.Eval))
+	case "vm":
+		cfg.Options = append(cfg.Options, parrot.WithBackend(parrot.VM))
+	case "reg":
+		cfg.Options = append(cfg.Options, parrot.WithBackend(parrot.Reg))
+	default:
+		return fmt.Errorf("test: unknown backend %q", *backend)
+	}
+	cfg.Options = append(cfg.Options, parrot.WithOptimizer(!*noopt), parrot.WithCapabilities(parrot.CapAll))
+	if *match != "" {
+		if cfg.Match, err = regexp.Compile(*match); err != nil {
+			return fmt.Errorf("test: -run: %w", err)
+		}
+	}
+	files, err := ptest.Files(paths)
+	if err != nil {
+		return err
+	}
+	var results []ptest.Result
+	var errs []error
+	start := time.Now()
+	for _, file := range files {
+		fileStart := time.Now()
+		rs, err := ptest.RunFile(context.Background(), file, cfg)
+		if err != nil {
+			fmt.Printf("FAIL\t%s\n\t%v\n", file, err)
+			errs = append(errs, err)
+			continue
+		}
+		status := "ok  "
+		for _, r := range rs {
+			if !r.Passed() {
+				status = "FAIL"
+			}
+			if !r.Passed() || *verbose {
+				printResult(r)
+			}
+		}
+		if len(rs) == 0 {
+			fmt.Printf("?   \t%s\t[no tests]\n", file)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%.3fs\n", status, file, time.Since(fileStart).Seconds())
+		results = append(results, rs...)
+	}
+	if *jsonOut != "" {
+		if err := writeReport(*jsonOut, results, ptest.WriteJSON); err != nil {
+			return err
+		}
+	}
+	if *junitOut != "" {
+		if err := writeReport(*junitOut, results, ptest.WriteJUnit); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Passed() {
+			failed++
+		}
+	}
+	fmt.Printf("%d passed, %d failed (%.3fs)\n", len(results)-failed, failed, time.Since(start).Seconds())
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("test: %d of %d tests failed", failed, len(results)))
+	}
+	return errors.Join(errs...)
+}
+
+func benchCmd(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	backend := fs.String("backend", "all", "measure the evaluator `eval`, the bytecode `vm` or `all` of them")
+	noopt := fs.Bool("noopt", false, "don't optimize the scripts")
+	d := fs.Duration("time", time.Second, "run each script for at least `d`")
+	profile := fs.Bool("profile", false, "print where the VM spends its time in a run of each script")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var backends []parrot.Backend
+	switch *backend {
+	case "eval":
+		backends = []parrot.Backend{parrot.Eval}
+	case "vm":
+		backends = []parrot.Backend{parrot.VM}
+	case "all":
+		backends = []parrot.Backend{parrot.Eval, parrot.VM}
+	default:
+		return fmt.Errorf("bench: unknown backend %q", *backend)
+	}
+	programs := bench.Programs
+	if len(files) > 0 {
+		programs = nil
+		for _, name := range files {
+			src, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			programs = append(programs, bench.Program{Name: name, Source: string(src)})
+		}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "program\tbackend\truns\ttime/run\n")
+	for _, p := range programs {
+		for _, b := range backends {
+			runs, elapsed, err := measure(p, b, !*noopt, *d)
+			if err != nil {
+				tw.Flush()
+				return fmt.Errorf("%s on %s: %w", p.Name, b, err)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%v\n", p.Name, b, runs, (elapsed / time.Duration(runs)).Round(time.Microsecond))
+		}
+	}
+	tw.Flush()
+	if *profile {
+		for _, p := range programs {
+			fmt.Printf("\n%s on vm:\n", p.Name)
+			if err := profileVM(p.Source, !*noopt); err != nil {
+				return fmt.Errorf("%s: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// measure runs p on the back end b until d has elapsed, returning the
+// number of runs and the time they took.
+func measure(p bench.Program, b parrot.Backend, opt bool, d time.Duration) (runs int, elapsed time.Duration, err error) {
+	prog, err := parrot.Compile(p.Source, parrot.WithBackend(b), parrot.WithOptimizer(opt),
+		parrot.WithCapabilities(parrot.CapAll))
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	for runs == 0 || elapsed < d {
+		v, err := parrot.Run(context.Background(), prog, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		if p.Result != "" && v.String() != p.Result {
+			return 0, 0, fmt.Errorf("got %s, want %s", v, p.Result)
+		}
+		runs++
+		elapsed = time.Since(start)
+	}
+	return runs, elapsed, nil
+}
+
+// profileVM runs src once on the VM with the profiler on, and prints the
+// hotspots.
+func profileVM(src string, opt bool) error {
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	if opt {
+		optimize.Program(prog)
+	}
+	c := compile.New()
+	if !opt {
+		c.Passes = nil
+	}
+	if err := c.Compile(prog); err != nil {
+		return err
+	}
+	p := vm.NewProfile()
+	machine := vm.New()
+	machine.SetProfile(p)
+	machine.Next(c.Constants, c.OpCodes.Output())
+	if err := machine.Run(); err != nil {
+		return err
+	}
+	return p.WriteReport(os.Stdout, 10)
+}
+
+// printResult prints the outcome of a test with its output, indented.
+func printResult(r ptest.Result) {
+	status := "PASS"
+	if !r.Passed() {
+		status = "FAIL"
+	}
+	fmt.Printf("--- %s: %s (%.3fs)\n", status, r.Name, r.Duration.Seconds())
+	text := r.Output
+	if r.Err != nil {
+		text += r.Err.Error() + "\n"
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line != "" {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+}
+
+// writeReport writes the report of results to the file name with write.
+func writeReport(name string, results []ptest.Result, write func(io.Writer, []ptest.Result) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseFile parses and optionally optimizes the script in name.
+func parseFile(name string, opt bool) (*parser.Program, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	prog, errs := parser.Parse(string(src))
+	if len(errs) > 0 {
+		var perrs []error
+		for _, e := range errs {
+			perrs = append(perrs, fmt.Errorf("%s:%w", name, e))
+		}
+		return nil, errors.Join(perrs...)
+	}
+	if opt {
+		optimize.Program(prog)
+	}
+	return prog, nil
+}
+
+// compileFile parses, optionally optimizes and compiles the script in name,
+// directly or through SSA, returning the statistics of the peephole passes.
+func compileFile(name string, opt, useSSA bool) (*prc.File, compile.Stats, error) {
+	prog, err := parseFile(name, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := compile.New()
+	if !opt {
+		c.Passes = nil
+	}
+	if useSSA {
+		err = ssa.Compile(prog, c, opt)
+	} else {
+		err = c.Compile(prog)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return prc.New(c, name), c.Stats, nil
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	noopt := fs.Bool("noopt", false, "don't optimize the script")
+	useSSA := fs.Bool("ssa", false, "compile the script through the SSA form")
+	backend := fs.String("backend", "vm", "run the script on the bytecode `vm` or the register VM `reg`")
+	profile := fs.Bool("profile", false, "print where the VM spent its time to stderr")
+	if err := parseBackend(fs, backend, args); err != nil {
+		return err
+	}
+	if *backend == "reg" {
+		p, name, err := loadReg(fs, noopt, args)
+		if err != nil {
+			return err
+		}
+		val, err := regvm.New().Run(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if val != object.NULLObj {
+			fmt.Println(val)
+		}
+		return nil
+	}
+	f, err := loadFile(fs, noopt, useSSA, args)
+	if err != nil {
+		return err
+	}
+	machine := vm.New()
+	var p *vm.Profile
+	if *profile {
+		p = vm.NewProfile()
+		machine.SetProfile(p)
+	}
+	machine.Next(&f.Constants, f.Code)
+	err = machine.Run()
+	if p != nil {
+		p.WriteReport(os.Stderr, 10)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.Source, err)
+	}
+	if val := machine.LastPoppedStackElem(); val != nil && val != object.NULLObj {
+		fmt.Println(val)
+	}
+	return nil
+}
+
+func disasmCmd(args []string) error {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	noopt := fs.Bool("noopt", false, "don't optimize the script")
+	useSSA := fs.Bool("ssa", false, "compile the script through the SSA form")
+	backend := fs.String("backend", "vm", "list the code of the bytecode `vm` or of the register VM `reg`")
+	if err := parseBackend(fs, backend, args); err != nil {
+		return err
+	}
+	if *backend == "reg" {
+		p, _, err := loadReg(fs, noopt, args)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Print(p.Disassemble())
+		return err
+	}
+	f, err := loadFile(fs, noopt, useSSA, args)
+	if err != nil {
+		return err
+	}
+	return f.Disassemble(os.Stdout)
+}
+
+// loadFile parses the arguments of fs, and loads the .prc file or compiles
+// the script they name.
+func loadFile(fs *flag.FlagSet, noopt, useSSA *bool, args []string) (*prc.File, error) {
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("%s: expected one script", fs.Name())
+	}
+	if filepath.Ext(files[0]) != ".prc" {
+		f, _, err := compileFile(files[0], !*noopt, *useSSA)
+		return f, err
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		return nil, err
+	}
+	f, err := prc.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return f, f.Check()
+}
+
+// parseBackend parses the arguments of fs and checks the back end they
+// select.
+func parseBackend(fs *flag.FlagSet, backend *string, args []string) error {
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	switch *backend {
+	case "vm", "reg":
+		return nil
+	}
+	return fmt.Errorf("%s: unknown backend %q", fs.Name(), *backend)
+}
+
+// loadReg parses the arguments of fs and compiles the script they name for
+// the register VM, returning the script's name.
+func loadReg(fs *flag.FlagSet, noopt *bool, args []string) (*regvm.Proto, string, error) {
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) != 1 {
+		return nil, "", fmt.Errorf("%s: expected one script", fs.Name())
+	}
+	if filepath.Ext(files[0]) == ".prc" {
+		return nil, "", fmt.Errorf("%s: the register VM runs scripts, not bytecode files", fs.Name())
+	}
+	prog, err := parseFile(files[0], !*noopt)
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := regvm.NewCompiler(object.CapAll).Compile(prog)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", files[0], err)
+	}
+	return p, files[0], nil
+}
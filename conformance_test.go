@@ -0,0 +1,242 @@
+package parrot
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"parrot/internal/object"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance corpus is a directory of scripts, NAME.pr, each with the
+// expected output of every back end in NAME.out: the lines the script
+// prints, then its result as "=> value", or "error" if it fails, followed
+// by ": text" if the error message of every back end contains text.
+//
+// Where a back end knowingly departs from the evaluator, NAME.BACKEND.out
+// holds what it outputs instead; such known divergences are listed in the
+// report but don't fail the test.
+var (
+	update = flag.Bool("update", false, "rewrite the expected outputs of the conformance corpus from the evaluator")
+	report = flag.String("report", "", "write the conformance report to `file`")
+)
+
+const corpus = "testdata/conformance"
+
+// A conformanceConfig is a way of running scripts.
+type conformanceConfig struct {
+	name    string // the name of the back end, in the files of known divergences
+	backend Backend
+	opt     bool
+	ssa     bool // compile through the SSA form
+}
+
+func (c conformanceConfig) String() string {
+	if c.opt {
+		return c.name
+	}
+	return c.name + "-noopt"
+}
+
+var conformanceConfigs = []conformanceConfig{
+	{"eval", Eval, true, false},
+	{"eval", Eval, false, false},
+	{"vm", VM, true, false},
+	{"vm", VM, false, false},
+	{"ssa", VM, true, true},
+	{"ssa", VM, false, true},
+	{"reg", Reg, true, false},
+	{"reg", Reg, false, false},
+}
+
+var conformanceLimits = Limits{MaxSteps: 100000, MaxDepth: 200, MaxAlloc: 1 << 20}
+
+// runConformance runs src as configured, returning its output in the
+// format of the expected outputs.
+func runConformance(src string, cfg conformanceConfig) string {
+	var out bytes.Buffer
+	stdout := object.Stdout
+	object.Stdout = &out
+	defer func() { object.Stdout = stdout }()
+	res := func() string {
+		opts := []Option{WithBackend(cfg.backend), WithOptimizer(cfg.opt),
+			WithLimits(conformanceLimits), WithCapabilities(CapPure | CapIO)}
+		if cfg.ssa {
+			opts = append(opts, withSSA())
+		}
+		prog, err := Compile(src, opts...)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		v, err := Run(ctx, prog, nil)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "=> " + v.String()
+	}()
+	return out.String() + res + "\n"
+}
+
+// matches reports whether the output got satisfies the expected output
+// want.
+func matches(got, want string) bool {
+	if got == want {
+		return true
+	}
+	gotOut, gotRes := splitResult(got)
+	wantOut, wantRes := splitResult(want)
+	if gotOut != wantOut || !strings.HasPrefix(gotRes, "error") {
+		return false
+	}
+	text, ok := strings.CutPrefix(wantRes, "error")
+	if !ok {
+		return false
+	}
+	return text == "" || strings.HasPrefix(text, ": ") && strings.Contains(gotRes, text[2:])
+}
+
+// splitResult splits an output into the printed lines and the result.
+func splitResult(out string) (printed, res string) {
+	out = strings.TrimSuffix(out, "\n")
+	i := strings.LastIndexByte(out, '\n')
+	return out[:i+1], out[i+1:]
+}
+
+// A divergence is a back end not giving the expected output.
+type divergence struct {
+	script, config, want, got string
+	known                     bool
+}
+
+func TestConformance(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join(corpus, "*.pr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatalf("no scripts in %s", corpus)
+	}
+	var divs []divergence
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".pr")
+		src, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := strings.TrimSuffix(script, ".pr") + ".out"
+		if *update {
+			if err := os.WriteFile(golden, []byte(expected(string(src))), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %v, run with -update to create it", name, err)
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			for _, cfg := range conformanceConfigs {
+				got := runConformance(string(src), cfg)
+				if matches(got, string(want)) {
+					continue
+				}
+				d := divergence{script: name, config: cfg.String(), want: string(want), got: got}
+				known := strings.TrimSuffix(script, ".pr") + "." + cfg.name + ".out"
+				if w, err := os.ReadFile(known); err == nil && matches(got, string(w)) {
+					d.known = true
+					divs = append(divs, d)
+					continue
+				}
+				divs = append(divs, d)
+				t.Errorf("%s diverges:\n--- want\n%s--- got\n%s", cfg, want, got)
+			}
+		})
+	}
+	r := conformanceReport(len(scripts), divs)
+	if *report != "" {
+		if err := os.WriteFile(*report, []byte(r), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if t.Failed() || testing.Verbose() {
+		t.Log("\n" + r)
+	}
+}
+
+// expected returns the expected output of src, that of the evaluator, with
+// the error message kept only if all the back ends agree on it.
+func expected(src string) string {
+	want := runConformance(src, conformanceConfigs[0])
+	out, res := splitResult(want)
+	if !strings.HasPrefix(res, "error") {
+		return want
+	}
+	for _, cfg := range conformanceConfigs[1:] {
+		if got := runConformance(src, cfg); got != want {
+			return out + "error\n"
+		}
+	}
+	return want
+}
+
+// conformanceReport summarizes the divergences found running n scripts.
+func conformanceReport(n int, divs []divergence) string {
+	var b strings.Builder
+	var failed, known int
+	for _, d := range divs {
+		if d.known {
+			known++
+		} else {
+			failed++
+		}
+	}
+	fmt.Fprintf(&b, "conformance: %d scripts, %d back ends, %d divergences, %d known\n",
+		n, len(conformanceConfigs), failed, known)
+	for _, k := range []bool{false, true} {
+		for _, d := range divs {
+			if d.known != k {
+				continue
+			}
+			status := "DIVERGES"
+			if d.known {
+				status = "known"
+			}
+			fmt.Fprintf(&b, "\n%s %s on %s\n", status, d.script, d.config)
+			fmt.Fprintf(&b, "  want: %s\n", indent(d.want))
+			fmt.Fprintf(&b, "  got:  %s\n", indent(d.got))
+		}
+	}
+	return b.String()
+}
+
+func indent(s string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n        ")
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		got, want string
+		ok        bool
+	}{
+		{"=> 1\n", "=> 1\n", true},
+		{"=> 1\n", "=> 2\n", false},
+		{"a\n=> 1\n", "=> 1\n", false},
+		{"error: boom\n", "error\n", true},
+		{"error: a boom here\n", "error: boom\n", true},
+		{"error: bang\n", "error: boom\n", false},
+		{"=> error\n", "error\n", false},
+		{"x\nerror: boom\n", "x\nerror\n", true},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.got, tt.want); got != tt.ok {
+			t.Errorf("matches(%q, %q) = %v, want %v", tt.got, tt.want, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package parrot_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"parrot"
+)
+
+func Example() {
+	prog, err := parrot.Compile(`greet(name) + "!"`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	v, err := parrot.Run(context.Background(), prog, map[string]any{
+		"name": "parrot",
+		"greet": func(args ...parrot.Object) parrot.Object {
+			return parrot.MustObject("hello, " + args[0].String())
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(parrot.FromObject(v))
+	// Output: hello, parrot!
+}
+
+func ExampleCompile() {
+	// The program is compiled once for the VM, and can run many times.
+	prog, err := parrot.Compile(`fn sq(n) { n * n }; sq(x) + 1`,
+		parrot.WithBackend(parrot.VM),
+		parrot.WithLimits(parrot.Limits{MaxSteps: 10000}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for x := range 3 {
+		v, err := parrot.Run(context.Background(), prog, map[string]any{"x": x})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(v)
+	}
+	_, err = parrot.Compile(`1 +`)
+	fmt.Println(err != nil)
+	// Output:
+	// 1
+	// 2
+	// 5
+	// true
+}
+
+func ExampleRun() {
+	prog, err := parrot.Compile(`total / count`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	v, err := parrot.Run(ctx, prog, map[string]any{"total": 10, "count": 4})
+	fmt.Println(v, err)
+	// Script errors are returned as *parrot.Error.
+	_, err = parrot.Run(ctx, prog, map[string]any{"total": 10, "count": 0})
+	fmt.Println(err)
+	_, err = parrot.Run(ctx, prog, map[string]any{"total": 10})
+	fmt.Println(err)
+	// Output:
+	// 2 <nil>
+	// 7: division by zero
+	// 9: name "count" is not defined
+}
@@ -0,0 +1,57 @@
+package parrot
+
+import (
+	"parrot/internal/parser"
+	"parrot/internal/progen"
+	"strings"
+	"testing"
+)
+
+// FuzzEquivalence runs the programs generated from the fuzzed bytes on every
+// back end, which must not panic and must agree with the evaluator, and
+// checks that the program printed from its AST parses back to the same AST
+// and runs the same.
+func FuzzEquivalence(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("parrot"))
+	f.Add([]byte{3, 2, 1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	f.Add([]byte{8, 2, 2, 2, 2, 1, 3, 6, 6, 6, 1, 0, 0, 1, 2, 2, 3, 3, 4, 5, 6, 7, 7, 7})
+	f.Add([]byte("a longer seed, for longer programs with more functions in them"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		src := progen.Program(data)
+		want := runConformance(src, conformanceConfigs[0])
+		if _, res := splitResult(want); strings.Contains(res, "limit exceeded") {
+			t.Skip(res)
+		} else if strings.HasPrefix(res, "error") {
+			t.Fatalf("%s\n%s", src, want)
+		}
+		for _, cfg := range conformanceConfigs[1:] {
+			if got := runConformance(src, cfg); got != want {
+				t.Fatalf("%s\n%s diverges:\n--- want\n%s--- got\n%s", src, cfg, want, got)
+			}
+		}
+		printed := roundTrip(t, src)
+		if got := runConformance(printed, conformanceConfigs[0]); got != want {
+			t.Fatalf("%s\nprinted as\n%s\nruns differently:\n--- want\n%s--- got\n%s", src, printed, want, got)
+		}
+	})
+}
+
+// roundTrip returns src printed from its AST, which must parse back to the
+// same AST.
+func roundTrip(t *testing.T, src string) string {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		t.Fatalf("%s\n%v", src, errs[0])
+	}
+	printed := prog.String()
+	again, errs := parser.Parse(printed)
+	if len(errs) > 0 {
+		t.Fatalf("%s\nprinted as\n%s\n%v", src, printed, errs[0])
+	}
+	if s := again.String(); s != printed {
+		t.Fatalf("%s\nprinted as\n%s\nthen as\n%s", src, printed, s)
+	}
+	return printed
+}
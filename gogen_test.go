@@ -0,0 +1,133 @@
+package parrot
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"parrot/internal/gogen"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gogenMain is the program running the conformance scripts translated to
+// Go, each a package imported under its own name: "conformance NAME" runs
+// NAME.pr and prints its output in the format of the expected outputs.
+const gogenMain = `package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"parrot/rt"
+%s)
+
+var scripts = map[string]func(context.Context, map[string]rt.Value, ...rt.Option) (rt.Value, error){
+%s}
+
+func main() {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("error: parrot: internal error: %%v\n", r)
+		}
+	}()
+	v, err := scripts[os.Args[1]](context.Background(), nil,
+		rt.WithLimits(rt.Limits{MaxSteps: %d, MaxDepth: %d, MaxAlloc: %d}),
+		rt.WithCapabilities(rt.CapPure|rt.CapIO))
+	if err != nil {
+		fmt.Printf("error: %%v\n", err)
+		return
+	}
+	fmt.Printf("=> %%v\n", v)
+}
+`
+
+// TestGogenConformance translates the conformance corpus to Go, builds it
+// into one program and checks the output of every script like
+// TestConformance does, with the known divergences in NAME.gogen.out.
+func TestGogenConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a Go program")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool")
+	}
+	scripts, err := filepath.Glob(filepath.Join(corpus, "*.pr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated packages import parrot/rt, so they must be in the
+	// module.
+	dir, err := os.MkdirTemp(corpus, "gogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The output of the scripts failing to translate, by name.
+	failed := make(map[string]string)
+	var imports, cases strings.Builder
+	for i, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".pr")
+		src, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := Compile(string(src), WithCapabilities(CapPure|CapIO))
+		if err != nil {
+			failed[name] = "error: " + err.Error() + "\n"
+			continue
+		}
+		pkg := fmt.Sprintf("s%d", i)
+		code, err := gogen.Generate(prog.ast, gogen.Config{Package: pkg, Source: name + ".pr"})
+		if err != nil {
+			failed[name] = "error: " + err.Error() + "\n"
+			continue
+		}
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, pkg, pkg+".go"), code, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&imports, "\t%s %q\n", pkg, "parrot/"+filepath.ToSlash(filepath.Join(dir, pkg)))
+		fmt.Fprintf(&cases, "\t%q: %s.Run,\n", name, pkg)
+	}
+	l := conformanceLimits
+	main := fmt.Sprintf(gogenMain, imports.String(), cases.String(), l.MaxSteps, l.MaxDepth, l.MaxAlloc)
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(main), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "conformance")
+	if out, err := exec.Command(goTool, "build", "-o", bin, "./"+filepath.ToSlash(dir)).CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".pr")
+		want, err := os.ReadFile(strings.TrimSuffix(script, ".pr") + ".out")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, ok := failed[name]
+		if !ok {
+			out, err := exec.Command(bin, name).Output()
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			got = string(out)
+		}
+		if matches(got, string(want)) {
+			continue
+		}
+		known := strings.TrimSuffix(script, ".pr") + ".gogen.out"
+		if w, err := os.ReadFile(known); err == nil && matches(got, string(w)) {
+			continue
+		}
+		t.Errorf("%s diverges on gogen:\n--- want\n%s--- got\n%s", name, want, got)
+	}
+}
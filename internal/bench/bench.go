@@ -0,0 +1,56 @@
+// Package bench holds the canonical programs the back ends are measured
+// on, by the Go benchmarks and parrot bench.
+//
+// The language has no conditionals, so the programs branch by calling one
+// of a list of functions: for i >= 0, (i + 999999999) / 1000000000 is 0 if
+// i is 0 and 1 otherwise. Loops are tail calls.
+package bench
+
+// A Program is a benchmark program.
+type Program struct {
+	Name   string
+	Source string
+	Result string // the value the program returns
+}
+
+var Programs = []Program{
+	{
+		Name:   "fib",
+		Result: "6765",
+		Source: `fn fib_small(n, fib) { n }
+fn fib_big(n, fib) { fib(n - 1) + fib(n - 2) }
+fn fib(n) { [fib_small, fib_big][(n + 999999998) / 1000000000](n, fib) }
+fib(20)
+`,
+	},
+	{
+		Name:   "loop",
+		Result: "150003",
+		Source: `fn loop_done(i, acc, loop) { acc }
+fn loop_step(i, acc, loop) { loop(i - 1, acc + i % 7) }
+fn loop(i, acc) { [loop_done, loop_step][(i + 999999999) / 1000000000](i, acc, loop) }
+loop(50000, 0)
+`,
+	},
+	{
+		Name:   "strings",
+		Result: "6000",
+		Source: `fn build_done(i, s, build) { s }
+fn build_step(i, s, build) { build(i - 1, s + "ab" + "c") }
+fn build(i, s) { [build_done, build_step][(i + 999999999) / 1000000000](i, s, build) }
+len(build(2000, ""))
+`,
+	},
+	{
+		Name:   "lists",
+		Result: "80000",
+		Source: `fn lists_done(i, acc, lists) { acc }
+fn lists_step(i, acc, lists) {
+	l = [i, i + 1, i + 2, [i, acc]];
+	lists(i - 1, acc + l[2] - l[0] + len(l[3]) + len(l))
+}
+fn lists(i, acc) { [lists_done, lists_step][(i + 999999999) / 1000000000](i, acc, lists) }
+lists(10000, 0)
+`,
+	},
+}
@@ -1,6 +1,18 @@
+// Package code defines the instructions of the VM.
+//
+// An instruction is an op code byte, followed by a one byte argument if the
+// op code has one. Arguments wider than a byte are preceded by
+// OpExtendedArg prefixes, each carrying the next higher byte of the
+// argument, so most instructions take two bytes or one.
+//
+// Superinstructions stand for common sequences of instructions. Those
+// taking two operands pack them into their argument, see Pack.
 package code
 
-import "encoding/binary"
+import (
+	"fmt"
+	"strings"
+)
 
 type OpCode byte
 
@@ -31,12 +43,29 @@ const (
 	OpDiv
 	OpMod
 
+	OpMatch
+
 	OpReturnValue
 
 	OpCurrentClosure
 
+	// Variants of arithmetic and comparisons specialized for integers. The
+	// compiler doesn't emit them: the VM rewrites instructions in place to
+	// them once it sees integer operands, and back if the operands change.
+	OpAddInt
+	OpSubInt
+	OpMulInt
+	OpCmpEQInt
+	OpCmpNEInt
+	OpCmpLTInt
+	OpCmpLEInt
+	OpCmpGTInt
+	OpCmpGEInt
+
 	HAVE_ARGUMENT // OpCodes from here have an argument:
 
+	OpExtendedArg // prefix carrying the higher bytes of the next argument
+
 	OpConstant
 	OpGetGlobal
 	OpSetGlobal
@@ -44,11 +73,18 @@ const (
 	OpSetLocal
 	OpGetBuiltin
 	OpGetFree
+	OpGetAttr
 
 	OpList
 
-	OpFunction
+	OpClosure // a closure of a constant function and the free variables on the stack
 	OpCall
+	OpTailCall // OpCall reusing the frame of the calling function
+
+	// Superinstructions
+	OpGetLocal2     // OpGetLocal a; OpGetLocal b
+	OpAddLocalConst // OpGetLocal a; OpConstant b; OpAdd
+	OpCallGlobal    // OpGetGlobal b; OpCall a
 )
 
 // If op has an argument
@@ -56,6 +92,168 @@ func (op OpCode) HasArg() bool {
 	return op > HAVE_ARGUMENT
 }
 
-func ReadUint32(ins []byte) uint32 {
-	return binary.BigEndian.Uint32(ins)
+// Packed reports whether the argument of op packs two operands.
+func (op OpCode) Packed() bool {
+	switch op {
+	case OpClosure, OpGetLocal2, OpAddLocalConst, OpCallGlobal:
+		return true
+	}
+	return false
+}
+
+// CanPack reports whether the operands a and b fit in a packed argument:
+// a in its low byte and b in the three bytes above.
+func CanPack(a, b uint32) bool {
+	return a <= 0xff && b <= 0xffffff
+}
+
+// Pack packs the operands a and b into an argument, see CanPack.
+func Pack(a, b uint32) uint32 {
+	return b<<8 | a
+}
+
+// Unpack returns the operands packed into arg.
+func Unpack(arg int) (a, b int) {
+	return arg & 0xff, arg >> 8
+}
+
+var opNames = [...]string{
+	OpPop:            "OpPop",
+	OpTrue:           "OpTrue",
+	OpFalse:          "OpFalse",
+	OpAnd:            "OpAnd",
+	OpOr:             "OpOr",
+	OpBang:           "OpBang",
+	OpMinus:          "OpMinus",
+	OpIndex:          "OpIndex",
+	OpCmpEQ:          "OpCmpEQ",
+	OpCmpNE:          "OpCmpNE",
+	OpCmpLT:          "OpCmpLT",
+	OpCmpLE:          "OpCmpLE",
+	OpCmpGT:          "OpCmpGT",
+	OpCmpGE:          "OpCmpGE",
+	OpAdd:            "OpAdd",
+	OpSub:            "OpSub",
+	OpMul:            "OpMul",
+	OpDiv:            "OpDiv",
+	OpMod:            "OpMod",
+	OpMatch:          "OpMatch",
+	OpReturnValue:    "OpReturnValue",
+	OpCurrentClosure: "OpCurrentClosure",
+	OpAddInt:         "OpAddInt",
+	OpSubInt:         "OpSubInt",
+	OpMulInt:         "OpMulInt",
+	OpCmpEQInt:       "OpCmpEQInt",
+	OpCmpNEInt:       "OpCmpNEInt",
+	OpCmpLTInt:       "OpCmpLTInt",
+	OpCmpLEInt:       "OpCmpLEInt",
+	OpCmpGTInt:       "OpCmpGTInt",
+	OpCmpGEInt:       "OpCmpGEInt",
+	OpExtendedArg:    "OpExtendedArg",
+	OpConstant:       "OpConstant",
+	OpGetGlobal:      "OpGetGlobal",
+	OpSetGlobal:      "OpSetGlobal",
+	OpGetLocal:       "OpGetLocal",
+	OpSetLocal:       "OpSetLocal",
+	OpGetBuiltin:     "OpGetBuiltin",
+	OpGetFree:        "OpGetFree",
+	OpGetAttr:        "OpGetAttr",
+	OpList:           "OpList",
+	OpClosure:        "OpClosure",
+	OpCall:           "OpCall",
+	OpTailCall:       "OpTailCall",
+	OpGetLocal2:      "OpGetLocal2",
+	OpAddLocalConst:  "OpAddLocalConst",
+	OpCallGlobal:     "OpCallGlobal",
+}
+
+func (op OpCode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Op(%d)", byte(op))
+}
+
+// Append appends the instruction op with the argument arg, which is ignored
+// if op takes none, to ins.
+func Append(ins []byte, op OpCode, arg uint32) []byte {
+	if !op.HasArg() {
+		return append(ins, byte(op))
+	}
+	for shift := 24; shift > 0; shift -= 8 {
+		if b := arg >> shift; b > 0 {
+			ins = append(ins, byte(OpExtendedArg), byte(b))
+		}
+	}
+	return append(ins, byte(op), byte(arg))
+}
+
+// Decode decodes the instruction at ins[ip:], including any OpExtendedArg
+// prefixes, and returns it with the offset of the next instruction. It
+// fails if the instruction is truncated, or if prefixes precede an op code
+// without an argument.
+func Decode(ins []byte, ip int) (op OpCode, arg int, next int, err error) {
+	start := ip
+	for ip < len(ins) {
+		op = OpCode(ins[ip])
+		ip++
+		if !op.HasArg() {
+			if ip-1 > start {
+				return op, arg, ip, fmt.Errorf("%s at %d takes no argument", op, ip-1)
+			}
+			return op, arg, ip, nil
+		}
+		if ip >= len(ins) {
+			break
+		}
+		arg = arg<<8 | int(ins[ip])
+		ip++
+		if op != OpExtendedArg {
+			return op, arg, ip, nil
+		}
+	}
+	return op, arg, ip, fmt.Errorf("truncated instruction at %d", ip)
+}
+
+// Disassemble returns a listing of the instructions ins, one per line,
+// with their offsets and arguments.
+func Disassemble(ins []byte) (string, error) {
+	var b strings.Builder
+	for ip := 0; ip < len(ins); {
+		op, arg, next, err := Decode(ins, ip)
+		if err != nil {
+			return b.String(), err
+		}
+		if op.Packed() {
+			x, y := Unpack(arg)
+			fmt.Fprintf(&b, "%04d %-16s %d %d\n", ip, op, x, y)
+		} else if op.HasArg() {
+			fmt.Fprintf(&b, "%04d %-16s %d\n", ip, op, arg)
+		} else {
+			fmt.Fprintf(&b, "%04d %s\n", ip, op)
+		}
+		ip = next
+	}
+	return b.String(), nil
+}
+
+// SourcePos says that the instructions from Offset on were compiled from
+// the source at byte position Pos.
+type SourcePos struct {
+	Offset int
+	Pos    int
+}
+
+// SourceMap maps instruction offsets to source positions, sorted by offset.
+type SourceMap []SourcePos
+
+// Lookup returns the source position of the instruction at offset.
+func (m SourceMap) Lookup(offset int) (pos int, ok bool) {
+	for _, sp := range m {
+		if sp.Offset > offset {
+			break
+		}
+		pos, ok = sp.Pos, true
+	}
+	return
 }
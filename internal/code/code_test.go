@@ -0,0 +1,178 @@
+package code_test
+
+import (
+	"parrot/internal/bench"
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"strings"
+	"testing"
+)
+
+func TestAppendDecode(t *testing.T) {
+	tests := []struct {
+		op   code.OpCode
+		arg  uint32
+		size int
+	}{
+		{code.OpPop, 0, 1},
+		{code.OpAdd, 7, 1}, // the argument is ignored
+		{code.OpConstant, 0, 2},
+		{code.OpConstant, 0xff, 2},
+		{code.OpConstant, 0x100, 4},
+		{code.OpGetGlobal, 0xffff, 4},
+		{code.OpGetGlobal, 0x10000, 6},
+		{code.OpConstant, 0xffffff, 6},
+		{code.OpConstant, 1 << 24, 8},
+		{code.OpCall, 0xffffffff, 8},
+		{code.OpGetLocal2, code.Pack(0xff, 0xffffff), 8},
+	}
+	var ins []byte
+	for _, tt := range tests {
+		b := code.Append(nil, tt.op, tt.arg)
+		if len(b) != tt.size {
+			t.Errorf("%s %#x takes %d bytes, want %d", tt.op, tt.arg, len(b), tt.size)
+		}
+		ins = append(ins, b...)
+	}
+	// The instructions decode back in sequence.
+	ip := 0
+	for _, tt := range tests {
+		op, arg, next, err := code.Decode(ins, ip)
+		if err != nil {
+			t.Fatalf("Decode at %d: %v", ip, err)
+		}
+		want := int(tt.arg)
+		if !tt.op.HasArg() {
+			want = 0
+		}
+		if op != tt.op || arg != want || next != ip+tt.size {
+			t.Errorf("Decode at %d = %s %#x, next %d, want %s %#x, next %d", ip, op, arg, next, tt.op, want, ip+tt.size)
+		}
+		ip = next
+	}
+	if ip != len(ins) {
+		t.Errorf("decoded %d bytes of %d", ip, len(ins))
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	ins := code.Append(nil, code.OpConstant, 0x1234)
+	for n := 1; n < len(ins); n++ {
+		if _, _, _, err := code.Decode(ins[:n], 0); err == nil {
+			t.Errorf("Decode of %d bytes of %x succeeded", n, ins)
+		}
+	}
+}
+
+// TestDecodePrefix checks that Decode rejects OpExtendedArg prefixes before
+// an op code without an argument, which the VM would otherwise run.
+func TestDecodePrefix(t *testing.T) {
+	for _, ins := range [][]byte{
+		{byte(code.OpExtendedArg), 1, byte(code.OpTrue)},
+		{byte(code.OpExtendedArg), 1, byte(code.OpExtendedArg), 2, byte(code.OpReturnValue)},
+	} {
+		_, _, _, err := code.Decode(ins, 0)
+		if err == nil || !strings.Contains(err.Error(), "takes no argument") {
+			t.Errorf("Decode(%x) = %v, want an error", ins, err)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	for _, ab := range [][2]uint32{{0, 0}, {1, 2}, {0xff, 0xffffff}} {
+		if !code.CanPack(ab[0], ab[1]) {
+			t.Errorf("CanPack(%d, %d) = false", ab[0], ab[1])
+		}
+		a, b := code.Unpack(int(code.Pack(ab[0], ab[1])))
+		if uint32(a) != ab[0] || uint32(b) != ab[1] {
+			t.Errorf("Unpack(Pack(%d, %d)) = %d, %d", ab[0], ab[1], a, b)
+		}
+	}
+	if code.CanPack(0x100, 0) || code.CanPack(0, 1<<24) {
+		t.Error("CanPack accepts operands too wide")
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	ins := code.Append(nil, code.OpConstant, 0x100)
+	ins = code.Append(ins, code.OpCallGlobal, code.Pack(2, 5))
+	ins = code.Append(ins, code.OpReturnValue, 0)
+	got, err := code.Disassemble(ins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0000 OpConstant       256\n0004 OpCallGlobal     2 5\n0008 OpReturnValue\n"
+	if got != want {
+		t.Errorf("Disassemble = %q, want %q", got, want)
+	}
+	if !strings.Contains(code.OpCode(0xfe).String(), "254") {
+		t.Errorf("unknown op code prints as %s", code.OpCode(0xfe))
+	}
+}
+
+// programCode returns the instructions of the benchmark programs: their
+// top-level code and functions.
+func programCode(b *testing.B) [][]byte {
+	var ins [][]byte
+	for _, p := range bench.Programs {
+		prog, errs := parser.Parse(p.Source)
+		if len(errs) > 0 {
+			b.Fatal(errs[0])
+		}
+		c := compile.New()
+		if err := c.Compile(prog); err != nil {
+			b.Fatal(err)
+		}
+		ins = append(ins, c.OpCodes.Output())
+		for _, k := range *c.Constants {
+			if fn, ok := k.(*object.FunctionCompiled); ok {
+				ins = append(ins, fn.Instructions)
+			}
+		}
+	}
+	return ins
+}
+
+// BenchmarkDecode decodes the code of the benchmark programs, reporting
+// its size in bytes per instruction.
+func BenchmarkDecode(b *testing.B) {
+	progs := programCode(b)
+	var size, count int
+	for _, ins := range progs {
+		size += len(ins)
+		count += decodeAll(b, ins)
+	}
+	b.ReportMetric(float64(size)/float64(count), "bytes/instr")
+	b.ResetTimer()
+	for range b.N {
+		for _, ins := range progs {
+			decodeAll(b, ins)
+		}
+	}
+}
+
+func decodeAll(b *testing.B, ins []byte) (n int) {
+	for ip := 0; ip < len(ins); n++ {
+		_, _, next, err := code.Decode(ins, ip)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ip = next
+	}
+	return n
+}
+
+// BenchmarkAppend encodes instructions with arguments of one to four
+// bytes.
+func BenchmarkAppend(b *testing.B) {
+	args := []uint32{0x7f, 0x1234, 0x123456, 0x12345678}
+	ins := make([]byte, 0, 64)
+	for range b.N {
+		ins = ins[:0]
+		for _, arg := range args {
+			ins = code.Append(ins, code.OpConstant, arg)
+		}
+	}
+}
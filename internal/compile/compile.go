@@ -2,7 +2,6 @@ package compile
 
 import (
 	"bytes"
-	"encoding/binary"
 	"parrot/internal/code"
 	"parrot/internal/object"
 )
@@ -29,6 +28,36 @@ func (is *Instructions) Output() []byte {
 	return buf.Bytes()
 }
 
+// SourceMap returns the source positions recorded by Pos instructions.
+func (is *Instructions) SourceMap() code.SourceMap {
+	var m code.SourceMap
+	offset := 0
+	for _, i := range *is {
+		p, ok := i.(*Pos)
+		if !ok {
+			offset += len(i.Output())
+			continue
+		}
+		if n := len(m); n > 0 && m[n-1].Offset == offset {
+			m = m[:n-1]
+		}
+		if n := len(m); n == 0 || m[n-1].Pos != p.Pos {
+			m = append(m, code.SourcePos{Offset: offset, Pos: p.Pos})
+		}
+	}
+	return m
+}
+
+// Pos marks the source position of the following instructions. It outputs
+// nothing.
+type Pos struct {
+	Pos int
+}
+
+func (pos *Pos) Output() []byte {
+	return nil
+}
+
 type Op struct {
 	Op code.OpCode
 }
@@ -43,11 +72,7 @@ type OpArg struct {
 }
 
 func (oparg *OpArg) Output() []byte {
-	ret := [5]byte{
-		byte(oparg.Op),
-	}
-	binary.BigEndian.PutUint32(ret[1:], oparg.Arg)
-	return ret[:]
+	return code.Append(nil, oparg.Op, oparg.Arg)
 }
 
 type Compilable interface {
@@ -58,13 +83,39 @@ type Compiler struct {
 	Constants *[]object.Object
 	OpCodes   Instructions
 	*SymbolTable
+	// Passes are run over the instructions of the program and of each
+	// function, see Peephole. Stats counts their rewrites.
+	Passes []Pass
+	Stats  Stats
+	// Externals makes the names the program reads without defining them
+	// globals, left for the VM to report if they are unset when read,
+	// rather than compile errors. The globals are set before running the
+	// program, see SymbolTable.DefineExternal.
+	Externals bool
+	// constIndex maps the values of the deduplicated constants to their
+	// index. Like Constants, it is shared with the function compilers.
+	constIndex map[constKey]uint32
 }
 
 func New() *Compiler {
+	return NewWithCapabilities(object.CapAll)
+}
+
+// NewWithCapabilities returns a compiler for scripts that may only use the
+// builtins enabled by caps.
+func NewWithCapabilities(caps object.Capability) *Compiler {
 	c := &Compiler{
 		Constants:   &[]object.Object{},
 		OpCodes:     []Instruction{},
 		SymbolTable: NewSymbolTable(),
+		Passes:      DefaultPasses(),
+		Stats:       Stats{},
+		constIndex:  map[constKey]uint32{},
+	}
+	for i, b := range object.Builtins {
+		if caps.Has(b.Cap) {
+			c.DefineBuiltin(i, b.Name)
+		}
 	}
 	return c
 }
@@ -74,6 +125,10 @@ func (c *Compiler) NewForFunction() *Compiler {
 		Constants:   c.Constants,
 		OpCodes:     []Instruction{},
 		SymbolTable: NewEnclosedSymbolTable(c.SymbolTable),
+		Passes:      c.Passes,
+		Stats:       c.Stats,
+		Externals:   c.Externals,
+		constIndex:  c.constIndex,
 	}
 	return nc
 }
@@ -88,6 +143,12 @@ func (c *Compiler) OpArg(op code.OpCode, arg uint32) {
 	})
 }
 
+// Pos records that the following instructions are compiled from the source
+// at pos.
+func (c *Compiler) Pos(pos int) {
+	c.OpCodes.Add(&Pos{Pos: pos})
+}
+
 func (c *Compiler) Op(op code.OpCode) {
 	if op.HasArg() {
 		panic("Op called with an instruction which takes an Arg")
@@ -97,20 +158,47 @@ func (c *Compiler) Op(op code.OpCode) {
 	})
 }
 
-// Add constant, return the index into the Consts tuple.
+// Add constant, return the index into the Consts tuple. Equal scalars,
+// strings and patterns share one constant.
 func (c *Compiler) Const(o object.Object) uint32 {
-loop:
-	for i, v := range *c.Constants {
-		switch o.Type() {
-		case object.ListType, object.FunctionType, object.FunctionCompiledType:
-			break loop
-		}
-		if o.Type() == v.Type() && o.String() == v.String() {
-			return uint32(i)
+	key, ok := constKeyOf(o)
+	if ok {
+		if i, ok := c.constIndex[key]; ok {
+			return i
 		}
 	}
 	*c.Constants = append(*c.Constants, o)
-	return uint32(len(*c.Constants) - 1)
+	i := uint32(len(*c.Constants) - 1)
+	if ok {
+		c.constIndex[key] = i
+	}
+	return i
+}
+
+// constKey identifies a constant by its type and value.
+type constKey struct {
+	typ object.Type
+	val any
+}
+
+// constKeyOf returns the key of o, or false for a constant which isn't
+// deduplicated, such as a function.
+func constKeyOf(o object.Object) (constKey, bool) {
+	switch o := o.(type) {
+	case *object.Integer:
+		return constKey{o.Type(), int64(*o)}, true
+	case *object.String:
+		return constKey{o.Type(), string(*o)}, true
+	case *object.Boolean:
+		return constKey{o.Type(), bool(*o)}, true
+	case *object.NULL:
+		return constKey{o.Type(), nil}, true
+	case *object.Error:
+		return constKey{o.Type(), string(*o)}, true
+	case *object.Glob:
+		return constKey{o.Type(), o.Pattern()}, true
+	}
+	return constKey{}, false
 }
 
 func (c *Compiler) LoadSymbol(s Symbol) {
@@ -128,6 +216,11 @@ func (c *Compiler) LoadSymbol(s Symbol) {
 	}
 }
 
+// Compile compiles prog and runs the peephole passes over the result.
 func (c *Compiler) Compile(prog Compilable) error {
-	return prog.Compile(c)
+	if err := prog.Compile(c); err != nil {
+		return err
+	}
+	c.Peephole()
+	return nil
 }
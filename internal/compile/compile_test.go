@@ -0,0 +1,66 @@
+package compile_test
+
+import (
+	"fmt"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"strings"
+	"testing"
+)
+
+func TestConst(t *testing.T) {
+	c := compile.New()
+	fn := &object.FunctionCompiled{}
+	consts := []object.Object{
+		object.NewInteger(1),
+		object.NewInteger(1 << 40),
+		object.NewString("1"),
+		object.NewError("1"),
+		object.NULLObj,
+		object.TRUEObj,
+		fn,
+	}
+	var idx []uint32
+	for _, o := range consts {
+		idx = append(idx, c.Const(o))
+	}
+	// Equal values of the same type share a constant, functions don't.
+	for i, o := range []object.Object{
+		object.NewInteger(1),
+		object.NewInteger(1 << 40),
+		object.NewString("1"),
+		object.NewError("1"),
+		object.NULLObj,
+		object.NewBoolean(true),
+	} {
+		if got := c.Const(o); got != idx[i] {
+			t.Errorf("Const(%s %s) = %d, want %d", o.Type(), o, got, idx[i])
+		}
+	}
+	if got := c.Const(&object.FunctionCompiled{}); got != uint32(len(consts)) {
+		t.Errorf("Const of a new function = %d, want %d", got, len(consts))
+	}
+	if n := len(*c.Constants); n != len(consts)+1 {
+		t.Errorf("%d constants, want %d", n, len(consts)+1)
+	}
+}
+
+// BenchmarkConst compiles a program of 5000 distinct constants.
+func BenchmarkConst(b *testing.B) {
+	var sb strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&sb, "x%d = %d\n", i, i)
+	}
+	prog, errs := parser.Parse(sb.String())
+	if len(errs) > 0 {
+		b.Fatal(errs[0])
+	}
+	b.ReportAllocs()
+	for range b.N {
+		c := compile.New()
+		if err := c.Compile(prog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
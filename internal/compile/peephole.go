@@ -0,0 +1,228 @@
+package compile
+
+import "parrot/internal/code"
+
+// Pass is a peephole optimization over an instruction stream, run before
+// it is output.
+type Pass interface {
+	Name() string
+	// Run rewrites is, returning the result and the number of rewrites.
+	Run(is Instructions) (Instructions, int)
+}
+
+// Stats counts the rewrites made by each pass, by name.
+type Stats map[string]int
+
+// DefaultPasses returns the passes compilers run unless told otherwise.
+// Superinstructions comes last, since the others don't know the
+// instructions it fuses.
+func DefaultPasses() []Pass {
+	return []Pass{LoadPop{}, BangBang{}, Superinstructions{}}
+}
+
+// maxRounds bounds how often the passes are run over the same instructions
+// while they keep finding rewrites.
+const maxRounds = 8
+
+// Peephole runs the compiler's passes over its instructions until they
+// make no more rewrites, adding them up in the compiler's stats.
+func (c *Compiler) Peephole() {
+	for range maxRounds {
+		changed := false
+		for _, p := range c.Passes {
+			var n int
+			c.OpCodes, n = p.Run(c.OpCodes)
+			if n > 0 {
+				c.Stats[p.Name()] += n
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+}
+
+// opcode returns the op code of i, or false for a position mark.
+func opcode(i Instruction) (code.OpCode, bool) {
+	switch i := i.(type) {
+	case *Op:
+		return i.Op, true
+	case *OpArg:
+		return i.Op, true
+	}
+	return 0, false
+}
+
+// next returns the index of the first instruction from i on that isn't a
+// position mark, or len(is).
+func next(is Instructions, i int) int {
+	for i < len(is) {
+		if _, ok := opcode(is[i]); ok {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// LoadPop removes the loads of constants and locals whose value is popped
+// right away. Loads which can fail, such as those of unset globals, are
+// kept.
+type LoadPop struct{}
+
+func (LoadPop) Name() string { return "load-pop" }
+
+func (LoadPop) Run(is Instructions) (Instructions, int) {
+	out := make(Instructions, 0, len(is))
+	n := 0
+	for i := 0; i < len(is); i++ {
+		op, ok := opcode(is[i])
+		if ok && isLoad(op) {
+			if j := next(is, i+1); j < len(is) {
+				if pop, _ := opcode(is[j]); pop == code.OpPop {
+					out = append(out, is[i+1:j]...)
+					i = j
+					n++
+					continue
+				}
+			}
+		}
+		out = append(out, is[i])
+	}
+	return out, n
+}
+
+func isLoad(op code.OpCode) bool {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpGetLocal:
+		return true
+	}
+	return false
+}
+
+// BangBang removes double negations of values which are booleans already.
+type BangBang struct{}
+
+func (BangBang) Name() string { return "bang-bang" }
+
+func (BangBang) Run(is Instructions) (Instructions, int) {
+	out := make(Instructions, 0, len(is))
+	n := 0
+	var prev code.OpCode
+	havePrev := false
+	for i := 0; i < len(is); i++ {
+		op, ok := opcode(is[i])
+		if !ok {
+			out = append(out, is[i])
+			continue
+		}
+		if op == code.OpBang && havePrev && isBoolean(prev) {
+			if j := next(is, i+1); j < len(is) {
+				if bang, _ := opcode(is[j]); bang == code.OpBang {
+					out = append(out, is[i+1:j]...)
+					i = j
+					n++
+					continue
+				}
+			}
+		}
+		out = append(out, is[i])
+		prev, havePrev = op, true
+	}
+	return out, n
+}
+
+// isBoolean reports whether op always leaves a boolean on the stack.
+func isBoolean(op code.OpCode) bool {
+	switch op {
+	case code.OpTrue, code.OpFalse, code.OpBang, code.OpAnd, code.OpOr, code.OpMatch,
+		code.OpCmpEQ, code.OpCmpNE, code.OpCmpLT, code.OpCmpLE, code.OpCmpGT, code.OpCmpGE:
+		return true
+	}
+	return false
+}
+
+// Superinstructions fuses common sequences of instructions into single
+// instructions, which saves their dispatch in the VM.
+type Superinstructions struct{}
+
+func (Superinstructions) Name() string { return "superinstructions" }
+
+func (Superinstructions) Run(is Instructions) (Instructions, int) {
+	out := make(Instructions, 0, len(is))
+	n := 0
+	for i := 0; i < len(is); i++ {
+		fused, end := fuse(is, i)
+		if fused == nil {
+			out = append(out, is[i])
+			continue
+		}
+		// Keep the position marks, the last one is the fused instruction's.
+		for _, x := range is[i+1 : end] {
+			if _, ok := x.(*Pos); ok {
+				out = append(out, x)
+			}
+		}
+		out = append(out, fused)
+		i = end - 1
+		n++
+	}
+	return out, n
+}
+
+// fuse returns the superinstruction for the sequence starting at is[i],
+// and the index following the sequence, or nil.
+func fuse(is Instructions, i int) (Instruction, int) {
+	first, ok := is[i].(*OpArg)
+	if !ok {
+		return nil, 0
+	}
+	j := next(is, i+1)
+	if j == len(is) {
+		return nil, 0
+	}
+	second, ok := is[j].(*OpArg)
+	if !ok {
+		return nil, 0
+	}
+	switch {
+	case first.Op == code.OpGetLocal && code.CanPack(first.Arg, second.Arg):
+		if end, ok := addLocalConst(is, i); ok {
+			return &OpArg{Op: code.OpAddLocalConst, Arg: code.Pack(first.Arg, second.Arg)}, end
+		}
+		// Leave the second load to an OpAddLocalConst it starts.
+		if _, ok := addLocalConst(is, j); second.Op == code.OpGetLocal && !ok {
+			return &OpArg{Op: code.OpGetLocal2, Arg: code.Pack(first.Arg, second.Arg)}, j + 1
+		}
+	case first.Op == code.OpGetGlobal && second.Op == code.OpCall && code.CanPack(second.Arg, first.Arg):
+		return &OpArg{Op: code.OpCallGlobal, Arg: code.Pack(second.Arg, first.Arg)}, j + 1
+	}
+	return nil, 0
+}
+
+// addLocalConst reports whether is[i:] starts with an OpGetLocal, an
+// OpConstant whose arguments can be packed, and an OpAdd, returning the
+// index after them.
+func addLocalConst(is Instructions, i int) (int, bool) {
+	load, ok := is[i].(*OpArg)
+	if !ok || load.Op != code.OpGetLocal {
+		return 0, false
+	}
+	j := next(is, i+1)
+	if j == len(is) {
+		return 0, false
+	}
+	k, ok := is[j].(*OpArg)
+	if !ok || k.Op != code.OpConstant || !code.CanPack(load.Arg, k.Arg) {
+		return 0, false
+	}
+	add := next(is, j+1)
+	if add == len(is) {
+		return 0, false
+	}
+	if op, _ := opcode(is[add]); op != code.OpAdd {
+		return 0, false
+	}
+	return add + 1, true
+}
@@ -0,0 +1,122 @@
+package compile_test
+
+import (
+	"fmt"
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/parser"
+	"strings"
+	"testing"
+)
+
+// listing returns the instructions is, one per line, position marks as
+// "@pos".
+func listing(is compile.Instructions) string {
+	var b strings.Builder
+	for _, i := range is {
+		switch i := i.(type) {
+		case *compile.Pos:
+			fmt.Fprintf(&b, "@%d\n", i.Pos)
+		case *compile.Op:
+			fmt.Fprintf(&b, "%s\n", i.Op)
+		case *compile.OpArg:
+			fmt.Fprintf(&b, "%s %d\n", i.Op, i.Arg)
+		}
+	}
+	return b.String()
+}
+
+func op(o code.OpCode) compile.Instruction { return &compile.Op{Op: o} }
+
+func arg(o code.OpCode, a uint32) compile.Instruction { return &compile.OpArg{Op: o, Arg: a} }
+
+func pos(p int) compile.Instruction { return &compile.Pos{Pos: p} }
+
+func TestPasses(t *testing.T) {
+	tests := []struct {
+		name string
+		pass compile.Pass
+		in   compile.Instructions
+		out  compile.Instructions
+		n    int
+	}{
+		{"load-pop constant", compile.LoadPop{},
+			compile.Instructions{arg(code.OpConstant, 0), op(code.OpPop), op(code.OpTrue)},
+			compile.Instructions{op(code.OpTrue)}, 1},
+		{"load-pop booleans and locals", compile.LoadPop{},
+			compile.Instructions{op(code.OpTrue), op(code.OpPop), op(code.OpFalse), pos(3), op(code.OpPop), arg(code.OpGetLocal, 1), op(code.OpPop)},
+			compile.Instructions{pos(3)}, 3},
+		// Reading a global or a free variable fails if it is unset.
+		{"load-pop global", compile.LoadPop{},
+			compile.Instructions{arg(code.OpGetGlobal, 0), op(code.OpPop), arg(code.OpConstant, 0)},
+			compile.Instructions{arg(code.OpGetGlobal, 0), op(code.OpPop), arg(code.OpConstant, 0)}, 0},
+		{"load-pop free", compile.LoadPop{},
+			compile.Instructions{arg(code.OpGetFree, 0), op(code.OpPop)},
+			compile.Instructions{arg(code.OpGetFree, 0), op(code.OpPop)}, 0},
+		{"load-pop builtin", compile.LoadPop{},
+			compile.Instructions{arg(code.OpGetBuiltin, 0), op(code.OpPop)},
+			compile.Instructions{arg(code.OpGetBuiltin, 0), op(code.OpPop)}, 0},
+		{"load-pop at the end", compile.LoadPop{},
+			compile.Instructions{arg(code.OpConstant, 0)},
+			compile.Instructions{arg(code.OpConstant, 0)}, 0},
+
+		{"bang-bang comparison", compile.BangBang{},
+			compile.Instructions{op(code.OpCmpLT), op(code.OpBang), pos(2), op(code.OpBang)},
+			compile.Instructions{op(code.OpCmpLT), pos(2)}, 1},
+		{"bang-bang boolean", compile.BangBang{},
+			compile.Instructions{op(code.OpTrue), op(code.OpBang), op(code.OpBang), op(code.OpBang)},
+			compile.Instructions{op(code.OpTrue), op(code.OpBang)}, 1},
+		// !!x converts x to a boolean.
+		{"bang-bang integer", compile.BangBang{},
+			compile.Instructions{arg(code.OpConstant, 0), op(code.OpBang), op(code.OpBang)},
+			compile.Instructions{arg(code.OpConstant, 0), op(code.OpBang), op(code.OpBang)}, 0},
+
+		{"get-local2", compile.Superinstructions{},
+			compile.Instructions{arg(code.OpGetLocal, 1), pos(4), arg(code.OpGetLocal, 2), op(code.OpAdd)},
+			compile.Instructions{pos(4), arg(code.OpGetLocal2, code.Pack(1, 2)), op(code.OpAdd)}, 1},
+		{"add-local-const", compile.Superinstructions{},
+			compile.Instructions{arg(code.OpGetLocal, 0), arg(code.OpConstant, 3), op(code.OpAdd)},
+			compile.Instructions{arg(code.OpAddLocalConst, code.Pack(0, 3))}, 1},
+		// The second load starts an OpAddLocalConst.
+		{"get-local add-local-const", compile.Superinstructions{},
+			compile.Instructions{arg(code.OpGetLocal, 0), arg(code.OpGetLocal, 1), arg(code.OpConstant, 3), op(code.OpAdd), op(code.OpAdd)},
+			compile.Instructions{arg(code.OpGetLocal, 0), arg(code.OpAddLocalConst, code.Pack(1, 3)), op(code.OpAdd)}, 1},
+		{"call-global", compile.Superinstructions{},
+			compile.Instructions{arg(code.OpConstant, 0), arg(code.OpGetGlobal, 7), arg(code.OpCall, 1)},
+			compile.Instructions{arg(code.OpConstant, 0), arg(code.OpCallGlobal, code.Pack(1, 7))}, 1},
+		{"unpackable", compile.Superinstructions{},
+			compile.Instructions{arg(code.OpGetLocal, 0x100), arg(code.OpGetLocal, 0)},
+			compile.Instructions{arg(code.OpGetLocal, 0x100), arg(code.OpGetLocal, 0)}, 0},
+	}
+	for _, tt := range tests {
+		out, n := tt.pass.Run(tt.in)
+		if got, want := listing(out), listing(tt.out); got != want || n != tt.n {
+			t.Errorf("%s: %s made %d rewrites:\n%s, want %d:\n%s", tt.name, tt.pass.Name(), n, got, tt.n, want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		src  string
+		want compile.Stats
+	}{
+		{`1; true; 2`, compile.Stats{"load-pop": 2}},
+		{`x = 1; x; !!(x < 2)`, compile.Stats{"bang-bang": 1}},
+		{`fn f(a, b) { a; b + a + 1 }; f(1, 2)`, compile.Stats{"load-pop": 1, "superinstructions": 2}},
+		{`fn f(n) { n }; f(1) + f(2)`, compile.Stats{"superinstructions": 2}},
+	}
+	for _, tt := range tests {
+		prog, errs := parser.Parse(tt.src)
+		if len(errs) > 0 {
+			t.Fatalf("Parse(%q): %v", tt.src, errs[0])
+		}
+		c := compile.New()
+		if err := c.Compile(prog); err != nil {
+			t.Fatalf("Compile(%q): %v", tt.src, err)
+		}
+		if fmt.Sprint(c.Stats) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: stats %v, want %v", tt.src, c.Stats, tt.want)
+		}
+	}
+}
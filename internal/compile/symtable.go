@@ -73,6 +73,15 @@ func (s *SymbolTable) Define(name string) Symbol {
 	return symbol
 }
 
+// DefineExternal defines name as a global in the outermost table enclosing
+// s, and returns its symbol.
+func (s *SymbolTable) DefineExternal(name string) Symbol {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	return s.Define(name)
+}
+
 // DefineBuiltin creates and returns a symbol within builtin scope
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{
@@ -110,6 +119,17 @@ func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	return symbol
 }
 
+// Names returns the names of the symbols defined in s, by index.
+func (s *SymbolTable) Names() []string {
+	names := make([]string, s.NumDefinitions)
+	for name, symbol := range s.store {
+		if symbol.Scope == GlobalScope || symbol.Scope == LocalScope {
+			names[symbol.Index] = name
+		}
+	}
+	return names
+}
+
 // Resolve takes a name, looks for it in the SymbolTable's store, and returns it if found along
 // with a boolean representing whether it was found
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
@@ -0,0 +1,460 @@
+// Package glob matches strings against shell-style wildcard patterns.
+//
+//	?        any single character except '/'
+//	*        any sequence of characters except '/'
+//	**       any sequence of characters, '**/' also matches no directory
+//	[a-z]    a character in the class, [!a-z] or [^a-z] negates it
+//	{a,b}    one of the comma separated alternatives, which may nest
+//	\c       the character c
+//
+// A pattern is compiled once into an NFA whose states are turned into a DFA
+// lazily while matching, so matching is linear in the length of the input.
+package glob
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const separator = '/'
+
+// maxStates bounds the number of cached DFA states of a Matcher.
+const maxStates = 1024
+
+// Matcher is a compiled glob pattern. It is safe for concurrent use.
+type Matcher struct {
+	pattern string
+	prog    []inst
+	start   int
+
+	mu     sync.Mutex
+	states map[string]*dstate
+	init   *dstate
+}
+
+type opcode int
+
+const (
+	opRune  opcode = iota // match r
+	opOne                 // match any character except the separator
+	opAll                 // match any character
+	opClass               // match a character in class
+	opSplit               // continue at out and out1
+	opMatch
+)
+
+type inst struct {
+	op    opcode
+	r     rune
+	class *class
+	out   int
+	out1  int
+}
+
+type class struct {
+	ranges [][2]rune
+	negate bool
+}
+
+func (c *class) has(r rune) bool {
+	if r == separator {
+		return false
+	}
+	for _, rr := range c.ranges {
+		if rr[0] <= r && r <= rr[1] {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+// dstate is a DFA state: a set of NFA states reachable after some input.
+type dstate struct {
+	insts []int
+	match bool
+	next  map[rune]*dstate
+}
+
+// Compile parses pattern into a Matcher.
+func Compile(pattern string) (*Matcher, error) {
+	p := &parser{src: pattern}
+	n, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	m := &Matcher{
+		pattern: pattern,
+		states:  make(map[string]*dstate),
+	}
+	c := &compiler{}
+	f := c.compile(n)
+	match := c.emit(inst{op: opMatch})
+	c.patch(f.outs, match)
+	m.prog = c.prog
+	m.start = f.start
+	m.init = m.state(m.closure([]int{m.start}))
+	return m, nil
+}
+
+// MustCompile is like Compile but panics if the pattern is invalid.
+func MustCompile(pattern string) *Matcher {
+	m, err := Compile(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Matcher) String() string {
+	return m.pattern
+}
+
+// Match reports whether s matches the whole pattern.
+func (m *Matcher) Match(s string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.init
+	for _, r := range s {
+		d = m.step(d, r)
+		if len(d.insts) == 0 {
+			return false
+		}
+	}
+	return d.match
+}
+
+func (m *Matcher) step(d *dstate, r rune) *dstate {
+	if next, ok := d.next[r]; ok {
+		return next
+	}
+	var insts []int
+	for _, i := range d.insts {
+		in := &m.prog[i]
+		var ok bool
+		switch in.op {
+		case opRune:
+			ok = in.r == r
+		case opOne:
+			ok = r != separator
+		case opAll:
+			ok = true
+		case opClass:
+			ok = in.class.has(r)
+		}
+		if ok {
+			insts = append(insts, in.out)
+		}
+	}
+	next := m.state(m.closure(insts))
+	if len(m.states) > maxStates {
+		// Start over rather than growing without bound on odd inputs.
+		m.states = make(map[string]*dstate)
+		m.init = m.state(m.closure([]int{m.start}))
+		return next
+	}
+	d.next[r] = next
+	return next
+}
+
+// closure returns the sorted set of states reachable from insts without
+// consuming input.
+func (m *Matcher) closure(insts []int) []int {
+	seen := make(map[int]bool)
+	var set []int
+	var visit func(i int)
+	visit = func(i int) {
+		if seen[i] {
+			return
+		}
+		seen[i] = true
+		if m.prog[i].op == opSplit {
+			visit(m.prog[i].out)
+			visit(m.prog[i].out1)
+			return
+		}
+		set = append(set, i)
+	}
+	for _, i := range insts {
+		visit(i)
+	}
+	slices.Sort(set)
+	return set
+}
+
+func (m *Matcher) state(insts []int) *dstate {
+	var key strings.Builder
+	for _, i := range insts {
+		key.WriteString(strconv.Itoa(i))
+		key.WriteByte(',')
+	}
+	if d, ok := m.states[key.String()]; ok {
+		return d
+	}
+	d := &dstate{insts: insts, next: make(map[rune]*dstate)}
+	for _, i := range insts {
+		if m.prog[i].op == opMatch {
+			d.match = true
+		}
+	}
+	m.states[key.String()] = d
+	return d
+}
+
+type nodeKind int
+
+const (
+	nodeRune nodeKind = iota
+	nodeOne
+	nodeStar
+	nodeGlobstar // ** followed by a separator
+	nodeAll      // ** elsewhere
+	nodeClass
+	nodeSeq
+	nodeAlt
+)
+
+type node struct {
+	kind  nodeKind
+	r     rune
+	class *class
+	subs  []*node
+}
+
+// Error is a syntax error in a pattern.
+type Error struct {
+	Pattern string
+	Pos     int
+	Msg     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("glob: %s at %d in %q", e.Msg, e.Pos+1, e.Pattern)
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) parse() (*node, error) {
+	n, err := p.parseSeq(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return n, nil
+}
+
+func (p *parser) errorf(format string, a ...any) error {
+	return &Error{Pattern: p.src, Pos: p.pos, Msg: fmt.Sprintf(format, a...)}
+}
+
+// parseSeq parses up to the end of the pattern, or inside braces up to the
+// next ',' or '}'.
+func (p *parser) parseSeq(inBraces bool) (*node, error) {
+	seq := &node{kind: nodeSeq}
+	for p.pos < len(p.src) {
+		r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		if inBraces && (r == ',' || r == '}') {
+			break
+		}
+		p.pos += n
+		switch r {
+		case '*':
+			if strings.HasPrefix(p.src[p.pos:], "*") {
+				p.pos++
+				if strings.HasPrefix(p.src[p.pos:], string(separator)) {
+					p.pos++
+					seq.subs = append(seq.subs, &node{kind: nodeGlobstar})
+				} else {
+					seq.subs = append(seq.subs, &node{kind: nodeAll})
+				}
+			} else {
+				seq.subs = append(seq.subs, &node{kind: nodeStar})
+			}
+		case '?':
+			seq.subs = append(seq.subs, &node{kind: nodeOne})
+		case '[':
+			c, err := p.parseClass()
+			if err != nil {
+				return nil, err
+			}
+			seq.subs = append(seq.subs, &node{kind: nodeClass, class: c})
+		case '{':
+			alt, err := p.parseAlt()
+			if err != nil {
+				return nil, err
+			}
+			seq.subs = append(seq.subs, alt)
+		case '\\':
+			if p.pos >= len(p.src) {
+				return nil, p.errorf("trailing backslash")
+			}
+			r, n = utf8.DecodeRuneInString(p.src[p.pos:])
+			p.pos += n
+			seq.subs = append(seq.subs, &node{kind: nodeRune, r: r})
+		default:
+			seq.subs = append(seq.subs, &node{kind: nodeRune, r: r})
+		}
+	}
+	return seq, nil
+}
+
+func (p *parser) parseAlt() (*node, error) {
+	start := p.pos - 1
+	alt := &node{kind: nodeAlt}
+	for {
+		seq, err := p.parseSeq(true)
+		if err != nil {
+			return nil, err
+		}
+		alt.subs = append(alt.subs, seq)
+		if p.pos >= len(p.src) {
+			p.pos = start
+			return nil, p.errorf("unterminated '{'")
+		}
+		p.pos++
+		if p.src[p.pos-1] == '}' {
+			return alt, nil
+		}
+	}
+}
+
+func (p *parser) parseClass() (*class, error) {
+	start := p.pos - 1
+	c := &class{}
+	if p.pos < len(p.src) && (p.src[p.pos] == '!' || p.src[p.pos] == '^') {
+		c.negate = true
+		p.pos++
+	}
+	for first := true; ; first = false {
+		if p.pos >= len(p.src) {
+			p.pos = start
+			return nil, p.errorf("unterminated '['")
+		}
+		if p.src[p.pos] == ']' && !first {
+			p.pos++
+			return c, nil
+		}
+		lo := p.classChar()
+		hi := lo
+		if strings.HasPrefix(p.src[p.pos:], "-") && !strings.HasPrefix(p.src[p.pos:], "-]") {
+			p.pos++
+			if p.pos >= len(p.src) {
+				continue
+			}
+			hi = p.classChar()
+			if hi < lo {
+				return nil, p.errorf("invalid range %c-%c", lo, hi)
+			}
+		}
+		c.ranges = append(c.ranges, [2]rune{lo, hi})
+	}
+}
+
+func (p *parser) classChar() rune {
+	r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	if r == '\\' && p.pos < len(p.src) {
+		r, n = utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += n
+	}
+	return r
+}
+
+// compiler turns the pattern tree into an NFA program.
+type compiler struct {
+	prog []inst
+}
+
+// frag is a partially built piece of the program with dangling exits.
+type frag struct {
+	start int
+	outs  []exit
+}
+
+type exit struct {
+	inst int
+	alt  bool // patch out1 instead of out
+}
+
+func (c *compiler) emit(i inst) int {
+	c.prog = append(c.prog, i)
+	return len(c.prog) - 1
+}
+
+func (c *compiler) patch(outs []exit, target int) {
+	for _, e := range outs {
+		if e.alt {
+			c.prog[e.inst].out1 = target
+		} else {
+			c.prog[e.inst].out = target
+		}
+	}
+}
+
+// empty returns a fragment matching the empty string.
+func (c *compiler) empty() frag {
+	i := c.emit(inst{op: opSplit})
+	return frag{start: i, outs: []exit{{i, false}, {i, true}}}
+}
+
+// loop returns a fragment matching any number of characters accepted by op.
+func (c *compiler) loop(op opcode) frag {
+	split := c.emit(inst{op: opSplit})
+	one := c.emit(inst{op: op, out: split})
+	c.prog[split].out = one
+	return frag{start: split, outs: []exit{{split, true}}}
+}
+
+func (c *compiler) compile(n *node) frag {
+	switch n.kind {
+	case nodeRune:
+		i := c.emit(inst{op: opRune, r: n.r})
+		return frag{start: i, outs: []exit{{i, false}}}
+	case nodeOne:
+		i := c.emit(inst{op: opOne})
+		return frag{start: i, outs: []exit{{i, false}}}
+	case nodeClass:
+		i := c.emit(inst{op: opClass, class: n.class})
+		return frag{start: i, outs: []exit{{i, false}}}
+	case nodeStar:
+		return c.loop(opOne)
+	case nodeAll:
+		return c.loop(opAll)
+	case nodeGlobstar:
+		// (.*/)?
+		split := c.emit(inst{op: opSplit})
+		all := c.loop(opAll)
+		sep := c.emit(inst{op: opRune, r: separator})
+		c.patch(all.outs, sep)
+		c.prog[split].out = all.start
+		return frag{start: split, outs: []exit{{split, true}, {sep, false}}}
+	case nodeSeq:
+		if len(n.subs) == 0 {
+			return c.empty()
+		}
+		f := c.compile(n.subs[0])
+		for _, sub := range n.subs[1:] {
+			next := c.compile(sub)
+			c.patch(f.outs, next.start)
+			f.outs = next.outs
+		}
+		return f
+	case nodeAlt:
+		f := c.compile(n.subs[0])
+		for _, sub := range n.subs[1:] {
+			next := c.compile(sub)
+			split := c.emit(inst{op: opSplit, out: f.start, out1: next.start})
+			f = frag{start: split, outs: append(f.outs, next.outs...)}
+		}
+		return f
+	}
+	panic("glob: unknown node")
+}
@@ -0,0 +1,124 @@
+package glob
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{"abc", []string{"abc"}, []string{"", "ab", "abcd", "abd"}},
+		{"", []string{""}, []string{"a"}},
+		{"a?c", []string{"abc", "a-c", "aéc"}, []string{"ac", "abbc", "a/c"}},
+		{"*.go", []string{"x.go", ".go", "main_test.go"}, []string{"x.gox", "dir/x.go"}},
+		{"a*b*c", []string{"abc", "aXbYc", "abbbc", "acbc"}, []string{"ab", "acb", "a/b/c"}},
+		{"**", []string{"", "a", "a/b/c"}, nil},
+		{"a/**", []string{"a/", "a/b", "a/b/c"}, []string{"a", "b/c"}},
+		{"**/*.go", []string{"x.go", "a/x.go", "a/b/x.go"}, []string{"x.c", "a/x.c", "a/"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"ab", "a//b/c", "a/xb"}},
+		{"**.go", []string{"a.go", "a/b.go"}, []string{"a.c"}},
+		{"[abc]", []string{"a", "c"}, []string{"d", "", "ab"}},
+		{"[a-c0-9]x", []string{"bx", "7x"}, []string{"dx", "x"}},
+		{"[!a-c]", []string{"d", "é"}, []string{"a", "/"}},
+		{"[^a-c]", []string{"d"}, []string{"b"}},
+		{"[]]", []string{"]"}, []string{"["}},
+		{"[a-]", []string{"a", "-"}, []string{"b"}},
+		{`[\]]`, []string{"]"}, []string{`\`}},
+		{"{a,b}c", []string{"ac", "bc"}, []string{"c", "abc"}},
+		{"{a,}c", []string{"ac", "c"}, []string{"bc"}},
+		{"x{a,{b,c}d}", []string{"xa", "xbd", "xcd"}, []string{"xb", "xad", "xd"}},
+		{"{*.go,**/*_test.pr}", []string{"a.go", "a_test.pr", "a/b/c_test.pr"}, []string{"a/b.go", "a.pr"}},
+		{`\*\?`, []string{"*?"}, []string{"ab", `\*\?`}},
+		{"a},", []string{"a},"}, []string{"a"}},
+		{"cpu.*.{user,system}", []string{"cpu.0.user", "cpu.total.system"}, []string{"cpu.0.idle", "mem.0.user"}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.pattern, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if !m.Match(s) {
+				t.Errorf("%q doesn't match %q", tt.pattern, s)
+			}
+		}
+		for _, s := range tt.nomatch {
+			if m.Match(s) {
+				t.Errorf("%q matches %q", tt.pattern, s)
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		pattern, err string
+	}{
+		{"a{b", `glob: unterminated '{' at 2 in "a{b"`},
+		{"{a,{b}", `glob: unterminated '{' at 1 in "{a,{b}"`},
+		{"{a,b", `glob: unterminated '{' at 1 in "{a,b"`},
+		{"[ab", `glob: unterminated '[' at 1 in "[ab"`},
+		{"[z-a]", `glob: invalid range z-a at 5 in "[z-a]"`},
+		{`ab\`, `glob: trailing backslash at 4 in "ab\\"`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.pattern)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("Compile(%q) = %v, want %s", tt.pattern, err, tt.err)
+		}
+	}
+}
+
+func TestMaxStates(t *testing.T) {
+	// The DFA remembers the last 12 characters, which takes 2^12 states.
+	const n = 12
+	m := MustCompile("*a" + strings.Repeat("?", n-1))
+	r := rand.New(rand.NewSource(1))
+	for range 200 {
+		b := make([]byte, 40+r.Intn(40))
+		for i := range b {
+			b[i] = "ab"[r.Intn(2)]
+		}
+		s := string(b)
+		if got, want := m.Match(s), s[len(s)-n] == 'a'; got != want {
+			t.Fatalf("Match(%q) = %v, want %v", s, got, want)
+		}
+		if len(m.states) > maxStates+1 {
+			t.Fatalf("%d DFA states cached, want at most %d", len(m.states), maxStates+1)
+		}
+	}
+}
+
+func TestConcurrentMatch(t *testing.T) {
+	m := MustCompile("{a,b}*[0-9]")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				s := strings.Repeat("x", j%7)
+				if m.Match("a"+s+"1") != true || m.Match("c"+s+"1") != false {
+					t.Errorf("goroutine %d: wrong match", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkMatch(b *testing.B) {
+	m := MustCompile("**/{cmd,internal}/*/*_test.go")
+	s := "src/github.com/parrot/internal/glob/glob_test.go"
+	for range b.N {
+		m.Match(s)
+	}
+}
@@ -0,0 +1,451 @@
+// Package gogen translates parsed programs into Go source code that runs
+// them on the runtime in package parrot/rt.
+//
+// The top-level code and each function of a script become Go functions,
+// whose locals are Go variables and whose constants are package variables
+// created once. Operators, calls and globals go through an rt.Thread, which
+// gives them the semantics of the bytecode VM. Like the VM, the generated
+// code doesn't support closures.
+package gogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/token"
+	"strings"
+)
+
+// Config configures the generated code.
+type Config struct {
+	// Package is the name of the generated package. For package main, the
+	// code includes a main function that runs the script with all
+	// capabilities and prints its result.
+	Package string
+	// Source is the name of the script, for comments and error messages.
+	Source string
+}
+
+// Generate returns the Go source of a package running prog, which declares
+//
+//	var Program *rt.Program
+//	func Run(ctx context.Context, globals map[string]rt.Value, opts ...rt.Option) (rt.Value, error)
+func Generate(prog *parser.Program, cfg Config) (src []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(genError)
+			if !ok {
+				panic(r)
+			}
+			src, err = nil, e.err
+		}
+	}()
+	g := &generator{
+		globals: make(map[string]int),
+		consts:  make(map[string]string),
+	}
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*parser.ExprStmt); ok {
+			switch e := s.E.(type) {
+			case *parser.Assign:
+				g.global(e.Left.String())
+			case *parser.Function:
+				if e.Name != "" {
+					g.global(e.Name)
+				}
+			}
+		}
+	}
+	top := &funcState{g: g}
+	top.body(prog)
+	var code bytes.Buffer
+	g.writeFile(&code, cfg, top)
+	src, err = format.Source(code.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("gogen: formatting the generated code: %w", err)
+	}
+	return src, nil
+}
+
+// genError carries an error out of the recursive code generation.
+type genError struct {
+	err error
+}
+
+func fail(format string, a ...any) {
+	panic(genError{fmt.Errorf(format, a...)})
+}
+
+type generator struct {
+	globals map[string]int
+	names   []string
+	consts  map[string]string // Go expressions of constants to their variables
+	kdecls  []string
+	funcs   []*funcState
+}
+
+// global returns the index of the global name, defining it if needed.
+func (g *generator) global(name string) int {
+	if i, ok := g.globals[name]; ok {
+		return i
+	}
+	g.globals[name] = len(g.names)
+	g.names = append(g.names, name)
+	return g.globals[name]
+}
+
+// constant returns the variable holding the value of the Go expression
+// init, which is evaluated once.
+func (g *generator) constant(init string) string {
+	if k, ok := g.consts[init]; ok {
+		return k
+	}
+	k := fmt.Sprintf("k%d", len(g.kdecls))
+	g.consts[init] = k
+	g.kdecls = append(g.kdecls, fmt.Sprintf("%s = %s", k, init))
+	return k
+}
+
+func (g *generator) writeFile(w *bytes.Buffer, cfg Config, top *funcState) {
+	source := cfg.Source
+	if source == "" {
+		source = "a script"
+	}
+	fmt.Fprintf(w, "// Code generated by parrot build from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(w, "package %s\n\n", cfg.Package)
+	w.WriteString("import (\n\"context\"\n")
+	if cfg.Package == "main" {
+		w.WriteString("\"fmt\"\n\"os\"\n")
+	}
+	w.WriteString("\n\"parrot/rt\"\n)\n\n")
+
+	fmt.Fprintf(w, "// Program is %s translated to Go.\n", source)
+	w.WriteString("var Program = &rt.Program{\nGlobals: []string{")
+	for i, name := range g.names {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		fmt.Fprintf(w, "%q", name)
+	}
+	w.WriteString("},\nMain: top,\n}\n\n")
+
+	w.WriteString("// Run runs Program with the given globals, see rt.Run.\n")
+	w.WriteString("func Run(ctx context.Context, globals map[string]rt.Value, opts ...rt.Option) (rt.Value, error) {\n")
+	w.WriteString("return rt.Run(ctx, Program, globals, opts...)\n}\n\n")
+
+	if cfg.Package == "main" {
+		w.WriteString("func main() {\n")
+		w.WriteString("v, err := Run(context.Background(), nil, rt.WithCapabilities(rt.CapAll))\n")
+		fmt.Fprintf(w, "if err != nil {\nfmt.Fprintf(os.Stderr, \"%%s: %%v\\n\", %q, err)\nos.Exit(1)\n}\n", cfg.Source)
+		w.WriteString("if v != rt.Null {\nfmt.Println(v)\n}\n}\n\n")
+	}
+
+	if len(g.kdecls) > 0 || len(g.funcs) > 0 {
+		w.WriteString("var (\n")
+		for _, d := range g.kdecls {
+			w.WriteString(d + "\n")
+		}
+		for _, fs := range g.funcs {
+			fmt.Fprintf(w, "%s = &rt.Func{Name: %q, Params: %d}\n", fs.fn, fs.name, fs.params)
+		}
+		w.WriteString(")\n\n")
+	}
+	if len(g.funcs) > 0 {
+		// The bodies refer to the functions, which would be an
+		// initialization cycle for a composite literal.
+		w.WriteString("func init() {\n")
+		for _, fs := range g.funcs {
+			fmt.Fprintf(w, "%s.Body = %sBody\n", fs.fn, fs.fn)
+		}
+		w.WriteString("}\n\n")
+	}
+
+	w.WriteString("func top(t *rt.Thread) rt.Value {\n")
+	w.WriteString(top.code.String())
+	w.WriteString("}\n")
+	for _, fs := range g.funcs {
+		name := fs.name
+		if name == "" {
+			name = "an anonymous function"
+		}
+		fmt.Fprintf(w, "\n// %sBody is %s.\n", fs.fn, name)
+		fmt.Fprintf(w, "func %sBody(t *rt.Thread, args []rt.Value) rt.Value {\n", fs.fn)
+		fs.writeLocals(w)
+		w.WriteString(fs.code.String())
+		w.WriteString("}\n")
+	}
+}
+
+// funcState is the state of the function being generated.
+type funcState struct {
+	g      *generator
+	parent *funcState
+	fn     string // variable of the rt.Func, empty for the top level
+	name   string
+	params int
+	locals map[string]*local // nil for the top level
+	order  []*local
+	code   strings.Builder
+}
+
+// local is a local variable of a function.
+type local struct {
+	name string
+	v    string // the Go variable
+	used bool
+}
+
+func (fs *funcState) emit(format string, a ...any) {
+	fmt.Fprintf(&fs.code, format, a...)
+	fs.code.WriteByte('\n')
+}
+
+// define returns a new local for name.
+func (fs *funcState) define(name string) *local {
+	l := &local{name: name, v: fmt.Sprintf("l%d", len(fs.order))}
+	fs.locals[name] = l
+	fs.order = append(fs.order, l)
+	return l
+}
+
+// writeLocals declares the parameters and locals of fs.
+func (fs *funcState) writeLocals(w *bytes.Buffer) {
+	for i, l := range fs.order {
+		if i < fs.params {
+			fmt.Fprintf(w, "%s := args[%d] // %s\n", l.v, i, l.name)
+		} else {
+			fmt.Fprintf(w, "var %s rt.Value // %s\n", l.v, l.name)
+		}
+		if !l.used {
+			fmt.Fprintf(w, "_ = %s\n", l.v)
+		}
+	}
+}
+
+// body generates the statements of a program or function body, returning
+// the value of the last one.
+func (fs *funcState) body(prog *parser.Program) {
+	var last parser.Expr
+	for i, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		if i == len(prog.Stmts)-1 {
+			last = s.E
+			break
+		}
+		fs.stmt(s.E)
+	}
+	switch {
+	case last == nil:
+		fs.emit("return rt.Null")
+	case fs.binding(last):
+		fs.emit("return %s", fs.ident(&parser.Ident{Name: boundName(last)}))
+	default:
+		if call, ok := last.(*parser.Call); ok && call.Tail && fs.locals != nil {
+			fs.emit("return t.TailCall(%s)", fs.callArgs(call))
+			return
+		}
+		fs.emit("return %s", fs.expr(last))
+	}
+}
+
+// stmt generates e, discarding its value.
+func (fs *funcState) stmt(e parser.Expr) {
+	if !fs.binding(e) {
+		fs.emit("_ = %s", fs.expr(e))
+	}
+}
+
+// binding generates e as a statement if it binds a name, an assignment or
+// a named function, and reports whether it did.
+func (fs *funcState) binding(e parser.Expr) bool {
+	switch e := e.(type) {
+	case *parser.Assign:
+		fs.emit("%s", fs.assign(e.Left.String(), fs.expr(e.Right), true))
+		return true
+	case *parser.Function:
+		if e.Name != "" {
+			fs.emit("%s", fs.assign(e.Name, fs.function(e), true))
+			return true
+		}
+	}
+	return false
+}
+
+// boundName returns the name bound by an assignment or named function.
+func boundName(e parser.Expr) string {
+	if a, ok := e.(*parser.Assign); ok {
+		return a.Left.String()
+	}
+	return e.(*parser.Function).Name
+}
+
+// assign returns the code assigning the Go expression v to name, which is
+// a global at the top level and a local in functions, as a statement or as
+// an expression yielding v. The value is computed before name is defined,
+// so that it refers to an outer name = name.
+func (fs *funcState) assign(name, v string, stmt bool) string {
+	if fs.locals == nil {
+		return fmt.Sprintf("t.Set(%d, %s)", fs.g.global(name), v)
+	}
+	l, ok := fs.locals[name]
+	if !ok {
+		l = fs.define(name)
+	}
+	if stmt {
+		return fmt.Sprintf("%s = %s", l.v, v)
+	}
+	l.used = true
+	return fmt.Sprintf("rt.Assign(&%s, %s)", l.v, v)
+}
+
+// expr returns the Go expression computing e.
+func (fs *funcState) expr(e parser.Expr) string {
+	switch e := e.(type) {
+	case *parser.Integer:
+		return fs.g.constant(fmt.Sprintf("rt.Int(%d)", e.Value))
+	case *parser.String:
+		return fs.g.constant(fmt.Sprintf("rt.Str(%q)", e.Literal))
+	case *parser.Boolean:
+		if e.Value {
+			return "rt.True"
+		}
+		return "rt.False"
+	case *parser.Ident:
+		return fs.ident(e)
+	case *parser.ListExpr:
+		elems := make([]string, len(e.List))
+		for i, x := range e.List {
+			elems[i] = fs.expr(x)
+		}
+		return fmt.Sprintf("t.List(%s)", strings.Join(elems, ", "))
+	case *parser.PrefixExpr:
+		switch e.TokenType {
+		case token.BANG:
+			return fmt.Sprintf("t.Not(%s)", fs.expr(e.Right))
+		case token.MINUS:
+			return fmt.Sprintf("t.Neg(%s)", fs.expr(e.Right))
+		case token.ADD:
+			return fs.expr(e.Right)
+		}
+		fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+	case *parser.InfixExpr:
+		return fs.infix(e)
+	case *parser.IndexExpr:
+		return fmt.Sprintf("t.Index(%s, %s)", fs.expr(e.Left), fs.expr(e.Index))
+	case *parser.Selector:
+		return fmt.Sprintf("t.Attr(%s, %q)", fs.expr(e.X), e.Name)
+	case *parser.Call:
+		return fmt.Sprintf("t.Call(%s)", fs.callArgs(e))
+	case *parser.Assign:
+		// Assignments and named functions yield the value they bind.
+		return fs.assign(e.Left.String(), fs.expr(e.Right), false)
+	case *parser.Function:
+		if e.Name == "" {
+			return fs.function(e)
+		}
+		return fs.assign(e.Name, fs.function(e), false)
+	}
+	fail("Go code generation does not support %T", e)
+	return ""
+}
+
+var infixMethods = map[token.Type]string{
+	token.ADD:   "Add",
+	token.MINUS: "Sub",
+	token.MUL:   "Mul",
+	token.DIV:   "Div",
+	token.MOD:   "Mod",
+	token.EQ:    "EQ",
+	token.NOTEQ: "NE",
+	token.LT:    "LT",
+	token.LE:    "LE",
+	token.GT:    "GT",
+	token.GE:    "GE",
+	token.AND:   "And",
+	token.OR:    "Or",
+	token.TILDE: "Match",
+}
+
+func (fs *funcState) infix(e *parser.InfixExpr) string {
+	m, ok := infixMethods[e.TokenType]
+	if !ok {
+		fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+	}
+	x := fs.expr(e.Left)
+	var y string
+	if pattern, ok := e.Right.(*parser.String); ok && e.TokenType == token.TILDE {
+		// Compile literal patterns once, when the package is initialized.
+		if g, ok := object.NewGlob(pattern.Literal).(*object.Error); ok {
+			fail("%s", string(*g))
+		}
+		y = fs.g.constant(fmt.Sprintf("rt.Glob(%q)", pattern.Literal))
+	} else {
+		y = fs.expr(e.Right)
+	}
+	return fmt.Sprintf("t.%s(%s, %s)", m, x, y)
+}
+
+// ident returns the Go expression for the variable e: a local, the running
+// function, a global or a builtin. Other names are globals the host is
+// expected to define.
+func (fs *funcState) ident(e *parser.Ident) string {
+	name := e.Name
+	if fs.locals != nil {
+		if l, ok := fs.locals[name]; ok {
+			l.used = true
+			return l.v
+		}
+		if name == fs.name {
+			return fs.fn
+		}
+		for p := fs.parent; p != nil && p.locals != nil; p = p.parent {
+			if _, ok := p.locals[name]; ok || name == p.name {
+				fail("%d: closures are not supported: %s is a local of %s", e.Pos+1, name, p.name)
+			}
+		}
+	}
+	if g, ok := fs.g.globals[name]; ok {
+		return fmt.Sprintf("t.Get(%d)", g)
+	}
+	if _, ok := object.ResolveBuiltin(name); ok {
+		return fmt.Sprintf("t.Builtin(%q)", name)
+	}
+	return fmt.Sprintf("t.Get(%d)", fs.g.global(name))
+}
+
+// callArgs returns the arguments of Thread.Call for e, the arguments of the
+// call coming first because the VM evaluates them before the function.
+func (fs *funcState) callArgs(e *parser.Call) string {
+	args := "nil"
+	if len(e.Args) > 0 {
+		elems := make([]string, len(e.Args))
+		for i, a := range e.Args {
+			elems[i] = fs.expr(a)
+		}
+		args = fmt.Sprintf("[]rt.Value{%s}", strings.Join(elems, ", "))
+	}
+	return fmt.Sprintf("%s, %s", args, fs.expr(e.Fn))
+}
+
+// function generates the function e and returns its variable.
+func (fs *funcState) function(e *parser.Function) string {
+	nfs := &funcState{
+		g:      fs.g,
+		parent: fs,
+		fn:     fmt.Sprintf("fn%d", len(fs.g.funcs)),
+		name:   e.Name,
+		params: len(e.Params),
+		locals: make(map[string]*local),
+	}
+	fs.g.funcs = append(fs.g.funcs, nfs)
+	for _, p := range e.Params {
+		nfs.define(p.Name)
+	}
+	nfs.body(e.Body)
+	return nfs.fn
+}
@@ -60,6 +60,8 @@ func (l *Lexer) NextToken() (tok token.Token) {
 		} else {
 			tok = l.newToken(token.BANG, "!")
 		}
+	case '~':
+		tok = l.newToken(token.TILDE, "~")
 	case '.':
 		if l.peek() == '.' {
 			tok = l.newToken(token.DOTDOT, "..")
@@ -101,6 +103,10 @@ func (l *Lexer) NextToken() (tok token.Token) {
 			number := l.readNumber()
 			return l.newToken(token.NUM, number, pos)
 		}
+		if !isIdentifier(l.ch) {
+			tok = l.newToken(token.ERR, string(l.ch))
+			break
+		}
 		identifier := l.readIdentifier()
 		return l.newToken(token.LookupKeyWord(identifier), identifier, pos)
 	}
@@ -0,0 +1,33 @@
+package lexer
+
+import (
+	"parrot/internal/token"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzLexer checks that the lexer reaches the end of any input, with a
+// token for each character at most, in order.
+func FuzzLexer(f *testing.F) {
+	f.Add("x = 10; fn f(a) { a[1:] + 'b' }")
+	f.Add(`"unterminated`)
+	f.Add("@#$ é 0x10 ..")
+	f.Fuzz(func(t *testing.T, src string) {
+		l := New(src)
+		n := utf8.RuneCountInString(src)
+		pos := -1
+		for i := 0; ; i++ {
+			if i > n {
+				t.Fatalf("%q: more than %d tokens", src, n)
+			}
+			tok := l.NextToken()
+			if tok.Type == token.EOF {
+				break
+			}
+			if tok.Pos <= pos || tok.Pos >= n {
+				t.Fatalf("%q: token %q at %d after %d", src, tok.Literal, tok.Pos, pos)
+			}
+			pos = tok.Pos
+		}
+	})
+}
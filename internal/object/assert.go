@@ -0,0 +1,101 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Equal reports whether x and y are equal values: ints, strings and
+// booleans by value, lists element by element, other objects by identity.
+func Equal(x, y Object) bool {
+	switch x := x.(type) {
+	case *Integer:
+		y, ok := y.(*Integer)
+		return ok && *x == *y
+	case *String:
+		y, ok := y.(*String)
+		return ok && *x == *y
+	case *Boolean:
+		y, ok := y.(*Boolean)
+		return ok && *x == *y
+	case *List:
+		y, ok := y.(*List)
+		if !ok || len(*x) != len(*y) {
+			return false
+		}
+		for i := range *x {
+			if !Equal((*x)[i], (*y)[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return x == y
+}
+
+// assertEq is the assert_eq builtin.
+func assertEq(args ...Object) Object {
+	if l := len(args); l != 2 && l != 3 {
+		return NewError("assert_eq: wrong number of arguments, expected 2 or 3, got %d", l)
+	}
+	got, want := args[0], args[1]
+	if Equal(got, want) {
+		return NULLObj
+	}
+	var msg string
+	if len(args) == 3 {
+		msg = ": " + args[2].String()
+	}
+	if gs, ok := got.(*String); ok {
+		if ws, ok := want.(*String); ok && strings.Contains(string(*gs)+string(*ws), "\n") {
+			return NewError("assert_eq failed%s (-want +got):\n%s", msg, lineDiff(string(*gs), string(*ws)))
+		}
+	}
+	return NewError("assert_eq failed%s: got %s, want %s", msg, repr(got), repr(want))
+}
+
+// repr returns o as it is written in scripts, for the values that can be.
+func repr(o Object) string {
+	if s, ok := o.(*String); ok {
+		return s.Quoted()
+	}
+	return o.String()
+}
+
+// lineDiff returns the lines of got and want, those of want only marked
+// with "-" and those of got only with "+".
+func lineDiff(got, want string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var d strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&d, "  %s\n", a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&d, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&d, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return strings.TrimSuffix(d.String(), "\n")
+}
@@ -1,5 +1,50 @@
 package object
 
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// Capability is a set of builtins a host can enable for scripts.
+type Capability uint
+
+const (
+	CapPure   Capability = 1 << iota // computations without side effects
+	CapIO                            // printing and file access
+	CapOS                            // the process environment
+	CapTime                          // the clock
+	CapRandom                        // random numbers
+
+	CapAll = CapPure | CapIO | CapOS | CapTime | CapRandom
+)
+
+var capNames = []string{"pure", "io", "os", "time", "random"}
+
+func (c Capability) String() string {
+	var names []string
+	for i, name := range capNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Has reports whether c includes all of want.
+func (c Capability) Has(want Capability) bool {
+	return c&want == want
+}
+
+// Stdout is where the print builtin writes.
+var Stdout io.Writer = os.Stdout
+
 type BuiltinFn func(args ...Object) Object
 
 func (b BuiltinFn) Type() Type {
@@ -10,6 +55,10 @@ func (b BuiltinFn) String() string {
 	return "<builtin function>"
 }
 
+func (b BuiltinFn) Call(args ...Object) Object {
+	return b(args...)
+}
+
 func ResolveBuiltin(name string) (BuiltinFn, bool) {
 	for _, b := range Builtins {
 		if name == b.Name {
@@ -19,26 +68,204 @@ func ResolveBuiltin(name string) (BuiltinFn, bool) {
 	return nil, false
 }
 
+// BuiltinCapability returns the capability the builtin name needs.
+func BuiltinCapability(name string) (Capability, bool) {
+	for _, b := range Builtins {
+		if name == b.Name {
+			return b.Cap, true
+		}
+	}
+	return 0, false
+}
+
+// DisabledError is the error for a script using a builtin whose capability
+// is not enabled.
+func DisabledError(name string, c Capability) error {
+	return fmt.Errorf("builtin %s is disabled, it needs the %s capability", name, c)
+}
+
 var Builtins = []struct {
 	Name    string
 	Builtin BuiltinFn
+	Cap     Capability
 }{
 	{
 		Name: "len",
+		Cap:  CapPure,
 		Builtin: func(args ...Object) Object {
 			if l := len(args); l != 1 {
 				return NewError("len: wrong number of arguments, expected 1, got %d", l)
 			}
 			switch o := args[0].(type) {
 			case *List:
-				ret := Integer(len(*o))
-				return &ret
+				return NewInteger(int64(len(*o)))
 			case *String:
-				ret := Integer(len(*o))
-				return &ret
+				return NewInteger(int64(len(*o)))
 			default:
 				return NewError("len: object of type %q has no length", o.Type())
 			}
 		},
 	},
+	{
+		Name: "peg",
+		Cap:  CapPure,
+		Builtin: func(args ...Object) Object {
+			if len(args) == 0 || len(args)%2 != 1 {
+				return NewError("peg: expected a grammar followed by name, function pairs")
+			}
+			src, ok := args[0].(*String)
+			if !ok {
+				return NewError("peg: grammar must be a string, not %s", args[0].Type())
+			}
+			actions := make(map[string]Callable)
+			for i := 1; i < len(args); i += 2 {
+				name, ok := args[i].(*String)
+				if !ok {
+					return NewError("peg: action name must be a string, not %s", args[i].Type())
+				}
+				fn, ok := args[i+1].(Callable)
+				if !ok {
+					return NewError("peg: action %q is not callable", string(*name))
+				}
+				actions[string(*name)] = fn
+			}
+			return NewGrammar(string(*src), actions)
+		},
+	},
+	{
+		Name: "glob",
+		Cap:  CapPure,
+		Builtin: func(args ...Object) Object {
+			switch len(args) {
+			case 1:
+				if p, ok := args[0].(*String); ok {
+					return NewGlob(string(*p))
+				}
+				return NewError("glob: pattern must be a string, not %s", args[0].Type())
+			case 2:
+				return MatchGlob(args[1], args[0])
+			default:
+				return NewError("glob: wrong number of arguments, expected 1 or 2, got %d", len(args))
+			}
+		},
+	},
+	{
+		Name: "print",
+		Cap:  CapIO,
+		Builtin: func(args ...Object) Object {
+			var s []string
+			for _, a := range args {
+				s = append(s, a.String())
+			}
+			if _, err := fmt.Fprintln(Stdout, strings.Join(s, " ")); err != nil {
+				return NewError("print: %s", err)
+			}
+			return NULLObj
+		},
+	},
+	{
+		Name: "read_file",
+		Cap:  CapIO,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 1 {
+				return NewError("read_file: wrong number of arguments, expected 1, got %d", l)
+			}
+			name, ok := args[0].(*String)
+			if !ok {
+				return NewError("read_file: file name must be a string, not %s", args[0].Type())
+			}
+			b, err := os.ReadFile(string(*name))
+			if err != nil {
+				return NewError("read_file: %s", err)
+			}
+			return NewString(string(b))
+		},
+	},
+	{
+		Name: "write_file",
+		Cap:  CapIO,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 2 {
+				return NewError("write_file: wrong number of arguments, expected 2, got %d", l)
+			}
+			name, ok := args[0].(*String)
+			if !ok {
+				return NewError("write_file: file name must be a string, not %s", args[0].Type())
+			}
+			data, ok := args[1].(*String)
+			if !ok {
+				return NewError("write_file: data must be a string, not %s", args[1].Type())
+			}
+			if err := os.WriteFile(string(*name), []byte(*data), 0o644); err != nil {
+				return NewError("write_file: %s", err)
+			}
+			return NULLObj
+		},
+	},
+	{
+		Name: "getenv",
+		Cap:  CapOS,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 1 {
+				return NewError("getenv: wrong number of arguments, expected 1, got %d", l)
+			}
+			name, ok := args[0].(*String)
+			if !ok {
+				return NewError("getenv: variable name must be a string, not %s", args[0].Type())
+			}
+			if v, ok := os.LookupEnv(string(*name)); ok {
+				return NewString(v)
+			}
+			return NULLObj
+		},
+	},
+	{
+		Name: "now",
+		Cap:  CapTime,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 0 {
+				return NewError("now: wrong number of arguments, expected 0, got %d", l)
+			}
+			return NewInteger(time.Now().UnixMilli())
+		},
+	},
+	{
+		Name: "rand",
+		Cap:  CapRandom,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 1 {
+				return NewError("rand: wrong number of arguments, expected 1, got %d", l)
+			}
+			n, ok := args[0].(*Integer)
+			if !ok || *n <= 0 {
+				return NewError("rand: argument must be a positive int, not %s", args[0])
+			}
+			return NewInteger(rand.Int64N(int64(*n)))
+		},
+	},
+	{
+		Name: "assert",
+		Cap:  CapPure,
+		Builtin: func(args ...Object) Object {
+			if l := len(args); l != 1 && l != 2 {
+				return NewError("assert: wrong number of arguments, expected 1 or 2, got %d", l)
+			}
+			cond, ok := args[0].(*Boolean)
+			if !ok {
+				return NewError("assert: condition must be a bool, not %s", args[0].Type())
+			}
+			if *cond {
+				return NULLObj
+			}
+			if len(args) == 2 {
+				return NewError("assertion failed: %s", args[1])
+			}
+			return NewError("assertion failed")
+		},
+	},
+	{
+		Name:    "assert_eq",
+		Cap:     CapPure,
+		Builtin: assertEq,
+	},
 }
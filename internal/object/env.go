@@ -1,21 +1,33 @@
 package object
 
+import "context"
+
 type Env struct {
 	Store map[string]Object
 	Outer *Env
+	// Budget, when set, limits the evaluation. It is shared with the
+	// environments wrapping this one. NewEnv sets one without limits but
+	// the call depth.
+	Budget *Budget
+	// Caps are the builtin capabilities enabled for the evaluation.
+	Caps Capability
 }
 
 func NewEnv() *Env {
 	return &Env{
-		Store: make(map[string]Object),
-		Outer: nil,
+		Store:  make(map[string]Object),
+		Outer:  nil,
+		Budget: NewBudget(context.Background(), Limits{}),
+		Caps:   CapAll,
 	}
 }
 
 func NewEnvWrap(e *Env) *Env {
 	return &Env{
-		Store: make(map[string]Object),
-		Outer: e,
+		Store:  make(map[string]Object),
+		Outer:  e,
+		Budget: e.Budget,
+		Caps:   e.Caps,
 	}
 }
 
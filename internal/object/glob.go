@@ -0,0 +1,85 @@
+package object
+
+import (
+	"fmt"
+	"parrot/internal/glob"
+	"sync"
+)
+
+// Glob is a compiled glob pattern. Calling it with a string reports whether
+// the string matches.
+type Glob struct {
+	m *glob.Matcher
+}
+
+func (g *Glob) Type() Type     { return GlobType }
+func (g *Glob) String() string { return fmt.Sprintf("<glob %q>", g.m.String()) }
+
+func (g *Glob) Call(args ...Object) Object {
+	if l := len(args); l != 1 {
+		return NewError("glob: wrong number of arguments, expected 1, got %d", l)
+	}
+	return g.Match(args[0])
+}
+
+// Pattern returns the pattern g was compiled from.
+func (g *Glob) Pattern() string {
+	return g.m.String()
+}
+
+// Match reports whether s, which must be a string, matches g.
+func (g *Glob) Match(s Object) Object {
+	str, ok := s.(*String)
+	if !ok {
+		return NewError("glob: cannot match %s", s.Type())
+	}
+	if g.m.Match(string(*str)) {
+		return TRUEObj
+	}
+	return FALSEObj
+}
+
+var globCache struct {
+	sync.Mutex
+	m map[string]*Glob
+}
+
+// maxGlobCache bounds the number of patterns compiled at run time that are
+// kept around.
+const maxGlobCache = 256
+
+// NewGlob compiles pattern, reusing the matcher of an earlier call with the
+// same pattern.
+func NewGlob(pattern string) Object {
+	globCache.Lock()
+	defer globCache.Unlock()
+	if g, ok := globCache.m[pattern]; ok {
+		return g
+	}
+	m, err := glob.Compile(pattern)
+	if err != nil {
+		return NewError("%s", err)
+	}
+	if globCache.m == nil || len(globCache.m) >= maxGlobCache {
+		globCache.m = make(map[string]*Glob)
+	}
+	g := &Glob{m: m}
+	globCache.m[pattern] = g
+	return g
+}
+
+// MatchGlob matches s against pattern, which is either a Glob or a string
+// holding a glob pattern.
+func MatchGlob(s, pattern Object) Object {
+	switch p := pattern.(type) {
+	case *Glob:
+		return p.Match(s)
+	case *String:
+		g := NewGlob(string(*p))
+		if g.Type() == ERRORType {
+			return g
+		}
+		return g.(*Glob).Match(s)
+	}
+	return NewError("glob: pattern must be a string or glob, not %s", pattern.Type())
+}
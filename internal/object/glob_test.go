@@ -0,0 +1,35 @@
+package object
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGlobCache(t *testing.T) {
+	g := NewGlob("*.pr")
+	if NewGlob("*.pr") != g {
+		t.Error("the same pattern compiled twice")
+	}
+	if e, ok := NewGlob("[a").(*Error); !ok {
+		t.Errorf(`NewGlob("[a") = %v, want an error`, e)
+	}
+	// Filling the cache starts it over, and the patterns still match.
+	for i := range maxGlobCache + 1 {
+		p := fmt.Sprintf("x%d*", i)
+		if MatchGlob(NewString(fmt.Sprintf("x%dy", i)), NewString(p)) != TRUEObj {
+			t.Fatalf("%q doesn't match", p)
+		}
+	}
+	globCache.Lock()
+	n := len(globCache.m)
+	globCache.Unlock()
+	if n > maxGlobCache {
+		t.Errorf("%d patterns cached, want at most %d", n, maxGlobCache)
+	}
+	if MatchGlob(NewString("a.pr"), g) != TRUEObj || MatchGlob(NewString("a.go"), g) != FALSEObj {
+		t.Error("a glob compiled before the cache was reset doesn't match")
+	}
+	if e, ok := MatchGlob(NewInteger(1), g).(*Error); !ok {
+		t.Errorf("matching an integer = %v, want an error", e)
+	}
+}
@@ -0,0 +1,80 @@
+package object
+
+import (
+	"errors"
+	"parrot/internal/peg"
+)
+
+// Grammar is a compiled PEG grammar. Calling it with a string matches the
+// grammar against a prefix of the string and returns the list of captured
+// values. When it doesn't match, the error gives the offset the match
+// failed at.
+type Grammar struct {
+	g       *peg.Grammar
+	actions map[string]Callable
+}
+
+func (g *Grammar) Type() Type     { return GrammarType }
+func (g *Grammar) String() string { return "<grammar>" }
+
+func NewGrammar(src string, actions map[string]Callable) Object {
+	g, err := peg.Compile(src)
+	if err != nil {
+		return NewError("%s", err)
+	}
+	for _, name := range g.Actions() {
+		if _, ok := actions[name]; !ok {
+			return NewError("peg: no function for action %q", name)
+		}
+	}
+	return &Grammar{g: g, actions: actions}
+}
+
+// errAction stops a match when an action returns an error object.
+var errAction = errors.New("action failed")
+
+func (g *Grammar) Call(args ...Object) Object {
+	if l := len(args); l != 1 {
+		return NewError("grammar: wrong number of arguments, expected 1, got %d", l)
+	}
+	s, ok := args[0].(*String)
+	if !ok {
+		return NewError("grammar: cannot match %s", args[0].Type())
+	}
+	var actionErr Object
+	caps, err := g.g.Match(string(*s), func(name string, vals []any) (any, error) {
+		var args []Object
+		for _, v := range vals {
+			args = append(args, fromCapture(v))
+		}
+		ret := g.actions[name].Call(args...)
+		if ret != nil && ret.Type() == ERRORType {
+			actionErr = ret
+			return nil, errAction
+		}
+		return ret, nil
+	})
+	if err == errAction {
+		return actionErr
+	}
+	if err != nil {
+		return NewError("%s", err)
+	}
+	return fromCapture(caps)
+}
+
+func fromCapture(v any) Object {
+	switch v := v.(type) {
+	case string:
+		return NewString(v)
+	case []any:
+		l := make(List, 0, len(v))
+		for _, e := range v {
+			l = append(l, fromCapture(e))
+		}
+		return &l
+	case Object:
+		return v
+	}
+	return NULLObj
+}
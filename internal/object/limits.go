@@ -0,0 +1,109 @@
+package object
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrStepLimit  = errors.New("step limit exceeded")
+	ErrDepthLimit = errors.New("maximum call depth exceeded")
+	ErrAllocLimit = errors.New("allocation limit exceeded")
+)
+
+// Limits bounds the resources a script may use. A zero field means no limit.
+type Limits struct {
+	// MaxSteps bounds the number of instructions the VM executes, or the
+	// number of statements and calls the evaluator runs.
+	MaxSteps int64
+	// MaxDepth bounds the number of nested function calls. Unlike the
+	// other limits, zero means DefaultMaxDepth: deeper recursion would
+	// overflow the Go stack of the evaluator.
+	MaxDepth int
+	// MaxAlloc bounds the bytes allocated for lists and strings.
+	MaxAlloc int64
+}
+
+// DefaultMaxDepth is the call depth allowed when Limits.MaxDepth is zero,
+// the size of the VMs' call stacks.
+const DefaultMaxDepth = 2048
+
+// ctxCheckInterval is the number of steps between checks for cancellation.
+const ctxCheckInterval = 1024
+
+// Budget tracks the resources used by a run against its Limits and
+// watches its context for cancellation.
+type Budget struct {
+	limits Limits
+	ctx    context.Context
+	steps  int64
+	depth  int
+	alloc  int64
+}
+
+func NewBudget(ctx context.Context, limits Limits) *Budget {
+	return &Budget{limits: limits, ctx: ctx}
+}
+
+// Step accounts for one step of execution.
+func (b *Budget) Step() error {
+	b.steps++
+	if b.limits.MaxSteps > 0 && b.steps > b.limits.MaxSteps {
+		return ErrStepLimit
+	}
+	if b.steps%ctxCheckInterval == 0 {
+		return b.ctx.Err()
+	}
+	return nil
+}
+
+// Enter accounts for a function call, which must be paired with Leave.
+func (b *Budget) Enter() error {
+	limit := b.limits.MaxDepth
+	if limit <= 0 {
+		limit = DefaultMaxDepth
+	}
+	if b.depth >= limit {
+		return ErrDepthLimit
+	}
+	b.depth++
+	return nil
+}
+
+func (b *Budget) Leave() {
+	b.depth--
+}
+
+// Alloc accounts for the memory held by a newly created list or string.
+func (b *Budget) Alloc(o Object) error {
+	switch o := o.(type) {
+	case *String:
+		b.alloc += int64(len(*o))
+	case *List:
+		b.alloc += int64(len(*o)) * 16
+	default:
+		return nil
+	}
+	if b.limits.MaxAlloc > 0 && b.alloc > b.limits.MaxAlloc {
+		return ErrAllocLimit
+	}
+	return nil
+}
+
+// Interrupt is the error object of a run stopped by its Budget or context.
+type Interrupt struct {
+	Err error
+}
+
+func (i *Interrupt) Type() Type     { return ERRORType }
+func (i *Interrupt) String() string { return "error: " + i.Err.Error() }
+
+// Interrupted reports whether err stopped a run because of b's limits or
+// context.
+func (b *Budget) Interrupted(err error) bool {
+	switch {
+	case errors.Is(err, ErrStepLimit), errors.Is(err, ErrDepthLimit), errors.Is(err, ErrAllocLimit):
+		return true
+	}
+	return b.ctx.Err() != nil && errors.Is(err, b.ctx.Err())
+}
@@ -2,6 +2,7 @@ package object
 
 import (
 	"fmt"
+	"parrot/internal/code"
 	"strconv"
 	"strings"
 )
@@ -17,6 +18,8 @@ const (
 	ListType     Type = "list"
 	FunctionType Type = "function"
 	BuiltinType  Type = "builtin"
+	GrammarType  Type = "grammar"
+	GlobType     Type = "glob"
 
 	FunctionCompiledType Type = "functioncompiled"
 )
@@ -30,10 +33,30 @@ type Object interface {
 	String() string
 }
 
+// Callable is implemented by objects that can be called with arguments,
+// which lets builtins call back into functions passed in by a script.
+type Callable interface {
+	Object
+	Call(args ...Object) Object
+}
+
+// HasAttrs is implemented by objects with attributes read by x.name.
+type HasAttrs interface {
+	Object
+	Attr(name string) Object
+}
+
+// Indexable is implemented by objects other than lists and strings that
+// support x[key].
+type Indexable interface {
+	Object
+	Index(key Object) Object
+}
+
 var (
 	NULLObj  = &NULL{}
-	TRUEObj  = NewBoolean(true)
-	FALSEObj = NewBoolean(false)
+	TRUEObj  = newBoolean(true)
+	FALSEObj = newBoolean(false)
 )
 
 type NULL struct{}
@@ -56,12 +79,44 @@ type Integer int64
 func (i *Integer) Type() Type     { return IntType }
 func (i *Integer) String() string { return strconv.FormatInt(int64(*i), 10) }
 
+// The integers from smallIntMin to smallIntMax are preallocated, since
+// they are the bulk of counters, indices and lengths.
+const (
+	smallIntMin = -128
+	smallIntMax = 1023
+)
+
+var smallInts = func() (ints [smallIntMax - smallIntMin + 1]Integer) {
+	for i := range ints {
+		ints[i] = Integer(i + smallIntMin)
+	}
+	return
+}()
+
+// NewInteger returns an integer object for n, which is shared when n is
+// small. Integer objects must not be modified.
+func NewInteger(n int64) Object {
+	if n >= smallIntMin && n <= smallIntMax {
+		return &smallInts[n-smallIntMin]
+	}
+	i := Integer(n)
+	return &i
+}
+
 type Boolean bool
 
 func (b *Boolean) Type() Type     { return BoolType }
 func (b *Boolean) String() string { return strconv.FormatBool(bool(*b)) }
 
+// NewBoolean returns TRUEObj or FALSEObj.
 func NewBoolean(b bool) Object {
+	if b {
+		return TRUEObj
+	}
+	return FALSEObj
+}
+
+func newBoolean(b bool) Object {
 	ret := Boolean(b)
 	return &ret
 }
@@ -99,9 +154,14 @@ func NewList(elems ...Object) Object {
 	return &l
 }
 
+// Body is the body of a user defined function.
+type Body interface {
+	Eval(env *Env) Object
+}
+
 type Function struct {
 	Params []string
-	Body   any
+	Body   Body
 	Env    *Env
 }
 
@@ -113,10 +173,47 @@ func (function *Function) String() string {
 	return fmt.Sprintf("fn(%s) { %v }", strings.Join(function.Params, ", "), function.Body)
 }
 
+// Call evaluates the body with args bound to the parameters. Tail calls
+// returned by the body are run here in turn, so tail recursion runs in
+// constant space.
+func (function *Function) Call(args ...Object) Object {
+	for {
+		if len(args) != len(function.Params) {
+			return NewError(
+				"wrong number of arguments: expected %d, got %d",
+				len(function.Params),
+				len(args),
+			)
+		}
+		env := NewEnvWrap(function.Env)
+		for i, a := range args {
+			env.Set(function.Params[i], a)
+		}
+		ret := function.Body.Eval(env)
+		tc, ok := ret.(*TailCall)
+		if !ok {
+			return ret
+		}
+		function, args = tc.Fn, tc.Args
+	}
+}
+
+// TailCall is what a function body evaluates to when it ends in a call of
+// another function, which the caller then runs in place of the finished one.
+type TailCall struct {
+	Fn   *Function
+	Args []Object
+}
+
+func (tc *TailCall) Type() Type     { return FunctionType }
+func (tc *TailCall) String() string { return "<tail call>" }
+
 type FunctionCompiled struct {
 	Instructions []byte
 	ParamsCnt    int8
 	LocalCnt     int
+	SourceMap    code.SourceMap
+	Name         string // the name of the function, if any, for profiles
 }
 
 func (functioncompiled *FunctionCompiled) Type() Type {
@@ -126,3 +223,18 @@ func (functioncompiled *FunctionCompiled) Type() Type {
 func (functioncompiled *FunctionCompiled) String() string {
 	return "<functioncompiled>"
 }
+
+// Closure is a compiled function with the values of the variables of the
+// enclosing functions it refers to, captured when it was created.
+type Closure struct {
+	Fn   *FunctionCompiled
+	Free []Object
+}
+
+func (closure *Closure) Type() Type {
+	return FunctionCompiledType
+}
+
+func (closure *Closure) String() string {
+	return "<closure>"
+}
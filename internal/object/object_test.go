@@ -0,0 +1,18 @@
+package object
+
+import "testing"
+
+func TestNewInteger(t *testing.T) {
+	for _, n := range []int64{smallIntMin - 1, smallIntMin, 0, 7, smallIntMax, smallIntMax + 1, 1 << 40} {
+		a, b := NewInteger(n), NewInteger(n)
+		if int64(*a.(*Integer)) != n {
+			t.Errorf("NewInteger(%d) = %s", n, a)
+		}
+		if shared := a == b; shared != (n >= smallIntMin && n <= smallIntMax) {
+			t.Errorf("NewInteger(%d) shared: %v", n, shared)
+		}
+	}
+	if NewBoolean(true) != TRUEObj || NewBoolean(false) != FALSEObj {
+		t.Error("NewBoolean doesn't return TRUEObj and FALSEObj")
+	}
+}
@@ -0,0 +1,215 @@
+// Package optimize rewrites parsed programs into cheaper equivalent ones
+// before they are evaluated or compiled.
+//
+// Program runs these passes:
+//
+//   - constant folding: arithmetic, comparisons, string concatenation and
+//     boolean logic on literals are computed once, as the evaluator would;
+//   - constant propagation: a global assigned a literal exactly once, and
+//     never bound otherwise, is replaced by the literal where it is used
+//     after the assignment, enabling more folding;
+//   - dead code elimination: literals whose value is discarded, that is
+//     statements but the last of a program or function body, are removed.
+//
+// Expressions whose evaluation fails are left alone, so they fail at run
+// time as before.
+package optimize
+
+import (
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"strconv"
+)
+
+// Program optimizes prog in place and returns it. Since propagation
+// assumes prog is the whole program, it is not suited to code run
+// piecemeal, as in a REPL, where Fold is.
+func Program(prog *parser.Program) *parser.Program {
+	Fold(prog)
+	propagate(prog)
+	Fold(prog)
+	eliminate(prog)
+	return prog
+}
+
+// Fold folds the constant expressions of prog in place and returns it.
+func Fold(prog *parser.Program) *parser.Program {
+	rewrite(prog, fold)
+	return prog
+}
+
+// rewrite replaces every expression in prog, innermost first, by the result
+// of f.
+func rewrite(prog *parser.Program, f func(parser.Expr) parser.Expr) {
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*parser.ExprStmt); ok {
+			s.E = rewriteExpr(s.E, f)
+		}
+	}
+}
+
+func rewriteExpr(e parser.Expr, f func(parser.Expr) parser.Expr) parser.Expr {
+	switch e := e.(type) {
+	case *parser.ListExpr:
+		for i, x := range e.List {
+			e.List[i] = rewriteExpr(x, f)
+		}
+	case *parser.PrefixExpr:
+		e.Right = rewriteExpr(e.Right, f)
+	case *parser.InfixExpr:
+		e.Left = rewriteExpr(e.Left, f)
+		e.Right = rewriteExpr(e.Right, f)
+	case *parser.IndexExpr:
+		e.Left = rewriteExpr(e.Left, f)
+		e.Index = rewriteExpr(e.Index, f)
+	case *parser.SliceExpr:
+		e.Left = rewriteExpr(e.Left, f)
+		for _, x := range []*parser.Expr{&e.Lo, &e.Hi, &e.Step} {
+			if *x != nil {
+				*x = rewriteExpr(*x, f)
+			}
+		}
+	case *parser.Selector:
+		e.X = rewriteExpr(e.X, f)
+	case *parser.Call:
+		e.Fn = rewriteExpr(e.Fn, f)
+		for i, x := range e.Args {
+			e.Args[i] = rewriteExpr(x, f)
+		}
+	case *parser.Assign:
+		e.Right = rewriteExpr(e.Right, f)
+	case *parser.Function:
+		rewrite(e.Body, f)
+	}
+	return f(e)
+}
+
+// fold evaluates e if its operands are literals.
+func fold(e parser.Expr) parser.Expr {
+	switch x := e.(type) {
+	case *parser.PrefixExpr:
+		if !isLiteral(x.Right) {
+			return e
+		}
+		return evalLiteral(e, x.Pos)
+	case *parser.InfixExpr:
+		if !isLiteral(x.Left) || !isLiteral(x.Right) {
+			return e
+		}
+		return evalLiteral(e, x.Pos)
+	}
+	return e
+}
+
+func isLiteral(e parser.Expr) bool {
+	switch e.(type) {
+	case *parser.Integer, *parser.String, *parser.Boolean:
+		return true
+	}
+	return false
+}
+
+// evalLiteral returns the literal e evaluates to, or e if it fails, such
+// as on a division by zero, so that the failure happens at run time.
+func evalLiteral(e parser.Expr, pos int) (lit parser.Expr) {
+	defer func() {
+		if recover() != nil {
+			lit = e
+		}
+	}()
+	switch o := e.Eval(object.NewEnv()).(type) {
+	case *object.Integer:
+		return &parser.Integer{Value: int64(*o), Literal: strconv.FormatInt(int64(*o), 10), Pos: pos}
+	case *object.String:
+		return &parser.String{Literal: string(*o), Pos: pos}
+	case *object.Boolean:
+		return &parser.Boolean{Value: bool(*o), Pos: pos}
+	}
+	return e
+}
+
+// propagate replaces the globals assigned a literal once by the literal
+// after the assignment.
+func propagate(prog *parser.Program) {
+	bindings := make(map[string]int)
+	rewrite(prog, func(e parser.Expr) parser.Expr {
+		switch x := e.(type) {
+		case *parser.Assign:
+			bindings[x.Left.String()]++
+		case *parser.Function:
+			if x.Name != "" {
+				bindings[x.Name]++
+			}
+			for _, param := range x.Params {
+				// Never propagate into a function shadowing the global.
+				bindings[param.Name] += 2
+			}
+		}
+		return e
+	})
+
+	consts := make(map[string]parser.Expr)
+	for _, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		if len(consts) > 0 {
+			s.E = rewriteExpr(s.E, func(e parser.Expr) parser.Expr {
+				if id, ok := e.(*parser.Ident); ok {
+					if lit, ok := consts[id.Name]; ok {
+						return relocate(lit, id.Pos)
+					}
+				}
+				return e
+			})
+		}
+		if a, ok := s.E.(*parser.Assign); ok && isLiteral(a.Right) {
+			if name := a.Left.String(); bindings[name] == 1 {
+				consts[name] = a.Right
+			}
+		}
+	}
+}
+
+// relocate returns a copy of the literal lit at pos.
+func relocate(lit parser.Expr, pos int) parser.Expr {
+	switch l := lit.(type) {
+	case *parser.Integer:
+		c := *l
+		c.Pos = pos
+		return &c
+	case *parser.String:
+		c := *l
+		c.Pos = pos
+		return &c
+	case *parser.Boolean:
+		c := *l
+		c.Pos = pos
+		return &c
+	}
+	return lit
+}
+
+// eliminate removes the literal statements whose value is discarded.
+func eliminate(prog *parser.Program) {
+	eliminateStmts(prog)
+	rewrite(prog, func(e parser.Expr) parser.Expr {
+		if f, ok := e.(*parser.Function); ok {
+			eliminateStmts(f.Body)
+		}
+		return e
+	})
+}
+
+func eliminateStmts(prog *parser.Program) {
+	var stmts []parser.Stmt
+	for i, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if ok && i < len(prog.Stmts)-1 && isLiteral(s.E) {
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	prog.Stmts = stmts
+}
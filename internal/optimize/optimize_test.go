@@ -0,0 +1,141 @@
+package optimize
+
+import (
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"testing"
+)
+
+func parse(t *testing.T, src string) *parser.Program {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		t.Fatalf("Parse(%q): %v", src, errs[0])
+	}
+	return prog
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`1 + 2 * 3`, "7"},
+		{`-(2 - 5)`, "3"},
+		{`"a" + "b" + "c"`, `"abc"`},
+		{`!true; true and false; false or true`, "false; false; true"},
+		{`1 < 2; "b" <= "a"`, "true; false"},
+		{`[1 + 1, x + (2 * 3)]`, "[2, x + 6]"},
+		{`fn f(n) { n * (4 - 1) }`, "fn f(n) { n * 3 }"},
+		// Failures are left for run time.
+		{`1 / 0; 5 % (1 - 1)`, "1 / 0; 5 % 0"},
+		{`1 + "a"; -"a"`, `1 + "a"; -"a"`},
+		// Only literals are folded.
+		{`x + 1 + 2`, "x + 1 + 2"},
+	}
+	for _, tt := range tests {
+		if got := Fold(parse(t, tt.src)).String(); got != tt.want {
+			t.Errorf("Fold(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestFoldPos(t *testing.T) {
+	prog := Fold(parse(t, `x; 10 + 20`))
+	lit := prog.Stmts[1].(*parser.ExprStmt).E.(*parser.Integer)
+	if lit.Value != 30 || lit.Literal != "30" || lit.Pos != 6 {
+		t.Errorf("folded %+v, want 30 at the + at 6", lit)
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`x = 1; x + 1`, "x = 1; 2"},
+		{`x = "a"; fn f() { x + "b" }`, `x = "a"; fn f() { "ab" }`},
+		// Only the uses after the assignment.
+		{`y = x; x = 1; x`, "y = x; x = 1; 1"},
+		// Not globals assigned twice, even inside a function body.
+		{`x = 1; x = 2; x`, "x = 1; x = 2; x"},
+		{`x = 1; fn f() { x = 2 }; f(); x`, "x = 1; fn f() { x = 2 }; f(); x"},
+		{`x = 1; fn f() { fn g() { x = 2 } }; x`, "x = 1; fn f() { fn g() { x = 2 } }; x"},
+		// Nor shadowed by a parameter or a function name.
+		{`fn f(x) { x }; x = 2; f(x)`, "fn f(x) { x }; x = 2; f(x)"},
+		{`x = 2; fn x() { 1 }; x`, "x = 2; fn x() { 1 }; x"},
+		// Nor assigned something else than a literal.
+		{`x = [1]; x`, "x = [1]; x"},
+		{`x = 1 + 1; x`, "x = 2; 2"},
+	}
+	for _, tt := range tests {
+		if got := Program(parse(t, tt.src)).String(); got != tt.want {
+			t.Errorf("Program(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestPropagatePos(t *testing.T) {
+	prog := Program(parse(t, `x = 5; [x, x]`))
+	list := prog.Stmts[1].(*parser.ExprStmt).E.(*parser.ListExpr)
+	a, b := list.List[0].(*parser.Integer), list.List[1].(*parser.Integer)
+	if a.Pos != 8 || b.Pos != 11 {
+		t.Errorf("propagated at %d and %d, want at the uses at 8 and 11", a.Pos, b.Pos)
+	}
+}
+
+func TestEliminate(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`1; "a"; x`, "x"},
+		{`x; 1`, "x; 1"},
+		{`fn f() { 1; 2 }; f()`, "fn f() { 2 }; f()"},
+		{`fn f() { 1 + 1; g() }`, "fn f() { g() }"},
+		// Statements with effects stay.
+		{`print("a"); 1`, `print("a"); 1`},
+		{`1 / 0; 2`, "1 / 0; 2"},
+	}
+	for _, tt := range tests {
+		if got := Program(parse(t, tt.src)).String(); got != tt.want {
+			t.Errorf("Program(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// panicking is an expression whose evaluation panics.
+type panicking struct {
+	parser.Integer
+}
+
+func (p *panicking) Eval(env *object.Env) object.Object {
+	panic("boom")
+}
+
+func (p *panicking) Compile(c *compile.Compiler) error {
+	return nil
+}
+
+func TestEvalLiteralPanic(t *testing.T) {
+	e := &panicking{}
+	if got := evalLiteral(e, 0); got != parser.Expr(e) {
+		t.Errorf("evalLiteral = %v, want the expression left alone", got)
+	}
+}
+
+// TestSemantics checks that optimized programs evaluate to what they did
+// before.
+func TestSemantics(t *testing.T) {
+	for _, src := range []string{
+		`x = 3; fn f(n) { n * x + (2 - 1) }; f(4)`,
+		`x = 1; fn g() { x = x + 10 }; g(); x + 1`,
+		`s = "ab"; t = s + s; [t, len(t), 1 + 2 * 3]`,
+		`a = 1; b = a < 2; !b or a == 1`,
+		`x = 5; fn k(x) { x }; k(7) + x`,
+	} {
+		want := parse(t, src).Eval(object.NewEnv()).String()
+		got := Program(parse(t, src)).Eval(object.NewEnv()).String()
+		if got != want {
+			t.Errorf("%q = %s optimized, %s not", src, got, want)
+		}
+	}
+}
@@ -45,9 +45,20 @@ type Program struct {
 	Stmts []Stmt
 }
 
+func (p *Program) String() string {
+	var stmts []string
+	for _, stmt := range p.Stmts {
+		stmts = append(stmts, stmt.String())
+	}
+	return strings.Join(stmts, "; ")
+}
+
 func (p *Program) Eval(env *object.Env) object.Object {
 	var ret object.Object
 	for _, stmt := range p.Stmts {
+		if err := step(env); err != nil {
+			return err
+		}
 		switch node := stmt.(type) {
 		case *ExprStmt:
 			ret = node.E.Eval(env)
@@ -60,15 +71,31 @@ func (p *Program) Eval(env *object.Env) object.Object {
 }
 
 func (p *Program) Compile(c *compile.Compiler) error {
-	for _, stmt := range p.Stmts {
+	for i, stmt := range p.Stmts {
 		err := stmt.Compile(c)
 		if err != nil {
 			return err
 		}
+		if s, ok := stmt.(*ExprStmt); ok && i < len(p.Stmts)-1 && leavesValue(s.E) {
+			// Discard the value, only the last one is the result.
+			c.Op(code.OpPop)
+		}
 	}
 	return nil
 }
 
+// leavesValue reports whether the compiled e leaves its value on the stack,
+// which assignments and function definitions don't.
+func leavesValue(e Expr) bool {
+	switch e := e.(type) {
+	case *Assign:
+		return false
+	case *Function:
+		return e.Name == ""
+	}
+	return true
+}
+
 type Ident struct {
 	Name string
 	Pos  int
@@ -82,7 +109,11 @@ func (ident *Ident) Eval(env *object.Env) object.Object {
 	if v, ok := env.Get(ident.Name); ok {
 		return v
 	}
-	if o, ok := object.ResolveBuiltin(ident.Name); ok {
+	if cap, ok := object.BuiltinCapability(ident.Name); ok {
+		if !env.Caps.Has(cap) {
+			return object.NewError("%d: %s", ident.Pos+1, object.DisabledError(ident.Name, cap))
+		}
+		o, _ := object.ResolveBuiltin(ident.Name)
 		return o
 	}
 	return object.NewError("%d: name %q is not defined", ident.Pos+1, ident)
@@ -90,9 +121,18 @@ func (ident *Ident) Eval(env *object.Env) object.Object {
 
 func (ident *Ident) Compile(c *compile.Compiler) error {
 	if symbol, ok := c.Resolve(ident.Name); ok {
+		c.Pos(ident.Pos)
 		c.LoadSymbol(symbol)
 		return nil
 	}
+	if cap, ok := object.BuiltinCapability(ident.Name); ok {
+		return fmt.Errorf("%d: %w", ident.Pos+1, object.DisabledError(ident.Name, cap))
+	}
+	if c.Externals {
+		c.Pos(ident.Pos)
+		c.LoadSymbol(c.DefineExternal(ident.Name))
+		return nil
+	}
 	return fmt.Errorf("undefined variable %s", ident.Name)
 }
 
@@ -130,7 +170,11 @@ type String struct {
 }
 
 func (s *String) String() string {
-	return s.Literal
+	// There are no escapes, a literal holds at most one kind of quote.
+	if strings.Contains(s.Literal, `"`) {
+		return "'" + s.Literal + "'"
+	}
+	return `"` + s.Literal + `"`
 }
 
 func (s *String) Eval(env *object.Env) object.Object {
@@ -154,13 +198,11 @@ func (n *Integer) String() string {
 }
 
 func (n *Integer) Eval(env *object.Env) object.Object {
-	v := object.Integer(n.Value)
-	return &v
+	return object.NewInteger(n.Value)
 }
 
 func (n *Integer) Compile(c *compile.Compiler) error {
-	o := object.Integer(n.Value)
-	c.OpArg(code.OpConstant, c.Const(&o))
+	c.OpArg(code.OpConstant, c.Const(object.NewInteger(n.Value)))
 	return nil
 }
 
@@ -183,9 +225,12 @@ func (listexpr *ListExpr) Eval(env *object.Env) object.Object {
 	var objs []object.Object
 	for _, e := range listexpr.List {
 		o := e.Eval(env)
+		if isError(o) {
+			return o
+		}
 		objs = append(objs, o)
 	}
-	return object.NewList(objs...)
+	return charge(env, object.NewList(objs...))
 }
 
 func (listexpr *ListExpr) Compile(c *compile.Compiler) error {
@@ -206,7 +251,7 @@ type PrefixExpr struct {
 }
 
 func (prefixexpr *PrefixExpr) String() string {
-	return prefixexpr.Literal + prefixexpr.Right.String()
+	return prefixexpr.Literal + operand(prefixexpr.Right, PrefixBP)
 }
 
 func (prefixexpr *PrefixExpr) Eval(env *object.Env) object.Object {
@@ -227,8 +272,7 @@ func (prefixexpr *PrefixExpr) Eval(env *object.Env) object.Object {
 		if right.Type() != object.IntType {
 			return object.NewError("%s: runtime error: unkown operator: -%s", right.String(), right.Type())
 		}
-		ret := object.Integer(-(int64(*(right.(*object.Integer)))))
-		return &ret
+		return object.NewInteger(-(int64(*(right.(*object.Integer)))))
 	case token.ADD:
 		return right
 	}
@@ -266,7 +310,7 @@ type IndexExpr struct {
 }
 
 func (i *IndexExpr) String() string {
-	return fmt.Sprintf("%v[%v]", i.Left, i.Index)
+	return fmt.Sprintf("%s[%v]", operand(i.Left, CallBP), i.Index)
 }
 
 func (i *IndexExpr) Eval(env *object.Env) object.Object {
@@ -288,6 +332,7 @@ func (i *IndexExpr) Compile(c *compile.Compiler) error {
 	if err := i.Index.Compile(c); err != nil {
 		return err
 	}
+	c.Pos(i.LbrackPos)
 	c.Op(code.OpIndex)
 	return nil
 }
@@ -297,23 +342,60 @@ func evalIndexExpr(left, index object.Object) object.Object {
 	case left.Type() == object.ListType && index.Type() == object.IntType:
 		l := left.(*object.List)
 		i := index.(*object.Integer)
-		if int(*i) >= len(*l) {
+		if *i < 0 || int(*i) >= len(*l) {
 			return object.NewError("index out of range")
 		}
 		return (*l)[int(*i)]
 	case left.Type() == object.StringType && index.Type() == object.IntType:
 		s := left.(*object.String)
 		i := index.(*object.Integer)
-		if int(*i) >= len(*s) {
+		if *i < 0 || int(*i) >= len(*s) {
 			return object.NewError("index out of range")
 		}
 		return object.NewString(string(string(*s)[*i]))
-		// TODO map
 	default:
+		if x, ok := left.(object.Indexable); ok {
+			return x.Index(index)
+		}
 		return object.NewError("invalid index operator for types %v and %v", left.Type(), index.Type())
 	}
 }
 
+// Selector represents an attribute reference: X.Name.
+type Selector struct {
+	X    Expr
+	Name string
+	Pos  int
+}
+
+func (s *Selector) String() string {
+	return fmt.Sprintf("%s.%s", operand(s.X, CallBP), s.Name)
+}
+
+func (s *Selector) Eval(env *object.Env) object.Object {
+	x := s.X.Eval(env)
+	if isError(x) {
+		return x
+	}
+	return evalSelector(x, s.Name)
+}
+
+func (s *Selector) Compile(c *compile.Compiler) error {
+	if err := s.X.Compile(c); err != nil {
+		return err
+	}
+	c.Pos(s.Pos)
+	c.OpArg(code.OpGetAttr, c.Const(object.NewString(s.Name)))
+	return nil
+}
+
+func evalSelector(x object.Object, name string) object.Object {
+	if o, ok := x.(object.HasAttrs); ok {
+		return o.Attr(name)
+	}
+	return object.NewError("%q object has no attribute %q", x.Type(), name)
+}
+
 // SliceExpr represents a slice or substring expression: Left[Lo:Hi]
 type SliceExpr struct {
 	Left         Expr
@@ -323,7 +405,16 @@ type SliceExpr struct {
 }
 
 func (s *SliceExpr) String() string {
-	return fmt.Sprintf("%v[%v:%v]", s.Left, s.Lo, s.Hi)
+	str := func(e Expr) string {
+		if e == nil {
+			return ""
+		}
+		return e.String()
+	}
+	if s.Step != nil {
+		return fmt.Sprintf("%s[%s:%s:%s]", operand(s.Left, CallBP), str(s.Lo), str(s.Hi), s.Step)
+	}
+	return fmt.Sprintf("%s[%s:%s]", operand(s.Left, CallBP), str(s.Lo), str(s.Hi))
 }
 
 func (s *SliceExpr) Eval(env *object.Env) object.Object {
@@ -354,12 +445,12 @@ func (s *SliceExpr) Eval(env *object.Env) object.Object {
 			return stepObj
 		}
 	}
-	return evalSliceExpr(lftObj, loObj, hiObj, stepObj)
+	return charge(env, evalSliceExpr(lftObj, loObj, hiObj, stepObj))
 }
 
 func (s *SliceExpr) Compile(c *compile.Compiler) error {
 	// TODO
-	panic("not implemented")
+	return fmt.Errorf("%d: slices are not supported by the compiler", s.LbrackPos+1)
 }
 
 func evalSliceExpr(leftObj, loObj, hiObj, stepObj object.Object) object.Object {
@@ -443,57 +534,71 @@ func evalSliceExpr(leftObj, loObj, hiObj, stepObj object.Object) object.Object {
 }
 
 type Call struct {
-	fn   Expr
-	args []Expr
+	Fn   Expr
+	Args []Expr
+	Tail bool // the call ends a function body
 }
 
 func (call *Call) String() string {
 	var args []string
-	for _, a := range call.args {
+	for _, a := range call.Args {
 		args = append(args, a.String())
 	}
-	return fmt.Sprintf("%v(%s)", call.fn, strings.Join(args, ", "))
+	return fmt.Sprintf("%s(%s)", operand(call.Fn, CallBP), strings.Join(args, ", "))
 }
 
 func (call *Call) Eval(env *object.Env) object.Object {
-	fnObj := call.fn.Eval(env)
-	switch fn := fnObj.(type) {
-	case object.BuiltinFn:
-		var args []object.Object
-		for _, a := range call.args {
-			args = append(args, a.Eval(env))
-		}
-		return fn(args...)
-	case *object.Function:
-		if len(call.args) != len(fn.Params) {
-			return object.NewError(
-				"wrong number of arguments: expected %d, got %d",
-				len(fn.Params),
-				len(call.args),
-			)
-		}
-		newEnv := object.NewEnvWrap(fn.Env)
-		for i, a := range call.args {
-			newEnv.Set(fn.Params[i], a.Eval(env))
-		}
-		return fn.Body.(*Program).Eval(newEnv)
-	default:
+	fnObj := call.Fn.Eval(env)
+	if isError(fnObj) {
+		return fnObj
+	}
+	fn, ok := fnObj.(object.Callable)
+	if !ok {
 		return object.NewError("%q object is not callable", fnObj.Type())
 	}
+	var args []object.Object
+	for _, a := range call.Args {
+		arg := a.Eval(env)
+		if isError(arg) {
+			return arg
+		}
+		args = append(args, arg)
+	}
+	if f, ok := fn.(*object.Function); ok && call.Tail {
+		// Leave the call to the caller's trampoline in Function.Call.
+		if err := step(env); err != nil {
+			return err
+		}
+		return &object.TailCall{Fn: f, Args: args}
+	}
+	if b := env.Budget; b != nil {
+		if err := step(env); err != nil {
+			return err
+		}
+		if err := b.Enter(); err != nil {
+			return &object.Interrupt{Err: err}
+		}
+		defer b.Leave()
+	}
+	return fn.Call(args...)
 }
 
 func (call *Call) Compile(c *compile.Compiler) (err error) {
-	for _, arg := range call.args {
+	for _, arg := range call.Args {
 		err = arg.Compile(c)
 		if err != nil {
 			return err
 		}
 	}
-	err = call.fn.Compile(c)
+	err = call.Fn.Compile(c)
 	if err != nil {
 		return err
 	}
-	c.OpArg(code.OpCall, uint32(len(call.args)))
+	if call.Tail {
+		c.OpArg(code.OpTailCall, uint32(len(call.Args)))
+	} else {
+		c.OpArg(code.OpCall, uint32(len(call.Args)))
+	}
 	return nil
 }
 
@@ -506,7 +611,7 @@ type Assign struct {
 }
 
 func (assign *Assign) String() string {
-	return assign.Left.String() + assign.Literal + assign.Right.String()
+	return operand(assign.Left, AssignBP) + " " + assign.Literal + " " + operand(assign.Right, AssignBP+1)
 }
 
 func (assign *Assign) Eval(env *object.Env) object.Object {
@@ -516,8 +621,29 @@ func (assign *Assign) Eval(env *object.Env) object.Object {
 }
 
 func (assign *Assign) Compile(c *compile.Compiler) (err error) {
-	symbol := c.Define(assign.Left.String())
-	err = assign.Right.Compile(c)
+	name := assign.Left.String()
+	symbol, ok := c.Resolve(name)
+	switch {
+	case ok && (symbol.Scope == compile.GlobalScope || symbol.Scope == compile.LocalScope):
+		// Like the evaluator, update the variable in scope.
+		err = assign.Right.Compile(c)
+	case ok && symbol.Scope == compile.FreeScope:
+		return fmt.Errorf("%d: cannot assign %s, a variable of an enclosing function", assign.Pos+1, name)
+	default:
+		// A new variable, which may shadow a builtin. A function literal
+		// may refer to the variable it is assigned to, other values are
+		// computed before it exists.
+		if _, ok := assign.Right.(*Function); ok {
+			symbol = c.Define(name)
+			err = assign.Right.Compile(c)
+		} else if err = assign.Right.Compile(c); err == nil {
+			// Reading the variable in Right made it an external global,
+			// see compile.Compiler.Externals.
+			if symbol, ok = c.Resolve(name); !ok || symbol.Scope != compile.GlobalScope {
+				symbol = c.Define(name)
+			}
+		}
+	}
 	if err != nil {
 		return
 	}
@@ -540,7 +666,14 @@ func (function *Function) String() string {
 	for _, p := range function.Params {
 		params = append(params, p.String())
 	}
-	return fmt.Sprintf("fn(%s) {%v}", strings.Join(params, ","), function.Body)
+	name := "fn"
+	if function.Name != "" {
+		name += " " + function.Name
+	}
+	if len(function.Body.Stmts) == 0 {
+		return fmt.Sprintf("%s(%s) {}", name, strings.Join(params, ", "))
+	}
+	return fmt.Sprintf("%s(%s) { %v }", name, strings.Join(params, ", "), function.Body)
 }
 
 func (function *Function) Eval(env *object.Env) object.Object {
@@ -558,8 +691,33 @@ func (function *Function) Eval(env *object.Env) object.Object {
 	return fn
 }
 
+// loadResult leaves the value of the last statement of a compiled body on
+// the stack where the statement itself doesn't: an assignment yields the
+// assigned value and a function definition or an empty body null.
+func loadResult(c *compile.Compiler, body *Program) {
+	var last Expr
+	if n := len(body.Stmts); n > 0 {
+		if stmt, ok := body.Stmts[n-1].(*ExprStmt); ok {
+			last = stmt.E
+		}
+	}
+	if last != nil && leavesValue(last) {
+		return
+	}
+	if a, ok := last.(*Assign); ok {
+		if symbol, ok := c.Resolve(a.Left.String()); ok {
+			c.LoadSymbol(symbol)
+			return
+		}
+	}
+	c.OpArg(code.OpConstant, c.Const(object.NULLObj))
+}
+
 func (function *Function) Compile(c *compile.Compiler) (err error) {
 	nc := c.NewForFunction()
+	if function.Name != "" {
+		nc.DefineFunctionName(function.Name)
+	}
 
 	for _, param := range function.Params {
 		nc.Define(param.Name)
@@ -569,12 +727,29 @@ func (function *Function) Compile(c *compile.Compiler) (err error) {
 	if err != nil {
 		return err
 	}
+	loadResult(nc, function.Body)
+	nc.Op(code.OpReturnValue)
+	nc.Peephole()
 	f := object.FunctionCompiled{
 		Instructions: nc.OpCodes.Output(),
 		ParamsCnt:    int8(len(function.Params)),
 		LocalCnt:     nc.SymbolTable.NumDefinitions,
+		SourceMap:    nc.OpCodes.SourceMap(),
+		Name:         function.Name,
+	}
+	index := c.Const(&f)
+	if n := uint32(len(nc.FreeSymbols)); n > 0 {
+		// Capture the variables of the enclosing functions it refers to.
+		if !code.CanPack(n, index) {
+			return fmt.Errorf("a function may refer to at most 255 variables of enclosing functions")
+		}
+		for _, s := range nc.FreeSymbols {
+			c.LoadSymbol(s)
+		}
+		c.OpArg(code.OpClosure, code.Pack(n, index))
+	} else {
+		c.OpArg(code.OpConstant, index)
 	}
-	c.OpArg(code.OpConstant, c.Const(&f))
 
 	if function.Name != "" {
 		symbol := c.Define(function.Name)
@@ -596,7 +771,31 @@ type InfixExpr struct {
 }
 
 func (infixexpr *InfixExpr) String() string {
-	return infixexpr.Left.String() + infixexpr.Literal + infixexpr.Right.String()
+	bp := bindingPower[infixexpr.TokenType]
+	return operand(infixexpr.Left, bp) + " " + infixexpr.Literal + " " + operand(infixexpr.Right, bp+1)
+}
+
+// precedence returns the binding power of the operator of e, that of calls
+// for postfix and primary expressions.
+func precedence(e Expr) int {
+	switch e := e.(type) {
+	case *Assign:
+		return AssignBP
+	case *InfixExpr:
+		return bindingPower[e.TokenType]
+	case *PrefixExpr:
+		return PrefixBP
+	}
+	return CallBP
+}
+
+// operand returns the source of e as the operand of an operator that takes
+// operands binding at least as tightly as bp, in parentheses if needed.
+func operand(e Expr, bp int) string {
+	if precedence(e) < bp {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
 }
 
 func (infixexpr *InfixExpr) Eval(env *object.Env) object.Object {
@@ -608,13 +807,16 @@ func (infixexpr *InfixExpr) Eval(env *object.Env) object.Object {
 	if isError(right) {
 		return right
 	}
+	if infixexpr.TokenType == token.TILDE {
+		return object.MatchGlob(left, right)
+	}
 	switch {
 	case left.Type() == object.BoolType && right.Type() == object.BoolType:
 		return evalBooleanInfix(infixexpr, left, right)
 	case left.Type() == object.IntType && right.Type() == object.IntType:
 		return evalNumberInfix(infixexpr, left, right)
 	case left.Type() == object.StringType && right.Type() == object.StringType:
-		return evalStringInfix(infixexpr, left, right)
+		return charge(env, evalStringInfix(infixexpr, left, right))
 	}
 	return object.NewError(
 		"%d: runtime error: unkown operator: %s %s %s",
@@ -627,17 +829,13 @@ func evalBooleanInfix(infixexpr *InfixExpr, left, right object.Object) object.Ob
 	rightVal := bool(*right.(*object.Boolean))
 	switch infixexpr.TokenType {
 	case token.AND:
-		ret := object.Boolean(leftVal && rightVal)
-		return &ret
+		return object.NewBoolean(leftVal && rightVal)
 	case token.OR:
-		ret := object.Boolean(leftVal || rightVal)
-		return &ret
+		return object.NewBoolean(leftVal || rightVal)
 	case token.EQ:
-		ret := object.Boolean(leftVal == rightVal)
-		return &ret
+		return object.NewBoolean(leftVal == rightVal)
 	case token.NOTEQ:
-		ret := object.Boolean(leftVal != rightVal)
-		return &ret
+		return object.NewBoolean(leftVal != rightVal)
 	}
 	return object.NewError("pos: %d: runtime error: unkown operator: %s %s %s",
 		infixexpr.Pos, left.String(), infixexpr.Literal, right.String())
@@ -648,38 +846,31 @@ func evalNumberInfix(infixexpr *InfixExpr, left, right object.Object) object.Obj
 	rightVal := int64(*right.(*object.Integer))
 	switch infixexpr.TokenType {
 	case token.ADD:
-		ret := object.Integer(leftVal + rightVal)
-		return &ret
+		return object.NewInteger(leftVal + rightVal)
 	case token.MINUS:
-		ret := object.Integer(leftVal - rightVal)
-		return &ret
+		return object.NewInteger(leftVal - rightVal)
 	case token.MUL:
-		ret := object.Integer(leftVal * rightVal)
-		return &ret
-	case token.DIV:
-		ret := object.Integer(leftVal / rightVal)
-		return &ret
-	case token.MOD:
-		ret := object.Integer(leftVal % rightVal)
-		return &ret
+		return object.NewInteger(leftVal * rightVal)
+	case token.DIV, token.MOD:
+		if rightVal == 0 {
+			return object.NewError("%d: division by zero", infixexpr.Pos+1)
+		}
+		if infixexpr.TokenType == token.DIV {
+			return object.NewInteger(leftVal / rightVal)
+		}
+		return object.NewInteger(leftVal % rightVal)
 	case token.LT:
-		ret := object.Boolean(leftVal < rightVal)
-		return &ret
+		return object.NewBoolean(leftVal < rightVal)
 	case token.LE:
-		ret := object.Boolean(leftVal <= rightVal)
-		return &ret
+		return object.NewBoolean(leftVal <= rightVal)
 	case token.GT:
-		ret := object.Boolean(leftVal > rightVal)
-		return &ret
+		return object.NewBoolean(leftVal > rightVal)
 	case token.GE:
-		ret := object.Boolean(leftVal >= rightVal)
-		return &ret
+		return object.NewBoolean(leftVal >= rightVal)
 	case token.EQ:
-		ret := object.Boolean(leftVal == rightVal)
-		return &ret
+		return object.NewBoolean(leftVal == rightVal)
 	case token.NOTEQ:
-		ret := object.Boolean(leftVal != rightVal)
-		return &ret
+		return object.NewBoolean(leftVal != rightVal)
 	}
 	return object.NewError("pos: %d: runtime error: unkown operator: %s %s %s",
 		infixexpr.Pos, left.String(), infixexpr.Literal, right.String())
@@ -693,23 +884,17 @@ func evalStringInfix(infixexpr *InfixExpr, left, right object.Object) object.Obj
 		ret := object.String(leftVal + rightVal)
 		return &ret
 	case token.LT:
-		ret := object.Boolean(leftVal < rightVal)
-		return &ret
+		return object.NewBoolean(leftVal < rightVal)
 	case token.LE:
-		ret := object.Boolean(leftVal <= rightVal)
-		return &ret
+		return object.NewBoolean(leftVal <= rightVal)
 	case token.GT:
-		ret := object.Boolean(leftVal > rightVal)
-		return &ret
+		return object.NewBoolean(leftVal > rightVal)
 	case token.GE:
-		ret := object.Boolean(leftVal >= rightVal)
-		return &ret
+		return object.NewBoolean(leftVal >= rightVal)
 	case token.EQ:
-		ret := object.Boolean(leftVal == rightVal)
-		return &ret
+		return object.NewBoolean(leftVal == rightVal)
 	case token.NOTEQ:
-		ret := object.Boolean(leftVal != rightVal)
-		return &ret
+		return object.NewBoolean(leftVal != rightVal)
 	}
 	return object.NewError("pos: %d: runtime error: unkown operator: %s %s %s",
 		infixexpr.Pos, left.String(), infixexpr.Literal, right.String())
@@ -720,6 +905,17 @@ func (infixexpr *InfixExpr) Compile(c *compile.Compiler) (err error) {
 	if err != nil {
 		return
 	}
+	if pattern, ok := infixexpr.Right.(*String); ok && infixexpr.TokenType == token.TILDE {
+		// Compile literal patterns once, they are shared through the constant pool.
+		g := object.NewGlob(pattern.Literal)
+		if g.Type() == object.ERRORType {
+			return fmt.Errorf("%s", string(*g.(*object.Error)))
+		}
+		c.OpArg(code.OpConstant, c.Const(g))
+		c.Pos(infixexpr.Pos)
+		c.Op(code.OpMatch)
+		return nil
+	}
 	err = infixexpr.Right.Compile(c)
 	if err != nil {
 		return
@@ -752,13 +948,39 @@ func (infixexpr *InfixExpr) Compile(c *compile.Compiler) (err error) {
 		op = code.OpAnd
 	case token.OR:
 		op = code.OpOr
+	case token.TILDE:
+		op = code.OpMatch
 	default:
-		panic(fmt.Sprintf("unkown BinOp: %s", infixexpr.TokenType))
+		return fmt.Errorf("%d: unsupported operator %s", infixexpr.Pos+1, infixexpr.Literal)
 	}
+	c.Pos(infixexpr.Pos)
 	c.Op(op)
 	return nil
 }
 
+// step accounts for one step against env's budget, returning an error
+// object when the evaluation has to stop.
+func step(env *object.Env) object.Object {
+	if env.Budget == nil {
+		return nil
+	}
+	if err := env.Budget.Step(); err != nil {
+		return &object.Interrupt{Err: err}
+	}
+	return nil
+}
+
+// charge accounts for the allocation of o against env's budget.
+func charge(env *object.Env, o object.Object) object.Object {
+	if env.Budget == nil {
+		return o
+	}
+	if err := env.Budget.Alloc(o); err != nil {
+		return &object.Interrupt{Err: err}
+	}
+	return o
+}
+
 func isError(obj object.Object) bool {
 	if obj != nil {
 		return obj.Type() == object.ERRORType
@@ -16,6 +16,17 @@ type Error struct {
 	Err error
 }
 
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Pos+1, e.Msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// bailout is the panic stopping the parser at the first error.
+type bailout struct{}
+
 type Parser struct {
 	l         *lexer.Lexer
 	curToken  *token.Token
@@ -47,7 +58,7 @@ func (p *Parser) parseExpr(rbp int) (e Expr) {
 			Msg: fmt.Sprintf("got '%s', want primary expr", p.curToken.Literal),
 			Err: err,
 		})
-		panic(err)
+		panic(bailout{})
 	}
 	left := prefixFn(p)
 	for p.peekToken.Type != token.SEMICOLON && rbp < bindingPower[p.peekToken.Type] {
@@ -58,9 +69,6 @@ func (p *Parser) parseExpr(rbp int) (e Expr) {
 		p.nextToken()
 		left = infixFn(p, left)
 	}
-	if p.peekToken.Type == token.SEMICOLON {
-		p.nextToken()
-	}
 	return left
 }
 
@@ -68,6 +76,11 @@ func (p *Parser) parseExprStmt() *ExprStmt {
 	stmt := &ExprStmt{
 		E: p.parseExpr(LowestBP),
 	}
+	// The semicolon ends the statement, not a nested expression, which the
+	// statement would then go on with.
+	if p.peekToken.Type == token.SEMICOLON {
+		p.nextToken()
+	}
 	return stmt
 }
 
@@ -81,7 +94,11 @@ func (p *Parser) parseStmt() (s Stmt) {
 func (p *Parser) Parse() (prog *Program, errs []*Error) {
 	prog = &Program{}
 	defer func() {
-		_ = recover()
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+		}
 		errs = p.errs
 	}()
 	for p.curToken.Type != token.EOF {
@@ -103,7 +120,7 @@ func (p *Parser) peekError(t token.Type) {
 		Msg: fmt.Sprintf("expected next token to be %v, got %v insted", t, p.peekToken.Type),
 		Err: err,
 	})
-	panic(nil)
+	panic(bailout{})
 }
 
 func (p *Parser) expectPeek(t token.Type) bool {
@@ -164,7 +181,7 @@ func numberNud(p *Parser) (e Expr) {
 			Pos: tok.Pos,
 			Msg: err.Error(),
 		})
-		return nil
+		panic(bailout{})
 	}
 	return &Integer{
 		Value:   n,
@@ -200,7 +217,7 @@ func funcNud(p *Parser) (e Expr) {
 		Name:   "",
 	}
 	if p.peekToken.Type != token.LPAR {
-		p.nextToken()
+		p.expectPeek(token.IDENT)
 		expression.Name = p.curToken.Literal
 	}
 	if !p.expectPeek(token.LPAR) {
@@ -211,22 +228,34 @@ func funcNud(p *Parser) (e Expr) {
 		return nil
 	}
 	expression.Body = parseBlock(p)
+	markTailCall(expression.Body)
 	return expression
 }
 
+// markTailCall marks a call ending the function body as a tail call.
+func markTailCall(body *Program) {
+	if n := len(body.Stmts); n > 0 {
+		if stmt, ok := body.Stmts[n-1].(*ExprStmt); ok {
+			if call, ok := stmt.E.(*Call); ok {
+				call.Tail = true
+			}
+		}
+	}
+}
+
 func parseFuncParams(p *Parser) (params []*Ident) {
 	if p.peekToken.Type == token.RPAR {
 		p.nextToken()
 		return
 	}
-	p.nextToken()
+	p.expectPeek(token.IDENT)
 	params = append(params, &Ident{
 		Name: p.curToken.Literal,
 		Pos:  p.curToken.Pos,
 	})
 	for p.peekToken.Type == token.COMMA {
 		p.nextToken()
-		p.nextToken()
+		p.expectPeek(token.IDENT)
 		params = append(params, &Ident{
 			Name: p.curToken.Literal,
 			Pos:  p.curToken.Pos,
@@ -313,8 +342,20 @@ func assignLed(p *Parser, left Expr) (e Expr) {
 
 func callLed(p *Parser, left Expr) (e Expr) {
 	return &Call{
-		fn:   left,
-		args: parseNodeList(p, token.COMMA, token.RPAR),
+		Fn:   left,
+		Args: parseNodeList(p, token.COMMA, token.RPAR),
+	}
+}
+
+func selectorLed(p *Parser, left Expr) (e Expr) {
+	tok := p.curToken
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	return &Selector{
+		X:    left,
+		Name: p.curToken.Literal,
+		Pos:  tok.Pos,
 	}
 }
 
@@ -396,6 +437,7 @@ func init() {
 	bindingPower[token.AND] = AndBP
 	bindingPower[token.EQ] = EqualsBP
 	bindingPower[token.NOTEQ] = EqualsBP
+	bindingPower[token.TILDE] = EqualsBP
 	bindingPower[token.IN] = LessGreaterBP
 	bindingPower[token.LT] = LessGreaterBP
 	bindingPower[token.GT] = LessGreaterBP
@@ -408,6 +450,7 @@ func init() {
 	bindingPower[token.MOD] = ModuloBP
 	bindingPower[token.LPAR] = CallBP
 	bindingPower[token.LBRK] = IndexBP
+	bindingPower[token.DOT] = IndexBP
 
 	prefixParsers[token.NUM] = numberNud
 	prefixParsers[token.STR] = stringNud
@@ -433,6 +476,7 @@ func init() {
 	infixParsers[token.GE] = infixLed
 	infixParsers[token.EQ] = infixLed
 	infixParsers[token.NOTEQ] = infixLed
+	infixParsers[token.TILDE] = infixLed
 	infixParsers[token.IN] = infixLed
 	infixParsers[token.OR] = infixLed
 	infixParsers[token.AND] = infixLed
@@ -441,4 +485,5 @@ func init() {
 
 	infixParsers[token.LPAR] = callLed
 	infixParsers[token.LBRK] = indexOrsliceLed
+	infixParsers[token.DOT] = selectorLed
 }
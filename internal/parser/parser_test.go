@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"os"
+	"parrot/internal/compile"
+	"path/filepath"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"1-(2-3)", "1 - (2 - 3)"},
+		{"(1-2)-3", "1 - 2 - 3"},
+		{"a*(b%c)", "a * b % c"},
+		{"(a*b)%c", "(a * b) % c"},
+		{"1 in [1]", "1 in [1]"},
+		{"a and !(b or c)", "a and !(b or c)"},
+		{"-(-a)", "--a"},
+		{"(-a)(1)", "(-a)(1)"},
+		{"-a(1)", "-a(1)"},
+		{"a = b = c", "a = b = c"},
+		{"a = (b = c)", "a = (b = c)"},
+		{"(a = 1) + 2", "(a = 1) + 2"},
+		{`"it's"`, `"it's"`},
+		{`'say "hi"'`, `'say "hi"'`},
+		{"s ~ 'a*'", `s ~ "a*"`},
+		{"x[1:2:3]; x[:]; x[::2]; x[1]", "x[1:2:3]; x[:]; x[::2]; x[1]"},
+		{"(a + b).c[0]", "(a + b).c[0]"},
+		{"fn add(a,b) { a+b }", "fn add(a, b) { a + b }"},
+		{"f = fn() {}; f()", "f = fn() {}; f()"},
+		{"x = 10; [x, 1]", "x = 10; [x, 1]"},
+	}
+	for _, tt := range tests {
+		prog, errs := Parse(tt.src)
+		if len(errs) > 0 {
+			t.Errorf("Parse(%q): %v", tt.src, errs[0])
+			continue
+		}
+		if got := prog.String(); got != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"1 +",
+		"fn (1) {}",
+		"fn f(a, 2) {}",
+		"fn 1() {}",
+		"99999999999999999999",
+		"@",
+		"[1, 2",
+		"f(",
+		"x.1",
+	} {
+		if _, errs := Parse(src); len(errs) == 0 {
+			t.Errorf("Parse(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+// FuzzParse checks that parsing and compiling any input don't panic, and
+// that a parsed program printed back parses to the same program.
+func FuzzParse(f *testing.F) {
+	scripts, _ := filepath.Glob("../../testdata/conformance/*.pr")
+	for _, script := range scripts {
+		src, err := os.ReadFile(script)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+	f.Add("fn f(a, b) { a[1:2:-1] + -b.c(1)[0] }; f = fn() {}; x = 1 in [1]")
+	f.Add("'say \"hi\"' ~ \"*\" == !(a = b = 3) or 1 % 2 * 3")
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, errs := Parse(src)
+		if len(errs) > 0 {
+			return
+		}
+		// The compiler may reject the program, but not crash.
+		_ = compile.New().Compile(prog)
+		printed := prog.String()
+		again, errs := Parse(printed)
+		if len(errs) > 0 {
+			t.Fatalf("%q printed as %q: %v", src, printed, errs[0])
+		}
+		if s := again.String(); s != printed {
+			t.Fatalf("%q printed as %q, then as %q", src, printed, s)
+		}
+	})
+}
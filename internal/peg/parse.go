@@ -0,0 +1,338 @@
+package peg
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Compile parses the grammar src.
+func Compile(src string) (g *Grammar, err error) {
+	p := &parser{src: src}
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = perr
+		}
+	}()
+	g = p.parseGrammar()
+	return g, nil
+}
+
+// Error is a syntax error in a grammar.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("peg: %d: %s", e.Pos+1, e.Msg)
+}
+
+type parser struct {
+	src     string
+	pos     int
+	refs    []*ruleRef
+	actions map[string]bool
+
+	actionNames []string
+}
+
+func (p *parser) errorf(format string, a ...any) {
+	panic(&Error{Pos: p.pos, Msg: fmt.Sprintf(format, a...)})
+}
+
+func (p *parser) parseGrammar() *Grammar {
+	g := &Grammar{}
+	p.actions = make(map[string]bool)
+	p.skip()
+	if p.atDefinition() {
+		for p.pos < len(p.src) {
+			if !p.atDefinition() {
+				p.errorf("expected rule definition")
+			}
+			start := p.pos
+			name := p.name()
+			for _, r := range g.rules {
+				if r.name == name {
+					p.pos = start
+					p.errorf("rule %q redefined", name)
+				}
+			}
+			p.skip()
+			p.pos += len("<-")
+			p.skip()
+			g.rules = append(g.rules, &rule{name: name, e: p.parseChoice()})
+		}
+	} else {
+		g.rules = append(g.rules, &rule{e: p.parseChoice()})
+		if p.pos < len(p.src) {
+			p.errorf("unexpected %q", p.peek())
+		}
+	}
+	for _, ref := range p.refs {
+		ref.index = -1
+		for i, r := range g.rules {
+			if r.name == ref.name {
+				ref.index = i
+				break
+			}
+		}
+		if ref.index < 0 {
+			p.pos = ref.pos
+			p.errorf("undefined rule %q", ref.name)
+		}
+	}
+	g.actions = p.actionNames
+	return g
+}
+
+func (p *parser) parseChoice() expr {
+	alts := []expr{p.parseSequence()}
+	for p.peek() == '/' {
+		p.pos++
+		p.skip()
+		alts = append(alts, p.parseSequence())
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return &choice{alts: alts}
+}
+
+func (p *parser) parseSequence() expr {
+	var items []expr
+	for p.pos < len(p.src) && !p.atSequenceEnd() {
+		items = append(items, p.parsePrefix())
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &sequence{items: items}
+}
+
+func (p *parser) atSequenceEnd() bool {
+	switch p.peek() {
+	case '/', ')', '}':
+		return true
+	case '|':
+		return p.hasPrefix("|}")
+	}
+	return p.atDefinition()
+}
+
+func (p *parser) parsePrefix() expr {
+	switch p.peek() {
+	case '&':
+		p.pos++
+		p.skip()
+		return &predicate{e: p.parsePrefix()}
+	case '!':
+		p.pos++
+		p.skip()
+		return &predicate{e: p.parsePrefix(), not: true}
+	}
+	return p.parseSuffix()
+}
+
+func (p *parser) parseSuffix() expr {
+	e := p.parsePrimary()
+	for {
+		switch {
+		case p.peek() == '*':
+			p.pos++
+			e = &repeat{e: e}
+		case p.peek() == '+':
+			p.pos++
+			e = &repeat{e: e, min: 1}
+		case p.peek() == '?':
+			p.pos++
+			e = &optional{e: e}
+		case p.hasPrefix("->"):
+			p.pos += len("->")
+			p.skip()
+			name := p.name()
+			if name == "" {
+				p.errorf("expected action name after '->'")
+			}
+			if !p.actions[name] {
+				p.actions[name] = true
+				p.actionNames = append(p.actionNames, name)
+			}
+			e = &action{e: e, name: name}
+		default:
+			return e
+		}
+		p.skip()
+	}
+}
+
+func (p *parser) parsePrimary() (e expr) {
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		p.skip()
+		e = p.parseChoice()
+		p.expect(")")
+	case p.hasPrefix("{|"):
+		p.pos += len("{|")
+		p.skip()
+		e = &listCapture{e: p.parseChoice()}
+		p.expect("|}")
+	case c == '{':
+		p.pos++
+		p.skip()
+		e = &textCapture{e: p.parseChoice()}
+		p.expect("}")
+	case c == '\'' || c == '"':
+		e = &literal{s: p.quoted(c)}
+	case c == '[':
+		e = p.parseClass()
+	case c == '.':
+		p.pos++
+		e = &anyChar{}
+	case isNameStart(c):
+		ref := &ruleRef{pos: p.pos}
+		ref.name = p.name()
+		p.refs = append(p.refs, ref)
+		e = ref
+	default:
+		if p.pos >= len(p.src) {
+			p.errorf("unexpected end of grammar")
+		}
+		p.errorf("unexpected %q", c)
+	}
+	p.skip()
+	return e
+}
+
+func (p *parser) parseClass() expr {
+	start := p.pos
+	p.pos++ // [
+	c := &class{}
+	if p.peek() == '^' {
+		p.pos++
+		c.negate = true
+	}
+	first := true
+	for first || p.peek() != ']' {
+		if p.pos >= len(p.src) {
+			p.errorf("unterminated character class")
+		}
+		first = false
+		lo := p.char()
+		hi := lo
+		if p.peek() == '-' && !p.hasPrefix("-]") {
+			p.pos++
+			hi = p.char()
+			if hi < lo {
+				p.errorf("invalid range %c-%c", lo, hi)
+			}
+		}
+		c.ranges = append(c.ranges, runeRange{lo, hi})
+	}
+	p.pos++ // ]
+	c.src = p.src[start:p.pos]
+	return c
+}
+
+func (p *parser) quoted(quote rune) string {
+	start := p.pos
+	p.pos++
+	var s []rune
+	for p.peek() != quote {
+		if p.pos >= len(p.src) {
+			p.pos = start
+			p.errorf("unterminated literal")
+		}
+		s = append(s, p.char())
+	}
+	p.pos++
+	return string(s)
+}
+
+// char reads one character, interpreting backslash escapes.
+func (p *parser) char() rune {
+	r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	if r != '\\' || p.pos >= len(p.src) {
+		return r
+	}
+	r, n = utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	switch r {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	}
+	return r
+}
+
+func (p *parser) expect(s string) {
+	if !p.hasPrefix(s) {
+		if p.pos >= len(p.src) {
+			p.errorf("expected %q, got end of grammar", s)
+		}
+		p.errorf("expected %q, got %q", s, p.peek())
+	}
+	p.pos += len(s)
+}
+
+// atDefinition reports whether the input continues with `name <-`.
+func (p *parser) atDefinition() bool {
+	save := p.pos
+	defer func() { p.pos = save }()
+	if p.name() == "" {
+		return false
+	}
+	p.skip()
+	return p.hasPrefix("<-")
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	if !isNameStart(p.peek()) {
+		return ""
+	}
+	for isNameStart(p.peek()) || unicode.IsDigit(p.peek()) {
+		_, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += n
+	}
+	return p.src[start:p.pos]
+}
+
+// skip skips white space and comments.
+func (p *parser) skip() {
+	for p.pos < len(p.src) {
+		switch {
+		case unicode.IsSpace(p.peek()):
+			_, n := utf8.DecodeRuneInString(p.src[p.pos:])
+			p.pos += n
+		case p.hasPrefix("--"):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *parser) hasPrefix(s string) bool {
+	return len(p.src)-p.pos >= len(s) && p.src[p.pos:p.pos+len(s)] == s
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
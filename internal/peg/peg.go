@@ -0,0 +1,325 @@
+// Package peg implements a packrat parser for parsing expression grammars.
+//
+// Grammars are written in a syntax close to LPeg's re module:
+//
+//	name <- p        rule definition, the first rule is the start rule
+//	p1 p2            sequence
+//	p1 / p2          ordered choice
+//	p* p+ p?         repetition and option
+//	&p !p            and / not predicates
+//	'lit' "lit"      literal
+//	[a-z_] [^0-9]    character class
+//	.                any character
+//	( p )            grouping
+//	{ p }            capture the text matched by p
+//	{| p |}          collect the captures of p into a list
+//	p -> name        call action name with the captures of p
+//	-- comment       comment to the end of the line
+//
+// A grammar without rule definitions consists of a single pattern.
+package peg
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Action is called for every `p -> name` capture with the values captured
+// by p, or with the text matched by p when p captured nothing.
+type Action func(name string, args []any) (any, error)
+
+// Grammar is a compiled parsing expression grammar.
+type Grammar struct {
+	rules   []*rule
+	actions []string
+}
+
+type rule struct {
+	name string
+	e    expr
+}
+
+type expr any
+
+type (
+	literal struct {
+		s string
+	}
+	class struct {
+		ranges []runeRange
+		negate bool
+		src    string // as written in the grammar, for errors
+	}
+	anyChar  struct{}
+	sequence struct {
+		items []expr
+	}
+	choice struct {
+		alts []expr
+	}
+	repeat struct {
+		e   expr
+		min int
+	}
+	optional struct {
+		e expr
+	}
+	predicate struct {
+		e   expr
+		not bool
+	}
+	ruleRef struct {
+		name  string
+		index int
+		pos   int
+	}
+	textCapture struct {
+		e expr
+	}
+	listCapture struct {
+		e expr
+	}
+	action struct {
+		e    expr
+		name string
+	}
+)
+
+type runeRange struct {
+	lo, hi rune
+}
+
+func (c *class) has(r rune) bool {
+	for _, rr := range c.ranges {
+		if rr.lo <= r && r <= rr.hi {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+// Actions returns the names of the actions referenced by the grammar in
+// order of first appearance.
+func (g *Grammar) Actions() []string {
+	return g.actions
+}
+
+// Match matches g against a prefix of input and returns the values captured
+// by the start rule. If g doesn't match, the error is a *MatchError,
+// otherwise it is the first error returned by act.
+func (g *Grammar) Match(input string, act Action) ([]any, error) {
+	m := &matcher{
+		g:     g,
+		input: input,
+		memo:  make(map[memoKey]*memoEntry),
+		act:   act,
+	}
+	_, ok := m.call(0, 0)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if !ok {
+		return nil, &MatchError{Pos: m.far, Expected: m.expected}
+	}
+	return m.vals, nil
+}
+
+// MatchError reports that a grammar didn't match its input. Pos is the
+// furthest offset a literal, class or . failed to match at, which is where
+// the input most likely goes wrong, and Expected lists those that failed
+// there.
+type MatchError struct {
+	Pos      int
+	Expected []string
+}
+
+func (e *MatchError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("peg: no match at offset %d", e.Pos)
+	}
+	return fmt.Sprintf("peg: no match at offset %d, expected %s", e.Pos, strings.Join(e.Expected, " or "))
+}
+
+type memoKey struct {
+	rule, pos int
+}
+
+type memoEntry struct {
+	end  int
+	ok   bool
+	vals []any
+}
+
+type matcher struct {
+	g     *Grammar
+	input string
+	vals  []any // captures produced so far
+	memo  map[memoKey]*memoEntry
+	act   Action
+	err   error
+
+	// The furthest offset a terminal failed to match at and the terminals
+	// that did, not counting failures inside predicates, which are
+	// expected.
+	far       int
+	expected  []string
+	predicate int
+}
+
+// fail records that the terminal described by what failed to match at pos.
+func (m *matcher) fail(pos int, what string) {
+	switch {
+	case m.predicate > 0 || pos < m.far:
+		return
+	case pos > m.far:
+		m.far, m.expected = pos, nil
+	}
+	for _, e := range m.expected {
+		if e == what {
+			return
+		}
+	}
+	m.expected = append(m.expected, what)
+}
+
+// call matches rule i at pos, memoizing the result. A rule that is entered
+// again at the same position before it finishes (left recursion) fails.
+func (m *matcher) call(i, pos int) (int, bool) {
+	key := memoKey{i, pos}
+	if e, ok := m.memo[key]; ok {
+		if e.ok {
+			m.vals = append(m.vals, e.vals...)
+		}
+		return e.end, e.ok
+	}
+	entry := &memoEntry{end: pos}
+	m.memo[key] = entry
+	mark := len(m.vals)
+	end, ok := m.match(m.g.rules[i].e, pos)
+	if ok {
+		entry.end = end
+		entry.ok = true
+		entry.vals = append([]any(nil), m.vals[mark:]...)
+	}
+	return end, ok
+}
+
+func (m *matcher) match(e expr, pos int) (int, bool) {
+	if m.err != nil {
+		return pos, false
+	}
+	switch e := e.(type) {
+	case *literal:
+		if strings.HasPrefix(m.input[pos:], e.s) {
+			return pos + len(e.s), true
+		}
+		m.fail(pos, fmt.Sprintf("%q", e.s))
+		return pos, false
+	case *class:
+		r, n := utf8.DecodeRuneInString(m.input[pos:])
+		if n == 0 || !e.has(r) {
+			m.fail(pos, e.src)
+			return pos, false
+		}
+		return pos + n, true
+	case *anyChar:
+		if pos >= len(m.input) {
+			m.fail(pos, "any character")
+			return pos, false
+		}
+		_, n := utf8.DecodeRuneInString(m.input[pos:])
+		return pos + n, true
+	case *sequence:
+		mark := len(m.vals)
+		end := pos
+		for _, item := range e.items {
+			var ok bool
+			if end, ok = m.match(item, end); !ok {
+				m.vals = m.vals[:mark]
+				return pos, false
+			}
+		}
+		return end, true
+	case *choice:
+		mark := len(m.vals)
+		for _, alt := range e.alts {
+			if end, ok := m.match(alt, pos); ok {
+				return end, true
+			}
+			m.vals = m.vals[:mark]
+		}
+		return pos, false
+	case *repeat:
+		mark := len(m.vals)
+		end := pos
+		for n := 0; ; n++ {
+			next, ok := m.match(e.e, end)
+			if !ok {
+				if n < e.min {
+					m.vals = m.vals[:mark]
+					return pos, false
+				}
+				return end, true
+			}
+			if next == end {
+				// An empty match would repeat forever.
+				return end, true
+			}
+			end = next
+		}
+	case *optional:
+		if end, ok := m.match(e.e, pos); ok {
+			return end, true
+		}
+		return pos, true
+	case *predicate:
+		mark := len(m.vals)
+		m.predicate++
+		_, ok := m.match(e.e, pos)
+		m.predicate--
+		m.vals = m.vals[:mark]
+		if ok == e.not || m.err != nil {
+			return pos, false
+		}
+		return pos, true
+	case *ruleRef:
+		return m.call(e.index, pos)
+	case *textCapture:
+		mark := len(m.vals)
+		end, ok := m.match(e.e, pos)
+		if !ok {
+			return pos, false
+		}
+		m.vals = append(m.vals[:mark], m.input[pos:end])
+		return end, true
+	case *listCapture:
+		mark := len(m.vals)
+		end, ok := m.match(e.e, pos)
+		if !ok {
+			return pos, false
+		}
+		list := append([]any{}, m.vals[mark:]...)
+		m.vals = append(m.vals[:mark], list)
+		return end, true
+	case *action:
+		mark := len(m.vals)
+		end, ok := m.match(e.e, pos)
+		if !ok {
+			return pos, false
+		}
+		args := append([]any(nil), m.vals[mark:]...)
+		if len(args) == 0 {
+			args = []any{m.input[pos:end]}
+		}
+		v, err := m.act(e.name, args)
+		if err != nil {
+			m.err = err
+			m.vals = m.vals[:mark]
+			return pos, false
+		}
+		m.vals = append(m.vals[:mark], v)
+		return end, true
+	}
+	panic("peg: unknown expression")
+}
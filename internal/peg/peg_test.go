@@ -0,0 +1,176 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// join is an action returning its arguments joined by commas in brackets.
+func join(name string, args []any) (any, error) {
+	var s []string
+	for _, a := range args {
+		s = append(s, fmt.Sprint(a))
+	}
+	return name + "[" + strings.Join(s, ",") + "]", nil
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		grammar, input string
+		want           []any // nil for no match
+	}{
+		// Sequence, choice and repetition; the match is of a prefix.
+		{`'a' 'b'`, "abc", []any{}},
+		{`'a' 'b'`, "ac", nil},
+		{`'x' / 'a'`, "a", []any{}},
+		{`{'a'*} {'b'+}`, "aab", []any{"aa", "b"}},
+		{`{'a'*} {'b'+}`, "aa", nil},
+		{`{'a'?} 'b'`, "b", []any{""}},
+		{`{[a-c]+}`, "abcd", []any{"abc"}},
+		{`{[^0-9]+}`, "ab1", []any{"ab"}},
+		{`{.} {.}`, "héllo", []any{"h", "é"}},
+		{`{'\n'}`, "\n", []any{"\n"}},
+		// Predicates consume nothing and capture nothing.
+		{`&{'a'} {.}`, "ab", []any{"a"}},
+		{`!'a' {.}`, "ab", nil},
+		{`!'a' {.}`, "ba", []any{"b"}},
+		{`{(!';' .)*} ';'`, "key=v;", []any{"key=v"}},
+		// Captures: a failed alternative drops its captures.
+		{`{'a'} 'x' / {'a'} {'b'}`, "ab", []any{"a", "b"}},
+		{`{| {[a-z]} (',' {[a-z]})* |}`, "a,b,c", []any{[]any{"a", "b", "c"}}},
+		{`{| 'x'? |}`, "", []any{[]any{}}},
+		// Actions get the captures of their pattern, or the matched text.
+		{`[0-9]+ -> num`, "42", []any{"num[42]"}},
+		{`({[a-z]} {[0-9]}) -> pair`, "a1", []any{"pair[a,1]"}},
+		// Rules.
+		{`list <- {| item (',' item)* |}
+		  item <- {[a-z]+}   -- a word`, "ab,cd", []any{[]any{"ab", "cd"}}},
+		{`s <- '(' s ')' / ''`, "(())", []any{}},
+		// Left recursion fails, so the other alternative is taken.
+		{`e <- {e '+' n} / n
+		  n <- {[0-9]+}`, "1+2", []any{"1"}},
+	}
+	for _, tt := range tests {
+		g, err := Compile(tt.grammar)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.grammar, err)
+			continue
+		}
+		got, err := g.Match(tt.input, join)
+		var merr *MatchError
+		switch {
+		case tt.want == nil && !errors.As(err, &merr):
+			t.Errorf("%q on %q = %v, %v, want no match", tt.grammar, tt.input, got, err)
+		case tt.want != nil && err != nil:
+			t.Errorf("%q on %q: %v", tt.grammar, tt.input, err)
+		case tt.want != nil && len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%q on %q = %#v, want %#v", tt.grammar, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMatchError(t *testing.T) {
+	tests := []struct {
+		grammar, input string
+		pos            int
+		expected       []string
+	}{
+		{`'a' 'b'`, "ax", 1, []string{`"b"`}},
+		{`line <- date ' ' level
+		  date <- [0-9]+ '-' [0-9]+
+		  level <- 'INFO' / 'WARN'`, "12-30 ERROR", 6, []string{`"INFO"`, `"WARN"`}},
+		// The repetition stopping counts as a failure too.
+		{`[a-z]+ ':' [0-9]`, "abc:x", 4, []string{"[0-9]"}},
+		{`[a-z]+ ':'`, "abc", 3, []string{"[a-z]", `":"`}},
+		{`'a' .`, "a", 1, []string{"any character"}},
+		// Failures inside predicates are not reported.
+		{`!('a' 'b') 'a' 'c'`, "ad", 1, []string{`"c"`}},
+		{`'x'`, "", 0, []string{`"x"`}},
+	}
+	for _, tt := range tests {
+		g, err := Compile(tt.grammar)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", tt.grammar, err)
+		}
+		_, err = g.Match(tt.input, join)
+		var merr *MatchError
+		if !errors.As(err, &merr) {
+			t.Errorf("%q on %q: %v, want a MatchError", tt.grammar, tt.input, err)
+			continue
+		}
+		if merr.Pos != tt.pos || !reflect.DeepEqual(merr.Expected, tt.expected) {
+			t.Errorf("%q on %q: failed at %d expecting %q, want %d expecting %q",
+				tt.grammar, tt.input, merr.Pos, merr.Expected, tt.pos, tt.expected)
+		}
+	}
+	err := &MatchError{Pos: 4, Expected: []string{"[0-9]", `"-"`}}
+	if got, want := err.Error(), `peg: no match at offset 4, expected [0-9] or "-"`; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestMemoization(t *testing.T) {
+	// Both alternatives start with word at 0: the second one reuses the
+	// result of the first, so the action runs once.
+	g, err := Compile(`s <- word ':' / word ';'
+	                   word <- [a-z]+ -> count`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	got, err := g.Match("ab;", func(name string, args []any) (any, error) {
+		calls++
+		return args[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || !reflect.DeepEqual(got, []any{"ab"}) {
+		t.Errorf("got %v with %d action calls, want [ab] with 1", got, calls)
+	}
+}
+
+func TestActionError(t *testing.T) {
+	g, err := Compile(`{[a-z]} -> ok ([0-9] -> fail / .)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := g.Actions(); !reflect.DeepEqual(got, []string{"ok", "fail"}) {
+		t.Errorf("Actions() = %q", got)
+	}
+	boom := errors.New("boom")
+	_, err = g.Match("a1", func(name string, args []any) (any, error) {
+		if name == "fail" {
+			return nil, boom
+		}
+		return args[0], nil
+	})
+	if err != boom {
+		t.Errorf("Match = %v, want the action's error", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		grammar, err string
+	}{
+		{`a <- b`, `peg: 6: undefined rule "b"`},
+		{`a <- 'x'  a <- 'y'`, `peg: 11: rule "a" redefined`},
+		{`'abc`, `peg: 1: unterminated literal`},
+		{`[a-`, `peg: 4: unterminated character class`},
+		{`[z-a]`, `peg: 5: invalid range z-a`},
+		{`('a'`, `peg: 5: expected ")", got end of grammar`},
+		{`'a' -> `, `peg: 8: expected action name after '->'`},
+		{`'a' )`, `peg: 5: unexpected ')'`},
+		{`a <- 'x' 'y' <-`, `peg: 14: unexpected '<'`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.grammar)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("Compile(%q) = %v, want %s", tt.grammar, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+// Package prc reads and writes compiled programs in the portable .prc
+// format, so that scripts can be shipped precompiled and run without
+// parsing.
+//
+// A file starts with the magic "\x7fPRC" and a version byte. Then come the
+// source file name, the names of the global symbols by index, the names of
+// the builtins the code refers to by index, the constant pool and the
+// top-level code. Integers are varints, strings and byte slices are
+// prefixed with their length; a code object is its instructions followed by
+// its source map; a constant is a tag byte followed by its value, where
+// lists and compiled functions nest. The file ends with the CRC-32 of the
+// bytes before it.
+//
+// Decode checks the instructions too, so that the VM can run a decoded
+// file without going out of its stack, constants, globals or locals.
+package prc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/vm"
+	"strings"
+)
+
+const (
+	magic = "\x7fPRC"
+
+	// Version is the version of the format written by Encode. Version 2
+	// has variable-width instruction arguments, version 3 superinstructions
+	// and renumbered op codes, version 4 a checksum.
+	Version = 4
+)
+
+// Constant tags.
+const (
+	tagNull byte = iota
+	tagTrue
+	tagFalse
+	tagInt
+	tagString
+	tagError
+	tagList
+	tagGlob
+	tagFunction
+)
+
+// File is a compiled program.
+type File struct {
+	Source    string // name of the source file, if any
+	Globals   []string
+	Builtins  []string
+	Constants []object.Object
+	Code      []byte
+	SourceMap code.SourceMap
+}
+
+// New returns the File for the top-level code compiled by c from the
+// source file named source.
+func New(c *compile.Compiler, source string) *File {
+	f := &File{
+		Source:    source,
+		Globals:   c.Names(),
+		Constants: *c.Constants,
+		Code:      c.OpCodes.Output(),
+		SourceMap: c.OpCodes.SourceMap(),
+	}
+	for _, b := range object.Builtins {
+		f.Builtins = append(f.Builtins, b.Name)
+	}
+	return f
+}
+
+// Check reports an error if the code of f refers to builtins by indexes
+// that don't match the builtins of this build.
+func (f *File) Check() error {
+	for i, name := range f.Builtins {
+		if i >= len(object.Builtins) || object.Builtins[i].Name != name {
+			return fmt.Errorf("prc: %s was compiled with a different builtin %s", f.Source, name)
+		}
+	}
+	return nil
+}
+
+// Disassemble writes a listing of the constants and code of f to w. The
+// instructions are annotated with their source positions.
+func (f *File) Disassemble(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "source %q\n", f.Source)
+	for i, c := range f.Constants {
+		if fn, ok := c.(*object.FunctionCompiled); ok {
+			fmt.Fprintf(&b, "constant %d: function, %d params, %d locals\n", i, fn.ParamsCnt, fn.LocalCnt)
+			if err := disassemble(&b, "\t", fn.Instructions, fn.SourceMap); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "constant %d: %s %s\n", i, c.Type(), c)
+	}
+	b.WriteString("code:\n")
+	if err := disassemble(&b, "\t", f.Code, f.SourceMap); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func disassemble(b *strings.Builder, indent string, ins []byte, m code.SourceMap) error {
+	for ip := 0; ip < len(ins); {
+		op, arg, next, err := code.Decode(ins, ip)
+		if err != nil {
+			return fmt.Errorf("prc: %w", err)
+		}
+		fmt.Fprintf(b, "%s%04d %-16s", indent, ip, op)
+		if op.Packed() {
+			x, y := code.Unpack(arg)
+			fmt.Fprintf(b, " %d %d", x, y)
+		} else if op.HasArg() {
+			fmt.Fprintf(b, " %d", arg)
+		}
+		if pos, ok := m.Lookup(ip); ok {
+			fmt.Fprintf(b, "\t@%d", pos+1)
+		}
+		b.WriteByte('\n')
+		ip = next
+	}
+	return nil
+}
+
+// ErrFormat is returned when decoding data that is not a valid .prc file.
+var ErrFormat = errors.New("prc: invalid format")
+
+// Encode writes f to w.
+func Encode(w io.Writer, f *File) error {
+	e := &encoder{}
+	e.buf = append(e.buf, magic...)
+	e.buf = append(e.buf, Version)
+	e.string(f.Source)
+	e.strings(f.Globals)
+	e.strings(f.Builtins)
+	e.uint(len(f.Constants))
+	for _, c := range f.Constants {
+		if err := e.constant(c); err != nil {
+			return err
+		}
+	}
+	e.code(f.Code, f.SourceMap)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, crc32.ChecksumIEEE(e.buf))
+	_, err := w.Write(e.buf)
+	return err
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(n int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(n))
+}
+
+func (e *encoder) int(n int64) {
+	e.buf = binary.AppendVarint(e.buf, n)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) strings(ss []string) {
+	e.uint(len(ss))
+	for _, s := range ss {
+		e.string(s)
+	}
+}
+
+func (e *encoder) code(ins []byte, m code.SourceMap) {
+	e.string(string(ins))
+	e.uint(len(m))
+	for _, sp := range m {
+		e.uint(sp.Offset)
+		e.uint(sp.Pos)
+	}
+}
+
+func (e *encoder) constant(o object.Object) error {
+	switch o := o.(type) {
+	case *object.NULL:
+		e.buf = append(e.buf, tagNull)
+	case *object.Boolean:
+		if *o {
+			e.buf = append(e.buf, tagTrue)
+		} else {
+			e.buf = append(e.buf, tagFalse)
+		}
+	case *object.Integer:
+		e.buf = append(e.buf, tagInt)
+		e.int(int64(*o))
+	case *object.String:
+		e.buf = append(e.buf, tagString)
+		e.string(string(*o))
+	case *object.Error:
+		e.buf = append(e.buf, tagError)
+		e.string(string(*o))
+	case *object.List:
+		e.buf = append(e.buf, tagList)
+		e.uint(len(*o))
+		for _, x := range *o {
+			if err := e.constant(x); err != nil {
+				return err
+			}
+		}
+	case *object.Glob:
+		e.buf = append(e.buf, tagGlob)
+		e.string(o.Pattern())
+	case *object.FunctionCompiled:
+		e.buf = append(e.buf, tagFunction)
+		e.buf = append(e.buf, byte(o.ParamsCnt))
+		e.uint(o.LocalCnt)
+		e.code(o.Instructions, o.SourceMap)
+	default:
+		return fmt.Errorf("prc: cannot encode %s constant", o.Type())
+	}
+	return nil
+}
+
+// Decode reads a File from data.
+func Decode(data []byte) (*File, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) || len(data) <= len(magic) {
+		return nil, ErrFormat
+	}
+	if v := data[len(magic)]; v != Version {
+		return nil, fmt.Errorf("prc: unsupported version %d", v)
+	}
+	n := len(data) - crc32.Size
+	if n <= len(magic) || crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, fmt.Errorf("prc: checksum mismatch")
+	}
+	d := &decoder{buf: data[len(magic)+1 : n]}
+	f := &File{}
+	f.Source = d.string()
+	f.Globals = d.strings()
+	f.Builtins = d.strings()
+	k := d.uint()
+	for i := 0; i < k && d.err == nil; i++ {
+		f.Constants = append(f.Constants, d.constant())
+	}
+	f.Code, f.SourceMap = d.code()
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = ErrFormat
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := f.verify(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// decoder reads from buf, recording the first error in err; reads after
+// an error return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail(ErrFormat)
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint() int {
+	n, l := binary.Uvarint(d.buf)
+	if l <= 0 || n > math.MaxInt32 {
+		d.fail(ErrFormat)
+		return 0
+	}
+	d.buf = d.buf[l:]
+	return int(n)
+}
+
+func (d *decoder) int() int64 {
+	n, l := binary.Varint(d.buf)
+	if l <= 0 {
+		d.fail(ErrFormat)
+		return 0
+	}
+	d.buf = d.buf[l:]
+	return n
+}
+
+func (d *decoder) string() string {
+	n := d.uint()
+	if n > len(d.buf) {
+		d.fail(ErrFormat)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) strings() []string {
+	var ss []string
+	n := d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		ss = append(ss, d.string())
+	}
+	return ss
+}
+
+func (d *decoder) code() ([]byte, code.SourceMap) {
+	ins := []byte(d.string())
+	var m code.SourceMap
+	n := d.uint()
+	for i := 0; i < n && d.err == nil; i++ {
+		m = append(m, code.SourcePos{Offset: d.uint(), Pos: d.uint()})
+	}
+	return ins, m
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagNull:
+		return object.NULLObj
+	case tagTrue:
+		return object.TRUEObj
+	case tagFalse:
+		return object.FALSEObj
+	case tagInt:
+		return object.NewInteger(d.int())
+	case tagString:
+		return object.NewString(d.string())
+	case tagError:
+		return object.NewError("%s", d.string())
+	case tagList:
+		n := d.uint()
+		l := make(object.List, 0, min(n, len(d.buf)))
+		for i := 0; i < n && d.err == nil; i++ {
+			l = append(l, d.constant())
+		}
+		return &l
+	case tagGlob:
+		g := object.NewGlob(d.string())
+		if e, ok := g.(*object.Error); ok {
+			d.fail(fmt.Errorf("prc: %s", string(*e)))
+		}
+		return g
+	case tagFunction:
+		fn := &object.FunctionCompiled{ParamsCnt: int8(d.byte()), LocalCnt: d.uint()}
+		fn.Instructions, fn.SourceMap = d.code()
+		return fn
+	default:
+		d.fail(fmt.Errorf("prc: unknown constant tag %d", tag))
+		return object.NULLObj
+	}
+}
+
+// verify checks that the top-level code of f and the code of its
+// functions only refer to the constants, globals, builtins and locals
+// there are, and never pop more values than they pushed. The code has no
+// jumps, so following the instructions in order follows every path.
+func (f *File) verify() error {
+	if len(f.Globals) > vm.GlobalSize {
+		return fmt.Errorf("prc: %d globals, at most %d are supported", len(f.Globals), vm.GlobalSize)
+	}
+	if err := f.verifyCode(f.Code, 0, false); err != nil {
+		return fmt.Errorf("prc: top-level code: %w", err)
+	}
+	var verifyConst func(o object.Object) error
+	verifyConst = func(o object.Object) error {
+		switch o := o.(type) {
+		case *object.List:
+			for _, x := range *o {
+				if err := verifyConst(x); err != nil {
+					return err
+				}
+			}
+		case *object.FunctionCompiled:
+			if o.ParamsCnt < 0 || int(o.ParamsCnt) > o.LocalCnt {
+				return fmt.Errorf("function with %d params and %d locals", o.ParamsCnt, o.LocalCnt)
+			}
+			return f.verifyCode(o.Instructions, o.LocalCnt, true)
+		}
+		return nil
+	}
+	for i, c := range f.Constants {
+		if err := verifyConst(c); err != nil {
+			return fmt.Errorf("prc: constant %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// verifyCode checks the instructions ins of a function with the given
+// number of locals, or of the top-level code if fn is false, see verify.
+func (f *File) verifyCode(ins []byte, locals int, fn bool) error {
+	depth := 0
+	for ip := 0; ip < len(ins); {
+		op, arg, next, err := code.Decode(ins, ip)
+		if err != nil {
+			return err
+		}
+		x, y := code.Unpack(arg)
+		var bad bool
+		switch op {
+		case code.OpConstant:
+			bad = arg >= len(f.Constants)
+		case code.OpGetAttr:
+			bad = arg >= len(f.Constants) || f.Constants[arg].Type() != object.StringType
+		case code.OpClosure:
+			bad = y >= len(f.Constants) || f.Constants[y].Type() != object.FunctionCompiledType
+		case code.OpGetGlobal, code.OpSetGlobal:
+			bad = arg >= len(f.Globals)
+		case code.OpCallGlobal:
+			bad = y >= len(f.Globals)
+		case code.OpGetBuiltin:
+			bad = arg >= len(f.Builtins)
+		case code.OpGetLocal, code.OpSetLocal:
+			bad = arg >= locals
+		case code.OpGetLocal2:
+			bad = x >= locals || y >= locals
+		case code.OpAddLocalConst:
+			bad = x >= locals || y >= len(f.Constants)
+		case code.OpReturnValue, code.OpCurrentClosure:
+			// The top-level code has no frame to return from, nor a
+			// function running.
+			if !fn {
+				return fmt.Errorf("%s at %d outside a function", op, ip)
+			}
+		}
+		if bad {
+			return fmt.Errorf("invalid argument of %s at %d", op, ip)
+		}
+		pop, push, ok := stackEffect(op, arg)
+		if !ok {
+			return fmt.Errorf("invalid op code %d at %d", byte(op), ip)
+		}
+		if depth < pop {
+			return fmt.Errorf("%s at %d pops %d values of %d", op, ip, pop, depth)
+		}
+		depth += push - pop
+		ip = next
+	}
+	return nil
+}
+
+// stackEffect returns the number of values the instruction op with the
+// argument arg pops off the VM's stack and pushes, or false if op is not
+// an instruction.
+func stackEffect(op code.OpCode, arg int) (pop, push int, ok bool) {
+	x, _ := code.Unpack(arg)
+	switch op {
+	case code.OpPop, code.OpSetGlobal, code.OpSetLocal:
+		return 1, 0, true
+	case code.OpReturnValue:
+		return 1, 1, true
+	case code.OpTrue, code.OpFalse, code.OpCurrentClosure, code.OpConstant,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree,
+		code.OpAddLocalConst:
+		return 0, 1, true
+	case code.OpGetLocal2:
+		return 0, 2, true
+	case code.OpBang, code.OpMinus, code.OpGetAttr:
+		return 1, 1, true
+	case code.OpAnd, code.OpOr, code.OpIndex, code.OpMatch,
+		code.OpCmpEQ, code.OpCmpNE, code.OpCmpLT, code.OpCmpLE, code.OpCmpGT, code.OpCmpGE,
+		code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpAddInt, code.OpSubInt, code.OpMulInt,
+		code.OpCmpEQInt, code.OpCmpNEInt, code.OpCmpLTInt, code.OpCmpLEInt, code.OpCmpGTInt, code.OpCmpGEInt:
+		return 2, 1, true
+	case code.OpList:
+		return arg, 1, true
+	case code.OpClosure, code.OpCallGlobal:
+		return x, 1, true
+	case code.OpCall, code.OpTailCall:
+		// The function, on top of its arguments.
+		return arg + 1, 1, true
+	}
+	return 0, 0, false
+}
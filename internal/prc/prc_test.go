@@ -0,0 +1,257 @@
+package prc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/ssa"
+	"parrot/internal/vm"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compileSource compiles src as the parrot command does.
+func compileSource(t testing.TB, src string, opt, useSSA bool) (*File, error) {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	c := compile.New()
+	if !opt {
+		c.Passes = nil
+	}
+	var err error
+	if useSSA {
+		err = ssa.Compile(prog, c, opt)
+	} else {
+		err = c.Compile(prog)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(c, "test.pr"), nil
+}
+
+func encode(t testing.TB, f *File) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Encode(&b, f); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// run runs f on a new VM for at most a million steps, reporting a panic
+// as an error.
+func run(f *File) (res object.Object, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	machine := vm.New()
+	machine.SetBudget(object.NewBudget(context.Background(), object.Limits{MaxSteps: 1e6}))
+	machine.Next(&f.Constants, f.Code)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	fn := &object.FunctionCompiled{
+		Instructions: code.Append(code.Append(nil, code.OpGetLocal, 0), code.OpReturnValue, 0),
+		ParamsCnt:    1,
+		LocalCnt:     2,
+		SourceMap:    code.SourceMap{{Offset: 0, Pos: 3}},
+	}
+	inner := object.NewList(object.NewInteger(-1), object.NewString(""))
+	f := &File{
+		Source:   "all.pr",
+		Globals:  []string{"a", "b"},
+		Builtins: []string{"len"},
+		Constants: []object.Object{
+			object.NULLObj,
+			object.TRUEObj,
+			object.FALSEObj,
+			object.NewInteger(1 << 40),
+			object.NewString("héllo\x00"),
+			object.NewError("boom"),
+			object.NewList(object.NewInteger(1), inner, fn),
+			object.NewGlob("*.{go,pr}"),
+			fn,
+		},
+		Code:      code.Append(code.Append(nil, code.OpConstant, 8), code.OpPop, 0),
+		SourceMap: code.SourceMap{{Offset: 0, Pos: 0}, {Offset: 2, Pos: 7}},
+	}
+	g, err := Decode(encode(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Source != f.Source || !reflect.DeepEqual(g.Globals, f.Globals) ||
+		!reflect.DeepEqual(g.Builtins, f.Builtins) || !bytes.Equal(g.Code, f.Code) ||
+		!reflect.DeepEqual(g.SourceMap, f.SourceMap) {
+		t.Errorf("decoded %+v, want %+v", g, f)
+	}
+	if len(g.Constants) != len(f.Constants) {
+		t.Fatalf("%d constants, want %d", len(g.Constants), len(f.Constants))
+	}
+	for i, c := range f.Constants {
+		if got := g.Constants[i]; got.Type() != c.Type() || got.String() != c.String() {
+			t.Errorf("constant %d = %s %s, want %s %s", i, got.Type(), got, c.Type(), c)
+		}
+	}
+	// The function nested in the list is decoded with its code.
+	nested := (*g.Constants[6].(*object.List))[2].(*object.FunctionCompiled)
+	if !reflect.DeepEqual(nested, fn) {
+		t.Errorf("nested function = %+v, want %+v", nested, fn)
+	}
+	if m := object.MatchGlob(object.NewString("x.pr"), g.Constants[7]); m != object.TRUEObj {
+		t.Errorf("decoded glob doesn't match: %v", m)
+	}
+}
+
+func TestRoundTripCorpus(t *testing.T) {
+	scripts, err := filepath.Glob("../../testdata/conformance/*.pr")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no corpus: %v", err)
+	}
+	stdout := object.Stdout
+	object.Stdout = io.Discard
+	defer func() { object.Stdout = stdout }()
+	for _, script := range scripts {
+		src, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cfg := range []struct{ opt, ssa bool }{{true, false}, {false, false}, {true, true}} {
+			f, err := compileSource(t, string(src), cfg.opt, cfg.ssa)
+			if err != nil {
+				continue // a compile error, covered by the conformance tests
+			}
+			name := fmt.Sprintf("%s opt=%v ssa=%v", filepath.Base(script), cfg.opt, cfg.ssa)
+			g, err := Decode(encode(t, f))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			want, werr := run(f)
+			got, gerr := run(g)
+			if fmt.Sprint(want, werr) != fmt.Sprint(got, gerr) {
+				t.Errorf("%s: decoded file gives %v, %v, want %v, %v", name, got, gerr, want, werr)
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	f, err := compileSource(t, `fn f(a) { a + 1 }; f(2)`, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encode(t, f)
+	// reseal recomputes the checksum of data.
+	reseal := func(data []byte) []byte {
+		n := len(data) - crc32.Size
+		return binary.BigEndian.AppendUint32(data[:n:n], crc32.ChecksumIEEE(data[:n]))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "invalid format"},
+		{"magic", []byte("PRC"), "invalid format"},
+		{"version", append([]byte(magic), 1, 0, 0, 0, 0), "unsupported version 1"},
+		{"truncated", data[:len(data)-1], "checksum mismatch"},
+		{"flipped", append(append([]byte{}, data[:10]...), append([]byte{data[10] ^ 1}, data[11:]...)...), "checksum mismatch"},
+		{"trailing", reseal(append(append([]byte{}, data[:len(data)-crc32.Size]...), 0, 0, 0, 0, 0)), "invalid format"},
+	}
+	for _, tt := range tests {
+		_, err := Decode(tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Decode = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	seq := func(ins ...[]byte) []byte { return bytes.Join(ins, nil) }
+	op := func(op code.OpCode, arg uint32) []byte { return code.Append(nil, op, arg) }
+	verifyTests := []struct {
+		name   string
+		ins    []byte
+		locals int
+		err    string
+	}{
+		{"constant", op(code.OpConstant, 9), 0, "invalid argument of OpConstant"},
+		{"wide constant", op(code.OpConstant, 1<<24), 0, "invalid argument of OpConstant"},
+		{"global", op(code.OpGetGlobal, 5), 0, "invalid argument of OpGetGlobal"},
+		{"builtin", op(code.OpGetBuiltin, 200), 0, "invalid argument of OpGetBuiltin"},
+		{"local", op(code.OpGetLocal, 1), 1, "invalid argument of OpGetLocal"},
+		{"local2", op(code.OpGetLocal2, code.Pack(0, 3)), 1, "invalid argument of OpGetLocal2"},
+		{"attr", op(code.OpGetAttr, 0), 0, "invalid argument of OpGetAttr"},
+		{"closure", op(code.OpClosure, code.Pack(0, 0)), 0, "invalid argument of OpClosure"},
+		{"op code", []byte{0xfe, 0}, 0, "invalid op code 254"},
+		{"underflow", seq(op(code.OpTrue, 0), op(code.OpAdd, 0)), 0, "OpAdd at 1 pops 2 values of 1"},
+		{"call", seq(op(code.OpTrue, 0), op(code.OpCall, 1)), 0, "OpCall at 1 pops 2 values of 1"},
+		{"extended", []byte{byte(code.OpExtendedArg), 1}, 0, "truncated instruction"},
+		{"extended no argument", []byte{byte(code.OpExtendedArg), 1, byte(code.OpTrue)}, 0, "OpTrue at 2 takes no argument"},
+		{"top return", seq(op(code.OpTrue, 0), op(code.OpReturnValue, 0)), 0, "OpReturnValue at 1 outside a function"},
+		{"top closure", op(code.OpCurrentClosure, 0), 0, "OpCurrentClosure at 0 outside a function"},
+	}
+	for _, tt := range verifyTests {
+		g := &File{
+			Globals:   []string{"x"},
+			Builtins:  []string{"len"},
+			Constants: []object.Object{object.NewInteger(1)},
+			Code:      tt.ins,
+		}
+		if tt.locals > 0 {
+			g.Constants = append(g.Constants, &object.FunctionCompiled{Instructions: tt.ins, LocalCnt: tt.locals})
+			g.Code = nil
+		}
+		_, err := Decode(encode(t, g))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Decode = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestCorrupt checks that a corrupt file fails to decode, or runs without
+// crashing the VM, even with a valid checksum.
+func TestCorrupt(t *testing.T) {
+	f, err := compileSource(t, `fn adder(n) { fn(m) { n + m } }
+fn twice(f, x) { f(f(x)) }
+xs = [1, "a", twice(adder(2), 3)]; len(xs) + xs[2] - 1`, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encode(t, f)
+	n := len(data) - crc32.Size
+	r := rand.New(rand.NewSource(1))
+	for range 2000 {
+		b := append([]byte{}, data...)
+		for range 1 + r.Intn(3) {
+			b[len(magic)+1+r.Intn(n-len(magic)-1)] ^= byte(1 + r.Intn(255))
+		}
+		b = binary.BigEndian.AppendUint32(b[:n], crc32.ChecksumIEEE(b[:n]))
+		g, err := Decode(b)
+		if err != nil {
+			continue
+		}
+		if _, err := run(g); err != nil && strings.HasPrefix(err.Error(), "panic") {
+			t.Fatalf("%v running\n%x", err, b)
+		}
+	}
+}
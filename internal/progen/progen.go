@@ -0,0 +1,299 @@
+// Package progen generates random programs from the grammar of the
+// language, to fuzz the parser and compare the back ends.
+//
+// The programs are well typed, so they run without errors on every back
+// end: divisors are nonzero literals, list indexes are in range, names are
+// assigned once, and functions are defined at the top level and call only
+// those defined before them, which rules out closures and recursion.
+package progen
+
+import (
+	"fmt"
+	"parrot/internal/parser"
+	"strconv"
+	"strings"
+)
+
+// A Type is the type of an expression.
+type Type int
+
+const (
+	Int Type = iota
+	Str
+	Bool
+	List // a list of ints
+	numTypes
+)
+
+const (
+	maxDepth  = 4 // the depth of expressions
+	maxStmts  = 8 // the statements of a body, besides its result
+	maxFuncs  = 4
+	maxParams = 3
+	maxList   = 4
+)
+
+// Program returns the source of a program made by the decisions read from
+// data, one byte each. Once data is exhausted, every decision takes the
+// first choice, which ends the program soon.
+func Program(data []byte) string {
+	g := &generator{data: data}
+	return g.body(true)
+}
+
+type function struct {
+	name   string
+	params []Type
+	result Type
+}
+
+type generator struct {
+	data  []byte
+	names int
+	vars  [numTypes][]string // the variables in scope, by type
+	funcs []function
+}
+
+// choose returns a choice among n.
+func (g *generator) choose(n int) int {
+	if len(g.data) == 0 || n <= 1 {
+		return 0
+	}
+	b := g.data[0]
+	g.data = g.data[1:]
+	return int(b) % n
+}
+
+func (g *generator) name(prefix string) string {
+	g.names++
+	return prefix + strconv.Itoa(g.names)
+}
+
+// body returns statements ending with an expression, their result.
+func (g *generator) body(top bool) string {
+	var b strings.Builder
+	for n := g.choose(maxStmts + 1); n > 0; n-- {
+		b.WriteString(g.stmt(top))
+		// Statements are separated by semicolons: a newline doesn't end an
+		// expression.
+		b.WriteString([]string{"; ", ";\n"}[g.choose(2)])
+	}
+	e, _ := g.expr(Type(g.choose(int(numTypes))), 0)
+	b.WriteString(e)
+	return b.String()
+}
+
+func (g *generator) stmt(top bool) string {
+	switch g.choose(4) {
+	case 1:
+		e, _ := g.expr(Type(g.choose(int(numTypes))), 0)
+		return "print(" + e + ")"
+	case 2:
+		if top && len(g.funcs) < maxFuncs {
+			return g.function()
+		}
+	case 3:
+		e, _ := g.expr(Type(g.choose(int(numTypes))), 0)
+		return e
+	}
+	t := Type(g.choose(int(numTypes)))
+	e, _ := g.expr(t, 0)
+	name := g.name("v")
+	g.vars[t] = append(g.vars[t], name)
+	return name + " = " + e
+}
+
+// function returns the definition of a new function, which sees the
+// globals defined so far.
+func (g *generator) function() string {
+	f := function{name: g.name("f"), result: Type(g.choose(int(numTypes)))}
+	globals := g.vars
+	var params []string
+	for n := g.choose(maxParams + 1); n > 0; n-- {
+		t := Type(g.choose(int(numTypes)))
+		p := g.name("p")
+		f.params = append(f.params, t)
+		params = append(params, p)
+		g.vars[t] = append(g.vars[t][:len(g.vars[t]):len(g.vars[t])], p)
+	}
+	var b strings.Builder
+	for n := g.choose(3); n > 0; n-- {
+		b.WriteString(g.stmt(false))
+		b.WriteString("; ")
+	}
+	e, _ := g.expr(f.result, 0)
+	b.WriteString(e)
+	g.vars = globals
+	g.funcs = append(g.funcs, f)
+	return fmt.Sprintf("fn %s(%s) { %s }", f.name, strings.Join(params, ", "), b.String())
+}
+
+// expr returns an expression of type t and the binding power of its
+// operator, parenthesized where needed like the parser's String methods do.
+func (g *generator) expr(t Type, depth int) (string, int) {
+	if depth >= maxDepth {
+		return g.leaf(t, depth)
+	}
+	depth++
+	switch t {
+	case Int:
+		switch g.choose(8) {
+		case 1:
+			op := []string{"+", "-", "*"}[g.choose(3)]
+			return g.binary(Int, op, Int, depth)
+		case 2:
+			l, lp := g.expr(Int, depth)
+			op := []string{"/", "%"}[g.choose(2)]
+			return binary(l, lp, op, strconv.Itoa(1+g.choose(9)), parser.CallBP)
+		case 3:
+			e, p := g.expr(Int, depth)
+			return "-" + operand(e, p, parser.PrefixBP), parser.PrefixBP
+		case 4:
+			e, _ := g.expr(Str, depth)
+			return "len(" + e + ")", parser.CallBP
+		case 5:
+			e, _ := g.expr(List, depth)
+			return "len(" + e + ")", parser.CallBP
+		case 6:
+			return g.call(Int, depth)
+		case 7:
+			l, n := g.list(depth)
+			return l + "[" + strconv.Itoa(g.choose(n)) + "]", parser.CallBP
+		}
+	case Str:
+		switch g.choose(3) {
+		case 1:
+			return g.binary(Str, "+", Str, depth)
+		case 2:
+			return g.call(Str, depth)
+		}
+	case Bool:
+		switch g.choose(6) {
+		case 1:
+			operands := Type(g.choose(int(Bool) + 1))
+			ops := []string{"==", "!=", "<", "<=", ">", ">="}
+			if operands == Bool {
+				// Booleans aren't ordered.
+				ops = ops[:2]
+			}
+			return g.binary(operands, ops[g.choose(len(ops))], operands, depth)
+		case 2:
+			return g.binary(Bool, []string{"and", "or"}[g.choose(2)], Bool, depth)
+		case 3:
+			e, p := g.expr(Bool, depth)
+			return "!" + operand(e, p, parser.PrefixBP), parser.PrefixBP
+		case 4:
+			l, lp := g.expr(Str, depth)
+			patterns := []string{"*", "a*", "*b", "?", "??*", "*a*"}
+			return binary(l, lp, "~", `"`+patterns[g.choose(len(patterns))]+`"`, parser.CallBP)
+		case 5:
+			return g.call(Bool, depth)
+		}
+	case List:
+		if g.choose(2) == 1 {
+			return g.call(List, depth)
+		}
+	}
+	return g.leaf(t, depth)
+}
+
+// binary returns an expression applying op to operands of type lt and rt.
+func (g *generator) binary(lt Type, op string, rt Type, depth int) (string, int) {
+	l, lp := g.expr(lt, depth)
+	r, rp := g.expr(rt, depth)
+	return binary(l, lp, op, r, rp)
+}
+
+func binary(l string, lp int, op string, r string, rp int) (string, int) {
+	bp := precedence[op]
+	return operand(l, lp, bp) + " " + op + " " + operand(r, rp, bp+1), bp
+}
+
+var precedence = map[string]int{
+	"or":  parser.OrBP,
+	"and": parser.AndBP,
+	"==":  parser.EqualsBP,
+	"!=":  parser.EqualsBP,
+	"~":   parser.EqualsBP,
+	"<":   parser.LessGreaterBP,
+	"<=":  parser.LessGreaterBP,
+	">":   parser.LessGreaterBP,
+	">=":  parser.LessGreaterBP,
+	"+":   parser.SumBP,
+	"-":   parser.SumBP,
+	"*":   parser.ProductBP,
+	"/":   parser.ProductBP,
+	"%":   parser.ModuloBP,
+}
+
+// operand returns e, of binding power p, as the operand of an operator
+// taking operands binding at least as tightly as bp.
+func operand(e string, p, bp int) string {
+	if p < bp {
+		return "(" + e + ")"
+	}
+	return e
+}
+
+// call returns a call of a function returning t, or a leaf if there is
+// none.
+func (g *generator) call(t Type, depth int) (string, int) {
+	var fns []function
+	for _, f := range g.funcs {
+		if f.result == t {
+			fns = append(fns, f)
+		}
+	}
+	if len(fns) == 0 {
+		return g.leaf(t, depth)
+	}
+	f := fns[g.choose(len(fns))]
+	var args []string
+	for _, p := range f.params {
+		a, _ := g.expr(p, depth)
+		args = append(args, a)
+	}
+	return f.name + "(" + strings.Join(args, ", ") + ")", parser.CallBP
+}
+
+// list returns a list literal and its length, which is at least one.
+func (g *generator) list(depth int) (string, int) {
+	n := 1 + g.choose(maxList)
+	var elems []string
+	for i := 0; i < n; i++ {
+		e, _ := g.expr(Int, depth)
+		elems = append(elems, e)
+	}
+	return "[" + strings.Join(elems, ", ") + "]", n
+}
+
+// leaf returns a literal or a variable of type t.
+func (g *generator) leaf(t Type, depth int) (string, int) {
+	vars := g.vars[t]
+	if i := g.choose(len(vars) + 1); i > 0 {
+		return vars[i-1], parser.CallBP
+	}
+	switch t {
+	case Int:
+		if g.choose(16) == 15 {
+			return "9223372036854775807", parser.CallBP
+		}
+		return strconv.Itoa(g.choose(100)), parser.CallBP
+	case Str:
+		var s strings.Builder
+		for n := g.choose(4); n > 0; n-- {
+			s.WriteByte("ab '"[g.choose(4)])
+		}
+		if g.choose(2) == 1 && !strings.Contains(s.String(), "'") {
+			return "'" + s.String() + "'", parser.CallBP
+		}
+		return `"` + s.String() + `"`, parser.CallBP
+	case Bool:
+		return []string{"false", "true"}[g.choose(2)], parser.CallBP
+	}
+	if depth >= maxDepth || g.choose(2) == 0 {
+		return "[]", parser.CallBP
+	}
+	l, _ := g.list(maxDepth)
+	return l, parser.CallBP
+}
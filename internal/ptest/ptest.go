@@ -0,0 +1,165 @@
+// Package ptest runs tests written in Parrot.
+//
+// A test file, NAME_test.pr, defines test functions taking no arguments,
+// whose names start with test_. A test fails if calling its function
+// raises an error, typically with the assert and assert_eq builtins.
+//
+// Each test runs in a fresh interpreter: the top level of the file runs
+// again before the test function is called, so tests don't see the
+// globals set by the others.
+package ptest
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"parrot"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config configures how tests run.
+type Config struct {
+	Options []parrot.Option // compile the tests with these options
+	Timeout time.Duration   // stop each test after this long, if not 0
+	Match   *regexp.Regexp  // run only the tests whose names match, if not nil
+}
+
+// A Result is the outcome of a test.
+type Result struct {
+	File     string
+	Name     string
+	Err      error  // why the test failed, nil if it passed
+	Output   string // what the test printed
+	Duration time.Duration
+}
+
+// Passed reports whether the test passed.
+func (r *Result) Passed() bool {
+	return r.Err == nil
+}
+
+// Files returns the test files among paths, and those found in the
+// directories among them and their subdirectories, sorted in each
+// directory.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(name, "_test.pr") {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Tests returns the names of the test functions defined at the top level
+// of prog, by a named function or an assignment.
+func Tests(prog *parser.Program) []string {
+	var names []string
+	for _, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		var name string
+		switch e := s.E.(type) {
+		case *parser.Function:
+			name = e.Name
+		case *parser.Assign:
+			if _, ok := e.Right.(*parser.Function); ok {
+				if id, ok := e.Left.(*parser.Ident); ok {
+					name = id.Name
+				}
+			}
+		}
+		if strings.HasPrefix(name, "test_") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RunFile runs the tests of the file name, returning an error if it can't
+// be read or parsed.
+func RunFile(ctx context.Context, name string, cfg Config) ([]Result, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	prog, errs := parser.Parse(string(src))
+	if len(errs) > 0 {
+		return nil, &FileError{File: name, Err: errs[0]}
+	}
+	var results []Result
+	for _, test := range Tests(prog) {
+		if cfg.Match != nil && !cfg.Match.MatchString(test) {
+			continue
+		}
+		results = append(results, run(ctx, name, string(src), test, cfg))
+	}
+	return results, nil
+}
+
+// A FileError is an error in a test file.
+type FileError struct {
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.File + ":" + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// run runs the test function test of the file name, whose source is src.
+func run(ctx context.Context, name, src, test string, cfg Config) (r Result) {
+	r = Result{File: name, Name: test}
+	var out bytes.Buffer
+	stdout := object.Stdout
+	object.Stdout = &out
+	defer func() { object.Stdout = stdout }()
+	start := time.Now()
+	defer func() {
+		r.Duration = time.Since(start)
+		r.Output = out.String()
+	}()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	// The call is a statement of its own after the file: an identifier
+	// doesn't continue an expression, and the positions in the file stay
+	// the same.
+	prog, err := parrot.Compile(src+"\n"+test+"()", cfg.Options...)
+	if err == nil {
+		_, err = parrot.Run(ctx, prog, nil)
+	}
+	r.Err = err
+	return
+}
@@ -0,0 +1,91 @@
+package ptest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"parrot"
+	"regexp"
+	"testing"
+)
+
+const sample = "testdata/sample_test.pr"
+
+func TestRunFile(t *testing.T) {
+	want := map[string]string{
+		"test_double":   "",
+		"test_isolated": "",
+		"test_fresh":    "",
+		"test_lists":    "",
+		"test_fails":    "assert_eq failed: double(2): got 4, want 5",
+		"test_lines":    "assert_eq failed (-want +got):\n  a\n- c\n+ b",
+	}
+	for _, b := range []parrot.Backend{parrot.Eval, parrot.VM} {
+		results, err := RunFile(context.Background(), sample, Config{
+			Options: []parrot.Option{parrot.WithBackend(b), parrot.WithCapabilities(parrot.CapAll)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(want) {
+			t.Errorf("%s: got %d results, want %d", b, len(results), len(want))
+		}
+		for _, r := range results {
+			var msg string
+			if r.Err != nil {
+				msg = r.Err.Error()
+			}
+			if w, ok := want[r.Name]; !ok || msg != w {
+				t.Errorf("%s: %s: got error %q, want %q", b, r.Name, msg, w)
+			}
+		}
+		if r := results[3]; r.Output != "comparing lists\n" {
+			t.Errorf("%s: %s printed %q", b, r.Name, r.Output)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	results, err := RunFile(context.Background(), sample, Config{
+		Options: []parrot.Option{parrot.WithCapabilities(parrot.CapAll)},
+		Match:   regexp.MustCompile("fresh|isolated"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Passed() || !results[1].Passed() {
+		t.Errorf("got %+v, want test_isolated and test_fresh passing", results)
+	}
+}
+
+func TestReports(t *testing.T) {
+	results, err := RunFile(context.Background(), sample, Config{
+		Options: []parrot.Option{parrot.WithCapabilities(parrot.CapAll)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var js []jsonResult
+	if err := json.Unmarshal(buf.Bytes(), &js); err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != len(results) || js[4].Passed || js[4].Output != "before\n" {
+		t.Errorf("JSON report: %s", buf.Bytes())
+	}
+	buf.Reset()
+	if err := WriteJUnit(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var ju junitSuites
+	if err := xml.Unmarshal(buf.Bytes(), &ju); err != nil {
+		t.Fatal(err)
+	}
+	if len(ju.Suites) != 1 || ju.Suites[0].Tests != 6 || ju.Suites[0].Failures != 2 {
+		t.Errorf("JUnit report: %s", buf.Bytes())
+	}
+}
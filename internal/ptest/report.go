@@ -0,0 +1,111 @@
+package ptest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// jsonResult is a Result in the JSON report.
+type jsonResult struct {
+	File    string  `json:"file"`
+	Name    string  `json:"name"`
+	Passed  bool    `json:"passed"`
+	Error   string  `json:"error,omitempty"`
+	Output  string  `json:"output,omitempty"`
+	Elapsed float64 `json:"elapsed"` // in seconds
+}
+
+// WriteJSON writes results to w as a JSON array.
+func WriteJSON(w io.Writer, results []Result) error {
+	out := make([]jsonResult, 0, len(results))
+	for _, r := range results {
+		jr := jsonResult{
+			File:    r.File,
+			Name:    r.Name,
+			Passed:  r.Passed(),
+			Output:  r.Output,
+			Elapsed: r.Duration.Round(time.Microsecond).Seconds(),
+		}
+		if r.Err != nil {
+			jr.Error = r.Err.Error()
+		}
+		out = append(out, jr)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(out)
+}
+
+// The JUnit XML format, as read by CI servers: a suite per file.
+type (
+	junitSuites struct {
+		XMLName xml.Name     `xml:"testsuites"`
+		Suites  []junitSuite `xml:"testsuite"`
+	}
+	junitSuite struct {
+		Name     string      `xml:"name,attr"`
+		Tests    int         `xml:"tests,attr"`
+		Failures int         `xml:"failures,attr"`
+		Time     string      `xml:"time,attr"` // in seconds
+		Cases    []junitCase `xml:"testcase"`
+	}
+	junitCase struct {
+		Name      string        `xml:"name,attr"`
+		Classname string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitFailure `xml:"failure"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+	junitFailure struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// WriteJUnit writes results to w as a JUnit XML report.
+func WriteJUnit(w io.Writer, results []Result) error {
+	var suites junitSuites
+	var times []time.Duration // of the suites
+	for _, r := range results {
+		if n := len(suites.Suites); n == 0 || suites.Suites[n-1].Name != r.File {
+			suites.Suites = append(suites.Suites, junitSuite{Name: r.File})
+			times = append(times, 0)
+		}
+		s := &suites.Suites[len(suites.Suites)-1]
+		times[len(times)-1] += r.Duration
+		c := junitCase{
+			Name:      r.Name,
+			Classname: r.File,
+			Time:      seconds(r.Duration),
+			SystemOut: r.Output,
+		}
+		if r.Err != nil {
+			msg, _, _ := strings.Cut(r.Err.Error(), "\n")
+			c.Failure = &junitFailure{Message: msg, Text: r.Err.Error()}
+			s.Failures++
+		}
+		s.Tests++
+		s.Cases = append(s.Cases, c)
+	}
+	for i, t := range times {
+		suites.Suites[i].Time = seconds(t)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
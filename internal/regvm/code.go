@@ -0,0 +1,184 @@
+// Package regvm is an experimental register-based virtual machine, with a
+// code generator from the parser's AST.
+//
+// Like Lua's, its instructions are three-address words operating on the
+// registers of the current call frame, where a function keeps its
+// parameters and locals, so that an expression such as a + b compiles to a
+// single instruction instead of three pushes and a pop.
+package regvm
+
+import (
+	"fmt"
+	"parrot/internal/object"
+	"strings"
+)
+
+// Op is an operation code.
+type Op byte
+
+const (
+	OpMove       Op = iota // R[A] = R[B]
+	OpLoadK                // R[A] = K[Bx]
+	OpLoadTrue             // R[A] = true
+	OpLoadFalse            // R[A] = false
+	OpLoadNull             // R[A] = null
+	OpGetGlobal            // R[A] = G[Bx]
+	OpSetGlobal            // G[Bx] = R[A]
+	OpGetBuiltin           // R[A] = builtin Bx
+	OpSelf                 // R[A] = the running function
+
+	OpAdd   // R[A] = R[B] + R[C]
+	OpSub   // R[A] = R[B] - R[C]
+	OpMul   // R[A] = R[B] * R[C]
+	OpDiv   // R[A] = R[B] / R[C]
+	OpMod   // R[A] = R[B] % R[C]
+	OpEQ    // R[A] = R[B] == R[C]
+	OpNE    // R[A] = R[B] != R[C]
+	OpLT    // R[A] = R[B] < R[C]
+	OpLE    // R[A] = R[B] <= R[C]
+	OpGT    // R[A] = R[B] > R[C]
+	OpGE    // R[A] = R[B] >= R[C]
+	OpAnd   // R[A] = R[B] and R[C]
+	OpOr    // R[A] = R[B] or R[C]
+	OpMatch // R[A] = R[B] ~ R[C]
+
+	OpNot     // R[A] = !R[B]
+	OpNeg     // R[A] = -R[B]
+	OpIndex   // R[A] = R[B][R[C]]
+	OpGetAttr // R[A] = R[B].(R[C])
+	OpList    // R[A] = [R[B], ..., R[B+C-1]]
+
+	OpCall     // R[A] = R[B](R[B+1], ..., R[B+C])
+	OpTailCall // return R[B](R[B+1], ..., R[B+C])
+	OpReturn   // return R[A]
+)
+
+var opNames = [...]string{
+	OpMove:       "MOVE",
+	OpLoadK:      "LOADK",
+	OpLoadTrue:   "LOADTRUE",
+	OpLoadFalse:  "LOADFALSE",
+	OpLoadNull:   "LOADNULL",
+	OpGetGlobal:  "GETGLOBAL",
+	OpSetGlobal:  "SETGLOBAL",
+	OpGetBuiltin: "GETBUILTIN",
+	OpSelf:       "SELF",
+	OpAdd:        "ADD",
+	OpSub:        "SUB",
+	OpMul:        "MUL",
+	OpDiv:        "DIV",
+	OpMod:        "MOD",
+	OpEQ:         "EQ",
+	OpNE:         "NE",
+	OpLT:         "LT",
+	OpLE:         "LE",
+	OpGT:         "GT",
+	OpGE:         "GE",
+	OpAnd:        "AND",
+	OpOr:         "OR",
+	OpMatch:      "MATCH",
+	OpNot:        "NOT",
+	OpNeg:        "NEG",
+	OpIndex:      "INDEX",
+	OpGetAttr:    "GETATTR",
+	OpList:       "LIST",
+	OpCall:       "CALL",
+	OpTailCall:   "TAILCALL",
+	OpReturn:     "RETURN",
+}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Op(%d)", byte(op))
+}
+
+// usesBx reports whether op takes a 16 bit Bx operand instead of B and C.
+func (op Op) usesBx() bool {
+	switch op {
+	case OpLoadK, OpGetGlobal, OpSetGlobal, OpGetBuiltin:
+		return true
+	}
+	return false
+}
+
+// Instr is an instruction: an op code and the operands A, B and C of a
+// byte each, or A and Bx of two bytes.
+type Instr uint32
+
+const maxArg = 1<<8 - 1
+const maxArgBx = 1<<16 - 1
+
+func iABC(op Op, a, b, c int) Instr {
+	return Instr(op) | Instr(a)<<8 | Instr(b)<<16 | Instr(c)<<24
+}
+
+func iABx(op Op, a, bx int) Instr {
+	return Instr(op) | Instr(a)<<8 | Instr(bx)<<16
+}
+
+func (i Instr) Op() Op  { return Op(i) }
+func (i Instr) A() int  { return int(i >> 8 & 0xff) }
+func (i Instr) B() int  { return int(i >> 16 & 0xff) }
+func (i Instr) C() int  { return int(i >> 24) }
+func (i Instr) Bx() int { return int(i >> 16) }
+
+func (i Instr) String() string {
+	if i.Op().usesBx() {
+		return fmt.Sprintf("%-10s %d %d", i.Op(), i.A(), i.Bx())
+	}
+	return fmt.Sprintf("%-10s %d %d %d", i.Op(), i.A(), i.B(), i.C())
+}
+
+// Proto is a compiled function, or the top-level code of a program.
+type Proto struct {
+	Name      string
+	Code      []Instr
+	Consts    []object.Object
+	NumParams int
+	NumRegs   int
+	// Globals names the globals by index, for error messages. It is only
+	// set for top-level code.
+	Globals []string
+}
+
+// Disassemble returns a listing of p and of the functions among its
+// constants.
+func (p *Proto) Disassemble() string {
+	var b strings.Builder
+	p.disassemble(&b)
+	return b.String()
+}
+
+func (p *Proto) disassemble(b *strings.Builder) {
+	name := p.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	fmt.Fprintf(b, "function %s: %d params, %d registers\n", name, p.NumParams, p.NumRegs)
+	for pc, i := range p.Code {
+		fmt.Fprintf(b, "\t%04d %s\n", pc, i)
+	}
+	for i, k := range p.Consts {
+		fmt.Fprintf(b, "\tK%d = %s\n", i, k)
+	}
+	for _, k := range p.Consts {
+		if fn, ok := k.(*Function); ok {
+			fn.Proto.disassemble(b)
+		}
+	}
+}
+
+// Function is a function value of the register VM.
+type Function struct {
+	Proto *Proto
+}
+
+func (fn *Function) Type() object.Type { return object.FunctionCompiledType }
+func (fn *Function) String() string {
+	if fn.Proto.Name == "" {
+		return "<function>"
+	}
+	return fmt.Sprintf("<function %s>", fn.Proto.Name)
+}
@@ -0,0 +1,434 @@
+package regvm
+
+import (
+	"fmt"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/token"
+)
+
+// Compiler generates register code from parsed programs. The globals it
+// defines persist across Compile calls, so that programs can be compiled
+// piecemeal, as in a REPL.
+type Compiler struct {
+	globals map[string]int
+	caps    object.Capability
+	// Externals makes the names a program reads without defining them
+	// globals, which the VM reports if they are unset when read, rather
+	// than compile errors.
+	Externals bool
+}
+
+// NewCompiler returns a compiler for scripts that may only use the builtins
+// enabled by caps.
+func NewCompiler(caps object.Capability) *Compiler {
+	return &Compiler{
+		globals: make(map[string]int),
+		caps:    caps,
+	}
+}
+
+// Global returns the index of the global name, if defined.
+func (c *Compiler) Global(name string) (int, bool) {
+	i, ok := c.globals[name]
+	return i, ok
+}
+
+// DefineGlobal returns the index of the global name, defining it if needed.
+func (c *Compiler) DefineGlobal(name string) int {
+	if i, ok := c.globals[name]; ok {
+		return i
+	}
+	c.globals[name] = len(c.globals)
+	return c.globals[name]
+}
+
+// Compile compiles the top-level code of prog, which returns the value of
+// its last statement. The globals prog assigns are defined up front, so that
+// functions may refer to globals assigned after them.
+func (c *Compiler) Compile(prog *parser.Program) (p *Proto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(compileError)
+			if !ok {
+				panic(r)
+			}
+			p, err = nil, e.err
+		}
+	}()
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*parser.ExprStmt); ok {
+			switch e := s.E.(type) {
+			case *parser.Assign:
+				c.DefineGlobal(e.Left.String())
+			case *parser.Function:
+				if e.Name != "" {
+					c.DefineGlobal(e.Name)
+				}
+			}
+		}
+	}
+	fs := &funcState{c: c, proto: &Proto{}}
+	fs.body(prog)
+	fs.proto.Globals = make([]string, len(c.globals))
+	for name, i := range c.globals {
+		fs.proto.Globals[i] = name
+	}
+	return fs.proto, nil
+}
+
+// compileError carries an error out of the recursive code generation.
+type compileError struct {
+	err error
+}
+
+func fail(format string, a ...any) {
+	panic(compileError{fmt.Errorf(format, a...)})
+}
+
+// funcState is the state of the function being compiled.
+type funcState struct {
+	c      *Compiler
+	parent *funcState
+	proto  *Proto
+	locals map[string]int // registers of the locals, nil for the top level
+	top    int            // first free register
+	consts map[string]int
+}
+
+func (fs *funcState) emit(i Instr) {
+	fs.proto.Code = append(fs.proto.Code, i)
+}
+
+func (fs *funcState) emitABC(op Op, a, b, c int) {
+	fs.emit(iABC(op, a, b, c))
+}
+
+func (fs *funcState) emitABx(op Op, a, bx int) {
+	if bx > maxArgBx {
+		fail("too many constants or globals")
+	}
+	fs.emit(iABx(op, a, bx))
+}
+
+// alloc reserves the next free register.
+func (fs *funcState) alloc() int {
+	r := fs.top
+	fs.top++
+	if fs.top > maxArg {
+		fail("function needs too many registers")
+	}
+	fs.proto.NumRegs = max(fs.proto.NumRegs, fs.top)
+	return r
+}
+
+// constant returns the index of o in the constant pool.
+func (fs *funcState) constant(o object.Object) int {
+	if fs.consts == nil {
+		fs.consts = make(map[string]int)
+	}
+	key := ""
+	if _, ok := o.(*Function); !ok {
+		key = string(o.Type()) + ":" + o.String()
+		if i, ok := fs.consts[key]; ok {
+			return i
+		}
+	}
+	fs.proto.Consts = append(fs.proto.Consts, o)
+	i := len(fs.proto.Consts) - 1
+	if key != "" {
+		fs.consts[key] = i
+	}
+	return i
+}
+
+// body compiles the statements of a program or function body, returning
+// the value of the last one.
+func (fs *funcState) body(prog *parser.Program) {
+	var last parser.Expr
+	for i, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		if i == len(prog.Stmts)-1 {
+			last = s.E
+			break
+		}
+		fs.stmt(s.E)
+	}
+	var r int
+	switch {
+	case last == nil:
+		r = fs.alloc()
+		fs.emitABC(OpLoadNull, r, 0, 0)
+	case fs.binding(last):
+		r = fs.expr(&parser.Ident{Name: boundName(last)})
+	default:
+		r = fs.expr(last)
+	}
+	fs.emitABC(OpReturn, r, 0, 0)
+}
+
+// stmt compiles e, discarding its value.
+func (fs *funcState) stmt(e parser.Expr) {
+	save, n := fs.top, len(fs.locals)
+	if !fs.binding(e) {
+		fs.exprTo(e, fs.alloc())
+	}
+	// Keep the register of a new local.
+	fs.top = save + len(fs.locals) - n
+}
+
+// binding compiles e if it binds a name, an assignment or a named function,
+// and reports whether it did.
+func (fs *funcState) binding(e parser.Expr) bool {
+	switch e := e.(type) {
+	case *parser.Assign:
+		fs.assign(e.Left.String(), func(dst int) { fs.exprTo(e.Right, dst) })
+		return true
+	case *parser.Function:
+		if e.Name != "" {
+			fs.assign(e.Name, func(dst int) { fs.function(e, dst) })
+			return true
+		}
+	}
+	return false
+}
+
+// boundName returns the name bound by an assignment or named function.
+func boundName(e parser.Expr) string {
+	if a, ok := e.(*parser.Assign); ok {
+		return a.Left.String()
+	}
+	return e.(*parser.Function).Name
+}
+
+// assign compiles the assignment of the value load puts in its register to
+// name, which is a global at the top level and a local in functions.
+func (fs *funcState) assign(name string, load func(dst int)) {
+	if fs.locals == nil {
+		r := fs.alloc()
+		load(r)
+		fs.emitABx(OpSetGlobal, r, fs.c.DefineGlobal(name))
+		fs.top--
+		return
+	}
+	if r, ok := fs.locals[name]; ok {
+		load(r)
+		return
+	}
+	if fs.top != len(fs.locals) {
+		// The register would be freed along with the temporaries.
+		fail("cannot define the local %s inside an expression", name)
+	}
+	r := fs.alloc()
+	load(r)
+	fs.locals[name] = r
+}
+
+// expr compiles e and returns the register holding its value: the
+// register of a local, or a new one.
+func (fs *funcState) expr(e parser.Expr) int {
+	if id, ok := e.(*parser.Ident); ok && fs.locals != nil {
+		if r, ok := fs.locals[id.Name]; ok {
+			return r
+		}
+	}
+	r := fs.alloc()
+	fs.exprTo(e, r)
+	return r
+}
+
+// exprTo compiles e with its value going to register dst.
+func (fs *funcState) exprTo(e parser.Expr, dst int) {
+	switch e := e.(type) {
+	case *parser.Integer:
+		fs.emitABx(OpLoadK, dst, fs.constant(object.NewInteger(e.Value)))
+	case *parser.String:
+		fs.emitABx(OpLoadK, dst, fs.constant(object.NewString(e.Literal)))
+	case *parser.Boolean:
+		if e.Value {
+			fs.emitABC(OpLoadTrue, dst, 0, 0)
+		} else {
+			fs.emitABC(OpLoadFalse, dst, 0, 0)
+		}
+	case *parser.Ident:
+		fs.ident(e, dst)
+	case *parser.ListExpr:
+		if len(e.List) > maxArg {
+			fail("%d: list literal has more than %d elements", e.LbrackPos+1, maxArg)
+		}
+		save := fs.top
+		base := fs.top
+		for _, x := range e.List {
+			fs.exprTo(x, fs.alloc())
+		}
+		fs.top = save
+		fs.emitABC(OpList, dst, base, len(e.List))
+	case *parser.PrefixExpr:
+		switch e.TokenType {
+		case token.BANG:
+			fs.unary(OpNot, e.Right, dst)
+		case token.MINUS:
+			fs.unary(OpNeg, e.Right, dst)
+		case token.ADD:
+			fs.exprTo(e.Right, dst)
+		default:
+			fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+		}
+	case *parser.InfixExpr:
+		fs.infix(e, dst)
+	case *parser.IndexExpr:
+		save := fs.top
+		x := fs.expr(e.Left)
+		i := fs.expr(e.Index)
+		fs.top = save
+		fs.emitABC(OpIndex, dst, x, i)
+	case *parser.Selector:
+		save := fs.top
+		x := fs.expr(e.X)
+		k := fs.alloc()
+		fs.emitABx(OpLoadK, k, fs.constant(object.NewString(e.Name)))
+		fs.top = save
+		fs.emitABC(OpGetAttr, dst, x, k)
+	case *parser.Call:
+		fs.call(e, dst)
+	case *parser.Assign:
+		// Assignments and named functions yield the value they bind.
+		fs.binding(e)
+		fs.ident(&parser.Ident{Name: boundName(e), Pos: e.Pos}, dst)
+	case *parser.Function:
+		if e.Name == "" {
+			fs.function(e, dst)
+			break
+		}
+		fs.binding(e)
+		fs.ident(&parser.Ident{Name: boundName(e)}, dst)
+	default:
+		fail("the register VM does not support %T", e)
+	}
+}
+
+func (fs *funcState) unary(op Op, e parser.Expr, dst int) {
+	save := fs.top
+	x := fs.expr(e)
+	fs.top = save
+	fs.emitABC(op, dst, x, 0)
+}
+
+var infixOps = map[token.Type]Op{
+	token.ADD:   OpAdd,
+	token.MINUS: OpSub,
+	token.MUL:   OpMul,
+	token.DIV:   OpDiv,
+	token.MOD:   OpMod,
+	token.EQ:    OpEQ,
+	token.NOTEQ: OpNE,
+	token.LT:    OpLT,
+	token.LE:    OpLE,
+	token.GT:    OpGT,
+	token.GE:    OpGE,
+	token.AND:   OpAnd,
+	token.OR:    OpOr,
+	token.TILDE: OpMatch,
+}
+
+func (fs *funcState) infix(e *parser.InfixExpr, dst int) {
+	op, ok := infixOps[e.TokenType]
+	if !ok {
+		fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+	}
+	save := fs.top
+	x := fs.expr(e.Left)
+	var y int
+	if pattern, ok := e.Right.(*parser.String); ok && op == OpMatch {
+		// Compile literal patterns once, they are shared through the constant pool.
+		g := object.NewGlob(pattern.Literal)
+		if err, ok := g.(*object.Error); ok {
+			fail("%s", string(*err))
+		}
+		y = fs.alloc()
+		fs.emitABx(OpLoadK, y, fs.constant(g))
+	} else {
+		y = fs.expr(e.Right)
+	}
+	fs.top = save
+	fs.emitABC(op, dst, x, y)
+}
+
+// ident loads the variable e into dst.
+func (fs *funcState) ident(e *parser.Ident, dst int) {
+	name := e.Name
+	if fs.locals != nil {
+		if r, ok := fs.locals[name]; ok {
+			if r != dst {
+				fs.emitABC(OpMove, dst, r, 0)
+			}
+			return
+		}
+		if name == fs.proto.Name {
+			fs.emitABC(OpSelf, dst, 0, 0)
+			return
+		}
+		for p := fs.parent; p != nil && p.locals != nil; p = p.parent {
+			if _, ok := p.locals[name]; ok || name == p.proto.Name {
+				fail("%d: closures are not supported: %s is a local of %s", e.Pos+1, name, p.proto.Name)
+			}
+		}
+	}
+	if g, ok := fs.c.globals[name]; ok {
+		fs.emitABx(OpGetGlobal, dst, g)
+		return
+	}
+	for i, b := range object.Builtins {
+		if b.Name != name {
+			continue
+		}
+		if !fs.c.caps.Has(b.Cap) {
+			fail("%d: %w", e.Pos+1, object.DisabledError(name, b.Cap))
+		}
+		fs.emitABx(OpGetBuiltin, dst, i)
+		return
+	}
+	if fs.c.Externals {
+		fs.emitABx(OpGetGlobal, dst, fs.c.DefineGlobal(name))
+		return
+	}
+	fail("%d: name %q is not defined", e.Pos+1, name)
+}
+
+func (fs *funcState) call(e *parser.Call, dst int) {
+	if len(e.Args) >= maxArg {
+		fail("too many arguments")
+	}
+	save := fs.top
+	base := fs.alloc()
+	fs.exprTo(e.Fn, base)
+	for _, a := range e.Args {
+		fs.exprTo(a, fs.alloc())
+	}
+	fs.top = save
+	if e.Tail && fs.locals != nil {
+		fs.emitABC(OpTailCall, 0, base, len(e.Args))
+		// Only reached when the callee is a builtin, whose result is in base.
+		fs.emitABC(OpReturn, base, 0, 0)
+		return
+	}
+	fs.emitABC(OpCall, dst, base, len(e.Args))
+}
+
+// function compiles the function e and loads it into dst.
+func (fs *funcState) function(e *parser.Function, dst int) {
+	nfs := &funcState{
+		c:      fs.c,
+		parent: fs,
+		proto:  &Proto{Name: e.Name, NumParams: len(e.Params)},
+		locals: make(map[string]int),
+	}
+	for _, p := range e.Params {
+		nfs.locals[p.Name] = nfs.alloc()
+	}
+	nfs.body(e.Body)
+	fs.emitABx(OpLoadK, dst, fs.constant(&Function{Proto: nfs.proto}))
+}
@@ -0,0 +1,511 @@
+package regvm
+
+import (
+	"errors"
+	"fmt"
+	"parrot/internal/object"
+)
+
+const (
+	MaxRegisters = 1 << 16
+	MaxFrames    = object.DefaultMaxDepth
+)
+
+type frame struct {
+	fn   *Function
+	pc   int
+	base int // the first register of the frame
+	ret  int // the caller's register for the result
+}
+
+// VM runs register code. Its globals persist across runs.
+type VM struct {
+	regs    []object.Object
+	globals []object.Object
+	names   []string
+	frames  []*frame
+	budget  *object.Budget
+	caps    object.Capability
+}
+
+func New() *VM {
+	return &VM{
+		regs: make([]object.Object, 256),
+		caps: object.CapAll,
+	}
+}
+
+// SetBudget limits the following runs to b, or lifts the limits if b is nil.
+func (vm *VM) SetBudget(b *object.Budget) {
+	vm.budget = b
+}
+
+// SetCapabilities restricts the builtins the VM runs to those enabled by
+// caps.
+func (vm *VM) SetCapabilities(caps object.Capability) {
+	vm.caps = caps
+}
+
+// SetGlobal sets the global with the given index.
+func (vm *VM) SetGlobal(index int, o object.Object) {
+	for len(vm.globals) <= index {
+		vm.globals = append(vm.globals, nil)
+	}
+	vm.globals[index] = o
+}
+
+// Run runs the top-level code p and returns its result.
+func (vm *VM) Run(p *Proto) (object.Object, error) {
+	vm.frames = vm.frames[:0]
+	vm.names = p.Globals
+	for len(vm.globals) < len(p.Globals) {
+		vm.globals = append(vm.globals, nil)
+	}
+	if err := vm.pushFrame(&Function{Proto: p}, 0, 0); err != nil {
+		return nil, err
+	}
+	return vm.run(0)
+}
+
+// pushFrame starts a call of fn, whose arguments are in the registers from
+// base on.
+func (vm *VM) pushFrame(fn *Function, base, ret int) error {
+	if len(vm.frames) >= MaxFrames {
+		return fmt.Errorf("stack overflow")
+	}
+	if err := vm.grow(base + fn.Proto.NumRegs); err != nil {
+		return err
+	}
+	// The top-level code isn't a call.
+	if vm.budget != nil && len(vm.frames) > 0 {
+		if err := vm.budget.Enter(); err != nil {
+			return err
+		}
+	}
+	// Reuse the frame of an earlier call at this depth.
+	var f *frame
+	if n := len(vm.frames); n < cap(vm.frames) {
+		f = vm.frames[:n+1][n]
+	}
+	if f == nil {
+		f = &frame{}
+	}
+	*f = frame{fn: fn, base: base, ret: ret}
+	vm.frames = append(vm.frames, f)
+	return nil
+}
+
+// grow makes sure there are n registers.
+func (vm *VM) grow(n int) error {
+	if n > MaxRegisters {
+		return fmt.Errorf("stack overflow")
+	}
+	if n > len(vm.regs) {
+		regs := make([]object.Object, max(n, 2*len(vm.regs)))
+		copy(regs, vm.regs)
+		vm.regs = regs
+	}
+	return nil
+}
+
+// popFrame ends the current function call.
+func (vm *VM) popFrame() *frame {
+	f := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	if vm.budget != nil && len(vm.frames) > 0 {
+		vm.budget.Leave()
+	}
+	return f
+}
+
+// run executes instructions until the calls return down to stop frames,
+// returning the value of the last return. On error the frames above stop
+// are discarded.
+func (vm *VM) run(stop int) (ret object.Object, err error) {
+	f := vm.frames[len(vm.frames)-1]
+	code, k := f.fn.Proto.Code, f.fn.Proto.Consts
+	r := vm.regs[f.base:]
+	for {
+		if vm.budget != nil {
+			if err = vm.budget.Step(); err != nil {
+				break
+			}
+		}
+		i := code[f.pc]
+		f.pc++
+		switch i.Op() {
+		case OpMove:
+			r[i.A()] = r[i.B()]
+		case OpLoadK:
+			r[i.A()] = k[i.Bx()]
+		case OpLoadTrue:
+			r[i.A()] = object.TRUEObj
+		case OpLoadFalse:
+			r[i.A()] = object.FALSEObj
+		case OpLoadNull:
+			r[i.A()] = object.NULLObj
+		case OpGetGlobal:
+			o := vm.globals[i.Bx()]
+			if o == nil {
+				err = fmt.Errorf("name %q is not defined", vm.names[i.Bx()])
+				break
+			}
+			r[i.A()] = o
+		case OpSetGlobal:
+			vm.globals[i.Bx()] = r[i.A()]
+		case OpGetBuiltin:
+			b := object.Builtins[i.Bx()]
+			if !vm.caps.Has(b.Cap) {
+				err = object.DisabledError(b.Name, b.Cap)
+				break
+			}
+			r[i.A()] = b.Builtin
+		case OpSelf:
+			r[i.A()] = f.fn
+		case OpAdd:
+			a, b := r[i.B()], r[i.C()]
+			if x, ok := a.(*object.Integer); ok {
+				if y, ok := b.(*object.Integer); ok {
+					r[i.A()] = object.NewInteger(int64(*x + *y))
+					break
+				}
+			}
+			r[i.A()], err = vm.arith(i.Op(), a, b)
+		case OpSub, OpMul, OpDiv, OpMod:
+			r[i.A()], err = vm.arith(i.Op(), r[i.B()], r[i.C()])
+		case OpEQ, OpNE, OpLT, OpLE, OpGT, OpGE, OpAnd, OpOr:
+			r[i.A()], err = compare(i.Op(), r[i.B()], r[i.C()])
+		case OpMatch:
+			o := object.MatchGlob(r[i.B()], r[i.C()])
+			if e, ok := o.(*object.Error); ok {
+				err = fmt.Errorf("%s", string(*e))
+				break
+			}
+			r[i.A()] = o
+		case OpNot:
+			switch r[i.B()] {
+			case object.FALSEObj, object.NULLObj:
+				r[i.A()] = object.TRUEObj
+			default:
+				r[i.A()] = object.FALSEObj
+			}
+		case OpNeg:
+			x, ok := r[i.B()].(*object.Integer)
+			if !ok {
+				err = fmt.Errorf("runtime error: unknown operator: -%s", r[i.B()].Type())
+				break
+			}
+			r[i.A()] = object.NewInteger(-int64(*x))
+		case OpIndex:
+			r[i.A()], err = index(r[i.B()], r[i.C()])
+		case OpGetAttr:
+			r[i.A()], err = attr(r[i.B()], string(*r[i.C()].(*object.String)))
+		case OpList:
+			l := object.NewList(append([]object.Object(nil), r[i.B():i.B()+i.C()]...)...)
+			if err = vm.charge(l); err != nil {
+				break
+			}
+			r[i.A()] = l
+		case OpCall:
+			callee := r[i.B()]
+			fn, ok := callee.(*Function)
+			if !ok {
+				var o object.Object
+				o, err = vm.callGo(callee, r[i.B()+1:i.B()+1+i.C()])
+				// Callbacks may have grown the registers.
+				r = vm.regs[f.base:]
+				r[i.A()] = o
+				break
+			}
+			if fn.Proto.NumParams != i.C() {
+				err = fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.Proto.NumParams, i.C())
+				break
+			}
+			if err = vm.pushFrame(fn, f.base+i.B()+1, f.base+i.A()); err != nil {
+				break
+			}
+			f = vm.frames[len(vm.frames)-1]
+			code, k = fn.Proto.Code, fn.Proto.Consts
+			r = vm.regs[f.base:]
+		case OpTailCall:
+			callee := r[i.B()]
+			fn, ok := callee.(*Function)
+			if !ok {
+				// The following RETURN returns the result.
+				var o object.Object
+				o, err = vm.callGo(callee, r[i.B()+1:i.B()+1+i.C()])
+				r = vm.regs[f.base:]
+				r[i.B()] = o
+				break
+			}
+			if fn.Proto.NumParams != i.C() {
+				err = fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.Proto.NumParams, i.C())
+				break
+			}
+			if err = vm.grow(f.base + fn.Proto.NumRegs); err != nil {
+				break
+			}
+			copy(vm.regs[f.base:], r[i.B()+1:i.B()+1+i.C()])
+			f.fn, f.pc = fn, 0
+			code, k = fn.Proto.Code, fn.Proto.Consts
+			r = vm.regs[f.base:]
+		case OpReturn:
+			ret = r[i.A()]
+			vm.popFrame()
+			if len(vm.frames) == stop {
+				return ret, nil
+			}
+			vm.regs[f.ret] = ret
+			f = vm.frames[len(vm.frames)-1]
+			code, k = f.fn.Proto.Code, f.fn.Proto.Consts
+			r = vm.regs[f.base:]
+		default:
+			err = fmt.Errorf("unknown op code %s", i.Op())
+		}
+		if err != nil {
+			break
+		}
+	}
+	for len(vm.frames) > stop {
+		vm.popFrame()
+	}
+	return nil, err
+}
+
+// callGo calls a builtin or other Go callable with args.
+func (vm *VM) callGo(callee object.Object, args []object.Object) (object.Object, error) {
+	fn, ok := callee.(object.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%q object is not callable", callee.Type())
+	}
+	if vm.budget != nil {
+		if err := vm.budget.Enter(); err != nil {
+			return nil, err
+		}
+		defer vm.budget.Leave()
+	}
+	in := make([]object.Object, len(args))
+	for i, a := range args {
+		if f, ok := a.(*Function); ok {
+			a = &callback{vm: vm, fn: f}
+		}
+		in[i] = a
+	}
+	ret := fn.Call(in...)
+	switch e := ret.(type) {
+	case nil:
+		ret = object.NULLObj
+	case *object.Error:
+		return nil, fmt.Errorf("%s", string(*e))
+	case *object.Interrupt:
+		return nil, e.Err
+	}
+	return ret, nil
+}
+
+// callback lets builtins call a function on the VM that passed it.
+type callback struct {
+	vm *VM
+	fn *Function
+}
+
+func (cb *callback) Type() object.Type { return cb.fn.Type() }
+func (cb *callback) String() string    { return cb.fn.String() }
+
+// Call runs the function in a nested run loop, with its frame above the
+// registers of the running one.
+func (cb *callback) Call(args ...object.Object) object.Object {
+	vm := cb.vm
+	if cb.fn.Proto.NumParams != len(args) {
+		return object.NewError("wrong number of arguments: expected %d, got %d", cb.fn.Proto.NumParams, len(args))
+	}
+	base := 0
+	if n := len(vm.frames); n > 0 {
+		top := vm.frames[n-1]
+		base = top.base + top.fn.Proto.NumRegs
+	}
+	stop := len(vm.frames)
+	if err := vm.pushFrame(cb.fn, base, base); err != nil {
+		return vm.errorObject(err)
+	}
+	copy(vm.regs[base:], args)
+	ret, err := vm.run(stop)
+	if err != nil {
+		return vm.errorObject(err)
+	}
+	return ret
+}
+
+// errorObject turns err into an error object for builtins, keeping
+// interruptions distinguishable from script errors.
+func (vm *VM) errorObject(err error) object.Object {
+	if vm.budget != nil && vm.budget.Interrupted(err) {
+		return &object.Interrupt{Err: err}
+	}
+	return object.NewError("%s", err)
+}
+
+// charge accounts for the allocation of o.
+func (vm *VM) charge(o object.Object) error {
+	if vm.budget == nil {
+		return nil
+	}
+	return vm.budget.Alloc(o)
+}
+
+var opSymbols = map[Op]string{
+	OpAdd: "+", OpSub: "-", OpMul: "*", OpDiv: "/", OpMod: "%",
+	OpEQ: "==", OpNE: "!=", OpLT: "<", OpLE: "<=", OpGT: ">", OpGE: ">=",
+	OpAnd: "and", OpOr: "or",
+}
+
+func unknownOperator(op Op, a, b object.Object) error {
+	return fmt.Errorf("runtime error: unknown operator: %s %s %s", a, opSymbols[op], b)
+}
+
+// arith applies an arithmetic operator.
+func (vm *VM) arith(op Op, a, b object.Object) (object.Object, error) {
+	switch a := a.(type) {
+	case *object.Integer:
+		b, ok := b.(*object.Integer)
+		if !ok {
+			break
+		}
+		var n int64
+		x, y := int64(*a), int64(*b)
+		switch op {
+		case OpAdd:
+			n = x + y
+		case OpSub:
+			n = x - y
+		case OpMul:
+			n = x * y
+		case OpDiv, OpMod:
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == OpDiv {
+				n = x / y
+			} else {
+				n = x % y
+			}
+		}
+		return object.NewInteger(n), nil
+	case *object.String:
+		b, ok := b.(*object.String)
+		if !ok || op != OpAdd {
+			break
+		}
+		s := *a + *b
+		if err := vm.charge(&s); err != nil {
+			return nil, err
+		}
+		return &s, nil
+	}
+	return nil, unknownOperator(op, a, b)
+}
+
+// compare applies a comparison or logical operator.
+func compare(op Op, a, b object.Object) (object.Object, error) {
+	var res bool
+	switch x := a.(type) {
+	case *object.Integer:
+		y, ok := b.(*object.Integer)
+		if !ok {
+			return nil, unknownOperator(op, a, b)
+		}
+		res = ordered(op, *x, *y)
+	case *object.String:
+		y, ok := b.(*object.String)
+		if !ok {
+			return nil, unknownOperator(op, a, b)
+		}
+		res = ordered(op, *x, *y)
+	case *object.Boolean:
+		y, ok := b.(*object.Boolean)
+		if !ok {
+			return nil, unknownOperator(op, a, b)
+		}
+		switch op {
+		case OpEQ:
+			res = *x == *y
+		case OpNE:
+			res = *x != *y
+		case OpAnd:
+			res = bool(*x) && bool(*y)
+		case OpOr:
+			res = bool(*x) || bool(*y)
+		default:
+			return nil, unknownOperator(op, a, b)
+		}
+	default:
+		return nil, unknownOperator(op, a, b)
+	}
+	if op == OpAnd || op == OpOr {
+		if _, ok := a.(*object.Boolean); !ok {
+			return nil, unknownOperator(op, a, b)
+		}
+	}
+	if res {
+		return object.TRUEObj, nil
+	}
+	return object.FALSEObj, nil
+}
+
+func ordered[T object.Integer | object.String](op Op, x, y T) bool {
+	switch op {
+	case OpEQ:
+		return x == y
+	case OpNE:
+		return x != y
+	case OpLT:
+		return x < y
+	case OpLE:
+		return x <= y
+	case OpGT:
+		return x > y
+	case OpGE:
+		return x >= y
+	}
+	return false
+}
+
+func index(x, i object.Object) (object.Object, error) {
+	switch x := x.(type) {
+	case *object.List:
+		if n, ok := i.(*object.Integer); ok {
+			if *n < 0 || int(*n) >= len(*x) {
+				return nil, fmt.Errorf("index out of range")
+			}
+			return (*x)[*n], nil
+		}
+	case *object.String:
+		if n, ok := i.(*object.Integer); ok {
+			if *n < 0 || int(*n) >= len(*x) {
+				return nil, fmt.Errorf("index out of range")
+			}
+			return object.NewString(string(string(*x)[*n])), nil
+		}
+	}
+	ix, ok := x.(object.Indexable)
+	if !ok {
+		return nil, fmt.Errorf("invalid index operator for types %v and %v", x.Type(), i.Type())
+	}
+	o := ix.Index(i)
+	if e, ok := o.(*object.Error); ok {
+		return nil, fmt.Errorf("%s", string(*e))
+	}
+	return o, nil
+}
+
+func attr(x object.Object, name string) (object.Object, error) {
+	h, ok := x.(object.HasAttrs)
+	if !ok {
+		return nil, fmt.Errorf("%q object has no attribute %q", x.Type(), name)
+	}
+	o := h.Attr(name)
+	if e, ok := o.(*object.Error); ok {
+		return nil, fmt.Errorf("%s", string(*e))
+	}
+	return o, nil
+}
@@ -0,0 +1,172 @@
+package regvm
+
+import (
+	"context"
+	"errors"
+	"parrot/internal/bench"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"strings"
+	"testing"
+)
+
+// run compiles and runs src on a new VM.
+func run(t *testing.T, src string) (object.Object, error) {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		t.Fatalf("%q: %v", src, errs[0])
+	}
+	p, err := NewCompiler(object.CapAll).Compile(prog)
+	if err != nil {
+		return nil, err
+	}
+	return New().Run(p)
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`1 + 2 * 3 - 4 / 2 % 3`, "5"},
+		{`-(3 - 5)`, "2"},
+		{`!true == false`, "true"},
+		{`"ab" + "c"`, "abc"},
+		{`"a" < "b"`, "true"},
+		{`1 >= 2`, "false"},
+		{`[1, "a", [true]]`, `[1, "a", [true]]`},
+		{`l = [4, 5]; l[1]`, "5"},
+		{`len([1, 2, 3])`, "3"},
+		{`x = 1; x = x + 1; x`, "2"},
+		{`fn f(a, b) { c = a * b; c + 1 }; f(3, 4)`, "13"},
+		{`f = fn(n) { n }; f(7)`, "7"},
+		// A function sees the value of a global at the time of the call.
+		{`x = 5; fn g() { x * x }; x = 6; g()`, "36"},
+		// Assignments in functions define locals.
+		{`y = 1; fn g() { y = 2; y }; g() + y`, "3"},
+		{`fn twice(f, x) { f(f(x)) }; fn inc(n) { n + 1 }; twice(inc, 1)`, "3"},
+		{`fn f() {}; f()`, "null"},
+		{"", "null"},
+	}
+	for _, tt := range tests {
+		got, err := run(t, tt.src)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+		} else if got.String() != tt.want {
+			t.Errorf("%q = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`1 / 0`, "division by zero"},
+		{`x = 0; 5 % x`, "division by zero"},
+		{`1 + "a"`, "unknown operator"},
+		{`-"a"`, "unknown operator"},
+		{`y`, `name "y" is not defined`},
+		{`fn f(a) { a }; f(1, 2)`, "wrong number of arguments"},
+		{`x = 3; x(1)`, "not callable"},
+		{`[1][3]`, "index out of range"},
+		{`fn down(n) { 1 + down(n - 1) }; down(5)`, "stack overflow"},
+		{`fn adder(n) { fn(m) { n + m } }; adder(1)(2)`, "closures are not supported"},
+	}
+	for _, tt := range tests {
+		got, err := run(t, tt.src)
+		if err == nil {
+			if e, ok := got.(*object.Error); ok {
+				err = errors.New(string(*e))
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q = %v, %v, want an error containing %q", tt.src, got, err, tt.err)
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	for _, p := range bench.Programs {
+		got, err := run(t, p.Source)
+		if err != nil {
+			t.Errorf("%s: %v", p.Name, err)
+		} else if got.String() != p.Result {
+			t.Errorf("%s = %s, want %s", p.Name, got, p.Result)
+		}
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	prog, _ := parser.Parse(`x = x + n; x`)
+	c := NewCompiler(object.CapPure)
+	x, n := c.DefineGlobal("x"), c.DefineGlobal("n")
+	if c.DefineGlobal("x") != x {
+		t.Error("x defined twice")
+	}
+	p, err := c.Compile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New()
+	vm.SetGlobal(x, object.NewInteger(1))
+	vm.SetGlobal(n, object.NewInteger(10))
+	// The globals persist across runs.
+	for _, want := range []string{"11", "21"} {
+		got, err := vm.Run(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want {
+			t.Errorf("x = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	prog, _ := parser.Parse(`print("x")`)
+	_, err := NewCompiler(object.CapPure).Compile(prog)
+	if err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("print compiled without CapIO: %v", err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	prog, _ := parser.Parse(bench.Programs[1].Source)
+	p, err := NewCompiler(object.CapPure).Compile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New()
+	b := object.NewBudget(context.Background(), object.Limits{MaxSteps: 1000})
+	vm.SetBudget(b)
+	_, err = vm.Run(p)
+	if !errors.Is(err, object.ErrStepLimit) {
+		t.Errorf("Run = %v, want %v", err, object.ErrStepLimit)
+	}
+}
+
+func TestInstr(t *testing.T) {
+	i := iABC(OpAdd, 1, 0xff, 7)
+	if i.Op() != OpAdd || i.A() != 1 || i.B() != 0xff || i.C() != 7 {
+		t.Errorf("iABC decodes as %s", i)
+	}
+	i = iABx(OpLoadK, maxArg, maxArgBx)
+	if i.Op() != OpLoadK || i.A() != maxArg || i.Bx() != maxArgBx {
+		t.Errorf("iABx decodes as %s", i)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	prog, _ := parser.Parse(`fn sq(n) { n * n }; sq(3)`)
+	p, err := NewCompiler(object.CapPure).Compile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := p.Disassemble()
+	for _, s := range []string{"function sq: 1 params", "MUL        1 0 0", "CALL"} {
+		if !strings.Contains(d, s) {
+			t.Errorf("listing lacks %q:\n%s", s, d)
+		}
+	}
+}
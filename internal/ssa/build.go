@@ -0,0 +1,338 @@
+package ssa
+
+import (
+	"fmt"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/token"
+)
+
+// buildError carries an error out of the recursive lowering.
+type buildError struct {
+	err error
+}
+
+func fail(format string, a ...any) {
+	panic(buildError{fmt.Errorf(format, a...)})
+}
+
+// Build lowers prog to SSA, resolving names like the compiler c would:
+// the globals and builtins of c are visible, c itself is not modified.
+//
+// As in the compiler, a function sees the globals defined before it, and
+// the globals assigned at the top level, which functions cannot assign,
+// are forwarded to the top-level code reading them.
+func Build(prog *parser.Program, c *compile.Compiler) (fn *Func, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(buildError)
+			if !ok {
+				panic(r)
+			}
+			fn, err = nil, e.err
+		}
+	}()
+	b := &builder{c: c, globals: make(map[string]bool)}
+	fn = &Func{}
+	fb := b.newFunc(fn, nil)
+	fb.body(prog)
+	return fn, nil
+}
+
+type builder struct {
+	c *compile.Compiler
+	// globals are the names the program defines as globals so far.
+	globals map[string]bool
+}
+
+// funcBuilder lowers the body of a function.
+type funcBuilder struct {
+	b      *builder
+	parent *funcBuilder
+	fn     *Func
+	block  *Block
+	// defs are the current values of the variables at the end of each
+	// block.
+	defs map[*Block]map[string]*Value
+}
+
+func (b *builder) newFunc(fn *Func, parent *funcBuilder) *funcBuilder {
+	fb := &funcBuilder{b: b, parent: parent, fn: fn, defs: make(map[*Block]map[string]*Value)}
+	fb.block = fn.newBlock()
+	for i, p := range fn.Params {
+		fb.write(fb.block, p, fb.block.newValue(OpParam, i, -1))
+	}
+	return fb
+}
+
+func (fb *funcBuilder) write(b *Block, name string, v *Value) {
+	if fb.defs[b] == nil {
+		fb.defs[b] = make(map[string]*Value)
+	}
+	fb.defs[b][name] = v
+}
+
+// read returns the value of the variable name at the end of b, or nil if
+// it is not defined on every path to b.
+func (fb *funcBuilder) read(b *Block, name string) *Value {
+	if v, ok := fb.defs[b][name]; ok {
+		return v
+	}
+	var v *Value
+	switch len(b.Preds) {
+	case 0:
+		return nil
+	case 1:
+		v = fb.read(b.Preds[0], name)
+	default:
+		if !fb.defined(b, name, make(map[*Block]bool)) {
+			return nil
+		}
+		phi := &Value{ID: fb.fn.nextID, Op: OpPhi, Block: b, Pos: -1}
+		fb.fn.nextID++
+		b.Values = append([]*Value{phi}, b.Values...)
+		fb.write(b, name, phi)
+		for _, p := range b.Preds {
+			a := fb.read(p, name)
+			phi.Args = append(phi.Args, a)
+			a.Uses++
+		}
+		v = trivialPhi(phi)
+	}
+	fb.write(b, name, v)
+	return v
+}
+
+// defined reports whether the variable name is defined on every path to
+// the end of b, so that read doesn't leave behind phis of undefined
+// values. Paths back to a block in seen, loops, don't count.
+func (fb *funcBuilder) defined(b *Block, name string, seen map[*Block]bool) bool {
+	if _, ok := fb.defs[b][name]; ok || seen[b] {
+		return true
+	}
+	seen[b] = true
+	if len(b.Preds) == 0 {
+		return false
+	}
+	for _, p := range b.Preds {
+		if !fb.defined(p, name, seen) {
+			return false
+		}
+	}
+	return true
+}
+
+// trivialPhi returns the value phi selects if it always selects the same
+// one, removing phi, or phi itself.
+func trivialPhi(phi *Value) *Value {
+	var same *Value
+	for _, a := range phi.Args {
+		if a == same || a == phi {
+			continue
+		}
+		if same != nil {
+			return phi
+		}
+		same = a
+	}
+	phi.Block.Func.replace(phi, same)
+	phi.Block.remove(phi)
+	return same
+}
+
+// remove removes the unused value v from b.
+func (b *Block) remove(v *Value) {
+	for i, w := range b.Values {
+		if w == v {
+			b.Values = append(b.Values[:i], b.Values[i+1:]...)
+			break
+		}
+	}
+	for _, a := range v.Args {
+		a.Uses--
+	}
+}
+
+// body lowers the statements of prog, returning the value of the last one
+// as a function body does: an assignment yields the assigned value and a
+// function definition or an empty body null. At the top level a function
+// definition yields the function, the value the VM leaves last.
+func (fb *funcBuilder) body(prog *parser.Program) {
+	var res *Value
+	for i, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		if i < len(prog.Stmts)-1 {
+			fb.expr(s.E)
+			continue
+		}
+		if call, ok := s.E.(*parser.Call); ok && call.Tail && !fb.fn.Top() {
+			fb.block.newValue(OpTailCall, nil, -1, fb.callArgs(call)...)
+			return
+		}
+		res = fb.expr(s.E)
+		if f, ok := s.E.(*parser.Function); ok && f.Name != "" && !fb.fn.Top() {
+			res = nil
+		}
+	}
+	if res == nil {
+		res = fb.constant(object.NULLObj)
+	}
+	fb.block.newValue(OpReturn, nil, -1, res)
+}
+
+func (fb *funcBuilder) constant(o object.Object) *Value {
+	return fb.block.newValue(OpConst, o, -1)
+}
+
+var infixOps = map[token.Type]Op{
+	token.ADD:   OpAdd,
+	token.MINUS: OpSub,
+	token.MUL:   OpMul,
+	token.DIV:   OpDiv,
+	token.MOD:   OpMod,
+	token.EQ:    OpEQ,
+	token.NOTEQ: OpNE,
+	token.LT:    OpLT,
+	token.LE:    OpLE,
+	token.GT:    OpGT,
+	token.GE:    OpGE,
+	token.AND:   OpAnd,
+	token.OR:    OpOr,
+	token.TILDE: OpMatch,
+}
+
+// expr lowers e, in the order the compiler evaluates it, and returns its
+// value.
+func (fb *funcBuilder) expr(e parser.Expr) *Value {
+	switch e := e.(type) {
+	case *parser.Integer:
+		return fb.constant(object.NewInteger(e.Value))
+	case *parser.String:
+		return fb.constant(object.NewString(e.Literal))
+	case *parser.Boolean:
+		return fb.constant(object.NewBoolean(e.Value))
+	case *parser.Ident:
+		return fb.ident(e)
+	case *parser.ListExpr:
+		elems := make([]*Value, len(e.List))
+		for i, x := range e.List {
+			elems[i] = fb.expr(x)
+		}
+		return fb.block.newValue(OpList, nil, -1, elems...)
+	case *parser.PrefixExpr:
+		switch e.TokenType {
+		case token.BANG:
+			return fb.block.newValue(OpNot, nil, -1, fb.expr(e.Right))
+		case token.MINUS:
+			return fb.block.newValue(OpNeg, nil, -1, fb.expr(e.Right))
+		case token.ADD:
+			return fb.expr(e.Right)
+		}
+		fail("runtime error: %s", e.Literal)
+	case *parser.InfixExpr:
+		op, ok := infixOps[e.TokenType]
+		if !ok {
+			fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+		}
+		x := fb.expr(e.Left)
+		if pattern, ok := e.Right.(*parser.String); ok && op == OpMatch {
+			g := object.NewGlob(pattern.Literal)
+			if err, ok := g.(*object.Error); ok {
+				fail("%s", string(*err))
+			}
+			return fb.block.newValue(op, nil, e.Pos, x, fb.constant(g))
+		}
+		return fb.block.newValue(op, nil, e.Pos, x, fb.expr(e.Right))
+	case *parser.IndexExpr:
+		x := fb.expr(e.Left)
+		return fb.block.newValue(OpIndex, nil, e.LbrackPos, x, fb.expr(e.Index))
+	case *parser.Selector:
+		return fb.block.newValue(OpAttr, e.Name, e.Pos, fb.expr(e.X))
+	case *parser.Call:
+		return fb.block.newValue(OpCall, nil, -1, fb.callArgs(e)...)
+	case *parser.Assign:
+		return fb.assign(e.Left.String(), func() *Value { return fb.expr(e.Right) })
+	case *parser.Function:
+		if e.Name == "" {
+			return fb.function(e)
+		}
+		return fb.assign(e.Name, func() *Value { return fb.function(e) })
+	}
+	fail("SSA does not support %T", e)
+	return nil
+}
+
+// callArgs returns the arguments of the call e followed by the function,
+// which the VM evaluates last.
+func (fb *funcBuilder) callArgs(e *parser.Call) []*Value {
+	args := make([]*Value, 0, len(e.Args)+1)
+	for _, a := range e.Args {
+		args = append(args, fb.expr(a))
+	}
+	return append(args, fb.expr(e.Fn))
+}
+
+// assign binds name to the value computed by rhs and returns the value. A
+// global is defined before rhs is lowered, as the compiler does, a local
+// after, so that rhs refers to the outer name.
+func (fb *funcBuilder) assign(name string, rhs func() *Value) *Value {
+	if !fb.fn.Top() {
+		v := rhs()
+		fb.write(fb.block, name, v)
+		return v
+	}
+	fb.b.globals[name] = true
+	v := rhs()
+	fb.block.newValue(OpSetGlobal, name, -1, v)
+	fb.write(fb.block, name, v)
+	return v
+}
+
+// function lowers the function e and returns its value.
+func (fb *funcBuilder) function(e *parser.Function) *Value {
+	fn := &Func{Name: e.Name, Parent: fb.fn}
+	for _, p := range e.Params {
+		fn.Params = append(fn.Params, p.Name)
+	}
+	nfb := fb.b.newFunc(fn, fb)
+	nfb.body(e.Body)
+	return fb.block.newValue(OpFunc, fn, -1)
+}
+
+// ident returns the value of the variable e: a local, the running
+// function, a global or a builtin.
+func (fb *funcBuilder) ident(e *parser.Ident) *Value {
+	name := e.Name
+	if v := fb.read(fb.block, name); v != nil {
+		return v
+	}
+	if !fb.fn.Top() {
+		if name == fb.fn.Name {
+			return fb.block.newValue(OpSelf, nil, e.Pos)
+		}
+		for p := fb.parent; p != nil && !p.fn.Top(); p = p.parent {
+			if p.read(p.block, name) != nil || name == p.fn.Name {
+				fail("%d: closures are not supported: %s is a local of %s", e.Pos+1, name, p.fn.name())
+			}
+		}
+	}
+	symbol, ok := fb.b.c.Resolve(name)
+	switch {
+	case fb.b.globals[name] || ok && symbol.Scope == compile.GlobalScope:
+		return fb.block.newValue(OpGlobal, name, e.Pos)
+	case ok && symbol.Scope == compile.BuiltinScope:
+		return fb.block.newValue(OpBuiltin, name, e.Pos)
+	}
+	if cap, ok := object.BuiltinCapability(name); ok {
+		fail("%d: %w", e.Pos+1, object.DisabledError(name, cap))
+	}
+	if fb.b.c.Externals {
+		return fb.block.newValue(OpGlobal, name, e.Pos)
+	}
+	fail("undefined variable %s", name)
+	return nil
+}
@@ -0,0 +1,387 @@
+package ssa
+
+import (
+	"fmt"
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+)
+
+// Compile compiles prog with c through SSA: it is lowered, optimized unless
+// opt is false, and generated, and the peephole passes of c run over the
+// result.
+func Compile(prog *parser.Program, c *compile.Compiler, opt bool) error {
+	fn, err := Build(prog, c)
+	if err != nil {
+		return err
+	}
+	if opt {
+		Optimize(fn)
+	}
+	if err := Generate(fn, c); err != nil {
+		return err
+	}
+	c.Peephole()
+	return nil
+}
+
+// Generate emits the bytecode of fn, the top-level code of a program, with
+// c, which defines the globals fn assigns.
+//
+// The stack code is rebuilt from the values: a value used once, by a later
+// value of the block, is computed where it is used if that doesn't reorder
+// effects. Other values are stored in temporaries, locals in functions and
+// hidden globals at the top level, unless a global assigned the value
+// holds it, or they are cheap to compute again, like constants and
+// parameters.
+func Generate(fn *Func, c *compile.Compiler) error {
+	g := &generator{top: c, funcs: make(map[*Func]uint32)}
+	return g.function(fn, c)
+}
+
+type generator struct {
+	top   *compile.Compiler
+	funcs map[*Func]uint32 // the constants of the generated functions
+	temps int              // the hidden globals used as temporaries
+}
+
+// funcGen generates a function.
+type funcGen struct {
+	g  *generator
+	c  *compile.Compiler
+	fn *Func
+	// owners map the values computed where they are used to their user.
+	owners map[*Value]*Value
+	// effects are the values whose computation, with the values inlined in
+	// it, has effects.
+	effects map[*Value]bool
+	// slots are the temporaries holding values.
+	slots map[*Value]slot
+}
+
+type slot struct {
+	global bool
+	index  int
+}
+
+// global returns the index of the global name, defining it if needed.
+func (g *generator) global(name string) int {
+	if symbol, ok := g.top.Resolve(name); ok && symbol.Scope == compile.GlobalScope {
+		return symbol.Index
+	}
+	return g.top.Define(name).Index
+}
+
+func (g *generator) function(fn *Func, c *compile.Compiler) error {
+	if len(fn.Blocks) != 1 {
+		return fmt.Errorf("ssa: %s: the bytecode has no jumps for %d blocks", fn.name(), len(fn.Blocks))
+	}
+	fg := &funcGen{
+		g:       g,
+		c:       c,
+		fn:      fn,
+		owners:  make(map[*Value]*Value),
+		effects: make(map[*Value]bool),
+		slots:   make(map[*Value]slot),
+	}
+	b := fn.Entry()
+	fg.plan(b)
+	var stored *Value // the value assigned by the last root, at the top level
+	for _, v := range b.Values {
+		if fg.owners[v] != nil || fg.rematerialized(v) {
+			continue
+		}
+		switch v.Op {
+		case OpSetGlobal:
+			if err := fg.value(v.Args[0]); err != nil {
+				return err
+			}
+			i := g.global(v.Aux.(string))
+			c.OpArg(code.OpSetGlobal, uint32(i))
+			if a := v.Args[0]; fg.owners[a] == v && a.Uses > 1 {
+				// The global holds the value for its other uses.
+				fg.slots[a] = slot{global: true, index: i}
+			}
+			stored = v.Args[0]
+			continue
+		case OpReturn:
+			a := v.Args[0]
+			if !fn.Top() {
+				if err := fg.value(a); err != nil {
+					return err
+				}
+				c.Op(code.OpReturnValue)
+			} else if a != stored {
+				// Leave the result on the stack, where the VM finds it as
+				// it does the value an assignment pops last.
+				if err := fg.value(a); err != nil {
+					return err
+				}
+			}
+			continue
+		case OpTailCall:
+			if err := fg.args(v.Args); err != nil {
+				return err
+			}
+			c.OpArg(code.OpTailCall, uint32(len(v.Args)-1))
+			c.Op(code.OpReturnValue)
+			continue
+		}
+		if v.Uses == 0 && v.Op.pure() {
+			continue
+		}
+		if err := fg.compute(v); err != nil {
+			return err
+		}
+		stored = nil
+		if v.Uses == 0 {
+			c.Op(code.OpPop)
+			continue
+		}
+		fg.store(v)
+	}
+	return nil
+}
+
+// store stores the value v, just computed, in a new temporary.
+func (fg *funcGen) store(v *Value) {
+	if fg.fn.Top() {
+		i := fg.g.global(fmt.Sprintf("$t%d", fg.g.temps))
+		fg.g.temps++
+		fg.c.OpArg(code.OpSetGlobal, uint32(i))
+		fg.slots[v] = slot{global: true, index: i}
+		return
+	}
+	symbol := fg.c.Define(fmt.Sprintf("$%d", v.ID))
+	fg.c.OpArg(code.OpSetLocal, uint32(symbol.Index))
+	fg.slots[v] = slot{index: symbol.Index}
+}
+
+// rematerialized reports whether v is computed anew where it is used.
+func (fg *funcGen) rematerialized(v *Value) bool {
+	switch v.Op {
+	case OpConst, OpParam, OpBuiltin, OpSelf, OpFunc:
+		return true
+	case OpGlobal:
+		// Functions can't assign globals, the top level can.
+		return !fg.fn.Top()
+	}
+	return false
+}
+
+// effect reports whether v has effects or may fail, or reads a global the
+// block may assign.
+func (fg *funcGen) effect(v *Value) bool {
+	switch v.Op {
+	case OpNot, OpAnd, OpOr, OpList:
+		return false
+	}
+	return !fg.rematerialized(v)
+}
+
+// plan decides which values of b are inlined in their use.
+//
+// A value assigned to a global is also inlined in the assignment if its
+// other uses follow it and the global isn't assigned again before them,
+// the global standing for the value.
+func (fg *funcGen) plan(b *Block) {
+	index := make(map[*Value]int, len(b.Values))
+	last := make(map[*Value]int) // the index of the last use
+	for i, v := range b.Values {
+		index[v] = i
+		for _, a := range v.Args {
+			last[a] = i
+		}
+	}
+	for i, u := range b.Values {
+		// The arguments are computed in order, so going backwards, the
+		// values between an argument and u are those of the following
+		// arguments, which are inlined if they can be.
+		later := make(map[*Value]bool)
+		for j := len(u.Args) - 1; j >= 0; j-- {
+			a := u.Args[j]
+			if fg.rematerialized(a) || a.Block != b || index[a] > i || fg.owners[a] != nil {
+				continue
+			}
+			if a.Uses != 1 && (u.Op != OpSetGlobal || !fg.held(b.Values[i+1:last[a]], a, u)) {
+				continue
+			}
+			if fg.effects[a] && !fg.movable(b.Values[index[a]+1:i], later) {
+				continue
+			}
+			fg.owners[a] = u
+			fg.tree(a, later)
+		}
+		fg.effects[u] = fg.effect(u)
+		for _, a := range u.Args {
+			if fg.owners[a] == u && fg.effects[a] {
+				fg.effects[u] = true
+			}
+		}
+	}
+}
+
+// held reports whether the global assigned v by set still holds it over
+// values, which follow set: v is not used by set alone and it isn't used
+// before set.
+func (fg *funcGen) held(values []*Value, v, set *Value) bool {
+	uses := 0
+	for _, a := range set.Args {
+		if a == v {
+			uses++
+		}
+	}
+	for _, w := range values {
+		if w.Op == OpSetGlobal && w.Aux == set.Aux {
+			return false
+		}
+		for _, a := range w.Args {
+			if a == v {
+				uses++
+			}
+		}
+	}
+	// The last use itself follows values.
+	return uses+1 == v.Uses
+}
+
+// movable reports whether none of values, but those in later, has effects.
+func (fg *funcGen) movable(values []*Value, later map[*Value]bool) bool {
+	for _, w := range values {
+		if !later[w] && fg.effect(w) {
+			return false
+		}
+	}
+	return true
+}
+
+// tree adds v and the values inlined in it to set.
+func (fg *funcGen) tree(v *Value, set map[*Value]bool) {
+	set[v] = true
+	for _, a := range v.Args {
+		if fg.owners[a] == v {
+			fg.tree(a, set)
+		}
+	}
+}
+
+// value leaves v on the stack.
+func (fg *funcGen) value(v *Value) error {
+	if s, ok := fg.slots[v]; ok {
+		if s.global {
+			fg.c.OpArg(code.OpGetGlobal, uint32(s.index))
+		} else {
+			fg.c.OpArg(code.OpGetLocal, uint32(s.index))
+		}
+		return nil
+	}
+	return fg.compute(v)
+}
+
+func (fg *funcGen) args(args []*Value) error {
+	for _, a := range args {
+		if err := fg.value(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var binaryOps = map[Op]code.OpCode{
+	OpAdd:   code.OpAdd,
+	OpSub:   code.OpSub,
+	OpMul:   code.OpMul,
+	OpDiv:   code.OpDiv,
+	OpMod:   code.OpMod,
+	OpEQ:    code.OpCmpEQ,
+	OpNE:    code.OpCmpNE,
+	OpLT:    code.OpCmpLT,
+	OpLE:    code.OpCmpLE,
+	OpGT:    code.OpCmpGT,
+	OpGE:    code.OpCmpGE,
+	OpAnd:   code.OpAnd,
+	OpOr:    code.OpOr,
+	OpMatch: code.OpMatch,
+	OpIndex: code.OpIndex,
+}
+
+// compute emits the computation of v from its arguments.
+func (fg *funcGen) compute(v *Value) error {
+	c := fg.c
+	if err := fg.args(v.Args); err != nil {
+		return err
+	}
+	if v.Pos >= 0 {
+		c.Pos(v.Pos)
+	}
+	switch v.Op {
+	case OpConst:
+		switch v.Aux {
+		case object.TRUEObj:
+			c.Op(code.OpTrue)
+		case object.FALSEObj:
+			c.Op(code.OpFalse)
+		default:
+			c.OpArg(code.OpConstant, c.Const(v.Aux.(object.Object)))
+		}
+	case OpParam:
+		c.OpArg(code.OpGetLocal, uint32(v.Aux.(int)))
+	case OpGlobal:
+		c.OpArg(code.OpGetGlobal, uint32(fg.g.global(v.Aux.(string))))
+	case OpBuiltin:
+		symbol, _ := fg.g.top.Resolve(v.Aux.(string))
+		c.OpArg(code.OpGetBuiltin, uint32(symbol.Index))
+	case OpSelf:
+		c.Op(code.OpCurrentClosure)
+	case OpFunc:
+		k, err := fg.g.compiled(v.Aux.(*Func), c)
+		if err != nil {
+			return err
+		}
+		c.OpArg(code.OpConstant, k)
+	case OpNot:
+		c.Op(code.OpBang)
+	case OpNeg:
+		c.Op(code.OpMinus)
+	case OpAttr:
+		c.OpArg(code.OpGetAttr, c.Const(object.NewString(v.Aux.(string))))
+	case OpList:
+		c.OpArg(code.OpList, uint32(len(v.Args)))
+	case OpCall:
+		c.OpArg(code.OpCall, uint32(len(v.Args)-1))
+	default:
+		op, ok := binaryOps[v.Op]
+		if !ok {
+			return fmt.Errorf("ssa: cannot generate %s", v.LongString())
+		}
+		c.Op(op)
+	}
+	return nil
+}
+
+// compiled returns the constant of the function fn, generating it the
+// first time.
+func (g *generator) compiled(fn *Func, c *compile.Compiler) (uint32, error) {
+	if k, ok := g.funcs[fn]; ok {
+		return k, nil
+	}
+	nc := c.NewForFunction()
+	for _, p := range fn.Params {
+		nc.Define(p)
+	}
+	if err := g.function(fn, nc); err != nil {
+		return 0, err
+	}
+	nc.Peephole()
+	f := object.FunctionCompiled{
+		Instructions: nc.OpCodes.Output(),
+		ParamsCnt:    int8(len(fn.Params)),
+		LocalCnt:     nc.SymbolTable.NumDefinitions,
+		SourceMap:    nc.OpCodes.SourceMap(),
+		Name:         fn.Name,
+	}
+	k := c.Const(&f)
+	g.funcs[fn] = k
+	return k, nil
+}
@@ -0,0 +1,250 @@
+package ssa
+
+import (
+	"cmp"
+	"fmt"
+	"parrot/internal/object"
+)
+
+// Optimize runs the passes over fn and the functions it defines.
+func Optimize(fn *Func) {
+	ConstProp(fn)
+	CSE(fn)
+	DCE(fn)
+	for _, f := range fn.Funcs() {
+		Optimize(f)
+	}
+}
+
+// ConstProp replaces the operations on constants by their result, as the
+// VM would compute it, and returns the number of values replaced.
+// Operations which fail, such as a division by zero, are left alone. Since
+// variables are values, this propagates constants through them.
+func ConstProp(fn *Func) int {
+	n := 0
+	for _, b := range fn.Dominators() {
+		for _, v := range b.Values {
+			o := fold(v)
+			if o == nil {
+				continue
+			}
+			v.Op, v.Aux = OpConst, o
+			for _, a := range v.Args {
+				a.Uses--
+			}
+			v.Args = nil
+			n++
+		}
+	}
+	return n
+}
+
+// fold returns the constant v computes, or nil.
+func fold(v *Value) object.Object {
+	args := make([]object.Object, len(v.Args))
+	for i, a := range v.Args {
+		if a.Op != OpConst {
+			return nil
+		}
+		args[i] = a.Aux.(object.Object)
+	}
+	switch v.Op {
+	case OpNot:
+		return object.NewBoolean(args[0] == object.FALSEObj || args[0] == object.NULLObj)
+	case OpNeg:
+		if x, ok := args[0].(*object.Integer); ok {
+			return object.NewInteger(-int64(*x))
+		}
+	case OpAnd, OpOr:
+		x, ok := args[0].(*object.Boolean)
+		if !ok {
+			return nil
+		}
+		y, ok := args[1].(*object.Boolean)
+		if !ok {
+			return nil
+		}
+		if v.Op == OpAnd {
+			return object.NewBoolean(bool(*x) && bool(*y))
+		}
+		return object.NewBoolean(bool(*x) || bool(*y))
+	case OpMatch:
+		if _, ok := args[0].(*object.String); !ok {
+			return nil
+		}
+		if r, ok := object.MatchGlob(args[0], args[1]).(*object.Boolean); ok {
+			return r
+		}
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod:
+		return foldArith(v.Op, args[0], args[1])
+	case OpEQ, OpNE, OpLT, OpLE, OpGT, OpGE:
+		return foldCmp(v.Op, args[0], args[1])
+	}
+	return nil
+}
+
+func foldArith(op Op, x, y object.Object) object.Object {
+	if x, ok := x.(*object.String); ok && op == OpAdd {
+		if y, ok := y.(*object.String); ok {
+			return object.NewString(string(*x) + string(*y))
+		}
+		return nil
+	}
+	a, ok := x.(*object.Integer)
+	if !ok {
+		return nil
+	}
+	b, ok := y.(*object.Integer)
+	if !ok {
+		return nil
+	}
+	switch op {
+	case OpAdd:
+		return object.NewInteger(int64(*a + *b))
+	case OpSub:
+		return object.NewInteger(int64(*a - *b))
+	case OpMul:
+		return object.NewInteger(int64(*a * *b))
+	}
+	if *b == 0 {
+		return nil
+	}
+	if op == OpDiv {
+		return object.NewInteger(int64(*a / *b))
+	}
+	return object.NewInteger(int64(*a % *b))
+}
+
+// foldCmp compares x and y like the VM: booleans for equality only,
+// integers and strings by value. Other comparisons fail at run time.
+func foldCmp(op Op, x, y object.Object) object.Object {
+	var c int // the sign of x - y
+	switch a := x.(type) {
+	case *object.Boolean:
+		if _, ok := y.(*object.Boolean); !ok {
+			return nil
+		}
+		switch op {
+		case OpEQ:
+			return object.NewBoolean(x == y)
+		case OpNE:
+			return object.NewBoolean(x != y)
+		}
+		return nil
+	case *object.Integer:
+		b, ok := y.(*object.Integer)
+		if !ok {
+			return nil
+		}
+		c = cmp.Compare(*a, *b)
+	case *object.String:
+		b, ok := y.(*object.String)
+		if !ok {
+			return nil
+		}
+		c = cmp.Compare(*a, *b)
+	default:
+		return nil
+	}
+	switch op {
+	case OpEQ:
+		return object.NewBoolean(c == 0)
+	case OpNE:
+		return object.NewBoolean(c != 0)
+	case OpLT:
+		return object.NewBoolean(c < 0)
+	case OpLE:
+		return object.NewBoolean(c <= 0)
+	case OpGT:
+		return object.NewBoolean(c > 0)
+	}
+	return object.NewBoolean(c >= 0)
+}
+
+// DCE removes the unused values without effect and returns their number.
+func DCE(fn *Func) int {
+	n := 0
+	for changed := true; changed; {
+		changed = false
+		for _, b := range fn.Blocks {
+			for i := len(b.Values) - 1; i >= 0; i-- {
+				v := b.Values[i]
+				if v.Uses == 0 && v.Op.pure() {
+					b.remove(v)
+					n++
+					changed = true
+				}
+			}
+		}
+	}
+	return n
+}
+
+// CSE replaces the values computing the same as a value dominating them by
+// the latter, and returns the number of values replaced. Only operations
+// whose result depends on their arguments alone are considered: not calls,
+// nor lists which are distinct objects, nor indexing and attributes which
+// hosts may compute as they please.
+func CSE(fn *Func) int {
+	order := fn.Dominators()
+	children := make(map[*Block][]*Block)
+	for _, b := range order[1:] {
+		children[b.Idom] = append(children[b.Idom], b)
+	}
+	n := 0
+	avail := make(map[string]*Value)
+	var walk func(b *Block)
+	walk = func(b *Block) {
+		var added []string
+		var dups []*Value
+		for _, v := range b.Values {
+			key, ok := cseKey(v)
+			if !ok {
+				continue
+			}
+			if w, ok := avail[key]; ok {
+				fn.replace(v, w)
+				dups = append(dups, v)
+				continue
+			}
+			avail[key] = v
+			added = append(added, key)
+		}
+		for _, v := range dups {
+			b.remove(v)
+		}
+		n += len(dups)
+		for _, c := range children[b] {
+			walk(c)
+		}
+		for _, key := range added {
+			delete(avail, key)
+		}
+	}
+	walk(fn.Entry())
+	return n
+}
+
+// cseKey returns the key identifying what v computes, or false if v isn't
+// a candidate for CSE.
+func cseKey(v *Value) (string, bool) {
+	switch v.Op {
+	case OpConst:
+		o := v.Aux.(object.Object)
+		switch o.(type) {
+		case *object.Integer, *object.String, *object.Boolean, *object.NULL, *object.Glob:
+			return fmt.Sprintf("const %s %s", o.Type(), o.String()), true
+		}
+		return "", false
+	case OpGlobal, OpBuiltin, OpSelf, OpParam,
+		OpAdd, OpSub, OpMul, OpDiv, OpMod, OpEQ, OpNE, OpLT, OpLE, OpGT, OpGE,
+		OpAnd, OpOr, OpMatch, OpNot, OpNeg:
+	default:
+		return "", false
+	}
+	key := fmt.Sprintf("%s %v", v.Op, v.Aux)
+	for _, a := range v.Args {
+		key += " " + a.String()
+	}
+	return key, true
+}
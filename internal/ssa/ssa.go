@@ -0,0 +1,344 @@
+// Package ssa is an intermediate representation in static single
+// assignment form, between the parser's AST and the bytecode of the VM.
+//
+// A Func is a graph of basic blocks, each a sequence of Values ending in a
+// terminator. A Value is defined once, by the operation computing it from
+// its arguments, so that locals disappear into the values assigned to them
+// and optimizations such as constant propagation, common subexpression
+// elimination and dead code elimination are simple rewrites of the graph.
+// Where control flow merges, phi values select the definition of the
+// predecessor control came from.
+//
+// The language has no conditionals or loops yet, so Build makes functions
+// of a single block, and Generate, like the bytecode, has no jumps. The
+// passes work on any graph: phis, dominators and the dominator-ordered
+// walks are there for control flow to come.
+//
+// Build lowers a program, Optimize runs the passes and Generate emits the
+// bytecode of the result.
+package ssa
+
+import (
+	"fmt"
+	"parrot/internal/object"
+	"strings"
+)
+
+// Op is the operation of a Value.
+type Op int
+
+const (
+	OpConst     Op = iota // the constant Aux
+	OpParam               // the parameter with index Aux
+	OpGlobal              // the global named Aux
+	OpSetGlobal           // assigns Args[0] to the global named Aux
+	OpBuiltin             // the builtin named Aux
+	OpSelf                // the running function
+	OpFunc                // the function Aux, a *Func
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpEQ
+	OpNE
+	OpLT
+	OpLE
+	OpGT
+	OpGE
+	OpAnd
+	OpOr
+	OpMatch // Args[0] ~ Args[1]
+
+	OpNot
+	OpNeg
+	OpIndex // Args[0][Args[1]]
+	OpAttr  // Args[0].Aux
+	OpList  // [Args...]
+	OpCall  // calls Args[len-1] with the other Args, evaluated first
+	OpPhi   // Args[i] if control comes from the block's Preds[i]
+
+	// Terminators
+	OpReturn   // returns Args[0]
+	OpTailCall // returns OpCall of the Args, reusing the frame
+)
+
+var opNames = [...]string{
+	OpConst:     "const",
+	OpParam:     "param",
+	OpGlobal:    "global",
+	OpSetGlobal: "setglobal",
+	OpBuiltin:   "builtin",
+	OpSelf:      "self",
+	OpFunc:      "func",
+	OpAdd:       "add",
+	OpSub:       "sub",
+	OpMul:       "mul",
+	OpDiv:       "div",
+	OpMod:       "mod",
+	OpEQ:        "eq",
+	OpNE:        "ne",
+	OpLT:        "lt",
+	OpLE:        "le",
+	OpGT:        "gt",
+	OpGE:        "ge",
+	OpAnd:       "and",
+	OpOr:        "or",
+	OpMatch:     "match",
+	OpNot:       "not",
+	OpNeg:       "neg",
+	OpIndex:     "index",
+	OpAttr:      "attr",
+	OpList:      "list",
+	OpCall:      "call",
+	OpPhi:       "phi",
+	OpReturn:    "return",
+	OpTailCall:  "tailcall",
+}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// pure reports whether values of op have no effect but their result, and
+// never fail, so that they can be removed when unused. Reading a global
+// fails if it is unset, and logical operators on values other than
+// booleans.
+func (op Op) pure() bool {
+	switch op {
+	case OpConst, OpParam, OpBuiltin, OpSelf, OpFunc,
+		OpNot, OpList, OpPhi:
+		return true
+	}
+	return false
+}
+
+// Value is the result of an operation.
+type Value struct {
+	ID    int
+	Op    Op
+	Args  []*Value
+	Aux   any
+	Block *Block
+	Pos   int // source position, or -1
+	Uses  int // number of uses as an argument
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+// LongString returns the definition of v.
+func (v *Value) LongString() string {
+	var b strings.Builder
+	if !v.Op.terminator() && v.Op != OpSetGlobal {
+		fmt.Fprintf(&b, "%s = ", v)
+	}
+	b.WriteString(v.Op.String())
+	switch aux := v.Aux.(type) {
+	case nil:
+	case *object.String:
+		fmt.Fprintf(&b, " %s", aux.Quoted())
+	case object.Object:
+		fmt.Fprintf(&b, " %s", aux.String())
+	case *Func:
+		fmt.Fprintf(&b, " %s", aux.name())
+	default:
+		fmt.Fprintf(&b, " %v", aux)
+	}
+	for _, a := range v.Args {
+		fmt.Fprintf(&b, " %s", a)
+	}
+	return b.String()
+}
+
+func (op Op) terminator() bool {
+	return op == OpReturn || op == OpTailCall
+}
+
+// Block is a basic block: values computed in sequence, the last of which
+// is a terminator, or the start of a successor.
+type Block struct {
+	ID     int
+	Values []*Value
+	Preds  []*Block
+	Succs  []*Block
+	// Idom is the immediate dominator of the block, nil for the entry, set
+	// by Func.Dominators.
+	Idom *Block
+	Func *Func
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("b%d", b.ID)
+}
+
+// newValue appends a value to b.
+func (b *Block) newValue(op Op, aux any, pos int, args ...*Value) *Value {
+	v := &Value{ID: b.Func.nextID, Op: op, Args: args, Aux: aux, Block: b, Pos: pos}
+	b.Func.nextID++
+	for _, a := range args {
+		a.Uses++
+	}
+	b.Values = append(b.Values, v)
+	return v
+}
+
+// Func is a function, or the top-level code of a program.
+type Func struct {
+	Name   string
+	Params []string
+	Blocks []*Block // the entry block first
+	Parent *Func    // the enclosing function, nil for the top level
+	nextID int
+}
+
+// Top reports whether f is the top-level code of a program.
+func (f *Func) Top() bool {
+	return f.Parent == nil
+}
+
+func (f *Func) name() string {
+	switch {
+	case f.Top():
+		return "<top>"
+	case f.Name == "":
+		return "<anonymous>"
+	}
+	return f.Name
+}
+
+func (f *Func) newBlock() *Block {
+	b := &Block{ID: len(f.Blocks), Func: f}
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// Entry returns the entry block of f.
+func (f *Func) Entry() *Block {
+	return f.Blocks[0]
+}
+
+// Funcs returns the functions defined in f.
+func (f *Func) Funcs() []*Func {
+	var fns []*Func
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if fn, ok := v.Aux.(*Func); ok {
+				fns = append(fns, fn)
+			}
+		}
+	}
+	return fns
+}
+
+// replace replaces the uses of old by new.
+func (f *Func) replace(old, new *Value) {
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			for i, a := range v.Args {
+				if a == old {
+					v.Args[i] = new
+					old.Uses--
+					new.Uses++
+				}
+			}
+		}
+	}
+}
+
+// String returns a listing of f and of the functions it defines.
+func (f *Func) String() string {
+	var b strings.Builder
+	f.write(&b)
+	return b.String()
+}
+
+func (f *Func) write(w *strings.Builder) {
+	fmt.Fprintf(w, "func %s(%s)\n", f.name(), strings.Join(f.Params, ", "))
+	for _, b := range f.Blocks {
+		fmt.Fprintf(w, "  %s:", b)
+		if len(b.Preds) > 0 {
+			var preds []string
+			for _, p := range b.Preds {
+				preds = append(preds, p.String())
+			}
+			fmt.Fprintf(w, " <- %s", strings.Join(preds, " "))
+		}
+		if b.Idom != nil {
+			fmt.Fprintf(w, " (idom %s)", b.Idom)
+		}
+		w.WriteByte('\n')
+		for _, v := range b.Values {
+			fmt.Fprintf(w, "    %s\n", v.LongString())
+		}
+	}
+	for _, fn := range f.Funcs() {
+		fn.write(w)
+	}
+}
+
+// Dominators sets the immediate dominators of the blocks reachable from
+// the entry, with the algorithm of Cooper, Harvey and Kennedy, and returns
+// the blocks in reverse postorder.
+func (f *Func) Dominators() []*Block {
+	var order []*Block
+	seen := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b] = true
+		for _, s := range b.Succs {
+			if !seen[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	visit(f.Entry())
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	rpo := make(map[*Block]int, len(order))
+	for i, b := range order {
+		rpo[b] = i
+		b.Idom = nil
+	}
+	entry := f.Entry()
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for rpo[a] > rpo[b] {
+				a = a.Idom
+			}
+			for rpo[b] > rpo[a] {
+				b = b.Idom
+			}
+		}
+		return a
+	}
+	entry.Idom = entry
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order[1:] {
+			var idom *Block
+			for _, p := range b.Preds {
+				if p.Idom == nil {
+					continue
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = intersect(p, idom)
+				}
+			}
+			if b.Idom != idom {
+				b.Idom, changed = idom, true
+			}
+		}
+	}
+	entry.Idom = nil
+	return order
+}
@@ -0,0 +1,364 @@
+package ssa
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/vm"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func build(t *testing.T, src string) *Func {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		t.Fatalf("Parse(%q): %v", src, errs[0])
+	}
+	fn, err := Build(prog, compile.New())
+	if err != nil {
+		t.Fatalf("Build(%q): %v", src, err)
+	}
+	return fn
+}
+
+// listing returns the values of fn and its functions, one function a line.
+func listing(fn *Func) string {
+	var b strings.Builder
+	var list func(fn *Func)
+	list = func(fn *Func) {
+		b.WriteString(fn.name() + ":")
+		for _, blk := range fn.Blocks {
+			for _, v := range blk.Values {
+				b.WriteString(" " + v.LongString() + ";")
+			}
+		}
+		b.WriteByte('\n')
+		for _, f := range fn.Funcs() {
+			list(f)
+		}
+	}
+	list(fn)
+	return b.String()
+}
+
+func TestConstProp(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`x = 2 * 3; x + 4`,
+			"<top>: v0 = const 2; v1 = const 3; v2 = const 6; setglobal x v2; v4 = const 4; v5 = const 10; return v5;\n"},
+		{`!(1 < 2) or "a" + "b" == "ab"`,
+			`<top>: v0 = const 1; v1 = const 2; v2 = const true; v3 = const false; v4 = const "a"; v5 = const "b"; v6 = const "ab"; v7 = const "ab"; v8 = const true; v9 = const true; return v9;` + "\n"},
+		// Failures are left for run time.
+		{`1 / 0; -"a"`,
+			`<top>: v0 = const 1; v1 = const 0; v2 = div v0 v1; v3 = const "a"; v4 = neg v3; return v4;` + "\n"},
+		{`fn f(a) { a + (1 - 1) }`,
+			"<top>: v0 = func f; setglobal f v0; return v0;\nf: v0 = param 0; v1 = const 1; v2 = const 1; v3 = const 0; v4 = add v0 v3; return v4;\n"},
+	}
+	for _, tt := range tests {
+		fn := build(t, tt.src)
+		ConstProp(fn)
+		for _, f := range fn.Funcs() {
+			ConstProp(f)
+		}
+		if got := listing(fn); got != tt.want {
+			t.Errorf("ConstProp(%q) =\n%s\nwant\n%s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestDCE(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`[1, "a"]; !true; x = 5; x`,
+			"<top>: v5 = const 5; setglobal x v5; return v5;\n"},
+		// Calls, which may print, and operations which may fail stay.
+		{`print(1); rand(); 1 / 0; [1][2]; 5`,
+			"<top>: v0 = const 1; v1 = builtin print; v2 = call v0 v1; v3 = builtin rand; v4 = call v3; v5 = const 1; v6 = const 0; v7 = div v5 v6; v8 = const 1; v9 = list v8; v10 = const 2; v11 = index v9 v10; v12 = const 5; return v12;\n"},
+	}
+	for _, tt := range tests {
+		fn := build(t, tt.src)
+		DCE(fn)
+		if got := listing(fn); got != tt.want {
+			t.Errorf("DCE(%q) =\n%s\nwant\n%s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestCSE(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int // the values CSE replaces in f
+	}{
+		{`fn f(a) { [a * 2, a * 2, -a, -a < a, -a < a] }`, 5},
+		// Calls are neither merged, even of the same builtin, nor lists.
+		{`fn f() { [rand(), rand()] }`, 1},
+		{`fn f() { [print(1), print(1)] }`, 2},
+		{`fn f(a) { [[a], [a]] }`, 0},
+		{`fn f(a) { [a[0], a[0], a.x, a.x] }`, 1},
+	}
+	for _, tt := range tests {
+		fn := build(t, tt.src).Funcs()[0]
+		calls := strings.Count(listing(fn), "call")
+		if got := CSE(fn); got != tt.want {
+			t.Errorf("CSE(%q) = %d, want %d:\n%s", tt.src, got, tt.want, listing(fn))
+		}
+		if n := strings.Count(listing(fn), "call"); n != calls {
+			t.Errorf("%q: %d calls after CSE, want %d", tt.src, n, calls)
+		}
+	}
+}
+
+// TestOptimizeEffects checks that the passes together keep every call
+// of a builtin with effects, in order.
+func TestOptimizeEffects(t *testing.T) {
+	fn := build(t, `fn f(a) { print(a); print(a); rand(); rand(); a }; x = rand(); print(x); print(x); 1 + 2`)
+	Optimize(fn)
+	got := listing(fn)
+	want := "<top>: v0 = func f; setglobal f v0; v2 = builtin rand; v3 = call v2; setglobal x v3; v5 = builtin print; v6 = call v3 v5; v8 = call v3 v5; v11 = const 3; return v11;\n" +
+		"f: v0 = param 0; v1 = builtin print; v2 = call v0 v1; v4 = call v0 v1; v5 = builtin rand; v6 = call v5; v8 = call v5; return v0;\n"
+	if got != want {
+		t.Errorf("Optimize =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// newTestBuilder returns a builder of a function without blocks but the
+// entry, for the tests to draw their control flow.
+func newTestBuilder() *funcBuilder {
+	b := &builder{c: compile.New(), globals: make(map[string]bool)}
+	return b.newFunc(&Func{Name: "f", Parent: &Func{}}, nil)
+}
+
+// edge adds an edge from a to b.
+func edge(a, b *Block) {
+	a.Succs = append(a.Succs, b)
+	b.Preds = append(b.Preds, a)
+}
+
+// diamond returns the blocks of an if-else: entry branches to then and
+// els, which join.
+func diamond(fn *Func) (entry, then, els, join *Block) {
+	entry = fn.Entry()
+	then, els, join = fn.newBlock(), fn.newBlock(), fn.newBlock()
+	edge(entry, then)
+	edge(entry, els)
+	edge(then, join)
+	edge(els, join)
+	return
+}
+
+func TestPhi(t *testing.T) {
+	fb := newTestBuilder()
+	entry, then, els, join := diamond(fb.fn)
+	one := entry.newValue(OpConst, object.NewInteger(1), -1)
+	two := then.newValue(OpConst, object.NewInteger(2), -1)
+	three := els.newValue(OpConst, object.NewInteger(3), -1)
+	fb.write(entry, "x", one)
+	fb.write(entry, "y", one)
+	fb.write(then, "x", two)
+	fb.write(then, "z", two)
+	fb.write(els, "x", three)
+
+	phi := fb.read(join, "x")
+	if phi.Op != OpPhi || phi.Block != join || len(phi.Args) != 2 || phi.Args[0] != two || phi.Args[1] != three {
+		t.Fatalf("x at the join = %s", phi.LongString())
+	}
+	if two.Uses != 1 || three.Uses != 1 {
+		t.Errorf("phi arguments used %d and %d times, want once", two.Uses, three.Uses)
+	}
+	if fb.read(join, "x") != phi {
+		t.Error("x read twice makes two phis")
+	}
+	// The same value on both paths needs no phi, and a value defined on
+	// one path only is undefined.
+	if y := fb.read(join, "y"); y != one {
+		t.Errorf("y at the join = %v, want %s", y, one)
+	}
+	if z := fb.read(join, "z"); z != nil {
+		t.Errorf("z at the join = %s, want undefined", z.LongString())
+	}
+	if len(join.Values) != 1 {
+		t.Errorf("join has %d values, want the phi of x", len(join.Values))
+	}
+}
+
+func TestPhiLoop(t *testing.T) {
+	fb := newTestBuilder()
+	entry := fb.fn.Entry()
+	header, body := fb.fn.newBlock(), fb.fn.newBlock()
+	edge(entry, header)
+	edge(header, body)
+	edge(body, header)
+	zero := entry.newValue(OpConst, object.NewInteger(0), -1)
+	fb.write(entry, "i", zero)
+	fb.write(entry, "n", zero)
+	next := body.newValue(OpAdd, nil, -1, zero, zero)
+	fb.write(body, "i", next)
+
+	// i changes around the loop, n doesn't.
+	i := fb.read(header, "i")
+	if i.Op != OpPhi || len(i.Args) != 2 || i.Args[0] != zero || i.Args[1] != next {
+		t.Errorf("i in the loop = %s", i.LongString())
+	}
+	if n := fb.read(body, "n"); n != zero {
+		t.Errorf("n in the loop = %s, want %s", n.LongString(), zero)
+	}
+	if m := fb.read(body, "m"); m != nil {
+		t.Errorf("m in the loop = %s, want undefined", m.LongString())
+	}
+	if len(header.Values) != 1 {
+		t.Errorf("header has %d values, want the phi of i", len(header.Values))
+	}
+}
+
+func TestDominators(t *testing.T) {
+	fn := &Func{}
+	fn.newBlock()
+	entry, then, els, join := diamond(fn)
+	loop := fn.newBlock()
+	edge(join, loop)
+	edge(loop, join)
+	order := fn.Dominators()
+	if len(order) != 5 || order[0] != entry || order[len(order)-1] != loop {
+		t.Errorf("reverse postorder %v", order)
+	}
+	want := map[*Block]*Block{entry: nil, then: entry, els: entry, join: entry, loop: join}
+	for b, idom := range want {
+		if b.Idom != idom {
+			t.Errorf("idom of %s = %v, want %v", b, b.Idom, idom)
+		}
+	}
+	if s := fn.String(); !strings.Contains(s, "b3: <- b1 b2 b4 (idom b0)") {
+		t.Errorf("listing:\n%s", s)
+	}
+}
+
+// TestCSEDominators checks that CSE only reuses values of dominating
+// blocks.
+func TestCSEDominators(t *testing.T) {
+	fn := &Func{Params: []string{"a"}}
+	fn.newBlock()
+	entry, then, els, join := diamond(fn)
+	a := entry.newValue(OpParam, 0, -1)
+	add := func(b *Block) *Value { return b.newValue(OpAdd, nil, -1, a, a) }
+	mul := func(b *Block) *Value { return b.newValue(OpMul, nil, -1, a, a) }
+	add(entry)
+	add(then)
+	add(els)
+	add(join)
+	m1, m2, m3 := mul(then), mul(els), mul(join)
+	if n := CSE(fn); n != 3 {
+		t.Errorf("CSE replaced %d values, want the adds of the 3 blocks entry dominates", n)
+	}
+	for _, b := range []*Block{then, els, join} {
+		for _, v := range b.Values {
+			if v.Op == OpAdd {
+				t.Errorf("%s still computes %s", b, v.LongString())
+			}
+		}
+	}
+	// Neither branch dominates the other, nor the join.
+	if then.Values[0] != m1 || els.Values[0] != m2 || join.Values[0] != m3 {
+		t.Errorf("muls of the branches replaced:\n%s", fn)
+	}
+}
+
+func TestConstPropBlocks(t *testing.T) {
+	fb := newTestBuilder()
+	entry, then, els, join := diamond(fb.fn)
+	two := entry.newValue(OpConst, object.NewInteger(2), -1)
+	prod := join.newValue(OpMul, nil, -1, two, two)
+	fb.write(then, "x", then.newValue(OpConst, object.NewInteger(1), -1))
+	fb.write(els, "x", els.newValue(OpConst, object.NewInteger(1), -1))
+	x := fb.read(join, "x")
+	sum := join.newValue(OpAdd, nil, -1, x, two)
+	if n := ConstProp(fb.fn); n != 1 {
+		t.Errorf("ConstProp folded %d values, want 1", n)
+	}
+	if prod.Op != OpConst || prod.Aux.(object.Object).String() != "4" {
+		t.Errorf("2 * 2 = %s", prod.LongString())
+	}
+	// Phis of distinct constants are not folded.
+	if sum.Op != OpAdd {
+		t.Errorf("x + 2 = %s", sum.LongString())
+	}
+}
+
+// run runs the code of c on a VM for at most a million steps, returning
+// what it prints, its result and its error.
+func run(c *compile.Compiler) string {
+	var out bytes.Buffer
+	stdout := object.Stdout
+	object.Stdout = &out
+	defer func() { object.Stdout = stdout }()
+	machine := vm.New()
+	machine.SetBudget(object.NewBudget(context.Background(), object.Limits{MaxSteps: 1e6}))
+	machine.Next(c.Constants, c.OpCodes.Output())
+	if err := machine.Run(); err != nil {
+		return fmt.Sprintf("%serror: %v", out.String(), err)
+	}
+	return fmt.Sprintf("%s%v", out.String(), machine.LastPoppedStackElem())
+}
+
+// TestCorpus builds the conformance scripts, and checks that compiling
+// them through SSA, optimized or not, gives the code the same behavior on
+// the VM as compiling them directly.
+func TestCorpus(t *testing.T) {
+	scripts, err := filepath.Glob("../../testdata/conformance/*.pr")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no corpus: %v", err)
+	}
+	built := 0
+	for _, script := range scripts {
+		src, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(script)
+		parse := func() *parser.Program {
+			prog, errs := parser.Parse(string(src))
+			if len(errs) > 0 {
+				t.Fatalf("%s: %v", name, errs[0])
+			}
+			return prog
+		}
+		c := compile.New()
+		if err := c.Compile(parse()); err != nil {
+			continue // a compile error, covered by the conformance tests
+		}
+		want := run(c)
+		fn, err := Build(parse(), compile.New())
+		if err != nil {
+			if !strings.Contains(err.Error(), "closures are not supported") {
+				t.Errorf("%s: Build: %v", name, err)
+			}
+			continue
+		}
+		built++
+		for _, f := range append(fn.Funcs(), fn) {
+			if len(f.Blocks) != 1 || !f.Blocks[0].Values[len(f.Blocks[0].Values)-1].Op.terminator() {
+				t.Errorf("%s: %s is not one block ending in a terminator", name, f.name())
+			}
+		}
+		for _, opt := range []bool{false, true} {
+			c := compile.New()
+			if err := Compile(parse(), c, opt); err != nil {
+				t.Errorf("%s: Compile(opt=%v): %v", name, opt, err)
+				continue
+			}
+			if got := run(c); got != want {
+				t.Errorf("%s: opt=%v:\n%s\nwant\n%s", name, opt, got, want)
+			}
+		}
+	}
+	if built < len(scripts)/2 {
+		t.Errorf("built %d of %d scripts", built, len(scripts))
+	}
+}
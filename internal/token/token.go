@@ -29,6 +29,7 @@ const (
 	EQ   // "EQ"
 	ASSIGN
 	NOTEQ // "NE"
+	TILDE // "~"
 	IDENT
 	NUM // "number"
 	STR // "string"
@@ -82,6 +83,7 @@ var typeNames = [...]string{
 	EQ:     "==",
 	ASSIGN: "=",
 	NOTEQ:  "!=",
+	TILDE:  "~",
 	IDENT:  "identifier",
 	NUM:    "number",
 	STR:    "string",
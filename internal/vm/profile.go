@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"parrot/internal/code"
+	"parrot/internal/object"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A Profile records how many times a VM ran each op code and the code of
+// each function, and for how long. Timing every instruction slows the VM
+// down several times, so profiling is off unless SetProfile is called.
+type Profile struct {
+	Ops   [256]OpStats
+	Funcs map[*object.FunctionCompiled]*FuncStats // by function, nil for the top-level code
+
+	// The instruction running since start.
+	running bool
+	op      code.OpCode
+	fn      *FuncStats
+	start   time.Time
+}
+
+// OpStats are the statistics of an op code.
+type OpStats struct {
+	Count int64
+	Time  time.Duration
+}
+
+// FuncStats are the statistics of a function.
+type FuncStats struct {
+	Calls        int64 // tail calls included
+	Instructions int64
+	Time         time.Duration // spent in the function's own instructions
+}
+
+func NewProfile() *Profile {
+	return &Profile{Funcs: make(map[*object.FunctionCompiled]*FuncStats)}
+}
+
+// SetProfile records the following runs in p, or stops profiling if p is
+// nil.
+func (vm *VM) SetProfile(p *Profile) {
+	vm.profile = p
+}
+
+func (p *Profile) stats(fn *object.FunctionCompiled) *FuncStats {
+	s := p.Funcs[fn]
+	if s == nil {
+		s = &FuncStats{}
+		p.Funcs[fn] = s
+	}
+	return s
+}
+
+// call records a call of fn.
+func (p *Profile) call(fn *object.FunctionCompiled) {
+	p.stats(fn).Calls++
+}
+
+// instruction records the start of an op instruction of fn, which ends the
+// running one.
+func (p *Profile) instruction(op code.OpCode, fn *object.FunctionCompiled) {
+	now := time.Now()
+	p.stop(now)
+	s := p.stats(fn)
+	p.Ops[op].Count++
+	s.Instructions++
+	p.running, p.op, p.fn, p.start = true, op, s, now
+}
+
+// stop ends the running instruction at now.
+func (p *Profile) stop(now time.Time) {
+	if !p.running {
+		return
+	}
+	d := now.Sub(p.start)
+	p.Ops[p.op].Time += d
+	p.fn.Time += d
+	p.running = false
+}
+
+// WriteReport writes the n op codes and functions the most time was spent
+// in to w.
+func (p *Profile) WriteReport(w io.Writer, n int) error {
+	var total time.Duration
+	var ops []code.OpCode
+	for op, s := range p.Ops {
+		if s.Count > 0 {
+			ops = append(ops, code.OpCode(op))
+			total += s.Time
+		}
+	}
+	slices.SortStableFunc(ops, func(a, b code.OpCode) int {
+		return cmp.Compare(p.Ops[b].Time, p.Ops[a].Time)
+	})
+	fns := make([]*object.FunctionCompiled, 0, len(p.Funcs))
+	for fn := range p.Funcs {
+		fns = append(fns, fn)
+	}
+	slices.SortFunc(fns, func(a, b *object.FunctionCompiled) int {
+		if c := cmp.Compare(p.Funcs[b].Time, p.Funcs[a].Time); c != 0 {
+			return c
+		}
+		return strings.Compare(funcName(a), funcName(b))
+	})
+	percent := func(d time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "op code\tcount\ttime\t%%\n")
+	for _, op := range ops[:min(n, len(ops))] {
+		s := p.Ops[op]
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%.1f\n", op, s.Count, s.Time.Round(time.Microsecond), percent(s.Time))
+	}
+	fmt.Fprintf(tw, "\nfunction\tcalls\tinstructions\ttime\t%%\n")
+	for _, fn := range fns[:min(n, len(fns))] {
+		s := p.Funcs[fn]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%.1f\n", funcName(fn), s.Calls, s.Instructions, s.Time.Round(time.Microsecond), percent(s.Time))
+	}
+	return tw.Flush()
+}
+
+// funcName returns the name of fn in reports, where anonymous functions
+// are named by their source position.
+func funcName(fn *object.FunctionCompiled) string {
+	switch {
+	case fn == nil:
+		return "<top level>"
+	case fn.Name != "":
+		return fn.Name
+	case len(fn.SourceMap) == 0:
+		return "<anonymous>"
+	}
+	return fmt.Sprintf("fn at %d", fn.SourceMap[0].Pos+1)
+}
@@ -0,0 +1,62 @@
+package vm_test
+
+import (
+	"parrot/internal/bench"
+	"parrot/internal/compile"
+	"parrot/internal/parser"
+	"parrot/internal/vm"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	prog, errs := parser.Parse(bench.Programs[0].Source)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	c := compile.New()
+	if err := c.Compile(prog); err != nil {
+		t.Fatal(err)
+	}
+	p := vm.NewProfile()
+	machine := vm.New()
+	machine.SetProfile(p)
+	machine.Next(c.Constants, c.OpCodes.Output())
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := machine.LastPoppedStackElem().String(); got != bench.Programs[0].Result {
+		t.Fatalf("fib = %s, want %s", got, bench.Programs[0].Result)
+	}
+	calls := make(map[string]int64)
+	var ops, instructions int64
+	for fn, s := range p.Funcs {
+		if fn == nil {
+			calls["<top level>"] = s.Calls
+		} else {
+			calls[fn.Name] = s.Calls
+		}
+		instructions += s.Instructions
+	}
+	for _, s := range p.Ops {
+		ops += s.Count
+	}
+	// fib(20) makes 2*fib(21) - 1 calls of fib: fib(21) of them, with n < 2,
+	// call fib_small, the others fib_big.
+	want := map[string]int64{"<top level>": 1, "fib": 21891, "fib_big": 10945, "fib_small": 10946}
+	for name, n := range want {
+		if calls[name] != n {
+			t.Errorf("%s: %d calls, want %d", name, calls[name], n)
+		}
+	}
+	if ops != instructions {
+		t.Errorf("%d instructions by op code, %d by function", ops, instructions)
+	}
+	var b strings.Builder
+	if err := p.WriteReport(&b, 3); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.String(); strings.Count(r, "\n") != 2+3+1+3 || !strings.Contains(r, "\nfib ") {
+		t.Errorf("report:\n%s", r)
+	}
+}
@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"parrot/internal/code"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"strings"
+	"testing"
+)
+
+// TestSpecializedCode checks that after a run the VM's copies of the code
+// hold the superinstructions of the compiler and the integer operations
+// the VM specialized, while the compiled code is left alone.
+func TestSpecializedCode(t *testing.T) {
+	prog, errs := parser.Parse(`fn add(a, b) { c = a + b; c + 1 }
+fn sq(x) { x * x }
+r = add(1, sq(2))
+r < 100`)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	c := compile.New()
+	if err := c.Compile(prog); err != nil {
+		t.Fatal(err)
+	}
+	machine := New()
+	machine.Next(c.Constants, c.OpCodes.Output())
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := machine.LastPoppedStackElem(); got != True {
+		t.Fatalf("the program returned %s", got)
+	}
+
+	listings := map[string]string{}
+	disassemble := func(name string, ins []byte) {
+		t.Helper()
+		s, err := code.Disassemble(ins)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		listings[name] = s
+	}
+	disassemble("<main>", machine.main)
+	for _, o := range *c.Constants {
+		fn, ok := o.(*object.FunctionCompiled)
+		if !ok {
+			continue
+		}
+		ins, ok := machine.code[fn]
+		if !ok {
+			t.Fatalf("%s didn't run", fn.Name)
+		}
+		disassemble(fn.Name, ins)
+		if s, _ := code.Disassemble(fn.Instructions); strings.Contains(s, "Int") {
+			t.Errorf("the compiled code of %s was specialized:\n%s", fn.Name, s)
+		}
+	}
+	want := map[string][]code.OpCode{
+		"<main>": {code.OpCallGlobal, code.OpCmpLTInt},
+		"add":    {code.OpGetLocal2, code.OpAddInt, code.OpAddLocalConst},
+		"sq":     {code.OpGetLocal2, code.OpMulInt},
+	}
+	for name, ops := range want {
+		have := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(listings[name]), "\n") {
+			have[strings.Fields(line)[1]] = true
+		}
+		for _, op := range ops {
+			if !have[op.String()] {
+				t.Errorf("%s has no %s:\n%s", name, op, listings[name])
+			}
+		}
+	}
+}
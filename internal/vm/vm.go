@@ -1,14 +1,17 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"parrot/internal/code"
 	"parrot/internal/object"
+	"time"
 )
 
 const (
 	StackSize  = 2048
 	GlobalSize = 4096
+	MaxFrames  = object.DefaultMaxDepth
 )
 
 var (
@@ -18,43 +21,112 @@ var (
 )
 
 type Frame struct {
+	fn          *object.FunctionCompiled
+	cl          *object.Closure // the closure called, if fn was called as one
 	opCodes     []byte
 	ip          int // instruction pointer
 	basePointer int // the stack base pointer for the function call
-	parent      *Frame
 }
 
+// VM runs bytecode. It specializes instructions for the operand types it
+// sees in place, in its own copy of the code, so several VMs can run the
+// same code at once.
 type VM struct {
 	constants *[]object.Object
+	main      []byte                              // the copy of the top-level code
+	code      map[*object.FunctionCompiled][]byte // the copies of the functions' code
 	stack     []object.Object
 	globals   []object.Object
-	sp        int // Stack pointer: always points to the next free slot in the stack. Top of stack is stack[sp-1]
-	currFrame *Frame
+	names     []string // the names of the globals by index, see SetGlobalNames
+	sp        int      // Stack pointer: always points to the next free slot in the stack. Top of stack is stack[sp-1]
+	frames    []*Frame // frames[0] runs the top-level code, the others active function calls
+	currFrame *Frame   // the last frame
+	budget    *object.Budget
+	caps      object.Capability
+	profile   *Profile
 }
 
 func New() *VM {
+	main := &Frame{}
 	return &VM{
 		constants: &[]object.Object{},
 		stack:     make([]object.Object, StackSize),
 		globals:   make([]object.Object, GlobalSize),
 		sp:        0,
-		currFrame: &Frame{},
+		frames:    []*Frame{main},
+		currFrame: main,
+		caps:      object.CapAll,
 	}
 }
 
+// SetCapabilities restricts the builtins the VM runs to those enabled by
+// caps. The compiler already rejects disabled builtins; this guards against
+// bytecode compiled elsewhere.
+func (vm *VM) SetCapabilities(caps object.Capability) {
+	vm.caps = caps
+}
+
 func (vm *VM) Next(constants *[]object.Object, opCodes []byte) {
+	vm.unwind(1)
+	if constants != vm.constants {
+		clear(vm.code)
+	}
 	vm.constants = constants
-	vm.currFrame.opCodes = opCodes
+	vm.main = append(vm.main[:0], opCodes...)
+	vm.currFrame.opCodes = vm.main
 	vm.currFrame.ip = 0
 	vm.sp = 0
 }
 
-func (vm *VM) Run() (err error) {
-	// TODO
-	for vm.currFrame.ip < len(vm.currFrame.opCodes) {
-		op := vm.currFrame.opCodes[vm.currFrame.ip]
-		opc := code.OpCode(op)
-		vm.currFrame.ip += 1
+// SetBudget limits the following runs to b, or lifts the limits if b is nil.
+func (vm *VM) SetBudget(b *object.Budget) {
+	vm.budget = b
+}
+
+func (vm *VM) Run() error {
+	if vm.profile != nil {
+		vm.profile.call(nil)
+	}
+	return vm.run(0)
+}
+
+// run executes instructions until the function calls return down to stop
+// frames, or the top-level code ends. On error the frames above stop are
+// discarded.
+func (vm *VM) run(stop int) (err error) {
+	if vm.profile != nil {
+		defer func() { vm.profile.stop(time.Now()) }()
+	}
+	for len(vm.frames) > stop {
+		f := vm.currFrame
+		if f.ip >= len(f.opCodes) {
+			if len(vm.frames) == 1 {
+				return nil
+			}
+			err = fmt.Errorf("missing return at the end of %s", f.fn)
+			break
+		}
+		if vm.budget != nil {
+			if err = vm.budget.Step(); err != nil {
+				break
+			}
+		}
+		at := f.ip
+		opc := code.OpCode(f.opCodes[f.ip])
+		f.ip += 1
+		var arg int
+		if opc == code.OpExtendedArg {
+			// Wide arguments are rare: decode them as the verifier does.
+			if opc, arg, f.ip, err = code.Decode(f.opCodes, at); err != nil {
+				break
+			}
+		} else if opc.HasArg() {
+			arg = int(f.opCodes[f.ip])
+			f.ip++
+		}
+		if vm.profile != nil {
+			vm.profile.instruction(opc, f.fn)
+		}
 		switch opc {
 		case code.OpPop:
 			vm.pop()
@@ -63,97 +135,436 @@ func (vm *VM) Run() (err error) {
 		case code.OpFalse:
 			err = vm.push(False)
 		case code.OpAnd:
-			vm.doAND()
+			err = vm.doAND()
 		case code.OpOr:
-			vm.doOR()
+			err = vm.doOR()
 		case code.OpCmpEQ, code.OpCmpNE, code.OpCmpLE, code.OpCmpGE, code.OpCmpLT, code.OpCmpGT:
-			vm.doCmp(opc)
-		case code.OpAdd:
-			vm.doAdd()
-		case code.OpSub:
-			vm.doSub()
-		case code.OpMul:
-			vm.doMul()
-		case code.OpDiv:
-			vm.doDiv()
-		case code.OpMod:
-			vm.doMod()
+			vm.specialize(f, at, opc)
+			err = vm.doCmp(opc)
+		case code.OpAdd, code.OpSub, code.OpMul:
+			vm.specialize(f, at, opc)
+			err = vm.doArith(opc)
+		case code.OpAddInt, code.OpSubInt, code.OpMulInt,
+			code.OpCmpEQInt, code.OpCmpNEInt, code.OpCmpLTInt, code.OpCmpLEInt, code.OpCmpGTInt, code.OpCmpGEInt:
+			err = vm.doInt(f, at, opc)
+		case code.OpDiv, code.OpMod:
+			err = vm.doArith(opc)
+		case code.OpMatch:
+			err = vm.doMatch()
 		case code.OpMinus:
-			vm.doMinus()
+			err = vm.doMinus()
 		case code.OpBang:
 			vm.doBang()
 		case code.OpIndex:
-			vm.doIndex()
+			err = vm.doIndex()
+		case code.OpReturnValue:
+			err = vm.doReturn()
+		case code.OpCurrentClosure:
+			if f.cl != nil {
+				err = vm.push(f.cl)
+			} else {
+				err = vm.push(f.fn)
+			}
+		case code.OpClosure:
+			err = vm.doClosure(code.Unpack(arg))
+		case code.OpGetFree:
+			if f.cl == nil || arg >= len(f.cl.Free) {
+				err = fmt.Errorf("invalid free variable %d", arg)
+			} else {
+				err = vm.push(f.cl.Free[arg])
+			}
 		case code.OpConstant:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doLoadConst(int(arg))
-			vm.currFrame.ip += 4
+			vm.doLoadConst(arg)
 		case code.OpSetGlobal:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doStoreGlobal(int(arg))
-			vm.currFrame.ip += 4
+			vm.doStoreGlobal(arg)
 		case code.OpGetGlobal:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doGetGlobal(int(arg))
-			vm.currFrame.ip += 4
+			err = vm.doGetGlobal(arg)
 		case code.OpSetLocal:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doStoreLocal(int(arg))
-			vm.currFrame.ip += 4
+			vm.doStoreLocal(arg)
 		case code.OpGetLocal:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doGetLocal(int(arg))
-			vm.currFrame.ip += 4
+			vm.doGetLocal(arg)
+		case code.OpGetAttr:
+			err = vm.doGetAttr(arg)
+		case code.OpGetBuiltin:
+			err = vm.doGetBuiltin(arg)
 		case code.OpList:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			vm.doList(int(arg))
-			vm.currFrame.ip += 4
+			err = vm.doList(arg)
 		case code.OpCall:
-			arg := code.ReadUint32(vm.currFrame.opCodes[vm.currFrame.ip : vm.currFrame.ip+4])
-			err = vm.doCall(int(arg))
-			vm.currFrame.ip += 4
+			err = vm.doCall(arg)
+		case code.OpTailCall:
+			err = vm.doTailCall(arg)
+		case code.OpGetLocal2:
+			a, b := code.Unpack(arg)
+			vm.doGetLocal(a)
+			err = vm.push(vm.stack[f.basePointer+b])
+		case code.OpAddLocalConst:
+			err = vm.doAddLocalConst(arg)
+		case code.OpCallGlobal:
+			err = vm.doCallGlobal(code.Unpack(arg))
 		default:
-			panic("not implemented") // TODO: Implement
-
+			err = fmt.Errorf("unknown op code %s", opc)
+		}
+		if err != nil {
+			break
 		}
 	}
+	if err != nil {
+		vm.unwind(max(stop, 1))
+	}
 	return err
 }
 
+// intOps maps the operations with integer variants to these.
+var intOps = [256]code.OpCode{
+	code.OpAdd:   code.OpAddInt,
+	code.OpSub:   code.OpSubInt,
+	code.OpMul:   code.OpMulInt,
+	code.OpCmpEQ: code.OpCmpEQInt,
+	code.OpCmpNE: code.OpCmpNEInt,
+	code.OpCmpLT: code.OpCmpLTInt,
+	code.OpCmpLE: code.OpCmpLEInt,
+	code.OpCmpGT: code.OpCmpGTInt,
+	code.OpCmpGE: code.OpCmpGEInt,
+}
+
+// genericOps maps the integer variants back to their operations.
+var genericOps = func() (ops [256]code.OpCode) {
+	for op, intOp := range intOps {
+		if intOp != 0 {
+			ops[intOp] = code.OpCode(op)
+		}
+	}
+	return
+}()
+
+// intOperands returns the two operands on top of the stack if both are
+// integers.
+func (vm *VM) intOperands() (a, b int64, ok bool) {
+	x, ok := vm.stack[vm.sp-2].(*object.Integer)
+	if !ok {
+		return 0, 0, false
+	}
+	y, ok := vm.stack[vm.sp-1].(*object.Integer)
+	if !ok {
+		return 0, 0, false
+	}
+	return int64(*x), int64(*y), true
+}
+
+// instructions returns the VM's copy of the code of fn, which it may
+// specialize.
+func (vm *VM) instructions(fn *object.FunctionCompiled) []byte {
+	ins, ok := vm.code[fn]
+	if !ok {
+		if vm.code == nil {
+			vm.code = make(map[*object.FunctionCompiled][]byte)
+		}
+		ins = append([]byte(nil), fn.Instructions...)
+		vm.code[fn] = ins
+	}
+	return ins
+}
+
+// specialize rewrites the operation op at offset at of f's code to its
+// integer variant if its operands are integers, so that the following runs
+// of the instruction take the fast path of doInt.
+func (vm *VM) specialize(f *Frame, at int, op code.OpCode) {
+	if _, _, ok := vm.intOperands(); ok {
+		f.opCodes[at] = byte(intOps[op])
+	}
+}
+
+// doInt runs the integer variant op of an operation at offset at of f's
+// code. Operands of other types turn the instruction back into the
+// generic operation.
+func (vm *VM) doInt(f *Frame, at int, op code.OpCode) error {
+	a, b, ok := vm.intOperands()
+	if !ok {
+		generic := genericOps[op]
+		f.opCodes[at] = byte(generic)
+		switch generic {
+		case code.OpAdd, code.OpSub, code.OpMul:
+			return vm.doArith(generic)
+		}
+		return vm.doCmp(generic)
+	}
+	var result object.Object
+	switch op {
+	case code.OpAddInt:
+		result = object.NewInteger(a + b)
+	case code.OpSubInt:
+		result = object.NewInteger(a - b)
+	case code.OpMulInt:
+		result = object.NewInteger(a * b)
+	case code.OpCmpEQInt:
+		result = object.NewBoolean(a == b)
+	case code.OpCmpNEInt:
+		result = object.NewBoolean(a != b)
+	case code.OpCmpLTInt:
+		result = object.NewBoolean(a < b)
+	case code.OpCmpLEInt:
+		result = object.NewBoolean(a <= b)
+	case code.OpCmpGTInt:
+		result = object.NewBoolean(a > b)
+	case code.OpCmpGEInt:
+		result = object.NewBoolean(a >= b)
+	}
+	vm.sp--
+	vm.setTop(result)
+	return nil
+}
+
+// doAddLocalConst adds a constant to a local, packed in arg.
+func (vm *VM) doAddLocalConst(arg int) error {
+	local, index := code.Unpack(arg)
+	x := vm.stack[vm.currFrame.basePointer+local]
+	y := (*vm.constants)[index]
+	if a, ok := x.(*object.Integer); ok {
+		if b, ok := y.(*object.Integer); ok {
+			return vm.push(object.NewInteger(int64(*a + *b)))
+		}
+	}
+	if err := vm.push(x); err != nil {
+		return err
+	}
+	if err := vm.push(y); err != nil {
+		return err
+	}
+	return vm.doArith(code.OpAdd)
+}
+
+// doClosure makes a closure of the function constant index and the n free
+// variables on top of the stack.
+func (vm *VM) doClosure(n, index int) error {
+	fn, ok := (*vm.constants)[index].(*object.FunctionCompiled)
+	if !ok {
+		return fmt.Errorf("constant %d is not a function", index)
+	}
+	free := make([]object.Object, n)
+	copy(free, vm.stack[vm.sp-n:vm.sp])
+	vm.sp -= n
+	return vm.push(&object.Closure{Fn: fn, Free: free})
+}
+
 func (vm *VM) doCall(argsCnt int) (err error) {
 	f := vm.pop()
-	if f.Type() != object.FunctionCompiledType {
-		return fmt.Errorf("not function type")
+	switch fn := f.(type) {
+	case *object.FunctionCompiled:
+		return vm.pushFrame(fn, nil, argsCnt)
+	case *object.Closure:
+		return vm.pushFrame(fn.Fn, fn, argsCnt)
+	case object.Callable:
+		args := make([]object.Object, argsCnt)
+		for i := range argsCnt {
+			args[i] = vm.stack[vm.sp-argsCnt+i]
+			switch a := args[i].(type) {
+			case *object.FunctionCompiled:
+				args[i] = &callback{vm: vm, fn: a}
+			case *object.Closure:
+				args[i] = &callback{vm: vm, fn: a.Fn, cl: a}
+			}
+		}
+		vm.sp -= argsCnt
+		ret := fn.Call(args...)
+		if ret == nil {
+			ret = Null
+		}
+		switch e := ret.(type) {
+		case *object.Error:
+			return fmt.Errorf("%s", string(*e))
+		case *object.Interrupt:
+			return e.Err
+		}
+		return vm.push(ret)
+	}
+	return fmt.Errorf("not function type")
+}
+
+// doCallGlobal calls the global index with argsCnt arguments. Compiled
+// functions are called without going through the stack.
+func (vm *VM) doCallGlobal(argsCnt, index int) error {
+	switch fn := vm.globals[index].(type) {
+	case *object.FunctionCompiled:
+		return vm.pushFrame(fn, nil, argsCnt)
+	case *object.Closure:
+		return vm.pushFrame(fn.Fn, fn, argsCnt)
+	}
+	if err := vm.doGetGlobal(index); err != nil {
+		return err
 	}
-	fn := f.(*object.FunctionCompiled)
+	return vm.doCall(argsCnt)
+}
+
+// doTailCall calls a compiled function in the current frame, which is
+// finished but for returning the call's result. Anything else is called
+// as by doCall, leaving the result for the following OpReturnValue.
+func (vm *VM) doTailCall(argsCnt int) error {
+	var fn *object.FunctionCompiled
+	var cl *object.Closure
+	switch callee := vm.Top().(type) {
+	case *object.FunctionCompiled:
+		fn = callee
+	case *object.Closure:
+		fn, cl = callee.Fn, callee
+	}
+	if fn == nil || len(vm.frames) == 1 {
+		return vm.doCall(argsCnt)
+	}
+	vm.pop()
 	if fn.ParamsCnt != int8(argsCnt) {
 		return fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.ParamsCnt, argsCnt)
 	}
-	pf := vm.currFrame
-	nf := Frame{
-		opCodes:     fn.Instructions,
+	f := vm.currFrame
+	if f.basePointer+fn.LocalCnt >= StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+	if vm.profile != nil {
+		vm.profile.call(fn)
+	}
+	copy(vm.stack[f.basePointer:], vm.stack[vm.sp-argsCnt:vm.sp])
+	f.fn = fn
+	f.cl = cl
+	f.opCodes = vm.instructions(fn)
+	f.ip = 0
+	vm.sp = f.basePointer + fn.LocalCnt
+	return nil
+}
+
+// pushFrame starts a call of fn, or of the closure cl of fn if not nil,
+// with the argsCnt arguments on top of the stack; the run loop carries on
+// in the new frame.
+func (vm *VM) pushFrame(fn *object.FunctionCompiled, cl *object.Closure, argsCnt int) error {
+	if fn.ParamsCnt != int8(argsCnt) {
+		return fmt.Errorf("wrong number of arguments: expected %d, got %d", fn.ParamsCnt, argsCnt)
+	}
+	if vm.sp-argsCnt+fn.LocalCnt >= StackSize || len(vm.frames) > MaxFrames {
+		return fmt.Errorf("stack overflow")
+	}
+	if vm.budget != nil {
+		if err := vm.budget.Enter(); err != nil {
+			return err
+		}
+	}
+	if vm.profile != nil {
+		vm.profile.call(fn)
+	}
+	// Reuse the frame of an earlier call at this depth.
+	var f *Frame
+	if n := len(vm.frames); n < cap(vm.frames) {
+		f = vm.frames[:n+1][n]
+	}
+	if f == nil {
+		f = &Frame{}
+	}
+	*f = Frame{
+		fn:          fn,
+		cl:          cl,
+		opCodes:     vm.instructions(fn),
 		ip:          0,
 		basePointer: vm.sp - argsCnt,
-		parent:      pf,
 	}
-	vm.currFrame = &nf
-	vm.sp = nf.basePointer + fn.LocalCnt
-	err = vm.Run()
-	if err != nil {
-		return
+	vm.frames = append(vm.frames, f)
+	vm.currFrame = f
+	vm.sp = f.basePointer + fn.LocalCnt
+	return nil
+}
+
+// popFrame ends the current function call.
+func (vm *VM) popFrame() *Frame {
+	f := vm.currFrame
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.currFrame = vm.frames[len(vm.frames)-1]
+	if vm.budget != nil {
+		vm.budget.Leave()
 	}
+	return f
+}
+
+// unwind discards the frames above the first n.
+func (vm *VM) unwind(n int) {
+	for len(vm.frames) > n {
+		vm.popFrame()
+	}
+}
+
+func (vm *VM) doReturn() error {
 	ret := vm.pop()
-	vm.currFrame = pf
-	vm.sp = nf.basePointer
+	f := vm.popFrame()
+	vm.sp = f.basePointer
 	return vm.push(ret)
 }
 
+// callback lets builtins call a compiled function on the VM that passed it.
+type callback struct {
+	vm *VM
+	fn *object.FunctionCompiled
+	cl *object.Closure
+}
+
+func (cb *callback) Type() object.Type { return cb.fn.Type() }
+func (cb *callback) String() string    { return cb.fn.String() }
+
+// Call runs the function in a nested run loop, which returns once the
+// function does.
+func (cb *callback) Call(args ...object.Object) object.Object {
+	for _, a := range args {
+		if err := cb.vm.push(a); err != nil {
+			return cb.vm.errorObject(err)
+		}
+	}
+	stop := len(cb.vm.frames)
+	if err := cb.vm.pushFrame(cb.fn, cb.cl, len(args)); err != nil {
+		cb.vm.sp -= len(args)
+		return cb.vm.errorObject(err)
+	}
+	if err := cb.vm.run(stop); err != nil {
+		return cb.vm.errorObject(err)
+	}
+	return cb.vm.pop()
+}
+
+// SetGlobal sets the global with the given symbol index.
+func (vm *VM) SetGlobal(index int, o object.Object) {
+	vm.globals[index] = o
+}
+
+// SetGlobalNames names the globals by symbol index, for the error of
+// reading a global that is unset, as code compiled with
+// compile.Compiler.Externals may.
+func (vm *VM) SetGlobalNames(names []string) {
+	vm.names = names
+}
+
+// errorObject turns err into an error object for builtins, keeping
+// interruptions distinguishable from script errors.
+func (vm *VM) errorObject(err error) object.Object {
+	if vm.budget != nil && vm.budget.Interrupted(err) {
+		return &object.Interrupt{Err: err}
+	}
+	return object.NewError("%s", err)
+}
+
+// charge accounts for the allocation of o.
+func (vm *VM) charge(o object.Object) error {
+	if vm.budget == nil {
+		return nil
+	}
+	return vm.budget.Alloc(o)
+}
+
 func (vm *VM) doStoreGlobal(index int) {
 	vm.globals[index] = vm.pop()
 }
 
-func (vm *VM) doGetGlobal(index int) {
-	_ = vm.push(vm.globals[index])
+func (vm *VM) doGetGlobal(index int) error {
+	o := vm.globals[index]
+	if o == nil {
+		if index < len(vm.names) {
+			return fmt.Errorf("name %q is not defined", vm.names[index])
+		}
+		return fmt.Errorf("global %d is not defined", index)
+	}
+	return vm.push(o)
 }
 
 func (vm *VM) doStoreLocal(index int) {
@@ -168,17 +579,42 @@ func (vm *VM) doLoadConst(index int) {
 	_ = vm.push((*vm.constants)[index])
 }
 
-func (vm *VM) doList(llen int) {
+func (vm *VM) doList(llen int) error {
 	var list []object.Object
 	for i := range llen {
 		list = append(list, vm.stack[vm.sp-llen+i])
 	}
 	l := object.NewList(list...)
+	if err := vm.charge(l); err != nil {
+		return err
+	}
 	vm.sp -= llen
-	_ = vm.push(l)
+	return vm.push(l)
 }
 
-func (vm *VM) doIndex() {
+func (vm *VM) doGetBuiltin(index int) error {
+	b := object.Builtins[index]
+	if !vm.caps.Has(b.Cap) {
+		return object.DisabledError(b.Name, b.Cap)
+	}
+	return vm.push(b.Builtin)
+}
+
+func (vm *VM) doGetAttr(index int) error {
+	name := (*vm.constants)[index].(*object.String)
+	x, ok := vm.Top().(object.HasAttrs)
+	if !ok {
+		return fmt.Errorf("%q object has no attribute %q", vm.Top().Type(), string(*name))
+	}
+	o := x.Attr(string(*name))
+	if e, ok := o.(*object.Error); ok {
+		return fmt.Errorf("%s", string(*e))
+	}
+	vm.setTop(o)
+	return nil
+}
+
+func (vm *VM) doIndex() error {
 	index := vm.pop()
 	left := vm.Top()
 	switch {
@@ -186,7 +622,7 @@ func (vm *VM) doIndex() {
 		l := left.(*object.List)
 		i := index.(*object.Integer)
 		var o object.Object
-		if int(*i) >= len(*l) {
+		if *i < 0 || int(*i) >= len(*l) {
 			o = object.NewError("index out of range")
 		} else {
 			i := index.(*object.Integer)
@@ -197,27 +633,43 @@ func (vm *VM) doIndex() {
 		s := left.(*object.String)
 		i := index.(*object.Integer)
 		var o object.Object
-		if int(*i) >= len(*s) {
+		if *i < 0 || int(*i) >= len(*s) {
 			o = object.NewError("index out of range")
 		} else {
 			o = object.NewString(string(string(*s)[*i]))
 		}
 		vm.setTop(o)
 	default:
-		panic("not implemented") // TODO: Implement
+		x, ok := left.(object.Indexable)
+		if !ok {
+			return fmt.Errorf("invalid index operator for types %v and %v", left.Type(), index.Type())
+		}
+		o := x.Index(index)
+		if e, ok := o.(*object.Error); ok {
+			return fmt.Errorf("%s", string(*e))
+		}
+		vm.setTop(o)
 	}
+	return nil
 }
 
-func (vm *VM) doMinus() {
-	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		result := -*va
-		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
+func (vm *VM) doMatch() error {
+	pattern := vm.pop()
+	result := object.MatchGlob(vm.Top(), pattern)
+	if e, ok := result.(*object.Error); ok {
+		return fmt.Errorf("%s", string(*e))
 	}
+	vm.setTop(result)
+	return nil
+}
+
+func (vm *VM) doMinus() error {
+	a, ok := vm.Top().(*object.Integer)
+	if !ok {
+		return fmt.Errorf("runtime error: unknown operator: -%s", vm.Top())
+	}
+	vm.setTop(object.NewInteger(-int64(*a)))
+	return nil
 }
 
 func (vm *VM) doBang() {
@@ -229,87 +681,79 @@ func (vm *VM) doBang() {
 	}
 }
 
-func (vm *VM) doMod() {
-	b := vm.pop()
-	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
-		result := *va % *vb
-		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
-	}
+var opSymbols = [256]string{
+	code.OpAdd: "+", code.OpSub: "-", code.OpMul: "*", code.OpDiv: "/", code.OpMod: "%",
+	code.OpCmpEQ: "==", code.OpCmpNE: "!=", code.OpCmpLT: "<", code.OpCmpLE: "<=",
+	code.OpCmpGT: ">", code.OpCmpGE: ">=",
+	code.OpAnd: "and", code.OpOr: "or",
 }
 
-func (vm *VM) doDiv() {
-	b := vm.pop()
-	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
-		result := *va / *vb
-		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
-	}
+// unknownOperator is the error of the operation op on operands of the
+// wrong types.
+func unknownOperator(op code.OpCode, a, b object.Object) error {
+	return fmt.Errorf("runtime error: unknown operator: %s %s %s", a, opSymbols[op], b)
 }
 
-func (vm *VM) doMul() {
-	b := vm.pop()
-	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
-		result := *va * *vb
-		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
-	}
-}
+// errDivisionByZero is the error of a division or modulo by zero.
+var errDivisionByZero = errors.New("division by zero")
 
-func (vm *VM) doSub() {
+// doArith runs the arithmetic operation op on the two integers on top of
+// the stack, or for OpAdd on two strings.
+func (vm *VM) doArith(op code.OpCode) error {
 	b := vm.pop()
 	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
-		result := *va - *vb
+	if x, ok := a.(*object.String); ok && op == code.OpAdd {
+		y, ok := b.(*object.String)
+		if !ok {
+			return unknownOperator(op, a, b)
+		}
+		result := *x + *y
+		if err := vm.charge(&result); err != nil {
+			return err
+		}
 		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
+		return nil
 	}
-}
-
-func (vm *VM) doAdd() {
-	b := vm.pop()
-	a := vm.Top()
-	switch a.Type() {
-	case object.IntType:
-		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
-		result := *va + *vb
-		vm.setTop(&result)
-	case object.StringType:
-		va := a.(*object.String)
-		vb := b.(*object.String)
-		result := *va + *vb
-		vm.setTop(&result)
-	default:
-		panic("not implemented") // TODO: Implement
+	x, ok := a.(*object.Integer)
+	if !ok {
+		return unknownOperator(op, a, b)
+	}
+	y, ok := b.(*object.Integer)
+	if !ok {
+		return unknownOperator(op, a, b)
+	}
+	var n int64
+	switch op {
+	case code.OpAdd:
+		n = int64(*x + *y)
+	case code.OpSub:
+		n = int64(*x - *y)
+	case code.OpMul:
+		n = int64(*x * *y)
+	case code.OpDiv, code.OpMod:
+		if *y == 0 {
+			return errDivisionByZero
+		}
+		if op == code.OpDiv {
+			n = int64(*x / *y)
+		} else {
+			n = int64(*x % *y)
+		}
 	}
+	vm.setTop(object.NewInteger(n))
+	return nil
 }
 
-func (vm *VM) doCmp(opCode code.OpCode) {
+func (vm *VM) doCmp(opCode code.OpCode) error {
 	b := vm.pop()
 	a := vm.Top()
 	result := False
 	switch a.Type() {
 	case object.BoolType:
+		// Booleans are only compared for equality, like in the evaluator.
+		if b.Type() != object.BoolType {
+			return unknownOperator(opCode, a, b)
+		}
 		switch opCode {
 		case code.OpCmpEQ:
 			if a == b {
@@ -319,26 +763,15 @@ func (vm *VM) doCmp(opCode code.OpCode) {
 			if a != b {
 				result = True
 			}
-		case code.OpCmpLE:
-			if a == b || (a == False) {
-				result = True
-			}
-		case code.OpCmpGE:
-			if a == b || (a == True) {
-				result = True
-			}
-		case code.OpCmpLT:
-			if a == False && b == True {
-				result = True
-			}
-		case code.OpCmpGT:
-			if a == True && b == False {
-				result = True
-			}
+		default:
+			return unknownOperator(opCode, a, b)
 		}
 	case object.IntType:
 		va := a.(*object.Integer)
-		vb := b.(*object.Integer)
+		vb, ok := b.(*object.Integer)
+		if !ok {
+			return unknownOperator(opCode, a, b)
+		}
 		switch opCode {
 		case code.OpCmpEQ:
 			if *va == *vb {
@@ -367,7 +800,10 @@ func (vm *VM) doCmp(opCode code.OpCode) {
 		}
 	case object.StringType:
 		va := a.(*object.String)
-		vb := b.(*object.String)
+		vb, ok := b.(*object.String)
+		if !ok {
+			return unknownOperator(opCode, a, b)
+		}
 		switch opCode {
 		case code.OpCmpEQ:
 			if *va == *vb {
@@ -395,32 +831,38 @@ func (vm *VM) doCmp(opCode code.OpCode) {
 			}
 		}
 	default:
-		panic("not implemented") // TODO: Implement
+		return unknownOperator(opCode, a, b)
 	}
 	vm.setTop(result)
+	return nil
 }
 
-func (vm *VM) doOR() {
+func (vm *VM) doOR() error {
 	b := vm.pop()
 	a := vm.Top()
+	if a.Type() != object.BoolType || b.Type() != object.BoolType {
+		return unknownOperator(code.OpOr, a, b)
+	}
 	if a != True && b != True {
 		vm.setTop(False)
 	} else {
 		vm.setTop(True)
 	}
+	return nil
 }
 
-func (vm *VM) doAND() {
+func (vm *VM) doAND() error {
 	b := vm.pop()
 	a := vm.Top()
-	if a == True && b == True {
-		if a != True {
-			vm.setTop(True)
-		}
+	if a.Type() != object.BoolType || b.Type() != object.BoolType {
+		return unknownOperator(code.OpAnd, a, b)
 	}
-	if a != False {
+	if a == True && b == True {
+		vm.setTop(True)
+	} else {
 		vm.setTop(False)
 	}
+	return nil
 }
 
 func (vm *VM) push(o object.Object) error {
@@ -0,0 +1,114 @@
+package vm_test
+
+import (
+	"fmt"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/parser"
+	"parrot/internal/vm"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// callsSrc makes 600 calls of global functions on small integers.
+func callsSrc() string {
+	var b strings.Builder
+	b.WriteString("fn add(a, b) { c = a + b; c * 2 - a }\n")
+	b.WriteString("fn sq(x) { x * x }\n")
+	for i := range 300 {
+		fmt.Fprintf(&b, "v%d = add(%d, sq(%d)) %% 7 + %d\n", i, i, i+1, i*3)
+	}
+	b.WriteString("v1 + v2\n")
+	return b.String()
+}
+
+// localsSrc makes 300 calls of a function adding constants to locals.
+func localsSrc() string {
+	var b strings.Builder
+	b.WriteString("fn step(x, y) { a = x + 1; b = y + 2; c = a + 3; d = b + 4; a < b and c <= d or a + b > c + d }\n")
+	for i := range 300 {
+		fmt.Fprintf(&b, "w%d = step(%d, %d)\n", i, i%50, i%40)
+	}
+	b.WriteString("w1\n")
+	return b.String()
+}
+
+func compileSource(tb testing.TB, src string, passes []compile.Pass) *compile.Compiler {
+	tb.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		tb.Fatal(errs[0])
+	}
+	c := compile.New()
+	c.Passes = passes
+	if err := c.Compile(prog); err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// TestConcurrent runs the same code on several VMs at once, which
+// specialize it each in their own copy. Run with -race.
+func TestConcurrent(t *testing.T) {
+	// f's additions see integers on some calls and strings on others.
+	c := compileSource(t, `fn f(a, b) { a + b < a + b + b }
+r = [f(1, 2), f("a", "b"), f(3, 4), f(5, 0)]; r`, compile.DefaultPasses())
+	out := c.OpCodes.Output()
+	fn := (*c.Constants)[0].(*object.FunctionCompiled)
+	shared := string(fn.Instructions)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := vm.New()
+			for range 100 {
+				m.Next(c.Constants, out)
+				if err := m.Run(); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := m.LastPoppedStackElem().String(); got != "[true, true, true, false]" {
+					t.Errorf("got %s", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if string(fn.Instructions) != shared {
+		t.Error("the VMs rewrote the shared code of f")
+	}
+}
+
+// BenchmarkRun runs programs of calls on the stack VM, without and with
+// superinstructions, reporting the size of the top-level code. The
+// integer results and the frames don't allocate.
+func BenchmarkRun(b *testing.B) {
+	progs := []struct{ name, src string }{{"calls", callsSrc()}, {"locals", localsSrc()}}
+	passes := []struct {
+		name   string
+		passes []compile.Pass
+	}{
+		{"plain", []compile.Pass{compile.LoadPop{}, compile.BangBang{}}},
+		{"super", compile.DefaultPasses()},
+	}
+	for _, p := range progs {
+		for _, ps := range passes {
+			b.Run(p.name+"/"+ps.name, func(b *testing.B) {
+				c := compileSource(b, p.src, ps.passes)
+				out := c.OpCodes.Output()
+				m := vm.New()
+				b.ReportAllocs()
+				b.ReportMetric(float64(len(out)), "bytes")
+				for range b.N {
+					m.Next(c.Constants, out)
+					if err := m.Run(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
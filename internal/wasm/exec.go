@@ -0,0 +1,230 @@
+package wasm
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxDepth bounds the nesting of calls.
+const MaxDepth = 10000
+
+// Trap is a runtime error of Wasm code.
+type Trap struct {
+	Msg string
+}
+
+func (t *Trap) Error() string {
+	return "wasm: trap: " + t.Msg
+}
+
+func trap(format string, a ...any) {
+	panic(&Trap{Msg: fmt.Sprintf(format, a...)})
+}
+
+// Machine is an instance of a module. Values are held in uint64s, i32s in
+// their low 32 bits.
+type Machine struct {
+	mod     *Module
+	globals []uint64
+	depth   int
+	// Fuel is the number of instructions left to run before trapping, if
+	// positive when the run starts.
+	Fuel int64
+	fuel bool
+}
+
+// NewMachine instantiates m.
+func NewMachine(m *Module) *Machine {
+	vm := &Machine{mod: m, globals: make([]uint64, len(m.Globals))}
+	for i, g := range m.Globals {
+		vm.globals[i] = g.Init
+	}
+	return vm
+}
+
+// Invoke calls the function exported as name with args, returning its
+// results.
+func (vm *Machine) Invoke(name string, args ...uint64) (res []uint64, err error) {
+	i, ok := vm.mod.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("wasm: no function is exported as %q", name)
+	}
+	fn := vm.mod.Funcs[i]
+	if len(args) != len(fn.Params) {
+		return nil, fmt.Errorf("wasm: %s expects %d arguments, got %d", name, len(fn.Params), len(args))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t, ok := r.(*Trap)
+			if !ok {
+				panic(r)
+			}
+			res, err = nil, t
+		}
+	}()
+	vm.fuel = vm.Fuel > 0
+	vm.depth = 0
+	return vm.call(fn, args), nil
+}
+
+// label is a block entered by a function.
+type label struct {
+	cont   int // where a branch goes
+	height int // the height of the stack on entry
+	arity  int // the number of values a branch keeps
+	loop   bool
+}
+
+func (vm *Machine) call(fn *Func, args []uint64) []uint64 {
+	if vm.depth >= MaxDepth {
+		trap("call stack exhausted")
+	}
+	vm.depth++
+	defer func() { vm.depth-- }()
+	locals := make([]uint64, len(fn.Params)+len(fn.Locals))
+	copy(locals, args)
+	var stack []uint64
+	var labels []label
+	pop := func() uint64 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	push := func(v uint64) { stack = append(stack, v) }
+	branch := func(depth int) int {
+		l := labels[len(labels)-1-depth]
+		kept := stack[len(stack)-l.arity:]
+		stack = append(stack[:l.height], kept...)
+		if l.loop {
+			labels = labels[:len(labels)-depth]
+		} else {
+			labels = labels[:len(labels)-1-depth]
+		}
+		return l.cont
+	}
+	code := fn.Code
+	for pc := 0; pc < len(code); pc++ {
+		if vm.fuel {
+			if vm.Fuel <= 0 {
+				trap("out of fuel")
+			}
+			vm.Fuel--
+		}
+		ins := code[pc]
+		switch ins.Op {
+		case OpUnreachable:
+			trap("unreachable")
+		case OpNop:
+		case OpBlock:
+			labels = append(labels, label{cont: ins.End + 1, height: len(stack), arity: ins.Arity})
+		case OpLoop:
+			labels = append(labels, label{cont: pc + 1, height: len(stack), loop: true})
+		case OpEnd:
+			labels = labels[:len(labels)-1]
+		case OpBr:
+			pc = branch(int(ins.Imm)) - 1
+		case OpBrIf:
+			if uint32(pop()) != 0 {
+				pc = branch(int(ins.Imm)) - 1
+			}
+		case OpReturn:
+			return stack[len(stack)-len(fn.Results):]
+		case OpCall:
+			callee := vm.mod.Funcs[ins.Imm]
+			n := len(callee.Params)
+			args := append([]uint64(nil), stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], vm.call(callee, args)...)
+		case OpDrop:
+			pop()
+		case OpLocalGet:
+			push(locals[ins.Imm])
+		case OpLocalSet:
+			locals[ins.Imm] = pop()
+		case OpLocalTee:
+			locals[ins.Imm] = stack[len(stack)-1]
+		case OpGlobalGet:
+			push(vm.globals[ins.Imm])
+		case OpGlobalSet:
+			if !vm.mod.Globals[ins.Imm].Mutable {
+				trap("global %d is immutable", ins.Imm)
+			}
+			vm.globals[ins.Imm] = pop()
+		case OpI32Const, OpI64Const:
+			push(ins.Imm)
+		case OpI32Eqz:
+			push(boolValue(uint32(pop()) == 0))
+		case OpI64Eqz:
+			push(boolValue(pop() == 0))
+		case OpI64ExtendI32U:
+			push(uint64(uint32(pop())))
+		default:
+			y, x := pop(), pop()
+			push(binary(ins.Op, x, y))
+		}
+	}
+	return stack[len(stack)-len(fn.Results):]
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binary applies a binary operator.
+func binary(op Opcode, x, y uint64) uint64 {
+	a, b := int64(x), int64(y)
+	switch op {
+	case OpI32Eq:
+		return boolValue(uint32(x) == uint32(y))
+	case OpI32Ne:
+		return boolValue(uint32(x) != uint32(y))
+	case OpI32And:
+		return uint64(uint32(x & y))
+	case OpI32Or:
+		return uint64(uint32(x | y))
+	case OpI32Xor:
+		return uint64(uint32(x ^ y))
+	case OpI32Add:
+		return uint64(uint32(x + y))
+	case OpI32Sub:
+		return uint64(uint32(x - y))
+	case OpI64Eq:
+		return boolValue(x == y)
+	case OpI64Ne:
+		return boolValue(x != y)
+	case OpI64LtS:
+		return boolValue(a < b)
+	case OpI64LeS:
+		return boolValue(a <= b)
+	case OpI64GtS:
+		return boolValue(a > b)
+	case OpI64GeS:
+		return boolValue(a >= b)
+	case OpI64Add:
+		return x + y
+	case OpI64Sub:
+		return x - y
+	case OpI64Mul:
+		return x * y
+	case OpI64DivS:
+		if b == 0 {
+			trap("division by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			trap("integer overflow")
+		}
+		return uint64(a / b)
+	case OpI64RemS:
+		if b == 0 {
+			trap("division by zero")
+		}
+		if b == -1 {
+			return 0
+		}
+		return uint64(a % b)
+	}
+	trap("unknown instruction %s", op)
+	return 0
+}
@@ -0,0 +1,594 @@
+package wasm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ValType is a Wasm value type.
+type ValType byte
+
+const (
+	I32 ValType = iota
+	I64
+)
+
+func (t ValType) String() string {
+	if t == I32 {
+		return "i32"
+	}
+	return "i64"
+}
+
+// Module is a parsed module.
+type Module struct {
+	Globals []Global
+	Funcs   []*Func
+	Exports map[string]int // indexes of the exported functions
+}
+
+// Global is a global variable.
+type Global struct {
+	Name    string
+	Type    ValType
+	Mutable bool
+	Init    uint64
+}
+
+// Func is a function.
+type Func struct {
+	Name    string
+	Params  []ValType
+	Results []ValType
+	Locals  []ValType // the locals after the parameters
+	Code    []Instr
+}
+
+// Instr is an instruction.
+type Instr struct {
+	Op  Opcode
+	Imm uint64 // the constant, index or label depth
+	// End is the index of the end of a block or loop, Arity the number of
+	// its results.
+	End, Arity int
+}
+
+// Opcode is an instruction code.
+type Opcode byte
+
+const (
+	OpUnreachable Opcode = iota
+	OpNop
+	OpBlock
+	OpLoop
+	OpEnd
+	OpBr
+	OpBrIf
+	OpReturn
+	OpCall
+	OpDrop
+	OpLocalGet
+	OpLocalSet
+	OpLocalTee
+	OpGlobalGet
+	OpGlobalSet
+	OpI32Const
+	OpI64Const
+	OpI32Eqz
+	OpI32Eq
+	OpI32Ne
+	OpI32And
+	OpI32Or
+	OpI32Xor
+	OpI32Add
+	OpI32Sub
+	OpI64Eqz
+	OpI64Eq
+	OpI64Ne
+	OpI64LtS
+	OpI64LeS
+	OpI64GtS
+	OpI64GeS
+	OpI64Add
+	OpI64Sub
+	OpI64Mul
+	OpI64DivS
+	OpI64RemS
+	OpI64ExtendI32U
+)
+
+var opNames = [...]string{
+	OpUnreachable:   "unreachable",
+	OpNop:           "nop",
+	OpBlock:         "block",
+	OpLoop:          "loop",
+	OpEnd:           "end",
+	OpBr:            "br",
+	OpBrIf:          "br_if",
+	OpReturn:        "return",
+	OpCall:          "call",
+	OpDrop:          "drop",
+	OpLocalGet:      "local.get",
+	OpLocalSet:      "local.set",
+	OpLocalTee:      "local.tee",
+	OpGlobalGet:     "global.get",
+	OpGlobalSet:     "global.set",
+	OpI32Const:      "i32.const",
+	OpI64Const:      "i64.const",
+	OpI32Eqz:        "i32.eqz",
+	OpI32Eq:         "i32.eq",
+	OpI32Ne:         "i32.ne",
+	OpI32And:        "i32.and",
+	OpI32Or:         "i32.or",
+	OpI32Xor:        "i32.xor",
+	OpI32Add:        "i32.add",
+	OpI32Sub:        "i32.sub",
+	OpI64Eqz:        "i64.eqz",
+	OpI64Eq:         "i64.eq",
+	OpI64Ne:         "i64.ne",
+	OpI64LtS:        "i64.lt_s",
+	OpI64LeS:        "i64.le_s",
+	OpI64GtS:        "i64.gt_s",
+	OpI64GeS:        "i64.ge_s",
+	OpI64Add:        "i64.add",
+	OpI64Sub:        "i64.sub",
+	OpI64Mul:        "i64.mul",
+	OpI64DivS:       "i64.div_s",
+	OpI64RemS:       "i64.rem_s",
+	OpI64ExtendI32U: "i64.extend_i32_u",
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Opcode(%d)", byte(op))
+}
+
+var opcodes = func() map[string]Opcode {
+	m := make(map[string]Opcode, len(opNames))
+	for op, name := range opNames {
+		m[name] = Opcode(op)
+	}
+	return m
+}()
+
+// node is an s-expression: an atom, a string or a list.
+type node struct {
+	atom string
+	str  bool
+	list []*node
+	pos  int
+}
+
+func (n *node) isList() bool {
+	return n.list != nil
+}
+
+// head returns the keyword starting a list, if any.
+func (n *node) head() string {
+	if len(n.list) == 0 || n.list[0].isList() || n.list[0].str {
+		return ""
+	}
+	return n.list[0].atom
+}
+
+// Parse parses a module in the text format. It supports the fields and the
+// plain, unfolded instructions that Generate emits.
+func Parse(src string) (*Module, error) {
+	p := &sexprParser{src: src}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if root.head() != "module" {
+		return nil, fmt.Errorf("wasm: %d: expected a module", root.pos)
+	}
+	return newModuleBuilder().build(root)
+}
+
+type sexprParser struct {
+	src string
+	off int
+}
+
+func (p *sexprParser) errorf(format string, a ...any) error {
+	return fmt.Errorf("wasm: %d: %s", p.off+1, fmt.Sprintf(format, a...))
+}
+
+func (p *sexprParser) skip() {
+	for p.off < len(p.src) {
+		switch c := p.src[p.off]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.off++
+		case strings.HasPrefix(p.src[p.off:], ";;"):
+			for p.off < len(p.src) && p.src[p.off] != '\n' {
+				p.off++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *sexprParser) parse() (*node, error) {
+	p.skip()
+	n, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.off < len(p.src) {
+		return nil, p.errorf("unexpected %q after the module", p.src[p.off])
+	}
+	return n, nil
+}
+
+func (p *sexprParser) node() (*node, error) {
+	if p.off >= len(p.src) {
+		return nil, p.errorf("unexpected end of input")
+	}
+	n := &node{pos: p.off + 1}
+	switch p.src[p.off] {
+	case '(':
+		p.off++
+		n.list = []*node{}
+		for {
+			p.skip()
+			if p.off >= len(p.src) {
+				return nil, p.errorf("missing )")
+			}
+			if p.src[p.off] == ')' {
+				p.off++
+				return n, nil
+			}
+			c, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, c)
+		}
+	case ')':
+		return nil, p.errorf("unexpected )")
+	case '"':
+		end := strings.IndexByte(p.src[p.off+1:], '"')
+		if end < 0 {
+			return nil, p.errorf("unterminated string")
+		}
+		n.atom, n.str = p.src[p.off+1:p.off+1+end], true
+		p.off += end + 2
+		return n, nil
+	}
+	start := p.off
+	for p.off < len(p.src) && !strings.ContainsRune(" \t\r\n()\";", rune(p.src[p.off])) {
+		p.off++
+	}
+	n.atom = p.src[start:p.off]
+	return n, nil
+}
+
+// moduleBuilder resolves the names of a module.
+type moduleBuilder struct {
+	m       *Module
+	funcs   map[string]int
+	globals map[string]int
+}
+
+func newModuleBuilder() *moduleBuilder {
+	return &moduleBuilder{
+		m:       &Module{Exports: make(map[string]int)},
+		funcs:   make(map[string]int),
+		globals: make(map[string]int),
+	}
+}
+
+func errorAt(n *node, format string, a ...any) error {
+	return fmt.Errorf("wasm: %d: %s", n.pos, fmt.Sprintf(format, a...))
+}
+
+func (b *moduleBuilder) build(root *node) (*Module, error) {
+	var bodies []*node
+	// Declare everything first, functions may call those defined after them.
+	for _, field := range root.list[1:] {
+		var err error
+		switch field.head() {
+		case "global":
+			err = b.global(field)
+		case "func":
+			err = b.declareFunc(field)
+			bodies = append(bodies, field)
+		case "export":
+			continue
+		default:
+			err = errorAt(field, "unsupported module field")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range root.list[1:] {
+		if field.head() == "export" {
+			if err := b.export(field); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, field := range bodies {
+		if err := b.funcBody(b.m.Funcs[i], field); err != nil {
+			return nil, err
+		}
+	}
+	return b.m, nil
+}
+
+func valType(n *node) (ValType, error) {
+	switch n.atom {
+	case "i32":
+		return I32, nil
+	case "i64":
+		return I64, nil
+	}
+	return 0, errorAt(n, "unsupported value type %q", n.atom)
+}
+
+func isID(n *node) bool {
+	return !n.isList() && !n.str && strings.HasPrefix(n.atom, "$")
+}
+
+func (b *moduleBuilder) global(n *node) error {
+	args := n.list[1:]
+	var g Global
+	if len(args) > 0 && isID(args[0]) {
+		g.Name = args[0].atom
+		b.globals[g.Name] = len(b.m.Globals)
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return errorAt(n, "malformed global")
+	}
+	t := args[0]
+	if t.head() == "mut" && len(t.list) == 2 {
+		g.Mutable = true
+		t = t.list[1]
+	}
+	var err error
+	if g.Type, err = valType(t); err != nil {
+		return err
+	}
+	init := args[1]
+	if init.head() != g.Type.String()+".const" || len(init.list) != 2 {
+		return errorAt(init, "unsupported global initializer")
+	}
+	if g.Init, err = constant(g.Type, init.list[1]); err != nil {
+		return err
+	}
+	b.m.Globals = append(b.m.Globals, g)
+	return nil
+}
+
+func constant(t ValType, n *node) (uint64, error) {
+	bits := 64
+	if t == I32 {
+		bits = 32
+	}
+	v, err := strconv.ParseInt(n.atom, 0, bits)
+	if err != nil {
+		u, uerr := strconv.ParseUint(n.atom, 0, bits)
+		if uerr != nil {
+			return 0, errorAt(n, "invalid %s constant %q", t, n.atom)
+		}
+		v = int64(u)
+	}
+	if t == I32 {
+		return uint64(uint32(v)), nil
+	}
+	return uint64(v), nil
+}
+
+func (b *moduleBuilder) declareFunc(n *node) error {
+	fn := &Func{}
+	idx := len(b.m.Funcs)
+	args := n.list[1:]
+	if len(args) > 0 && isID(args[0]) {
+		fn.Name = args[0].atom
+		b.funcs[fn.Name] = idx
+		args = args[1:]
+	}
+	for _, a := range args {
+		var err error
+		switch a.head() {
+		case "export":
+			if len(a.list) != 2 || !a.list[1].str {
+				return errorAt(a, "malformed export")
+			}
+			b.m.Exports[a.list[1].atom] = idx
+		case "param":
+			fn.Params, err = b.types(fn.Params, a)
+		case "result":
+			fn.Results, err = b.types(fn.Results, a)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	b.m.Funcs = append(b.m.Funcs, fn)
+	return nil
+}
+
+// types appends the types of a param, result or local list to ts.
+func (b *moduleBuilder) types(ts []ValType, n *node) ([]ValType, error) {
+	for _, a := range n.list[1:] {
+		if isID(a) {
+			continue
+		}
+		t, err := valType(a)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+func (b *moduleBuilder) export(n *node) error {
+	if len(n.list) != 3 || !n.list[1].str || n.list[2].head() != "func" || len(n.list[2].list) != 2 {
+		return errorAt(n, "unsupported export")
+	}
+	i, err := b.index(n.list[2].list[1], b.funcs, len(b.m.Funcs))
+	if err != nil {
+		return err
+	}
+	b.m.Exports[n.list[1].atom] = int(i)
+	return nil
+}
+
+// index resolves a name or number referring to one of n items.
+func (b *moduleBuilder) index(ref *node, names map[string]int, n int) (uint64, error) {
+	if isID(ref) {
+		i, ok := names[ref.atom]
+		if !ok {
+			return 0, errorAt(ref, "unknown name %s", ref.atom)
+		}
+		return uint64(i), nil
+	}
+	i, err := strconv.ParseUint(ref.atom, 10, 32)
+	if err != nil || int(i) >= n {
+		return 0, errorAt(ref, "invalid index %q", ref.atom)
+	}
+	return i, nil
+}
+
+// funcBody compiles the locals and instructions of fn.
+func (b *moduleBuilder) funcBody(fn *Func, n *node) error {
+	locals := make(map[string]int)
+	nlocals := 0
+	var body []*node
+	args := n.list[1:]
+	if len(args) > 0 && isID(args[0]) {
+		args = args[1:]
+	}
+	for _, a := range args {
+		switch a.head() {
+		case "param", "local":
+			for _, x := range a.list[1:] {
+				if isID(x) {
+					locals[x.atom] = nlocals
+					continue
+				}
+				if a.head() == "local" {
+					t, err := valType(x)
+					if err != nil {
+						return err
+					}
+					fn.Locals = append(fn.Locals, t)
+				}
+				nlocals++
+			}
+		case "export", "result":
+		default:
+			body = append(body, a)
+		}
+	}
+	var labels []string // names of the enclosing blocks, innermost last
+	var open []int      // indexes of their instructions
+	for i := 0; i < len(body); i++ {
+		a := body[i]
+		if a.isList() || a.str {
+			return errorAt(a, "folded instructions are not supported")
+		}
+		op, ok := opcodes[a.atom]
+		if !ok {
+			return errorAt(a, "unsupported instruction %s", a.atom)
+		}
+		ins := Instr{Op: op}
+		// imm returns the immediate operand.
+		imm := func() (*node, error) {
+			if i+1 >= len(body) || body[i+1].isList() {
+				return nil, errorAt(a, "%s needs an operand", op)
+			}
+			i++
+			return body[i], nil
+		}
+		var err error
+		var arg *node
+		switch op {
+		case OpBlock, OpLoop:
+			label := ""
+			if i+1 < len(body) && isID(body[i+1]) {
+				i++
+				label = body[i].atom
+			}
+			if i+1 < len(body) && body[i+1].head() == "result" {
+				i++
+				var rs []ValType
+				if rs, err = b.types(nil, body[i]); err != nil {
+					return err
+				}
+				ins.Arity = len(rs)
+			}
+			labels = append(labels, label)
+			open = append(open, len(fn.Code))
+		case OpEnd:
+			if len(open) == 0 {
+				return errorAt(a, "end without a block")
+			}
+			fn.Code[open[len(open)-1]].End = len(fn.Code)
+			labels, open = labels[:len(labels)-1], open[:len(open)-1]
+		case OpBr, OpBrIf:
+			if arg, err = imm(); err != nil {
+				return err
+			}
+			ins.Imm, err = labelDepth(arg, labels)
+		case OpCall:
+			if arg, err = imm(); err != nil {
+				return err
+			}
+			ins.Imm, err = b.index(arg, b.funcs, len(b.m.Funcs))
+		case OpLocalGet, OpLocalSet, OpLocalTee:
+			if arg, err = imm(); err != nil {
+				return err
+			}
+			ins.Imm, err = b.index(arg, locals, nlocals)
+		case OpGlobalGet, OpGlobalSet:
+			if arg, err = imm(); err != nil {
+				return err
+			}
+			ins.Imm, err = b.index(arg, b.globals, len(b.m.Globals))
+		case OpI32Const, OpI64Const:
+			if arg, err = imm(); err != nil {
+				return err
+			}
+			t := I64
+			if op == OpI32Const {
+				t = I32
+			}
+			ins.Imm, err = constant(t, arg)
+		}
+		if err != nil {
+			return err
+		}
+		fn.Code = append(fn.Code, ins)
+	}
+	if len(open) > 0 {
+		return errorAt(n, "block without end")
+	}
+	return nil
+}
+
+// labelDepth resolves a branch target to the number of blocks to leave.
+func labelDepth(ref *node, labels []string) (uint64, error) {
+	if isID(ref) {
+		for d := 0; d < len(labels); d++ {
+			if labels[len(labels)-1-d] == ref.atom {
+				return uint64(d), nil
+			}
+		}
+		return 0, errorAt(ref, "unknown label %s", ref.atom)
+	}
+	d, err := strconv.ParseUint(ref.atom, 10, 32)
+	if err != nil || int(d) >= len(labels) {
+		return 0, errorAt(ref, "invalid label %q", ref.atom)
+	}
+	return d, nil
+}
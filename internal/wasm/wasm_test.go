@@ -0,0 +1,248 @@
+package wasm
+
+import (
+	"fmt"
+	"os"
+	"parrot/internal/parser"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lower generates the module of src and parses it back, checking that it
+// exports main and each function src defines, with their parameters.
+func lower(t *testing.T, src string) (*Module, error) {
+	t.Helper()
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		t.Fatalf("Parse(%q): %v", src, errs[0])
+	}
+	wat, err := Generate(prog)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(wat)
+	if err != nil {
+		t.Fatalf("Parse of the module of %q: %v\n%s", src, err, wat)
+	}
+	want := map[string]int{"main": 0}
+	for _, stmt := range prog.Stmts {
+		if def := definition(stmt); def != nil {
+			want[def.Name] = len(def.Params)
+		}
+	}
+	if len(m.Exports) != len(want) || len(m.Funcs) != len(want) {
+		t.Errorf("%q: module exports %v of %d functions, want %v", src, m.Exports, len(m.Funcs), want)
+	}
+	for name, params := range want {
+		i, ok := m.Exports[name]
+		if !ok {
+			t.Errorf("%q: %s is not exported", src, name)
+		} else if fn := m.Funcs[i]; fn.Name != "$"+name || len(fn.Params) != params {
+			t.Errorf("%q: %s is exported as %s with %d parameters, want %d", src, name, fn.Name, len(fn.Params), params)
+		}
+	}
+	return m, nil
+}
+
+// run invokes the main function of m with the given fuel, returning its
+// result as the conformance tests print it.
+func run(m *Module, fuel int64) string {
+	machine := NewMachine(m)
+	machine.Fuel = fuel
+	res, err := machine.Invoke("main")
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if len(res) == 0 {
+		return "=> null"
+	}
+	// Generate only uses i32 for booleans.
+	if m.Funcs[m.Exports["main"]].Results[0] == I32 {
+		return fmt.Sprintf("=> %v", res[0] != 0)
+	}
+	return fmt.Sprintf("=> %d", int64(res[0]))
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`1 + 2 * 3 - -4`, "=> 11"},
+		{`7 / 2 + 7 % 2 * 10`, "=> 13"},
+		{`1 < 2 and !(3 >= 4) or false`, "=> true"},
+		{`true == (1 != 1)`, "=> false"},
+		// Types are inferred from the uses, through calls and globals.
+		{`fn sq(x) { x * x }; fn pos(x) { x > 0 }; y = sq(7); pos(y - 50)`, "=> false"},
+		{`fn f(a) { b = a + 1; b = b * 2; b }; x = f(4); x = x + f(0); x`, "=> 12"},
+		{`fn g() { n }; n = 5; g()`, "=> 5"},
+		{`fn nothing() { }; nothing()`, "=> null"},
+		{`n = 3; n = n * n`, "=> 9"},
+		{`1 / (2 - 2)`, "error: wasm: trap: division by zero"},
+		{`fn down(n) { 1 + down(n - 1) }; down(1)`, "error: wasm: trap: call stack exhausted"},
+	}
+	for _, tt := range tests {
+		m, err := lower(t, tt.src)
+		if err != nil {
+			t.Errorf("Generate(%q): %v", tt.src, err)
+			continue
+		}
+		if got := run(m, 1e6); got != tt.want {
+			t.Errorf("%q %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`"a"`, "strings are not supported"},
+		{`[1]`, "lists are not supported"},
+		{`1 + true`, "type mismatch: bool and int"},
+		{`fn f(x) { x }; f(1, 2)`, "wrong number of arguments"},
+		{`fn f() { fn g() { 1 } }`, "functions can only be defined at the top level"},
+		{`fn f(x) { x }; g = f; g(1)`, "function f can only be called"},
+		{`len(1)`, "only functions defined at the top level can be called"},
+		{`fn main() { 1 }`, "main is reserved"},
+	}
+	for _, tt := range tests {
+		prog, errs := parser.Parse(tt.src)
+		if len(errs) > 0 {
+			t.Fatalf("Parse(%q): %v", tt.src, errs[0])
+		}
+		_, err := Generate(prog)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Generate(%q) = %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+// TestTailLoop checks that a function calling itself last runs in constant
+// stack, as a loop, until it runs out of fuel.
+func TestTailLoop(t *testing.T) {
+	m, err := lower(t, `fn count(n, acc) { count(n - 1, acc + n) }; count(1000000, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := run(m, 10*MaxDepth), "error: wasm: trap: out of fuel"; got != want {
+		t.Errorf("tail loop %s, want %s", got, want)
+	}
+}
+
+// TestFuel checks that a run takes one unit of fuel per instruction.
+func TestFuel(t *testing.T) {
+	m, err := lower(t, `fn sq(x) { x * x }; a = sq(3); b = sq(a); a + b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := NewMachine(m)
+	machine.Fuel = 1000
+	if _, err := machine.Invoke("main"); err != nil {
+		t.Fatal(err)
+	}
+	used := 1000 - machine.Fuel
+	if used <= 0 || used >= 1000 {
+		t.Fatalf("the run used %d fuel", used)
+	}
+	for fuel, want := range map[int64]string{
+		used:     "=> 90",
+		used - 1: "error: wasm: trap: out of fuel",
+		1:        "error: wasm: trap: out of fuel",
+		0:        "=> 90", // no limit
+	} {
+		if got := run(m, fuel); got != want {
+			t.Errorf("with %d fuel %s, want %s", fuel, got, want)
+		}
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	m, err := lower(t, `fn add(a, b) { a + b }; fn neg(a) { a < 0 }; add(1, 2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := NewMachine(m)
+	if res, err := machine.Invoke("add", 40, 2); err != nil || !slices.Equal(res, []uint64{42}) {
+		t.Errorf("add(40, 2) = %v, %v", res, err)
+	}
+	minus := -5
+	if res, err := machine.Invoke("neg", uint64(minus)); err != nil || !slices.Equal(res, []uint64{1}) {
+		t.Errorf("neg(-5) = %v, %v", res, err)
+	}
+	if _, err := machine.Invoke("sub", 1); err == nil || !strings.Contains(err.Error(), `no function is exported as "sub"`) {
+		t.Errorf("Invoke of sub: %v", err)
+	}
+	if _, err := machine.Invoke("add", 1); err == nil || !strings.Contains(err.Error(), "add expects 2 arguments, got 1") {
+		t.Errorf("Invoke of add with 1 argument: %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		wat, err string
+	}{
+		{`(module`, "missing )"},
+		{`(module (func $f (result i64) i64.foo))`, "unsupported instruction i64.foo"},
+		{`(module (func $f (result i64) local.get $x))`, "unknown name $x"},
+		{`(module (func $f (result i64) i64.const 1) (export "g" (func $h)))`, "unknown name $h"},
+		{`(module (func $f br 3))`, `invalid label "3"`},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.wat)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) = %v, want %q", tt.wat, err, tt.err)
+		}
+	}
+}
+
+// traps are the errors of the corpus and the traps of Wasm code failing
+// the same way.
+var traps = map[string]string{
+	"error: division by zero":            "error: wasm: trap: division by zero",
+	"error: step limit exceeded":         "error: wasm: trap: out of fuel",
+	"error: maximum call depth exceeded": "error: wasm: trap: call stack exhausted",
+}
+
+// TestCorpus runs the conformance scripts in the subset Generate supports,
+// and checks that it reports the others as unsupported.
+func TestCorpus(t *testing.T) {
+	scripts, err := filepath.Glob("../../testdata/conformance/*.pr")
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no corpus: %v", err)
+	}
+	ran := 0
+	for _, script := range scripts {
+		src, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.ReadFile(strings.TrimSuffix(script, ".pr") + ".out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(script)
+		if _, errs := parser.Parse(string(src)); len(errs) > 0 {
+			continue
+		}
+		m, err := lower(t, string(src))
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), "wasm: ") {
+				t.Errorf("%s: Generate: %v", name, err)
+			}
+			continue
+		}
+		ran++
+		want := strings.TrimSpace(string(out))
+		if trap, ok := traps[want]; ok {
+			want = trap
+		}
+		if got := run(m, 1e6); got != want {
+			t.Errorf("%s: %s, want %s", name, got, want)
+		}
+	}
+	if ran < 10 {
+		t.Errorf("ran %d scripts of %d", ran, len(scripts))
+	}
+}
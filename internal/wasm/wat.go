@@ -0,0 +1,526 @@
+// Package wasm lowers a typed subset of Parrot to WebAssembly in the text
+// format, and runs the result on a small interpreter, so that the output can
+// be executed and tested without an external runtime.
+//
+// The subset has integers, which become i64, booleans, which become i32,
+// and named functions defined at the top level, called directly. The types
+// of parameters, locals and globals are inferred from their uses. A
+// function ending in a call of itself is lowered to a loop. Strings, lists,
+// builtins and functions as values are not supported.
+package wasm
+
+import (
+	"fmt"
+	"parrot/internal/parser"
+	"parrot/internal/token"
+	"strings"
+)
+
+// typ is a type variable of the inference, a node of a union-find forest.
+type typ struct {
+	parent *typ
+	kind   kind
+}
+
+type kind int
+
+const (
+	unknown kind = iota
+	intKind
+	boolKind
+	voidKind
+)
+
+var kindNames = [...]string{unknown: "unknown", intKind: "int", boolKind: "bool", voidKind: "void"}
+
+func (k kind) String() string {
+	return kindNames[k]
+}
+
+func newType(k kind) *typ {
+	return &typ{kind: k}
+}
+
+func (t *typ) find() *typ {
+	for t.parent != nil {
+		if t.parent.parent != nil {
+			t.parent = t.parent.parent
+		}
+		t = t.parent
+	}
+	return t
+}
+
+// resolved returns the kind of t, defaulting to int for values whose type
+// nothing constrains.
+func (t *typ) resolved() kind {
+	if k := t.find().kind; k != unknown {
+		return k
+	}
+	return intKind
+}
+
+// valType returns the Wasm value type of t.
+func (t *typ) valType() string {
+	if t.resolved() == boolKind {
+		return "i32"
+	}
+	return "i64"
+}
+
+// unify constrains a and b to the same type.
+func unify(a, b *typ, pos int) {
+	a, b = a.find(), b.find()
+	switch {
+	case a == b:
+	case a.kind == unknown:
+		a.parent = b
+	case b.kind == unknown:
+		b.parent = a
+	case a.kind != b.kind:
+		fail("%d: type mismatch: %s and %s", pos, a.kind, b.kind)
+	}
+}
+
+// genError carries an error out of the recursive code generation.
+type genError struct {
+	err error
+}
+
+func fail(format string, a ...any) {
+	panic(genError{fmt.Errorf("wasm: "+format, a...)})
+}
+
+// item is a line of generated code. A %s in text stands for the Wasm value
+// type of t, which is only known once the whole program has been inferred.
+type item struct {
+	text string
+	t    *typ
+}
+
+// function is a function of the generated module.
+type function struct {
+	name     string
+	def      *parser.Function // nil for the top-level code
+	params   []*typ
+	result   *typ
+	void     bool
+	locals   map[string]*typ // nil for the top-level code
+	order    []string        // locals after the parameters, in order
+	code     []item
+	selfTail bool
+}
+
+func (fn *function) emit(text string, t *typ) {
+	fn.code = append(fn.code, item{text, t})
+}
+
+// drop discards the value on top of the stack, not loading it in the
+// first place if it is that of an assignment.
+func (fn *function) drop() {
+	if n := len(fn.code); n > 0 {
+		last := fn.code[n-1].text
+		if v, ok := strings.CutPrefix(last, "local.tee "); ok {
+			fn.code[n-1].text = "local.set " + v
+			return
+		}
+		if v, ok := strings.CutPrefix(last, "global.get "); ok && n > 1 && fn.code[n-2].text == "global.set "+v {
+			fn.code = fn.code[:n-1]
+			return
+		}
+	}
+	fn.emit("drop", nil)
+}
+
+type generator struct {
+	funcs   map[string]*function
+	order   []*function
+	globals map[string]*typ
+	gorder  []string
+}
+
+// Generate translates prog to a module in the WebAssembly text format. The
+// module exports each function under its name and the top-level code as
+// main, which returns the value of the last statement. Globals start as
+// zero, where Parrot would report reading them before their assignment.
+func Generate(prog *parser.Program) (wat string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(genError)
+			if !ok {
+				panic(r)
+			}
+			wat, err = "", e.err
+		}
+	}()
+	g := &generator{funcs: make(map[string]*function), globals: make(map[string]*typ)}
+	top := &function{name: "main", result: newType(unknown)}
+	for _, stmt := range prog.Stmts {
+		if s, ok := stmt.(*parser.ExprStmt); ok && definition(stmt) == nil {
+			// Define the globals up front, for the functions to refer to.
+			if a, ok := s.E.(*parser.Assign); ok {
+				g.global(a.Left.String())
+			}
+		}
+		if def := definition(stmt); def != nil {
+			if def.Name == "main" {
+				fail("main is reserved for the top-level code")
+			}
+			if g.funcs[def.Name] != nil {
+				fail("function %s is defined twice", def.Name)
+			}
+			fn := &function{name: def.Name, def: def, result: newType(unknown), locals: make(map[string]*typ)}
+			for _, p := range def.Params {
+				fn.params = append(fn.params, newType(unknown))
+				fn.locals[p.Name] = fn.params[len(fn.params)-1]
+			}
+			g.funcs[def.Name] = fn
+			g.order = append(g.order, fn)
+		}
+	}
+	g.voids(prog, top)
+	for _, fn := range g.order {
+		g.body(fn, fn.def.Body)
+	}
+	g.body(top, prog)
+	return g.module(top), nil
+}
+
+// definition returns the function stmt defines at the top level: a named
+// function, or an anonymous one assigned to a name.
+func definition(stmt parser.Stmt) *parser.Function {
+	s, ok := stmt.(*parser.ExprStmt)
+	if !ok {
+		return nil
+	}
+	switch e := s.E.(type) {
+	case *parser.Function:
+		if e.Name != "" {
+			return e
+		}
+	case *parser.Assign:
+		if fn, ok := e.Right.(*parser.Function); ok && fn.Name == "" {
+			return &parser.Function{Params: fn.Params, Body: fn.Body, Name: e.Left.String()}
+		}
+	}
+	return nil
+}
+
+// voids finds the functions without a value: those with an empty body, and
+// those ending in a call of such a function.
+func (g *generator) voids(prog *parser.Program, top *function) {
+	isVoid := func(body *parser.Program) bool {
+		n := len(body.Stmts)
+		if n == 0 {
+			return true
+		}
+		s, ok := body.Stmts[n-1].(*parser.ExprStmt)
+		if !ok {
+			return false
+		}
+		call, ok := s.E.(*parser.Call)
+		if !ok {
+			return definition(s) != nil && body == prog
+		}
+		id, ok := call.Fn.(*parser.Ident)
+		return ok && g.funcs[id.Name] != nil && g.funcs[id.Name].void
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, fn := range g.order {
+			if !fn.void && isVoid(fn.def.Body) {
+				fn.void, changed = true, true
+			}
+		}
+	}
+	top.void = isVoid(prog)
+	for _, fn := range append(g.order, top) {
+		if fn.void {
+			fn.result = newType(voidKind)
+		}
+	}
+}
+
+// global returns the type of the global name, defining it if needed.
+func (g *generator) global(name string) *typ {
+	t, ok := g.globals[name]
+	if !ok {
+		t = newType(unknown)
+		g.globals[name] = t
+		g.gorder = append(g.gorder, name)
+	}
+	return t
+}
+
+// body generates the statements of fn, returning the value of the last one.
+func (g *generator) body(fn *function, prog *parser.Program) {
+	for i, stmt := range prog.Stmts {
+		s, ok := stmt.(*parser.ExprStmt)
+		if !ok {
+			continue
+		}
+		if fn.def == nil && definition(s) != nil {
+			continue
+		}
+		if i == len(prog.Stmts)-1 {
+			t := g.expr(fn, s.E)
+			if !fn.void {
+				unify(t, fn.result, pos(s.E))
+			}
+			break
+		}
+		if t := g.expr(fn, s.E); t.find().kind != voidKind {
+			fn.drop()
+		}
+	}
+}
+
+// value generates e, which must have a value.
+func (g *generator) value(fn *function, e parser.Expr) *typ {
+	t := g.expr(fn, e)
+	if t.find().kind == voidKind {
+		fail("%d: %s has no value", pos(e), e)
+	}
+	return t
+}
+
+// expr generates e, leaving its value on the stack, and returns its type.
+func (g *generator) expr(fn *function, e parser.Expr) *typ {
+	switch e := e.(type) {
+	case *parser.Integer:
+		fn.emit(fmt.Sprintf("i64.const %d", e.Value), nil)
+		return newType(intKind)
+	case *parser.Boolean:
+		if e.Value {
+			fn.emit("i32.const 1", nil)
+		} else {
+			fn.emit("i32.const 0", nil)
+		}
+		return newType(boolKind)
+	case *parser.Ident:
+		return g.ident(fn, e)
+	case *parser.PrefixExpr:
+		switch e.TokenType {
+		case token.BANG:
+			unify(g.value(fn, e.Right), newType(boolKind), e.Pos+1)
+			fn.emit("i32.eqz", nil)
+			return newType(boolKind)
+		case token.MINUS:
+			fn.emit("i64.const 0", nil)
+			unify(g.value(fn, e.Right), newType(intKind), e.Pos+1)
+			fn.emit("i64.sub", nil)
+			return newType(intKind)
+		case token.ADD:
+			t := g.value(fn, e.Right)
+			unify(t, newType(intKind), e.Pos+1)
+			return t
+		}
+		fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+	case *parser.InfixExpr:
+		return g.infix(fn, e)
+	case *parser.Call:
+		return g.call(fn, e)
+	case *parser.Assign:
+		return g.assign(fn, e)
+	case *parser.Function:
+		fail("functions can only be defined at the top level")
+	case *parser.String:
+		fail("%d: strings are not supported", e.Pos+1)
+	case *parser.ListExpr:
+		fail("%d: lists are not supported", e.LbrackPos+1)
+	}
+	fail("%d: %T is not supported", pos(e), e)
+	return nil
+}
+
+type binop struct {
+	operand, result kind
+	op              string
+}
+
+var binops = map[token.Type]binop{
+	token.ADD:   {intKind, intKind, "i64.add"},
+	token.MINUS: {intKind, intKind, "i64.sub"},
+	token.MUL:   {intKind, intKind, "i64.mul"},
+	token.DIV:   {intKind, intKind, "i64.div_s"},
+	token.MOD:   {intKind, intKind, "i64.rem_s"},
+	token.LT:    {intKind, boolKind, "i64.lt_s"},
+	token.LE:    {intKind, boolKind, "i64.le_s"},
+	token.GT:    {intKind, boolKind, "i64.gt_s"},
+	token.GE:    {intKind, boolKind, "i64.ge_s"},
+	token.AND:   {boolKind, boolKind, "i32.and"},
+	token.OR:    {boolKind, boolKind, "i32.or"},
+}
+
+func (g *generator) infix(fn *function, e *parser.InfixExpr) *typ {
+	x := g.value(fn, e.Left)
+	y := g.value(fn, e.Right)
+	switch e.TokenType {
+	case token.EQ, token.NOTEQ:
+		// Both operands have the same type, known in the end.
+		unify(x, y, e.Pos+1)
+		op := "%s.eq"
+		if e.TokenType == token.NOTEQ {
+			op = "%s.ne"
+		}
+		fn.emit(op, x)
+		return newType(boolKind)
+	}
+	b, ok := binops[e.TokenType]
+	if !ok {
+		fail("%d: unsupported operator %s", e.Pos+1, e.Literal)
+	}
+	unify(x, newType(b.operand), e.Pos+1)
+	unify(y, newType(b.operand), e.Pos+1)
+	fn.emit(b.op, nil)
+	return newType(b.result)
+}
+
+// ident loads a local or a global.
+func (g *generator) ident(fn *function, e *parser.Ident) *typ {
+	if t, ok := fn.locals[e.Name]; ok {
+		fn.emit("local.get $"+e.Name, nil)
+		return t
+	}
+	if t, ok := g.globals[e.Name]; ok {
+		fn.emit("global.get $"+e.Name, nil)
+		return t
+	}
+	if g.funcs[e.Name] != nil {
+		fail("%d: function %s can only be called", e.Pos+1, e.Name)
+	}
+	fail("%d: name %q is not defined", e.Pos+1, e.Name)
+	return nil
+}
+
+// assign assigns to a global at the top level and to a local in functions,
+// leaving the value on the stack.
+func (g *generator) assign(fn *function, e *parser.Assign) *typ {
+	name := e.Left.String()
+	if g.funcs[name] != nil {
+		fail("%d: cannot assign to the function %s", e.Pos+1, name)
+	}
+	t := g.value(fn, e.Right)
+	if fn.locals == nil {
+		gt := g.global(name)
+		unify(t, gt, e.Pos+1)
+		fn.emit("global.set $"+name, nil)
+		fn.emit("global.get $"+name, nil)
+		return gt
+	}
+	lt, ok := fn.locals[name]
+	if !ok {
+		lt = newType(unknown)
+		fn.locals[name] = lt
+		fn.order = append(fn.order, name)
+	}
+	unify(t, lt, e.Pos+1)
+	fn.emit("local.tee $"+name, nil)
+	return lt
+}
+
+func (g *generator) call(fn *function, e *parser.Call) *typ {
+	id, ok := e.Fn.(*parser.Ident)
+	callee := (*function)(nil)
+	if ok && fn.locals[id.Name] == nil && g.globals[id.Name] == nil {
+		callee = g.funcs[id.Name]
+	}
+	if callee == nil {
+		fail("%d: only functions defined at the top level can be called", pos(e.Fn))
+	}
+	if len(e.Args) != len(callee.params) {
+		fail("%d: wrong number of arguments: expected %d, got %d", id.Pos+1, len(callee.params), len(e.Args))
+	}
+	for i, a := range e.Args {
+		unify(g.value(fn, a), callee.params[i], pos(a))
+	}
+	if e.Tail && callee == fn {
+		// Rebind the parameters and start over.
+		for i := len(fn.def.Params) - 1; i >= 0; i-- {
+			fn.emit("local.set $"+fn.def.Params[i].Name, nil)
+		}
+		fn.emit("br $tail", nil)
+		fn.selfTail = true
+		return fn.result
+	}
+	fn.emit("call $"+callee.name, nil)
+	return callee.result
+}
+
+// pos returns the 1-based source position of e, or 0 if it has none.
+func pos(e parser.Expr) int {
+	switch e := e.(type) {
+	case *parser.Ident:
+		return e.Pos + 1
+	case *parser.Integer:
+		return e.Pos + 1
+	case *parser.Boolean:
+		return e.Pos + 1
+	case *parser.String:
+		return e.Pos + 1
+	case *parser.PrefixExpr:
+		return e.Pos + 1
+	case *parser.InfixExpr:
+		return e.Pos + 1
+	case *parser.Assign:
+		return e.Pos + 1
+	case *parser.ListExpr:
+		return e.LbrackPos + 1
+	case *parser.IndexExpr:
+		return e.LbrackPos + 1
+	case *parser.Selector:
+		return e.Pos + 1
+	case *parser.Call:
+		return pos(e.Fn)
+	}
+	return 0
+}
+
+// module returns the text of the module.
+func (g *generator) module(top *function) string {
+	var b strings.Builder
+	b.WriteString("(module\n")
+	for _, name := range g.gorder {
+		vt := g.globals[name].valType()
+		fmt.Fprintf(&b, "  (global $%s (mut %s) (%s.const 0))\n", name, vt, vt)
+	}
+	for _, fn := range append(g.order, top) {
+		g.function(&b, fn)
+	}
+	b.WriteString(")\n")
+	return b.String()
+}
+
+func (g *generator) function(b *strings.Builder, fn *function) {
+	fmt.Fprintf(b, "  (func $%s (export %q)", fn.name, fn.name)
+	if fn.def != nil {
+		for i, p := range fn.def.Params {
+			fmt.Fprintf(b, " (param $%s %s)", p.Name, fn.params[i].valType())
+		}
+	}
+	result := ""
+	if !fn.void {
+		result = fmt.Sprintf(" (result %s)", fn.result.valType())
+	}
+	b.WriteString(result)
+	b.WriteByte('\n')
+	for _, name := range fn.order {
+		fmt.Fprintf(b, "    (local $%s %s)\n", name, fn.locals[name].valType())
+	}
+	indent := "    "
+	if fn.selfTail {
+		fmt.Fprintf(b, "    loop $tail%s\n", result)
+		indent += "  "
+	}
+	for _, it := range fn.code {
+		text := it.text
+		if it.t != nil {
+			text = fmt.Sprintf(text, it.t.valType())
+		}
+		fmt.Fprintf(b, "%s%s\n", indent, text)
+	}
+	if fn.selfTail {
+		b.WriteString("    end\n")
+	}
+	b.WriteString("  )\n")
+}
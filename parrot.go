@@ -0,0 +1,484 @@
+// Package parrot embeds the Parrot interpreter in Go programs.
+//
+// A script is parsed once with Compile and can then be run any number of
+// times with different globals:
+//
+//	prog, err := parrot.Compile(`greet(name) + "!"`)
+//	if err != nil {
+//		return err
+//	}
+//	v, err := parrot.Run(ctx, prog, map[string]any{
+//		"name": "parrot",
+//		"greet": func(args ...parrot.Object) parrot.Object {
+//			return parrot.MustObject("hello, " + args[0].String())
+//		},
+//	})
+//	// parrot.FromObject(v) == "hello, parrot!"
+//
+// Go structs, maps and functions passed as globals are bridged through
+// reflection: fields and methods are read as attributes, functions are
+// called with their arguments converted, and a returned error becomes a
+// script error. Decode converts results back into Go values.
+//
+// Programs run on the tree-walking evaluator by default; pass
+// WithBackend(VM) to Compile to run them on the bytecode VM instead, or
+// WithBackend(Reg) for the experimental register VM. Go
+// functions can be made available to every script with RegisterBuiltin.
+package parrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"parrot/internal/compile"
+	"parrot/internal/object"
+	"parrot/internal/optimize"
+	"parrot/internal/parser"
+	"parrot/internal/regvm"
+	"parrot/internal/ssa"
+	"parrot/internal/vm"
+	"sort"
+)
+
+// Object is a Parrot value.
+type Object = object.Object
+
+// Builtin is a Go function callable from scripts.
+type Builtin = object.BuiltinFn
+
+// Limits bounds the resources a run may use, see WithLimits.
+type Limits = object.Limits
+
+// Capability is a set of builtins scripts may use, see WithCapabilities.
+type Capability = object.Capability
+
+const (
+	CapPure   = object.CapPure   // computations without side effects
+	CapIO     = object.CapIO     // print, read_file, write_file
+	CapOS     = object.CapOS     // getenv
+	CapTime   = object.CapTime   // now
+	CapRandom = object.CapRandom // rand
+	CapAll    = object.CapAll
+)
+
+// Errors returned by Run when a program exceeds its Limits.
+var (
+	ErrStepLimit  = object.ErrStepLimit
+	ErrDepthLimit = object.ErrDepthLimit
+	ErrAllocLimit = object.ErrAllocLimit
+)
+
+// Backend selects how programs are executed.
+type Backend int
+
+const (
+	// Eval runs programs with the tree-walking evaluator.
+	Eval Backend = iota
+	// VM compiles programs to bytecode and runs them on the virtual machine.
+	VM
+	// Reg compiles programs to register code and runs them on the
+	// experimental register VM, which doesn't support closures.
+	Reg
+)
+
+func (b Backend) String() string {
+	switch b {
+	case Eval:
+		return "eval"
+	case VM:
+		return "vm"
+	case Reg:
+		return "reg"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// Option configures a Program.
+type Option func(*Program)
+
+// WithBackend selects the back end a program runs on.
+func WithBackend(b Backend) Option {
+	return func(p *Program) {
+		p.backend = b
+	}
+}
+
+// WithLimits bounds the steps, call depth and allocations of every run of
+// the program. Exceeding a limit stops the run with ErrStepLimit,
+// ErrDepthLimit or ErrAllocLimit.
+func WithLimits(l Limits) Option {
+	return func(p *Program) {
+		p.limits = l
+	}
+}
+
+// WithCapabilities enables the builtins in caps for the program, which by
+// default may only use CapPure. Referring to a disabled builtin is an error
+// of Compile, whatever the back end.
+func WithCapabilities(caps Capability) Option {
+	return func(p *Program) {
+		p.caps = caps
+	}
+}
+
+// WithOptimizer turns the optimization of the program, such as constant
+// folding, on or off. It is on by default.
+func WithOptimizer(enabled bool) Option {
+	return func(p *Program) {
+		p.optimize = enabled
+	}
+}
+
+// withSSA compiles the program for the VM through the SSA form, as
+// "parrot run -ssa" does.
+func withSSA() Option {
+	return func(p *Program) {
+		p.ssa = true
+	}
+}
+
+// Program is a parsed script, compiled for its back end.
+type Program struct {
+	ast      *parser.Program
+	backend  Backend
+	limits   Limits
+	caps     Capability
+	optimize bool
+	ssa      bool
+	vm       *vmCode         // the code for VM
+	reg      *regvm.Proto    // the code for Reg
+	regc     *regvm.Compiler // the compiler of reg, which indexes the globals
+}
+
+// vmCode is a program compiled for the VM.
+type vmCode struct {
+	constants *[]object.Object
+	code      []byte
+	symbols   *compile.SymbolTable
+}
+
+// Error is a runtime error raised by a script.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Compile parses src into a Program and compiles it for the back end. The
+// names the script reads without defining them are globals to be set by
+// Run; reading one that is unset is a runtime error.
+func Compile(src string, opts ...Option) (*Program, error) {
+	ast, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		var err []error
+		for _, e := range errs {
+			err = append(err, e)
+		}
+		return nil, errors.Join(err...)
+	}
+	p := &Program{ast: ast, caps: CapPure, optimize: true}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.optimize {
+		optimize.Program(p.ast)
+	}
+	var err error
+	switch p.backend {
+	case VM:
+		p.vm, err = compileVM(p, nil)
+	case Reg:
+		p.reg, p.regc, err = compileReg(p, nil)
+	default:
+		err = checkBuiltins(p.ast, p.caps)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compileVM compiles prog for the VM. The names prog reads without
+// defining them are globals Run may set; the globals in names are defined
+// first, so that they take precedence over the builtins.
+func compileVM(prog *Program, names []string) (*vmCode, error) {
+	c := compile.NewWithCapabilities(prog.caps)
+	c.Externals = true
+	if !prog.optimize {
+		c.Passes = nil
+	}
+	for _, name := range names {
+		c.Define(name)
+	}
+	var err error
+	if prog.ssa {
+		err = ssa.Compile(prog.ast, c, prog.optimize)
+	} else {
+		err = c.Compile(prog.ast)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vmCode{constants: c.Constants, code: c.OpCodes.Output(), symbols: c.SymbolTable}, nil
+}
+
+// compileReg compiles prog for the register VM, like compileVM.
+func compileReg(prog *Program, names []string) (*regvm.Proto, *regvm.Compiler, error) {
+	c := regvm.NewCompiler(prog.caps)
+	c.Externals = true
+	for _, name := range names {
+		c.DefineGlobal(name)
+	}
+	p, err := c.Compile(prog.ast)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, c, nil
+}
+
+// checkBuiltins returns the error the compilers report for the first
+// builtin prog uses which caps disables, so that the evaluator rejects it
+// before running the program too. Like the compilers, it resolves names in
+// the scopes of prog's variables first.
+func checkBuiltins(prog *parser.Program, caps Capability) error {
+	scopes := []map[string]bool{{}}
+	defined := func(name string) bool {
+		for _, scope := range scopes {
+			if scope[name] {
+				return true
+			}
+		}
+		return false
+	}
+	define := func(name string) {
+		scopes[len(scopes)-1][name] = true
+	}
+	var check func(e parser.Expr) error
+	checkAll := func(es ...parser.Expr) error {
+		for _, e := range es {
+			if e == nil {
+				continue
+			}
+			if err := check(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	checkBody := func(body *parser.Program) error {
+		for _, stmt := range body.Stmts {
+			if s, ok := stmt.(*parser.ExprStmt); ok {
+				if err := check(s.E); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	check = func(e parser.Expr) error {
+		switch e := e.(type) {
+		case *parser.Ident:
+			if cap, ok := object.BuiltinCapability(e.Name); ok && !defined(e.Name) && !caps.Has(cap) {
+				return fmt.Errorf("%d: %w", e.Pos+1, object.DisabledError(e.Name, cap))
+			}
+		case *parser.ListExpr:
+			return checkAll(e.List...)
+		case *parser.PrefixExpr:
+			return check(e.Right)
+		case *parser.InfixExpr:
+			return checkAll(e.Left, e.Right)
+		case *parser.IndexExpr:
+			return checkAll(e.Left, e.Index)
+		case *parser.SliceExpr:
+			return checkAll(e.Left, e.Lo, e.Hi, e.Step)
+		case *parser.Selector:
+			return check(e.X)
+		case *parser.Call:
+			return checkAll(append([]parser.Expr{e.Fn}, e.Args...)...)
+		case *parser.Assign:
+			// A function literal may refer to the variable it is assigned
+			// to, other values are computed before it exists.
+			name := e.Left.String()
+			if _, ok := e.Right.(*parser.Function); ok {
+				define(name)
+				return check(e.Right)
+			}
+			if err := check(e.Right); err != nil {
+				return err
+			}
+			define(name)
+		case *parser.Function:
+			scope := map[string]bool{}
+			if e.Name != "" {
+				scope[e.Name] = true
+			}
+			scopes = append(scopes, scope)
+			for _, param := range e.Params {
+				define(param.Name)
+			}
+			err := checkBody(e.Body)
+			scopes = scopes[:len(scopes)-1]
+			if err != nil {
+				return err
+			}
+			if e.Name != "" {
+				define(e.Name)
+			}
+		}
+		return nil
+	}
+	return checkBody(prog)
+}
+
+// shadowed returns the names of the globals, sorted, if any of them is
+// also the name of a builtin the program isn't compiled to take as a
+// global, and nil otherwise. Programs are compiled again for such globals.
+func shadowed(globals map[string]Object, defined func(name string) bool) []string {
+	shadows := false
+	for name := range globals {
+		if _, ok := object.BuiltinCapability(name); ok && !defined(name) {
+			shadows = true
+		}
+	}
+	if !shadows {
+		return nil
+	}
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs prog with the given globals defined and returns the value of its
+// last expression. Globals are converted with ToObject. Cancelling ctx stops
+// the run with ctx's error.
+func Run(ctx context.Context, prog *Program, globals map[string]any) (ret Object, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	objs := make(map[string]Object, len(globals))
+	for name, v := range globals {
+		o, err := ToObject(v)
+		if err != nil {
+			return nil, fmt.Errorf("global %s: %w", name, err)
+		}
+		objs[name] = o
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ret, err = nil, fmt.Errorf("parrot: internal error: %v", r)
+		}
+	}()
+	budget := object.NewBudget(ctx, prog.limits)
+	switch prog.backend {
+	case VM:
+		ret, err = runVM(prog, objs, budget)
+	case Reg:
+		ret, err = runReg(prog, objs, budget)
+	default:
+		ret, err = runEval(prog, objs, budget)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch e := ret.(type) {
+	case nil:
+		ret = object.NULLObj
+	case *object.Error:
+		return nil, &Error{Msg: string(*e)}
+	case *object.Interrupt:
+		return nil, e.Err
+	}
+	return ret, nil
+}
+
+func runEval(prog *Program, globals map[string]Object, budget *object.Budget) (Object, error) {
+	env := object.NewEnv()
+	env.Budget = budget
+	env.Caps = prog.caps
+	for name, o := range globals {
+		env.Set(name, o)
+	}
+	return prog.ast.Eval(env), nil
+}
+
+func runVM(prog *Program, globals map[string]Object, budget *object.Budget) (Object, error) {
+	code := prog.vm
+	if names := shadowed(globals, func(name string) bool {
+		symbol, ok := code.symbols.Resolve(name)
+		return ok && symbol.Scope == compile.GlobalScope
+	}); names != nil {
+		var err error
+		if code, err = compileVM(prog, names); err != nil {
+			return nil, err
+		}
+	}
+	machine := vm.New()
+	machine.SetBudget(budget)
+	machine.SetCapabilities(prog.caps)
+	for name, o := range globals {
+		if symbol, ok := code.symbols.Resolve(name); ok && symbol.Scope == compile.GlobalScope {
+			machine.SetGlobal(symbol.Index, o)
+		}
+	}
+	machine.SetGlobalNames(code.symbols.Names())
+	machine.Next(code.constants, code.code)
+	if err := machine.Run(); err != nil {
+		if budget.Interrupted(err) {
+			return nil, err
+		}
+		return nil, &Error{Msg: err.Error()}
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+func runReg(prog *Program, globals map[string]Object, budget *object.Budget) (Object, error) {
+	p, c := prog.reg, prog.regc
+	if names := shadowed(globals, func(name string) bool {
+		_, ok := c.Global(name)
+		return ok
+	}); names != nil {
+		var err error
+		if p, c, err = compileReg(prog, names); err != nil {
+			return nil, err
+		}
+	}
+	machine := regvm.New()
+	machine.SetBudget(budget)
+	machine.SetCapabilities(prog.caps)
+	for name, o := range globals {
+		if i, ok := c.Global(name); ok {
+			machine.SetGlobal(i, o)
+		}
+	}
+	ret, err := machine.Run(p)
+	if err != nil {
+		if budget.Interrupted(err) {
+			return nil, err
+		}
+		return nil, &Error{Msg: err.Error()}
+	}
+	return ret, nil
+}
+
+// RegisterBuiltin makes fn available under name to all scripts compiled
+// afterwards, replacing any builtin with the same name. Registered builtins
+// belong to CapPure. It is not safe to call concurrently with Compile or Run.
+func RegisterBuiltin(name string, fn Builtin) {
+	for i, b := range object.Builtins {
+		if b.Name == name {
+			object.Builtins[i].Builtin = fn
+			object.Builtins[i].Cap = CapPure
+			return
+		}
+	}
+	object.Builtins = append(object.Builtins, struct {
+		Name    string
+		Builtin object.BuiltinFn
+		Cap     object.Capability
+	}{name, fn, CapPure})
+}
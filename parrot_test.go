@@ -0,0 +1,170 @@
+package parrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGlobals(t *testing.T) {
+	tests := []struct {
+		src     string
+		globals map[string]any
+		want    string // or the error, prefixed with "error: "
+	}{
+		{`x * y`, map[string]any{"x": 6, "y": 7}, "42"},
+		// Globals the script doesn't refer to are ignored.
+		{`x`, map[string]any{"x": 1, "unused": 2}, "1"},
+		{`x = x + 1; x`, map[string]any{"x": 1}, "2"},
+		{`fn f() { x }; f()`, map[string]any{"x": "a"}, "a"},
+		{`x + 1`, nil, `error: name "x" is not defined`},
+		// A global takes precedence over the builtin of the same name.
+		{`len`, map[string]any{"len": 3}, "3"},
+		{`len([1])`, map[string]any{"other": 3}, "1"},
+	}
+	for _, backend := range []Backend{Eval, VM, Reg} {
+		for _, tt := range tests {
+			prog, err := Compile(tt.src, WithBackend(backend))
+			if err != nil {
+				t.Fatalf("%s: %q: %v", backend, tt.src, err)
+			}
+			// Each program runs twice, on the code compiled once.
+			for range 2 {
+				got := ""
+				v, err := Run(context.Background(), prog, tt.globals)
+				if err != nil {
+					got = "error: " + err.Error()
+				} else {
+					got = v.String()
+				}
+				if got != tt.want && !(strings.HasPrefix(tt.want, "error: ") && strings.HasSuffix(got, tt.want[len("error: "):])) {
+					t.Errorf("%s: %q = %s, want %s", backend, tt.src, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+// TestRunConcurrent runs one program from several goroutines at once.
+func TestRunConcurrent(t *testing.T) {
+	src := `fn f(a, b) { a + b < b + b }; [f(x, 2), f(x, 3), f("a", "b")]`
+	for _, backend := range []Backend{Eval, VM, Reg} {
+		prog, err := Compile(src, WithBackend(backend))
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 50 {
+					v, err := Run(context.Background(), prog, map[string]any{"x": i})
+					if err != nil {
+						t.Errorf("%s: %v", backend, err)
+						return
+					}
+					want := fmt.Sprintf("[%v, %v, true]", i < 2, i < 3)
+					if v.String() != want {
+						t.Errorf("%s: x = %d: got %s, want %s", backend, i, v, want)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// TestDeepRecursion checks that unbounded recursion fails on every back
+// end without limits, rather than overflowing the Go stack.
+func TestDeepRecursion(t *testing.T) {
+	want := map[Backend]string{Eval: "maximum call depth exceeded", VM: "stack overflow", Reg: "stack overflow"}
+	for _, backend := range []Backend{Eval, VM, Reg} {
+		prog, err := Compile(`fn r(n) { r(n+1) + 1 }; r(0)`, WithBackend(backend))
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if _, err = Run(context.Background(), prog, nil); err == nil || !strings.Contains(err.Error(), want[backend]) {
+			t.Errorf("%s: Run = %v, want %q", backend, err, want[backend])
+		}
+	}
+}
+
+// TestLimits checks that each limit, and cancelling the context, stops a
+// run with its own error.
+func TestLimits(t *testing.T) {
+	const (
+		loop    = `fn loop(n) { loop(n + 1) }; loop(0)`
+		recurse = `fn r(n) { r(n + 1) + 1 }; r(0)`
+		grow    = `fn grow(s) { grow(s + s) }; grow("ab")`
+	)
+	tests := []struct {
+		name   string
+		src    string
+		limits Limits
+		want   error
+	}{
+		{"steps", loop, Limits{MaxSteps: 10000}, ErrStepLimit},
+		{"depth", recurse, Limits{MaxDepth: 50}, ErrDepthLimit},
+		{"alloc", grow, Limits{MaxAlloc: 1 << 20}, ErrAllocLimit},
+		// Without limits, only the context stops the loop.
+		{"deadline", loop, Limits{}, context.DeadlineExceeded},
+	}
+	for _, backend := range []Backend{Eval, VM} {
+		for _, tt := range tests {
+			prog, err := Compile(tt.src, WithBackend(backend), WithLimits(tt.limits))
+			if err != nil {
+				t.Fatalf("%s: %s: %v", backend, tt.name, err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			_, err = Run(ctx, prog, nil)
+			cancel()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: %s: Run = %v, want %v", backend, tt.name, err, tt.want)
+			}
+		}
+	}
+}
+
+// TestDisabledBuiltins checks that the evaluator and the VM reject a
+// program using a disabled builtin when it is compiled, unless a variable
+// shadows it.
+func TestDisabledBuiltins(t *testing.T) {
+	const disabled = "builtin getenv is disabled, it needs the os capability"
+	tests := []struct {
+		src  string
+		caps Capability
+		want string // the result, or the compile error prefixed with "error: "
+	}{
+		{`getenv("HOME")`, CapPure, "error: 1: " + disabled},
+		// Even in a function which is never called.
+		{`fn f() { [getenv] }; 1`, CapPure, "error: 11: " + disabled},
+		{`x = getenv; getenv = 1`, CapPure, "error: 5: " + disabled},
+		{`getenv = fn(x) { x }; getenv("a")`, CapPure, "a"},
+		{`fn getenv(x) { x }; getenv(2)`, CapPure, "2"},
+		{`fn f(getenv) { getenv }; f(3)`, CapPure, "3"},
+		{`fn f() { getenv = 4; getenv }; f()`, CapPure, "4"},
+		{`getenv("PARROT_UNSET_VARIABLE")`, CapPure | CapOS, "null"},
+	}
+	for _, backend := range []Backend{Eval, VM} {
+		for _, tt := range tests {
+			got := ""
+			prog, err := Compile(tt.src, WithBackend(backend), WithCapabilities(tt.caps))
+			if err != nil {
+				got = "error: " + err.Error()
+			} else if v, err := Run(context.Background(), prog, nil); err != nil {
+				got = "run error: " + err.Error()
+			} else {
+				got = v.String()
+			}
+			if got != tt.want {
+				t.Errorf("%s: %q = %s, want %s", backend, tt.src, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package parrot
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"parrot/internal/object"
+	"reflect"
+)
+
+// goType is the Parrot type of Go values exposed through reflection.
+const goType object.Type = "go"
+
+var (
+	objectType = reflect.TypeFor[Object]()
+	errorType  = reflect.TypeFor[error]()
+)
+
+// GoValue exposes a Go struct, map or function to scripts. Struct fields
+// and methods are read as attributes (x.Name, x.Method(...)), struct fields
+// also by their `parrot:"name"` tag; map entries are read as attributes or
+// by index (m["key"]); functions are callable with their arguments and
+// results converted as by ToObject and Decode.
+type GoValue struct {
+	v reflect.Value
+}
+
+func (g *GoValue) Type() object.Type { return goType }
+func (g *GoValue) String() string {
+	if g.v.CanInterface() {
+		return fmt.Sprint(g.v.Interface())
+	}
+	return g.v.String()
+}
+
+// Value returns the wrapped Go value.
+func (g *GoValue) Value() any {
+	return g.v.Interface()
+}
+
+func (g *GoValue) Attr(name string) Object {
+	v := g.v
+	if m := v.MethodByName(name); m.IsValid() {
+		return &GoValue{v: m}
+	}
+	if v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() || f.Name != name && f.Tag.Get("parrot") != name {
+				continue
+			}
+			o, err := toObject(v.Field(i))
+			if err != nil {
+				return object.NewError("%s.%s: %s", t, name, err)
+			}
+			return o
+		}
+	case reflect.Map:
+		return g.Index(object.NewString(name))
+	}
+	return object.NewError("%s has no attribute %q", g.v.Type(), name)
+}
+
+func (g *GoValue) Index(key Object) Object {
+	if g.v.Kind() != reflect.Map {
+		return object.NewError("%s is not indexable", g.v.Type())
+	}
+	k, err := fromObject(key, g.v.Type().Key())
+	if err != nil {
+		return object.NewError("key: %s", err)
+	}
+	e := g.v.MapIndex(k)
+	if !e.IsValid() {
+		return object.NULLObj
+	}
+	o, err := toObject(e)
+	if err != nil {
+		return object.NewError("%s", err)
+	}
+	return o
+}
+
+func (g *GoValue) Call(args ...Object) (ret Object) {
+	if g.v.Kind() != reflect.Func {
+		return object.NewError("%s is not callable", g.v.Type())
+	}
+	t := g.v.Type()
+	nin := t.NumIn()
+	if t.IsVariadic() && len(args) < nin-1 || !t.IsVariadic() && len(args) != nin {
+		return object.NewError("wrong number of arguments: expected %d, got %d", nin, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= nin-1 {
+			pt = t.In(nin - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		v, err := fromObject(a, pt)
+		if err != nil {
+			return object.NewError("argument %d: %s", i+1, err)
+		}
+		in[i] = v
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ret = object.NewError("%v", r)
+		}
+	}()
+	return fromResults(g.v.Call(in))
+}
+
+// fromResults converts the results of a Go function: a trailing non-nil
+// error becomes a Parrot error, no result is null and several results
+// become a list.
+func fromResults(out []reflect.Value) Object {
+	if n := len(out); n > 0 && out[n-1].Type() == errorType {
+		if !out[n-1].IsNil() {
+			return object.NewError("%s", out[n-1].Interface().(error))
+		}
+		out = out[:n-1]
+	}
+	var objs []Object
+	for _, v := range out {
+		o, err := toObject(v)
+		if err != nil {
+			return object.NewError("%s", err)
+		}
+		objs = append(objs, o)
+	}
+	switch len(objs) {
+	case 0:
+		return object.NULLObj
+	case 1:
+		return objs[0]
+	}
+	return object.NewList(objs...)
+}
+
+func toObject(v reflect.Value) (Object, error) {
+	if !v.IsValid() {
+		return object.NULLObj, nil
+	}
+	if v.Type().Implements(objectType) && v.CanInterface() {
+		if v.Kind() == reflect.Interface && v.IsNil() {
+			return object.NULLObj, nil
+		}
+		return v.Interface().(Object), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return object.TRUEObj, nil
+		}
+		return object.FALSEObj, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object.NewInteger(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows int", v.Uint())
+		}
+		return object.NewInteger(int64(v.Uint())), nil
+	case reflect.String:
+		return object.NewString(v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return object.NULLObj, nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return object.NewString(string(v.Bytes())), nil
+		}
+		l := make(object.List, 0, v.Len())
+		for i := range v.Len() {
+			o, err := toObject(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			l = append(l, o)
+		}
+		return &l, nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return object.NULLObj, nil
+		}
+		return toObject(v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			return object.NULLObj, nil
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			return toObject(v.Elem())
+		}
+		return &GoValue{v: v}, nil
+	case reflect.Map, reflect.Func:
+		if v.IsNil() {
+			return object.NULLObj, nil
+		}
+		return &GoValue{v: v}, nil
+	case reflect.Struct:
+		return &GoValue{v: v}, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to a Parrot value", v.Type())
+}
+
+// Decode stores the Go value of o in the value pointed to by ptr, converting
+// lists to slices or arrays, ints to any numeric type, Go values to their
+// wrapped value and callables to Go functions of ptr's element type.
+func Decode(o Object, ptr any) error {
+	p := reflect.ValueOf(ptr)
+	if p.Kind() != reflect.Pointer || p.IsNil() {
+		return errors.New("parrot: Decode needs a non-nil pointer")
+	}
+	v, err := fromObject(o, p.Elem().Type())
+	if err != nil {
+		return err
+	}
+	p.Elem().Set(v)
+	return nil
+}
+
+func fromObject(o Object, t reflect.Type) (reflect.Value, error) {
+	if g, ok := o.(*GoValue); ok {
+		if g.v.Type().AssignableTo(t) {
+			return g.v, nil
+		}
+		if g.v.Kind() == reflect.Pointer && g.v.Elem().Type().AssignableTo(t) {
+			return g.v.Elem(), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %s", g.v.Type(), t)
+	}
+	if o == nil {
+		o = object.NULLObj
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if x := FromObject(o); x != nil {
+			return reflect.ValueOf(x), nil
+		}
+		return reflect.Zero(t), nil
+	}
+	if reflect.TypeOf(o).AssignableTo(t) {
+		return reflect.ValueOf(o), nil
+	}
+	if o == object.NULLObj {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Slice, reflect.Map, reflect.Func:
+			return reflect.Zero(t), nil
+		}
+	}
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, ok := o.(*object.Boolean); ok {
+			v.SetBool(bool(*b))
+			return v, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := o.(*object.Integer); ok {
+			if v.OverflowInt(int64(*i)) {
+				return v, fmt.Errorf("%d overflows %s", int64(*i), t)
+			}
+			v.SetInt(int64(*i))
+			return v, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := o.(*object.Integer); ok {
+			if *i < 0 || v.OverflowUint(uint64(*i)) {
+				return v, fmt.Errorf("%d overflows %s", int64(*i), t)
+			}
+			v.SetUint(uint64(*i))
+			return v, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if i, ok := o.(*object.Integer); ok {
+			v.SetFloat(float64(*i))
+			return v, nil
+		}
+	case reflect.String:
+		if s, ok := o.(*object.String); ok {
+			v.SetString(string(*s))
+			return v, nil
+		}
+	case reflect.Slice:
+		if s, ok := o.(*object.String); ok && t.Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(string(*s)))
+			return v, nil
+		}
+		if l, ok := o.(*object.List); ok {
+			v = reflect.MakeSlice(t, len(*l), len(*l))
+			for i, e := range *l {
+				ev, err := fromObject(e, t.Elem())
+				if err != nil {
+					return v, fmt.Errorf("index %d: %w", i, err)
+				}
+				v.Index(i).Set(ev)
+			}
+			return v, nil
+		}
+	case reflect.Array:
+		if l, ok := o.(*object.List); ok {
+			if len(*l) != t.Len() {
+				return v, fmt.Errorf("cannot use list of length %d as %s", len(*l), t)
+			}
+			for i, e := range *l {
+				ev, err := fromObject(e, t.Elem())
+				if err != nil {
+					return v, fmt.Errorf("index %d: %w", i, err)
+				}
+				v.Index(i).Set(ev)
+			}
+			return v, nil
+		}
+	case reflect.Func:
+		if c, ok := o.(object.Callable); ok {
+			return makeFunc(c, t), nil
+		}
+	}
+	return v, fmt.Errorf("cannot use %s as %s", o.Type(), t)
+}
+
+// makeFunc returns a Go function of type t that calls c. A Parrot error
+// raised by c is returned as the function's trailing error result if it has
+// one, and panics otherwise.
+func makeFunc(c object.Callable, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			if n := len(out); n > 0 && t.Out(n-1) == errorType {
+				out[n-1] = reflect.ValueOf(&err).Elem()
+				return out
+			}
+			panic(err)
+		}
+		args := make([]Object, len(in))
+		for i, v := range in {
+			o, err := toObject(v)
+			if err != nil {
+				return fail(err)
+			}
+			args[i] = o
+		}
+		ret := c.Call(args...)
+		switch e := ret.(type) {
+		case *object.Error:
+			return fail(&Error{Msg: string(*e)})
+		case *object.Interrupt:
+			return fail(e.Err)
+		}
+		if len(out) > 0 && t.Out(0) != errorType {
+			v, err := fromObject(ret, t.Out(0))
+			if err != nil {
+				return fail(err)
+			}
+			out[0] = v
+		}
+		return out
+	})
+}
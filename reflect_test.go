@@ -0,0 +1,296 @@
+package parrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"parrot/internal/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type account struct {
+	Owner   string
+	Balance int64 `parrot:"balance"`
+	Tags    []string
+	Limits  map[string]int
+	secret  string
+}
+
+func (a account) Describe(prefix string) string {
+	return prefix + a.Owner
+}
+
+func (a *account) Deposit(n uint16) int64 {
+	a.Balance += int64(n)
+	return a.Balance
+}
+
+// runGo runs src on backend with globals, returning its result or error as
+// the conformance tests print them.
+func runGo(t *testing.T, backend Backend, src string, globals map[string]any) string {
+	t.Helper()
+	prog, err := Compile(src, WithBackend(backend))
+	if err != nil {
+		t.Fatalf("%s: Compile(%q): %v", backend, src, err)
+	}
+	v, err := Run(context.Background(), prog, globals)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return v.String()
+}
+
+// reflectTests are scripts and what they return, or the end of their error.
+type reflectTests []struct {
+	src, want string
+}
+
+func (tests reflectTests) run(t *testing.T, globals func() map[string]any) {
+	t.Helper()
+	for _, backend := range []Backend{Eval, VM, Reg} {
+		for _, tt := range tests {
+			got := runGo(t, backend, tt.src, globals())
+			if got != tt.want && !(strings.HasPrefix(tt.want, "error: ") && strings.HasSuffix(got, tt.want[len("error: "):])) {
+				t.Errorf("%s: %q = %s, want %s", backend, tt.src, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestGoValue(t *testing.T) {
+	globals := func() map[string]any {
+		a := account{
+			Owner:   "ann",
+			Balance: 10,
+			Tags:    []string{"x", "y"},
+			Limits:  map[string]int{"day": 100},
+			secret:  "s",
+		}
+		return map[string]any{
+			"a":   a,
+			"p":   &account{Owner: "bob"},
+			"m":   map[string]int{"one": 1, "two": 2},
+			"ids": map[int]string{7: "seven"},
+		}
+	}
+	reflectTests{
+		{`a.Owner`, "ann"},
+		// Fields are read by name or by tag.
+		{`a.balance + a.Balance`, "20"},
+		{`a.Tags[1] + a.Tags[0]`, "yx"},
+		{`len(a.Tags)`, "2"},
+		{`a.Limits.day`, "100"},
+		{`a.secret`, `error: parrot.account has no attribute "secret"`},
+		{`a.Missing`, `error: parrot.account has no attribute "Missing"`},
+		{`a[0]`, "error: parrot.account is not indexable"},
+		// Methods of values and of pointers.
+		{`a.Describe("owner: ")`, "owner: ann"},
+		{`p.Deposit(5); p.Deposit(6)`, "11"},
+		{`p.Owner`, "bob"},
+		{`a.Deposit`, `error: parrot.account has no attribute "Deposit"`},
+		// Map entries are read as attributes or by index.
+		{`m.one + m["two"]`, "3"},
+		{`m["three"]`, "null"},
+		{`m[1]`, "error: key: cannot use int as string"},
+		{`ids[7]`, "seven"},
+	}.run(t, globals)
+}
+
+func TestGoFunc(t *testing.T) {
+	errOdd := errors.New("odd")
+	globals := func() map[string]any {
+		return map[string]any{
+			"add": func(a int8, b uint) int { return int(a) + int(b) },
+			"sum": func(base int, xs ...int) int {
+				for _, x := range xs {
+					base += x
+				}
+				return base
+			},
+			"half": func(n int) (int, error) {
+				if n%2 != 0 {
+					return 0, errOdd
+				}
+				return n / 2, nil
+			},
+			"pair":  func() (string, bool) { return "a", true },
+			"none":  func() {},
+			"check": func(n int) error { return nil },
+			"boom":  func() int { panic("boom") },
+			"join":  func(b []byte, ss []string) string { return string(b) + strings.Join(ss, ",") },
+			"apply": func(f func(int) int, n int) int { return f(n) },
+			"any":   func(x any) string { return fmt.Sprintf("%T %v", x, x) },
+		}
+	}
+	reflectTests{
+		{`add(1, 2)`, "3"},
+		// Arguments are converted to the parameter types.
+		{`add(300, 1)`, "error: argument 1: 300 overflows int8"},
+		{`add(1, -1)`, "error: argument 2: -1 overflows uint"},
+		{`add("1", 2)`, "error: argument 1: cannot use string as int8"},
+		{`add(1)`, "error: wrong number of arguments: expected 2, got 1"},
+		{`join("ab", ["c", "d"])`, "abc,d"},
+		{`join("", [1])`, "error: argument 2: index 0: cannot use int as string"},
+		{`any([1, "a", true])`, "[]interface {} [1 a true]"},
+		// Variadic calls.
+		{`sum(1)`, "1"},
+		{`sum(1, 2, 3, 4)`, "10"},
+		{`sum(1, 2, "3")`, "error: argument 3: cannot use string as int"},
+		{`sum()`, "error: wrong number of arguments: expected 2, got 0"},
+		// Results: errors become Parrot errors, several results a list.
+		{`half(42)`, "21"},
+		{`half(3)`, "error: odd"},
+		{`check(1)`, "null"},
+		{`pair()`, `["a", true]`},
+		{`none()`, "null"},
+		{`boom()`, "error: boom"},
+		// Go functions get Parrot functions as Go functions.
+		{`apply(fn(n) { n * 2 }, 21)`, "42"},
+		// A Parrot error in a Go function without an error result panics.
+		{`apply(len, 1)`, `error: len: object of type "int" has no length`},
+	}.run(t, globals)
+}
+
+func TestDecode(t *testing.T) {
+	list := func(xs ...any) Object { return MustObject(xs) }
+	var i8 int8
+	if err := Decode(object.NewInteger(-128), &i8); err != nil || i8 != -128 {
+		t.Errorf("Decode of -128 = %d, %v", i8, err)
+	}
+	if err := Decode(object.NewInteger(128), &i8); err == nil || err.Error() != "128 overflows int8" {
+		t.Errorf("Decode of 128 into an int8: %v", err)
+	}
+	var u uint
+	if err := Decode(object.NewInteger(-1), &u); err == nil || err.Error() != "-1 overflows uint" {
+		t.Errorf("Decode of -1 into a uint: %v", err)
+	}
+	var f float64
+	if err := Decode(object.NewInteger(3), &f); err != nil || f != 3 {
+		t.Errorf("Decode of 3 into a float64 = %v, %v", f, err)
+	}
+	var ints []int
+	if err := Decode(list(1, 2), &ints); err != nil || !reflect.DeepEqual(ints, []int{1, 2}) {
+		t.Errorf("Decode into a []int = %v, %v", ints, err)
+	}
+	if err := Decode(object.NULLObj, &ints); err != nil || ints != nil {
+		t.Errorf("Decode of null into a []int = %v, %v", ints, err)
+	}
+	var arr [2]string
+	if err := Decode(list("a", "b"), &arr); err != nil || arr != [2]string{"a", "b"} {
+		t.Errorf("Decode into a [2]string = %v, %v", arr, err)
+	}
+	if err := Decode(list("a"), &arr); err == nil || err.Error() != "cannot use list of length 1 as [2]string" {
+		t.Errorf("Decode of a short list into a [2]string: %v", err)
+	}
+	var nested [][]bool
+	if err := Decode(list([]any{true}, []any{1}), &nested); err == nil || err.Error() != "index 1: index 0: cannot use int as bool" {
+		t.Errorf("Decode of a mistyped element: %v", err)
+	}
+	var x any
+	if err := Decode(list(1, "a"), &x); err != nil || !reflect.DeepEqual(x, []any{int64(1), "a"}) {
+		t.Errorf("Decode into an any = %#v, %v", x, err)
+	}
+	var o Object
+	if err := Decode(object.NewString("s"), &o); err != nil || o.String() != "s" {
+		t.Errorf("Decode into an Object = %v, %v", o, err)
+	}
+
+	// Go values decode to the values they wrap, or what they point to.
+	acc := &account{Owner: "ann"}
+	g := MustObject(acc)
+	var p *account
+	if err := Decode(g, &p); err != nil || p != acc {
+		t.Errorf("Decode into a *account = %p, %v, want %p", p, err, acc)
+	}
+	var a account
+	if err := Decode(g, &a); err != nil || a.Owner != "ann" {
+		t.Errorf("Decode into an account = %v, %v", a, err)
+	}
+	if err := Decode(g, &i8); err == nil || err.Error() != "cannot use *parrot.account as int8" {
+		t.Errorf("Decode of a Go value into an int8: %v", err)
+	}
+
+	if err := Decode(object.NewInteger(1), i8); err == nil {
+		t.Error("Decode into a non-pointer succeeded")
+	}
+	if err := Decode(object.NewInteger(1), (*int8)(nil)); err == nil {
+		t.Error("Decode into a nil pointer succeeded")
+	}
+}
+
+// TestMakeFunc decodes callables into Go functions and calls them.
+func TestMakeFunc(t *testing.T) {
+	double := Builtin(func(args ...Object) Object {
+		if len(args) != 1 {
+			return object.NewError("double takes 1 argument")
+		}
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return object.NewError("double of %s", args[0].Type())
+		}
+		return object.NewInteger(2 * int64(*n))
+	})
+
+	var f func(int) int
+	if err := Decode(double, &f); err != nil {
+		t.Fatal(err)
+	}
+	if got := f(21); got != 42 {
+		t.Errorf("f(21) = %d", got)
+	}
+
+	// A Parrot error is the trailing error result, or a panic.
+	var g func(string) (int, error)
+	if err := Decode(double, &g); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := g("a"); n != 0 || err == nil || err.Error() != "double of string" {
+		t.Errorf(`g("a") = %d, %v`, n, err)
+	}
+	var perr *Error
+	if _, err := g("a"); !errors.As(err, &perr) {
+		t.Errorf(`g("a") returned %T, want *Error`, err)
+	}
+	func() {
+		defer func() {
+			if r, ok := recover().(error); !ok || r.Error() != "double takes 1 argument" {
+				t.Errorf("h() panicked with %v", r)
+			}
+		}()
+		var h func() int
+		if err := Decode(double, &h); err != nil {
+			t.Fatal(err)
+		}
+		h()
+	}()
+
+	// Results which don't convert are errors too.
+	var s func(int) (string, error)
+	if err := Decode(double, &s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s(1); err == nil || err.Error() != "cannot use int as string" {
+		t.Errorf("s(1) = %v", err)
+	}
+
+	// Script functions are callables too.
+	prog, err := Compile(`fn(n) { n * 3 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := Run(context.Background(), prog, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Decode(fn, &f); err != nil {
+		t.Fatal(err)
+	}
+	if got := f(5); got != 15 {
+		t.Errorf("script f(5) = %d", got)
+	}
+	if err := Decode(object.NewInteger(1), &f); err == nil || err.Error() != "cannot use int as func(int) int" {
+		t.Errorf("Decode of an int into a func: %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"parrot/internal/compile"
 	"parrot/internal/object"
 	"parrot/internal/parser"
+	"parrot/internal/regvm"
+	"parrot/internal/ssa"
 	"parrot/internal/vm"
 	"strings"
 
@@ -33,6 +35,10 @@ func VMREPL() {
 			}
 			return
 		}
+		if src, ok := strings.CutPrefix(line, ":ssa "); ok && len(accumulatedInput) == 0 {
+			dumpSSA(c, src)
+			continue
+		}
 		accumulatedInput = append(accumulatedInput, line)
 		input := strings.Join(accumulatedInput, "\n")
 
@@ -56,9 +62,12 @@ func VMREPL() {
 				continue
 			}
 		}
+		accumulatedInput = []string{} // Reset accumulated input, the input is complete.
+		rl.SetPrompt(">>> ")
 		err = c.Compile(prog)
 		if err != nil {
 			fmt.Printf("err: %+v\n", err)
+			c.OpCodes = []compile.Instruction{}
 			continue
 		}
 		machine.Next(c.Constants, c.OpCodes.Output())
@@ -70,8 +79,80 @@ func VMREPL() {
 		if val := machine.LastPoppedStackElem(); val != nil && val != object.NULLObj {
 			fmt.Println(val)
 		}
-		accumulatedInput = []string{} // Reset accumulated input after successful execution.
+	}
+}
+
+// dumpSSA prints the optimized SSA form of src, as c would compile it,
+// without running it.
+func dumpSSA(c *compile.Compiler, src string) {
+	prog, errs := parser.Parse(src)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		return
+	}
+	fn, err := ssa.Build(prog, c)
+	if err != nil {
+		fmt.Printf("err: %+v\n", err)
+		return
+	}
+	ssa.Optimize(fn)
+	fmt.Print(fn)
+}
+
+// RegREPL runs the input on the experimental register VM.
+func RegREPL() {
+	rl, err := readline.New(">>> ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer rl.Close()
+
+	var accumulatedInput []string
+
+	machine := regvm.New()
+	c := regvm.NewCompiler(object.CapAll)
+	for {
+		line, err := rl.Readline()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println(err)
+			}
+			return
+		}
+		accumulatedInput = append(accumulatedInput, line)
+		input := strings.Join(accumulatedInput, "\n")
+
+		prog, errs := parser.Parse(input)
+		if len(errs) > 0 {
+			if errors.Is(errs[len(errs)-1].Err, parser.ErrEof) {
+				rl.SetPrompt("... ")
+				continue
+			}
+			for _, e := range errs {
+				fmt.Println(e)
+			}
+			accumulatedInput = []string{} // Reset accumulated input
+			rl.SetPrompt(">>> ")
+			continue
+		}
+		accumulatedInput = []string{} // Reset accumulated input, the input is complete.
 		rl.SetPrompt(">>> ")
+		p, err := c.Compile(prog)
+		if err != nil {
+			fmt.Printf("err: %+v\n", err)
+			continue
+		}
+		val, err := machine.Run(p)
+		if err != nil {
+			fmt.Printf("runtime error: %v\n", err)
+			continue
+		}
+		if val != object.NULLObj {
+			fmt.Println(val)
+		}
 	}
 }
 
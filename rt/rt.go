@@ -0,0 +1,555 @@
+// Package rt is the runtime of the Go code generated by parrot build.
+//
+// A script translated to Go becomes a Program whose Main and functions call
+// into a Thread for everything but moving values between variables:
+// operators, calls, globals and builtins. The Thread implements them with the
+// semantics of the bytecode VM, so that a script computes the same result
+// whether it is run by the VM or compiled into a Go binary.
+//
+// Runtime errors unwind the generated code as panics, which Run turns back
+// into errors.
+package rt
+
+import (
+	"context"
+	"fmt"
+	"parrot/internal/object"
+)
+
+// Value is a Parrot value.
+type Value = object.Object
+
+// Limits bounds the resources a run may use, see WithLimits.
+type Limits = object.Limits
+
+// Capability is a set of builtins scripts may use, see WithCapabilities.
+type Capability = object.Capability
+
+const (
+	CapPure   = object.CapPure   // computations without side effects
+	CapIO     = object.CapIO     // print, read_file, write_file
+	CapOS     = object.CapOS     // getenv
+	CapTime   = object.CapTime   // now
+	CapRandom = object.CapRandom // rand
+	CapAll    = object.CapAll
+)
+
+// Errors returned by Run when a program exceeds its Limits.
+var (
+	ErrStepLimit  = object.ErrStepLimit
+	ErrDepthLimit = object.ErrDepthLimit
+	ErrAllocLimit = object.ErrAllocLimit
+)
+
+// The constant values.
+var (
+	Null  Value = object.NULLObj
+	True  Value = object.TRUEObj
+	False Value = object.FALSEObj
+)
+
+// Int returns the integer n.
+func Int(n int64) Value {
+	return object.NewInteger(n)
+}
+
+// Str returns the string s.
+func Str(s string) Value {
+	return object.NewString(s)
+}
+
+// Glob returns the compiled glob pattern. It panics if pattern is invalid,
+// which parrot build reports before generating any code.
+func Glob(pattern string) Value {
+	g := object.NewGlob(pattern)
+	if e, ok := g.(*object.Error); ok {
+		panic(fmt.Sprintf("rt: %s", string(*e)))
+	}
+	return g
+}
+
+// Error is a runtime error raised by a script.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// interrupt carries an error of the Budget out of the generated code.
+type interrupt struct {
+	err error
+}
+
+// MaxFrames bounds the nesting of calls, like the call stack of the VM.
+const MaxFrames = 2048
+
+// Program is a script translated to Go.
+type Program struct {
+	// Globals names the globals of the script by index.
+	Globals []string
+	// Main runs the top-level code, returning the value of its last
+	// statement.
+	Main func(t *Thread) Value
+}
+
+// Option configures a run.
+type Option func(*Thread)
+
+// WithLimits bounds the steps, call depth and allocations of the run. Steps
+// are counted per call rather than per instruction.
+func WithLimits(l Limits) Option {
+	return func(t *Thread) {
+		t.limits = l
+	}
+}
+
+// WithCapabilities enables the builtins in caps, which by default are
+// limited to CapPure. Using a disabled builtin is an error.
+func WithCapabilities(caps Capability) Option {
+	return func(t *Thread) {
+		t.caps = caps
+	}
+}
+
+// Run runs p with the given globals defined and returns the value of its
+// last expression. Globals p doesn't refer to are ignored. Cancelling ctx
+// stops the run with ctx's error.
+func Run(ctx context.Context, p *Program, globals map[string]Value, opts ...Option) (ret Value, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := &Thread{
+		globals: make([]Value, len(p.Globals)),
+		names:   p.Globals,
+		caps:    CapPure,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.budget = object.NewBudget(ctx, t.limits)
+	for i, name := range p.Globals {
+		if v, ok := globals[name]; ok {
+			t.globals[i] = v
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case *Error:
+				ret, err = nil, r
+			case interrupt:
+				ret, err = nil, r.err
+			default:
+				panic(r)
+			}
+		}
+	}()
+	ret = p.Main(t)
+	switch e := ret.(type) {
+	case nil:
+		ret = Null
+	case *object.Error:
+		return nil, &Error{Msg: string(*e)}
+	case *object.Interrupt:
+		return nil, e.Err
+	}
+	return ret, nil
+}
+
+// Thread is the state of a run of a Program.
+type Thread struct {
+	globals []Value
+	names   []string
+	limits  Limits
+	caps    Capability
+	budget  *object.Budget
+	frames  int
+}
+
+// Fail raises a runtime error.
+func (t *Thread) Fail(format string, a ...any) {
+	panic(&Error{Msg: fmt.Sprintf(format, a...)})
+}
+
+// check raises err, which stops the run if it comes from the budget.
+func (t *Thread) check(err error) {
+	if err == nil {
+		return
+	}
+	if t.budget.Interrupted(err) {
+		panic(interrupt{err})
+	}
+	panic(&Error{Msg: err.Error()})
+}
+
+// Get returns the global with index i.
+func (t *Thread) Get(i int) Value {
+	v := t.globals[i]
+	if v == nil {
+		t.Fail("name %q is not defined", t.names[i])
+	}
+	return v
+}
+
+// Set assigns v to the global with index i and returns v.
+func (t *Thread) Set(i int, v Value) Value {
+	t.globals[i] = v
+	return v
+}
+
+// Assign assigns v to the variable p points to and returns v, for
+// assignments used as expressions.
+func Assign(p *Value, v Value) Value {
+	*p = v
+	return v
+}
+
+// Builtin returns the builtin name.
+func (t *Thread) Builtin(name string) Value {
+	for _, b := range object.Builtins {
+		if b.Name != name {
+			continue
+		}
+		if !t.caps.Has(b.Cap) {
+			t.check(object.DisabledError(name, b.Cap))
+		}
+		return b.Builtin
+	}
+	t.Fail("name %q is not defined", name)
+	return nil
+}
+
+// List returns a new list of elems.
+func (t *Thread) List(elems ...Value) Value {
+	l := object.NewList(elems...)
+	t.check(t.budget.Alloc(l))
+	return l
+}
+
+var opSymbols = map[string]string{
+	"Add": "+", "Sub": "-", "Mul": "*", "Div": "/", "Mod": "%",
+	"EQ": "==", "NE": "!=", "LT": "<", "LE": "<=", "GT": ">", "GE": ">=",
+	"And": "and", "Or": "or",
+}
+
+func (t *Thread) unknownOperator(op string, a, b Value) {
+	t.Fail("runtime error: unknown operator: %s %s %s", a, opSymbols[op], b)
+}
+
+// arith applies the arithmetic operator op to two integers.
+func (t *Thread) arith(op string, a, b Value) Value {
+	x, ok := a.(*object.Integer)
+	if !ok {
+		t.unknownOperator(op, a, b)
+	}
+	y, ok := b.(*object.Integer)
+	if !ok {
+		t.unknownOperator(op, a, b)
+	}
+	switch op {
+	case "Sub":
+		return object.NewInteger(int64(*x - *y))
+	case "Mul":
+		return object.NewInteger(int64(*x * *y))
+	}
+	if *y == 0 {
+		t.Fail("division by zero")
+	}
+	if op == "Div" {
+		return object.NewInteger(int64(*x / *y))
+	}
+	return object.NewInteger(int64(*x % *y))
+}
+
+// Add returns a + b, the sum of integers or the concatenation of strings.
+func (t *Thread) Add(a, b Value) Value {
+	switch x := a.(type) {
+	case *object.Integer:
+		if y, ok := b.(*object.Integer); ok {
+			return object.NewInteger(int64(*x + *y))
+		}
+	case *object.String:
+		if y, ok := b.(*object.String); ok {
+			s := *x + *y
+			t.check(t.budget.Alloc(&s))
+			return &s
+		}
+	}
+	t.unknownOperator("Add", a, b)
+	return nil
+}
+
+func (t *Thread) Sub(a, b Value) Value { return t.arith("Sub", a, b) }
+func (t *Thread) Mul(a, b Value) Value { return t.arith("Mul", a, b) }
+func (t *Thread) Div(a, b Value) Value { return t.arith("Div", a, b) }
+func (t *Thread) Mod(a, b Value) Value { return t.arith("Mod", a, b) }
+
+// compare applies the comparison op. Booleans are only compared for
+// equality, integers and strings are ordered; all only to their own type.
+func (t *Thread) compare(op string, a, b Value) Value {
+	var res bool
+	switch x := a.(type) {
+	case *object.Boolean:
+		if _, ok := b.(*object.Boolean); !ok {
+			t.unknownOperator(op, a, b)
+		}
+		switch op {
+		case "EQ":
+			res = a == b
+		case "NE":
+			res = a != b
+		default:
+			t.unknownOperator(op, a, b)
+		}
+	case *object.Integer:
+		y, ok := b.(*object.Integer)
+		if !ok {
+			t.unknownOperator(op, a, b)
+		}
+		res = ordered(op, *x, *y)
+	case *object.String:
+		y, ok := b.(*object.String)
+		if !ok {
+			t.unknownOperator(op, a, b)
+		}
+		res = ordered(op, *x, *y)
+	default:
+		t.unknownOperator(op, a, b)
+	}
+	return object.NewBoolean(res)
+}
+
+func ordered[T object.Integer | object.String](op string, x, y T) bool {
+	switch op {
+	case "EQ":
+		return x == y
+	case "NE":
+		return x != y
+	case "LT":
+		return x < y
+	case "LE":
+		return x <= y
+	case "GT":
+		return x > y
+	}
+	return x >= y
+}
+
+func (t *Thread) EQ(a, b Value) Value { return t.compare("EQ", a, b) }
+func (t *Thread) NE(a, b Value) Value { return t.compare("NE", a, b) }
+func (t *Thread) LT(a, b Value) Value { return t.compare("LT", a, b) }
+func (t *Thread) LE(a, b Value) Value { return t.compare("LE", a, b) }
+func (t *Thread) GT(a, b Value) Value { return t.compare("GT", a, b) }
+func (t *Thread) GE(a, b Value) Value { return t.compare("GE", a, b) }
+
+// And returns whether the booleans a and b are both true.
+func (t *Thread) And(a, b Value) Value {
+	t.booleans("And", a, b)
+	return object.NewBoolean(a == True && b == True)
+}
+
+// Or returns whether the boolean a or b is true.
+func (t *Thread) Or(a, b Value) Value {
+	t.booleans("Or", a, b)
+	return object.NewBoolean(a == True || b == True)
+}
+
+// booleans fails unless the operands a and b of op are booleans.
+func (t *Thread) booleans(op string, a, b Value) {
+	_, ok := a.(*object.Boolean)
+	if _, okb := b.(*object.Boolean); !ok || !okb {
+		t.unknownOperator(op, a, b)
+	}
+}
+
+// Not returns whether a is false or null.
+func (t *Thread) Not(a Value) Value {
+	return object.NewBoolean(a == False || a == Null)
+}
+
+// Neg returns -a.
+func (t *Thread) Neg(a Value) Value {
+	x, ok := a.(*object.Integer)
+	if !ok {
+		t.Fail("runtime error: unknown operator: -%s", a.Type())
+	}
+	return object.NewInteger(-int64(*x))
+}
+
+// Match returns whether the string s matches pattern, a glob or a string
+// holding a glob pattern.
+func (t *Thread) Match(s, pattern Value) Value {
+	o := object.MatchGlob(s, pattern)
+	if e, ok := o.(*object.Error); ok {
+		t.Fail("%s", string(*e))
+	}
+	return o
+}
+
+// Index returns x[i]. An index past the end of a list or string yields an
+// error value rather than failing, as on the VM.
+func (t *Thread) Index(x, i Value) Value {
+	switch x := x.(type) {
+	case *object.List:
+		if n, ok := i.(*object.Integer); ok {
+			if *n < 0 || int(*n) >= len(*x) {
+				return object.NewError("index out of range")
+			}
+			return (*x)[*n]
+		}
+	case *object.String:
+		if n, ok := i.(*object.Integer); ok {
+			if *n < 0 || int(*n) >= len(*x) {
+				return object.NewError("index out of range")
+			}
+			return object.NewString(string(string(*x)[*n]))
+		}
+	}
+	ix, ok := x.(object.Indexable)
+	if !ok {
+		t.Fail("invalid index operator for types %v and %v", x.Type(), i.Type())
+	}
+	o := ix.Index(i)
+	if e, ok := o.(*object.Error); ok {
+		t.Fail("%s", string(*e))
+	}
+	return o
+}
+
+// Attr returns x.name.
+func (t *Thread) Attr(x Value, name string) Value {
+	h, ok := x.(object.HasAttrs)
+	if !ok {
+		t.Fail("%q object has no attribute %q", x.Type(), name)
+	}
+	o := h.Attr(name)
+	if e, ok := o.(*object.Error); ok {
+		t.Fail("%s", string(*e))
+	}
+	return o
+}
+
+// Func is a script function.
+type Func struct {
+	Name   string
+	Params int
+	// Body runs the function with its arguments, returning its result or,
+	// for a call in tail position, the TailCall of Thread.TailCall.
+	Body func(t *Thread, args []Value) Value
+}
+
+func (f *Func) Type() object.Type { return object.FunctionCompiledType }
+func (f *Func) String() string {
+	if f.Name == "" {
+		return "<function>"
+	}
+	return fmt.Sprintf("<function %s>", f.Name)
+}
+
+// tailCall is what a function body returns to have its caller run the call
+// in place of the finished function.
+type tailCall struct {
+	fn   *Func
+	args []Value
+}
+
+func (tc *tailCall) Type() object.Type { return object.FunctionType }
+func (tc *tailCall) String() string    { return "<tail call>" }
+
+// Call calls fn with args. The arguments come first because they are
+// evaluated before the function, as on the VM.
+func (t *Thread) Call(args []Value, fn Value) Value {
+	t.check(t.budget.Step())
+	if f, ok := fn.(*Func); ok {
+		return t.call(f, args)
+	}
+	return t.callGo(fn, args)
+}
+
+// TailCall calls fn with args from the tail position of a function body,
+// whose result it must be. Script functions are left to the trampoline of
+// the caller, so that tail recursion doesn't grow the Go stack.
+func (t *Thread) TailCall(args []Value, fn Value) Value {
+	t.check(t.budget.Step())
+	if f, ok := fn.(*Func); ok {
+		return &tailCall{f, args}
+	}
+	return t.callGo(fn, args)
+}
+
+func (t *Thread) call(f *Func, args []Value) Value {
+	if t.frames >= MaxFrames {
+		t.Fail("stack overflow")
+	}
+	t.check(t.budget.Enter())
+	t.frames++
+	defer func() {
+		t.frames--
+		t.budget.Leave()
+	}()
+	for {
+		if len(args) != f.Params {
+			t.Fail("wrong number of arguments: expected %d, got %d", f.Params, len(args))
+		}
+		ret := f.Body(t, args)
+		tc, ok := ret.(*tailCall)
+		if !ok {
+			return ret
+		}
+		f, args = tc.fn, tc.args
+	}
+}
+
+// callGo calls a builtin or other Go callable.
+func (t *Thread) callGo(fn Value, args []Value) Value {
+	c, ok := fn.(object.Callable)
+	if !ok {
+		t.Fail("%q object is not callable", fn.Type())
+	}
+	t.check(t.budget.Enter())
+	defer t.budget.Leave()
+	for i, a := range args {
+		if f, ok := a.(*Func); ok {
+			args[i] = &callback{t: t, fn: f}
+		}
+	}
+	ret := c.Call(args...)
+	switch e := ret.(type) {
+	case nil:
+		ret = Null
+	case *object.Error:
+		t.Fail("%s", string(*e))
+	case *object.Interrupt:
+		panic(interrupt{e.Err})
+	}
+	return ret
+}
+
+// callback lets builtins call a script function passed to them.
+type callback struct {
+	t  *Thread
+	fn *Func
+}
+
+func (cb *callback) Type() object.Type { return cb.fn.Type() }
+func (cb *callback) String() string    { return cb.fn.String() }
+
+// Call runs the function, turning runtime errors into error values for the
+// builtin.
+func (cb *callback) Call(args ...Value) (ret Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case *Error:
+				ret = object.NewError("%s", r.Msg)
+			case interrupt:
+				ret = &object.Interrupt{Err: r.err}
+			default:
+				panic(r)
+			}
+		}
+	}()
+	return cb.t.call(cb.fn, args)
+}
@@ -0,0 +1,103 @@
+package parrot
+
+import (
+	"fmt"
+	"parrot/internal/object"
+	"reflect"
+)
+
+// ToObject converts a Go value to a Parrot value. Nil, bools, integers,
+// strings and slices or arrays of convertible values are copied; structs,
+// maps and functions are exposed through a GoValue.
+func ToObject(v any) (Object, error) {
+	switch v := v.(type) {
+	case nil:
+		return object.NULLObj, nil
+	case Object:
+		return v, nil
+	case bool:
+		if v {
+			return object.TRUEObj, nil
+		}
+		return object.FALSEObj, nil
+	case int:
+		return object.NewInteger(int64(v)), nil
+	case int8:
+		return object.NewInteger(int64(v)), nil
+	case int16:
+		return object.NewInteger(int64(v)), nil
+	case int32:
+		return object.NewInteger(int64(v)), nil
+	case int64:
+		return object.NewInteger(v), nil
+	case uint8:
+		return object.NewInteger(int64(v)), nil
+	case uint16:
+		return object.NewInteger(int64(v)), nil
+	case uint32:
+		return object.NewInteger(int64(v)), nil
+	case string:
+		return object.NewString(v), nil
+	case func(args ...Object) Object:
+		return Builtin(v), nil
+	case []any:
+		l := make(object.List, 0, len(v))
+		for i, e := range v {
+			o, err := ToObject(e)
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			l = append(l, o)
+		}
+		return &l, nil
+	case []Object:
+		return object.NewList(v...), nil
+	case []string:
+		l := make(object.List, 0, len(v))
+		for _, s := range v {
+			l = append(l, object.NewString(s))
+		}
+		return &l, nil
+	case []int:
+		l := make(object.List, 0, len(v))
+		for _, n := range v {
+			l = append(l, object.NewInteger(int64(n)))
+		}
+		return &l, nil
+	}
+	return toObject(reflect.ValueOf(v))
+}
+
+// MustObject is like ToObject but panics if v cannot be converted.
+func MustObject(v any) Object {
+	o, err := ToObject(v)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// FromObject converts a Parrot value to a Go value: null to nil, ints to
+// int64, bools to bool, strings to string and lists to []any. Other values
+// are returned as they are.
+func FromObject(o Object) any {
+	switch o := o.(type) {
+	case nil, *object.NULL:
+		return nil
+	case *object.Integer:
+		return int64(*o)
+	case *object.Boolean:
+		return bool(*o)
+	case *object.String:
+		return string(*o)
+	case *object.List:
+		l := make([]any, 0, len(*o))
+		for _, e := range *o {
+			l = append(l, FromObject(e))
+		}
+		return l
+	case *GoValue:
+		return o.Value()
+	}
+	return o
+}